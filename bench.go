@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/redact"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/proxy"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// maxBenchErrors is how many distinct errors the bench report lists.
+const maxBenchErrors = 5
+
+// runBench implements "smtp-proxy bench": concurrent synthetic clients
+// submit messages to a running proxy over SMTP, or with -pipeline to an
+// in-process pipeline whose upstream discards them, and the throughput
+// and latency percentiles are printed to out. It returns the exit code.
+func runBench(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(out)
+	addr := fs.String("addr", "", "proxy to submit to (default: SMTP_LISTEN_ADDR on localhost)")
+	pipeline := fs.Bool("pipeline", false, "run messages through the pipeline in-process, discarding them instead of relaying")
+	clients := fs.Int("c", 10, "concurrent clients")
+	total := fs.Int("n", 1000, "messages to send in total")
+	size := fs.Int("size", 10*1024, "message size in bytes")
+	rcpts := fs.Int("rcpts", 1, "recipients per message")
+	to := fs.String("to", "bench@example.com", "recipient address; with -rcpts above 1, numbered as bench+N@example.com")
+	startTLS := fs.Bool("starttls", false, "use STARTTLS, without verifying the proxy's certificate")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *clients < 1 || *total < 1 || *size < 1 || *rcpts < 1 {
+		fmt.Fprintln(out, "bench: -c, -n, -size and -rcpts must be positive")
+		return 2
+	}
+
+	// Per-message logging would swamp the report
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  configuration: %v\n", err)
+		return 1
+	}
+	slog.SetDefault(slog.New(redact.NewHandler(slog.Default().Handler(), cfg.Secrets(), cfg.LogAddresses)))
+
+	recipients := benchRecipients(*to, *rcpts)
+	message := benchMessage(cfg, recipients[0], *size)
+
+	var backend *proxy.Backend
+	if *pipeline {
+		discard := func(_ *config.Config, _ *relay.Envelope) error { return nil }
+		if backend, err = proxy.NewBackend(cfg, discard); err != nil {
+			fmt.Fprintf(out, "FAIL  startup: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(out, "pipeline   in-process, upstream discarded\n")
+	} else {
+		if *addr == "" {
+			*addr = localAddr(cfg.ListenAddr)
+		}
+		fmt.Fprintf(out, "proxy      %s\n", *addr)
+	}
+	fmt.Fprintf(out, "load       %d messages of %d bytes to %d recipients, %d clients\n", *total, len(message), *rcpts, *clients)
+
+	var (
+		next      atomic.Int64
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, *total)
+		failed    int
+		errs      []string
+		wg        sync.WaitGroup
+	)
+	record := func(d time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			latencies = append(latencies, d)
+			return
+		}
+		failed++
+		if msg := err.Error(); len(errs) < maxBenchErrors && !slices.Contains(errs, msg) {
+			errs = append(errs, msg)
+		}
+	}
+
+	start := time.Now()
+	for range *clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &benchClient{addr: *addr, cfg: cfg, startTLS: *startTLS}
+			defer client.close()
+			for next.Add(1) <= int64(*total) {
+				began := time.Now()
+				var err error
+				if backend != nil {
+					err = submit(backend, cfg, recipients, message)
+				} else {
+					err = client.send(recipients, message)
+				}
+				record(time.Since(began), err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sent := len(latencies)
+	fmt.Fprintf(out, "messages   %d sent, %d failed\n", sent, failed)
+	fmt.Fprintf(out, "elapsed    %s\n", elapsed.Round(time.Millisecond))
+	if sent > 0 {
+		rate := float64(sent) / elapsed.Seconds()
+		fmt.Fprintf(out, "throughput %.1f msg/s, %.2f MB/s\n", rate, rate*float64(len(message))/1e6)
+		slices.Sort(latencies)
+		fmt.Fprintf(out, "latency    p50 %s  p90 %s  p99 %s  max %s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[sent-1].Round(time.Microsecond))
+	}
+	for _, msg := range errs {
+		fmt.Fprintf(out, "error      %s\n", msg)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// benchClient is one synthetic client holding an SMTP connection to the
+// proxy across messages. A failed message drops the connection, so the
+// next one starts afresh, e.g. after a session limit hung up.
+type benchClient struct {
+	addr     string
+	cfg      *config.Config
+	startTLS bool
+	c        *smtp.Client
+}
+
+func (b *benchClient) send(recipients []string, message []byte) error {
+	if b.c == nil {
+		if err := b.connect(); err != nil {
+			return err
+		}
+	}
+	err := b.transaction(recipients, message)
+	if err != nil {
+		b.close()
+	}
+	return err
+}
+
+func (b *benchClient) connect() error {
+	var c *smtp.Client
+	var err error
+	if b.startTLS {
+		// Benchmarks run against local proxies, often with test certificates
+		c, err = smtp.DialStartTLS(b.addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		c, err = smtp.Dial(b.addr)
+	}
+	if err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		if err := c.Auth(sasl.NewPlainClient("", b.cfg.ProxyUsername, b.cfg.ProxyPassword)); err != nil {
+			c.Close()
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	b.c = c
+	return nil
+}
+
+func (b *benchClient) transaction(recipients []string, message []byte) error {
+	if err := b.c.Mail(b.cfg.DestFrom, nil); err != nil {
+		return fmt.Errorf("MAIL FROM: %w", err)
+	}
+	for _, rcpt := range recipients {
+		if err := b.c.Rcpt(rcpt, nil); err != nil {
+			return fmt.Errorf("RCPT TO: %w", err)
+		}
+	}
+	w, err := b.c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	return nil
+}
+
+func (b *benchClient) close() {
+	if b.c != nil {
+		_ = b.c.Close()
+		b.c = nil
+	}
+}
+
+// localAddr turns a listen address into one to dial on this host.
+func localAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// benchRecipients returns n recipients: to itself, or numbered variants of
+// it with a +N subaddress.
+func benchRecipients(to string, n int) []string {
+	if n == 1 {
+		return []string{to}
+	}
+	local, domain, _ := strings.Cut(to, "@")
+	list := make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("%s+%d@%s", local, i+1, domain)
+	}
+	return list
+}
+
+// benchMessage returns a plain text message of about size bytes, padded
+// with lines of filler text.
+func benchMessage(cfg *config.Config, to string, size int) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: " + cfg.DestFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: smtp-proxy bench message\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <bench." + relay.NewID() + "@bench.localhost>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n")
+	line := strings.Repeat("0123456789", 7) + "bench\r\n"
+	for b.Len()+len(line) <= size {
+		b.WriteString(line)
+	}
+	if rest := size - b.Len(); rest > 2 {
+		b.WriteString(strings.Repeat("x", rest-2) + "\r\n")
+	}
+	return b.Bytes()
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	return sorted[max(i, 0)].Round(time.Microsecond)
+}
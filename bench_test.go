@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestRunBench_Flags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-c", "0"},
+		{"-n", "-1"},
+		{"-size", "0"},
+		{"-rcpts", "0"},
+		{"-unknown"},
+	} {
+		var out bytes.Buffer
+		if code := runBench(args, &out); code != 2 {
+			t.Errorf("%v: expected exit code 2, got %d\n%s", args, code, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	runBench([]string{"-c", "0"}, &out)
+	if !strings.Contains(out.String(), "-c, -n, -size and -rcpts must be positive") {
+		t.Errorf("expected the flag error explained, got %q", out.String())
+	}
+}
+
+func TestRunBench_SMTP(t *testing.T) {
+	fake, addr := startFakeSMTP(t, "testuser", "testpass")
+	setTestEnv(t, "127.0.0.1:2525")
+
+	var out bytes.Buffer
+	if code := runBench([]string{"-addr", addr, "-c", "3", "-n", "12", "-size", "2048", "-rcpts", "2"}, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s", code, out.String())
+	}
+	report := out.String()
+	for _, want := range []string{
+		"proxy      " + addr + "\n",
+		"load       12 messages of 2048 bytes to 2 recipients, 3 clients\n",
+		"messages   12 sent, 0 failed\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected %q in the report\n%s", want, report)
+		}
+	}
+	if !regexp.MustCompile(`throughput \d+\.\d msg/s, \d+\.\d\d MB/s\n`).MatchString(report) ||
+		!regexp.MustCompile(`latency    p50 \S+  p90 \S+  p99 \S+  max \S+\n`).MatchString(report) {
+		t.Errorf("expected the throughput and latency summary\n%s", report)
+	}
+
+	received := fake.received()
+	if len(received) != 12 {
+		t.Fatalf("expected 12 messages at the server, got %d", len(received))
+	}
+	msg := received[0]
+	if len(msg.to) != 2 || msg.to[0] != "bench+1@example.com" || msg.to[1] != "bench+2@example.com" || len(msg.data) != 2048 {
+		t.Errorf("unexpected message to %v of %d bytes", msg.to, len(msg.data))
+	}
+}
+
+func TestRunBench_Failures(t *testing.T) {
+	_, addr := startFakeSMTP(t, "testuser", "other-pass")
+	setTestEnv(t, "127.0.0.1:2525")
+
+	var out bytes.Buffer
+	if code := runBench([]string{"-addr", addr, "-c", "2", "-n", "4"}, &out); code != 1 {
+		t.Fatalf("expected exit code 1, got %d\n%s", code, out.String())
+	}
+	report := out.String()
+	if !strings.Contains(report, "messages   0 sent, 4 failed\n") || strings.Contains(report, "throughput") {
+		t.Errorf("expected only failures reported\n%s", report)
+	}
+	// The same error from every client is listed once
+	if strings.Count(report, "error      AUTH:") != 1 {
+		t.Errorf("expected the AUTH error listed once\n%s", report)
+	}
+}
+
+func TestRunBench_Pipeline(t *testing.T) {
+	setTestEnv(t, "127.0.0.1:2525")
+
+	var out bytes.Buffer
+	if code := runBench([]string{"-pipeline", "-c", "2", "-n", "6", "-size", "1024"}, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s", code, out.String())
+	}
+	report := out.String()
+	if !strings.Contains(report, "pipeline   in-process, upstream discarded\n") || !strings.Contains(report, "messages   6 sent, 0 failed\n") {
+		t.Errorf("unexpected report\n%s", report)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	for _, tt := range []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{sorted, 50, 50 * time.Millisecond},
+		{sorted, 90, 90 * time.Millisecond},
+		{sorted, 99, 99 * time.Millisecond},
+		{sorted, 100, 100 * time.Millisecond},
+		{sorted[:3], 50, 2 * time.Millisecond},
+		{sorted[:3], 99, 3 * time.Millisecond},
+		{sorted[:1], 50, time.Millisecond},
+	} {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("p%d of %d: got %s, want %s", tt.p, len(tt.sorted), got, tt.want)
+		}
+	}
+}
+
+func TestBenchMessage(t *testing.T) {
+	cfg := &config.Config{DestFrom: "bench@example.org"}
+	for _, size := range []int{300, 1000, 10 * 1024} {
+		msg := benchMessage(cfg, "ops@example.com", size)
+		if len(msg) < size-2 || len(msg) > size || !bytes.HasSuffix(msg, []byte("\r\n")) {
+			t.Errorf("size %d: got a message of %d bytes", size, len(msg))
+		}
+		if !bytes.HasPrefix(msg, []byte("From: bench@example.org\r\nTo: ops@example.com\r\n")) {
+			t.Errorf("size %d: unexpected header %q", size, headerBlock(msg))
+		}
+	}
+
+	if got := benchRecipients("ops@example.com", 1); len(got) != 1 || got[0] != "ops@example.com" {
+		t.Errorf("expected the address itself for one recipient, got %v", got)
+	}
+	if got := benchRecipients("ops@example.com", 3); len(got) != 3 || got[0] != "ops+1@example.com" || got[2] != "ops+3@example.com" {
+		t.Errorf("expected numbered recipients, got %v", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/redact"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/smtpproxy"
+)
+
+// runCheck implements "smtp-proxy check": it loads and validates the
+// configuration and everything startup reads (keys, certificates, scripts,
+// plugins, lists) without listening, and with -connect logs in to every
+// upstream. It writes a report to out and returns the exit code.
+func runCheck(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(out)
+	connect := fs.Bool("connect", false, "connect, EHLO and AUTH to each upstream (TLS connect only for API transports)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// Keep startup logging out of the report
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(out, "FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(out, "ok    %s\n", name)
+	}
+
+	cfg, err := config.Load()
+	report("configuration", err)
+	if err != nil {
+		return 1
+	}
+	slog.SetDefault(slog.New(redact.NewHandler(slog.Default().Handler(), cfg.Secrets(), cfg.LogAddresses)))
+	_, err = smtpproxy.New(cfg)
+	report("startup files (keys, certificates, scripts, plugins, lists)", err)
+
+	if *connect {
+		upstream := func(name string, c *config.Config) {
+			report(fmt.Sprintf("upstream %s %s:%d (%s)", name, c.DestHost, c.DestPort, c.DestTransport), relay.Probe(c))
+		}
+		upstream("default", cfg)
+		for _, name := range slices.Sorted(maps.Keys(cfg.Routes)) {
+			upstream("route "+name, cfg.ForRoute(cfg.Routes[name]))
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -1,4 +1,4 @@
-module smtp-proxy
+module github.com/VahanMargaryan/smtp-proxy
 
 go 1.26.0
 
@@ -6,4 +6,7 @@ require (
 	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
 	github.com/emersion/go-smtp v0.24.0
 	github.com/joho/godotenv v1.5.1
+	go.starlark.net v0.0.0-20260908191801-89a6a09411d5
 )
+
+require golang.org/x/sys v0.42.0 // indirect
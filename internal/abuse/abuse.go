@@ -0,0 +1,151 @@
+// Package abuse scores messages for signs of abuse. Independent signals
+// each contribute points; the total is compared against thresholds that
+// tag, defer or block the message.
+package abuse
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// Message is what signals inspect.
+type Message struct {
+	Username     string
+	RemoteIP     string
+	AuthFailures int // failed AUTH attempts earlier in the session
+	Recipients   []string
+	Raw          []byte
+	Time         time.Time
+}
+
+// Signal scores one aspect of a message. Weight is the configured points
+// per unit; a signal returns how many points it awards.
+type Signal interface {
+	Name() string
+	Score(m *Message) int
+}
+
+// Verdict is the action a score calls for.
+type Verdict int
+
+const (
+	Accept Verdict = iota
+	Tag
+	Defer
+	Block
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Tag:
+		return "tag"
+	case Defer:
+		return "defer"
+	case Block:
+		return "block"
+	}
+	return "accept"
+}
+
+// Result is the outcome of scoring one message.
+type Result struct {
+	Score   int
+	Reasons []string // "signal=points" for every signal that scored
+	Verdict Verdict
+}
+
+// Header renders the result for an X-Abuse-Score header value.
+func (r Result) Header() string {
+	if len(r.Reasons) == 0 {
+		return fmt.Sprint(r.Score)
+	}
+	return fmt.Sprintf("%d (%s)", r.Score, strings.Join(r.Reasons, " "))
+}
+
+// Scorer runs signals and maps the total onto a verdict. A nil *Scorer
+// accepts everything.
+type Scorer struct {
+	signals []Signal
+	tag     int
+	deferAt int
+	block   int
+}
+
+// defaultWeights apply to signals not listed in cfg.AbuseWeights.
+var defaultWeights = map[string]int{
+	"auth_failures":     10,
+	"recipient_entropy": 20,
+	"content":           10,
+	"sending_spike":     30,
+}
+
+// New builds a scorer from cfg. It returns nil when no threshold is set,
+// and an error for unknown signal names.
+func New(cfg *config.Config) (*Scorer, error) {
+	if cfg.AbuseTagScore == 0 && cfg.AbuseDeferScore == 0 && cfg.AbuseBlockScore == 0 {
+		return nil, nil
+	}
+	weights := make(map[string]int, len(defaultWeights))
+	for name, w := range defaultWeights {
+		weights[name] = w
+	}
+	for name, w := range cfg.AbuseWeights {
+		if _, ok := defaultWeights[name]; !ok {
+			names := make([]string, 0, len(defaultWeights))
+			for n := range defaultWeights {
+				names = append(names, n)
+			}
+			slices.Sort(names)
+			return nil, fmt.Errorf("abuse: unknown signal %q (must be one of %s)", name, strings.Join(names, ", "))
+		}
+		weights[name] = w
+	}
+
+	var signals []Signal
+	if w := weights["auth_failures"]; w > 0 {
+		signals = append(signals, AuthFailures{Weight: w})
+	}
+	if w := weights["recipient_entropy"]; w > 0 {
+		signals = append(signals, RecipientEntropy{Weight: w, MinRecipients: 5, MaxBits: 2})
+	}
+	if w := weights["content"]; w > 0 {
+		signals = append(signals, Content{Weight: w, MaxLinks: 20})
+	}
+	if w := weights["sending_spike"]; w > 0 {
+		signals = append(signals, NewSendingSpike(w, cfg.AbuseSpikeRate, time.Minute))
+	}
+	return NewScorer(cfg.AbuseTagScore, cfg.AbuseDeferScore, cfg.AbuseBlockScore, signals...), nil
+}
+
+// NewScorer creates a scorer with explicit thresholds (0 disables one) and
+// signals, for programs that supply their own.
+func NewScorer(tag, deferAt, block int, signals ...Signal) *Scorer {
+	return &Scorer{signals: signals, tag: tag, deferAt: deferAt, block: block}
+}
+
+// Evaluate scores m with every signal.
+func (s *Scorer) Evaluate(m *Message) Result {
+	var r Result
+	if s == nil {
+		return r
+	}
+	for _, sig := range s.signals {
+		if points := sig.Score(m); points > 0 {
+			r.Score += points
+			r.Reasons = append(r.Reasons, fmt.Sprintf("%s=%d", sig.Name(), points))
+		}
+	}
+	switch {
+	case s.block > 0 && r.Score >= s.block:
+		r.Verdict = Block
+	case s.deferAt > 0 && r.Score >= s.deferAt:
+		r.Verdict = Defer
+	case s.tag > 0 && r.Score >= s.tag:
+		r.Verdict = Tag
+	}
+	return r
+}
@@ -0,0 +1,125 @@
+package abuse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestNew_DisabledByDefault(t *testing.T) {
+	s, err := New(&config.Config{})
+	if err != nil || s != nil {
+		t.Fatalf("expected nil scorer without thresholds, got %v, %v", s, err)
+	}
+	if r := s.Evaluate(&Message{AuthFailures: 100}); r.Verdict != Accept || r.Score != 0 {
+		t.Errorf("nil scorer should accept, got %+v", r)
+	}
+}
+
+func TestNew_UnknownSignal(t *testing.T) {
+	_, err := New(&config.Config{AbuseTagScore: 1, AbuseWeights: map[string]int{"karma": 5}})
+	if err == nil || !strings.Contains(err.Error(), "karma") {
+		t.Errorf("expected unknown signal error, got %v", err)
+	}
+}
+
+func TestScorer_Thresholds(t *testing.T) {
+	s := NewScorer(10, 20, 30, AuthFailures{Weight: 10})
+	tests := []struct {
+		failures int
+		want     Verdict
+	}{
+		{0, Accept},
+		{1, Tag},
+		{2, Defer},
+		{3, Block},
+		{5, Block},
+	}
+	for _, tt := range tests {
+		r := s.Evaluate(&Message{AuthFailures: tt.failures})
+		if r.Verdict != tt.want {
+			t.Errorf("%d failures: expected %s, got %s (score %d)", tt.failures, tt.want, r.Verdict, r.Score)
+		}
+	}
+
+	// A threshold of 0 is skipped rather than matching everything
+	s = NewScorer(0, 0, 15, AuthFailures{Weight: 10})
+	if r := s.Evaluate(&Message{AuthFailures: 1}); r.Verdict != Accept {
+		t.Errorf("expected accept below the only threshold, got %s", r.Verdict)
+	}
+}
+
+func TestScorer_Reasons(t *testing.T) {
+	s := NewScorer(1, 0, 0, AuthFailures{Weight: 10}, Content{Weight: 5})
+	r := s.Evaluate(&Message{AuthFailures: 2, Raw: []byte("Subject: hello\r\n\r\nBody")})
+	if r.Score != 20 || len(r.Reasons) != 1 || r.Reasons[0] != "auth_failures=20" {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if got := r.Header(); got != "20 (auth_failures=20)" {
+		t.Errorf("unexpected header value %q", got)
+	}
+}
+
+func TestRecipientEntropy(t *testing.T) {
+	sig := RecipientEntropy{Weight: 7, MinRecipients: 5, MaxBits: 2}
+
+	sameDomain := make([]string, 8)
+	spread := make([]string, 8)
+	for i := range sameDomain {
+		sameDomain[i] = fmt.Sprintf("user%d@example.com", i)
+		spread[i] = fmt.Sprintf("user@domain%d.com", i)
+	}
+	if got := sig.Score(&Message{Recipients: sameDomain}); got != 0 {
+		t.Errorf("one domain: expected 0, got %d", got)
+	}
+	if got := sig.Score(&Message{Recipients: spread}); got != 7 {
+		t.Errorf("eight domains: expected 7, got %d", got)
+	}
+	if got := sig.Score(&Message{Recipients: spread[:4]}); got != 0 {
+		t.Errorf("below MinRecipients: expected 0, got %d", got)
+	}
+}
+
+func TestContent(t *testing.T) {
+	sig := Content{Weight: 5, MaxLinks: 2}
+	tests := []struct {
+		name string
+		raw  string
+		want int
+	}{
+		{"clean", "Subject: Quarterly report\r\n\r\nSee attached.", 0},
+		{"shouting", "Subject: FREE MONEY NOW!!!\r\n\r\nClick.", 5},
+		{"no subject", "From: a@example.com\r\n\r\nHi", 5},
+		{"links", "Subject: Links\r\n\r\nhttp://a https://b http://c", 5},
+		{"shouting and links", "Subject: CLICK THESE LINKS\r\n\r\nhttp://a https://b http://c", 10},
+		{"short caps", "Subject: FYI OK\r\n\r\nBody", 0},
+	}
+	for _, tt := range tests {
+		if got := sig.Score(&Message{Raw: []byte(tt.raw)}); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSendingSpike(t *testing.T) {
+	sig := NewSendingSpike(9, 3, time.Minute)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if got := sig.Score(&Message{RemoteIP: "192.0.2.1", Time: start.Add(time.Duration(i) * time.Second)}); got != 0 {
+			t.Fatalf("message %d: expected 0, got %d", i, got)
+		}
+	}
+	if got := sig.Score(&Message{RemoteIP: "192.0.2.1", Time: start.Add(3 * time.Second)}); got != 9 {
+		t.Errorf("fourth message in a minute: expected 9, got %d", got)
+	}
+	if got := sig.Score(&Message{RemoteIP: "192.0.2.2", Time: start.Add(3 * time.Second)}); got != 0 {
+		t.Errorf("other client: expected 0, got %d", got)
+	}
+	if got := sig.Score(&Message{RemoteIP: "192.0.2.1", Time: start.Add(2 * time.Minute)}); got != 0 {
+		t.Errorf("after the window: expected 0, got %d", got)
+	}
+}
@@ -0,0 +1,151 @@
+package abuse
+
+import (
+	"bytes"
+	"math"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// AuthFailures awards Weight points per failed AUTH attempt in the session
+// before the one that succeeded.
+type AuthFailures struct {
+	Weight int
+}
+
+func (AuthFailures) Name() string { return "auth_failures" }
+
+func (s AuthFailures) Score(m *Message) int {
+	return s.Weight * m.AuthFailures
+}
+
+// RecipientEntropy awards Weight points when the recipients of a message
+// with at least MinRecipients are spread over many unrelated domains, as
+// in list-washing or spraying, measured as the Shannon entropy (in bits) of
+// the recipient domain distribution exceeding MaxBits.
+type RecipientEntropy struct {
+	Weight        int
+	MinRecipients int
+	MaxBits       float64
+}
+
+func (RecipientEntropy) Name() string { return "recipient_entropy" }
+
+func (s RecipientEntropy) Score(m *Message) int {
+	if len(m.Recipients) < s.MinRecipients {
+		return 0
+	}
+	if domainEntropy(m.Recipients) > s.MaxBits {
+		return s.Weight
+	}
+	return 0
+}
+
+func domainEntropy(recipients []string) float64 {
+	counts := make(map[string]int)
+	for _, r := range recipients {
+		_, domain, _ := strings.Cut(r, "@")
+		counts[strings.ToLower(domain)]++
+	}
+	n := float64(len(recipients))
+	var bits float64
+	for _, c := range counts {
+		p := float64(c) / n
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// Content awards Weight points for each heuristic the message trips: a
+// shouted (all caps) subject, more than MaxLinks links, or no subject.
+type Content struct {
+	Weight   int
+	MaxLinks int
+}
+
+func (Content) Name() string { return "content" }
+
+func (s Content) Score(m *Message) int {
+	hits := 0
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return 0
+	}
+	subject := msg.Header.Get("Subject")
+	if strings.TrimSpace(subject) == "" {
+		hits++
+	} else if shouted(subject) {
+		hits++
+	}
+	links := bytes.Count(m.Raw, []byte("http://")) + bytes.Count(m.Raw, []byte("https://"))
+	if s.MaxLinks > 0 && links > s.MaxLinks {
+		hits++
+	}
+	return s.Weight * hits
+}
+
+// shouted reports whether s has at least 10 letters, all upper case.
+func shouted(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if !unicode.IsUpper(r) {
+			return false
+		}
+		letters++
+	}
+	return letters >= 10
+}
+
+// SendingSpike awards Weight points when a client IP sends more than Max
+// messages within Window.
+type SendingSpike struct {
+	Weight int
+	Max    int
+	Window time.Duration
+
+	mu   sync.Mutex
+	sent map[string][]time.Time
+}
+
+// NewSendingSpike creates a spike signal. A max of 0 disables it.
+func NewSendingSpike(weight, max int, window time.Duration) *SendingSpike {
+	return &SendingSpike{Weight: weight, Max: max, Window: window, sent: make(map[string][]time.Time)}
+}
+
+func (*SendingSpike) Name() string { return "sending_spike" }
+
+func (s *SendingSpike) Score(m *Message) int {
+	if s.Max <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := m.Time.Add(-s.Window)
+	recent := s.sent[m.RemoteIP][:0]
+	for _, t := range s.sent[m.RemoteIP] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, m.Time)
+	s.sent[m.RemoteIP] = recent
+
+	// Forget idle clients so the map does not grow without bound
+	for ip, times := range s.sent {
+		if len(times) > 0 && !times[len(times)-1].After(cutoff) {
+			delete(s.sent, ip)
+		}
+	}
+
+	if len(recent) > s.Max {
+		return s.Weight
+	}
+	return 0
+}
@@ -0,0 +1,282 @@
+// Package accounting keeps per-day, per-user, per-destination-domain
+// delivery counters for chargeback and quota monitoring.
+package accounting
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dayLayout is the format of days in rows and filters.
+const dayLayout = "2006-01-02"
+
+// Counts are the recipients of one day, user and domain by outcome, and
+// the bytes relayed to those sent to.
+type Counts struct {
+	Sent     int64 `json:"sent"`
+	Deferred int64 `json:"deferred"`
+	Failed   int64 `json:"failed"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (c *Counts) add(o Counts) {
+	c.Sent += o.Sent
+	c.Deferred += o.Deferred
+	c.Failed += o.Failed
+	c.Bytes += o.Bytes
+}
+
+// Row is the counters of a day (UTC, YYYY-MM-DD), user and recipient
+// domain. After Rollup, the fields not grouped by are empty.
+type Row struct {
+	Day    string `json:"day,omitempty"`
+	User   string `json:"user,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Counts
+}
+
+type key struct {
+	day, user, domain string
+}
+
+// Ledger holds the counters, persisted as an append-only log with one
+// record of increments per line. Load sums the records and compacts the
+// file to one line per day, user and domain.
+type Ledger struct {
+	path string
+	now  func() time.Time
+
+	mu   sync.Mutex
+	rows map[key]*Counts
+}
+
+// Load reads the ledger at path, dropping days older than retention (0
+// keeps everything). A missing file yields an empty ledger that is
+// created on the first Add.
+func Load(path string, retention int) (*Ledger, error) {
+	return load(path, retention, time.Now)
+}
+
+func load(path string, retention int, now func() time.Time) (*Ledger, error) {
+	l := &Ledger{path: path, now: now}
+	rows, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	l.rows = rows
+	if retention > 0 {
+		oldest := now().UTC().AddDate(0, 0, -retention).Format(dayLayout)
+		for k := range l.rows {
+			if k.day < oldest {
+				delete(l.rows, k)
+			}
+		}
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Read returns the rows of the ledger at path without changing the file,
+// so it is safe while a proxy appends to it.
+func Read(path string) ([]Row, error) {
+	rows, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	return sorted(rows, Filter{}), nil
+}
+
+func read(path string) (map[key]*Counts, error) {
+	rows := make(map[key]*Counts)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rows, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accounting: open %s: %w", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var k key
+		var c Counts
+		_, err := fmt.Sscanf(scanner.Text(), "%s %q %s %d %d %d %d", &k.day, &k.user, &k.domain, &c.Sent, &c.Deferred, &c.Failed, &c.Bytes)
+		if err != nil {
+			continue
+		}
+		if rows[k] == nil {
+			rows[k] = new(Counts)
+		}
+		rows[k].add(c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("accounting: read %s: %w", path, err)
+	}
+	return rows, nil
+}
+
+// Add counts a message from user to recipients in the domains of counts,
+// today. A nil *Ledger counts nothing.
+func (l *Ledger) Add(user string, counts map[string]Counts) error {
+	if l == nil || len(counts) == 0 {
+		return nil
+	}
+	day := l.now().UTC().Format(dayLayout)
+	var b strings.Builder
+	for _, domain := range slices.Sorted(maps.Keys(counts)) {
+		c := counts[domain]
+		fmt.Fprintf(&b, "%s %q %s %d %d %d %d\n", day, user, domain, c.Sent, c.Deferred, c.Failed, c.Bytes)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for domain, c := range counts {
+		k := key{day, user, domain}
+		if l.rows[k] == nil {
+			l.rows[k] = new(Counts)
+		}
+		l.rows[k].add(c)
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("accounting: open %s: %w", l.path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("accounting: write %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Filter selects rows. Empty fields match everything; From and To are
+// inclusive days.
+type Filter struct {
+	From, To     string
+	User, Domain string
+}
+
+// ParseDay validates a YYYY-MM-DD day for a Filter.
+func ParseDay(s string) (string, error) {
+	if _, err := time.Parse(dayLayout, s); err != nil {
+		return "", fmt.Errorf("invalid day %q (expected YYYY-MM-DD)", s)
+	}
+	return s, nil
+}
+
+func (f Filter) match(k key) bool {
+	return (f.From == "" || k.day >= f.From) &&
+		(f.To == "" || k.day <= f.To) &&
+		(f.User == "" || k.user == f.User) &&
+		(f.Domain == "" || k.domain == strings.ToLower(f.Domain))
+}
+
+// Rows returns the rows f selects, by day, user and domain.
+func (l *Ledger) Rows(f Filter) []Row {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return sorted(l.rows, f)
+}
+
+// Select returns the rows f selects.
+func Select(rows []Row, f Filter) []Row {
+	var out []Row
+	for _, r := range rows {
+		if f.match(key{r.Day, r.User, r.Domain}) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Rollup sums rows over the fields not in by ("day", "user", "domain"),
+// keeping the order of first appearance. An unknown field is an error.
+func Rollup(rows []Row, by []string) ([]Row, error) {
+	var day, user, domain bool
+	for _, f := range by {
+		switch f {
+		case "day":
+			day = true
+		case "user":
+			user = true
+		case "domain":
+			domain = true
+		default:
+			return nil, fmt.Errorf("unknown field %q (must be day, user or domain)", f)
+		}
+	}
+	var out []Row
+	index := make(map[key]int)
+	for _, r := range rows {
+		var k key
+		if day {
+			k.day = r.Day
+		}
+		if user {
+			k.user = r.User
+		}
+		if domain {
+			k.domain = r.Domain
+		}
+		i, ok := index[k]
+		if !ok {
+			i = len(out)
+			index[k] = i
+			out = append(out, Row{Day: k.day, User: k.user, Domain: k.domain})
+		}
+		out[i].add(r.Counts)
+	}
+	return out, nil
+}
+
+func sorted(rows map[key]*Counts, f Filter) []Row {
+	var out []Row
+	for k, c := range rows {
+		if f.match(k) {
+			out = append(out, Row{Day: k.day, User: k.user, Domain: k.domain, Counts: *c})
+		}
+	}
+	slices.SortFunc(out, func(a, b Row) int {
+		return cmp.Or(cmp.Compare(a.Day, b.Day), cmp.Compare(a.User, b.User), cmp.Compare(a.Domain, b.Domain))
+	})
+	return out
+}
+
+// compact rewrites the file with one record per row, replacing it
+// atomically.
+func (l *Ledger) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".accounting-*")
+	if err != nil {
+		return fmt.Errorf("accounting: compact %s: %w", l.path, err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, r := range sorted(l.rows, Filter{}) {
+		fmt.Fprintf(w, "%s %q %s %d %d %d %d\n", r.Day, r.User, r.Domain, r.Sent, r.Deferred, r.Failed, r.Bytes)
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("accounting: compact %s: %w", l.path, err)
+	}
+	return nil
+}
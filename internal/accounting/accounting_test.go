@@ -0,0 +1,99 @@
+package accounting
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, path string, retention int, now *time.Time) *Ledger {
+	t.Helper()
+	l, err := load(path, retention, func() time.Time { return *now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting")
+	now := time.Date(2026, 10, 15, 23, 0, 0, 0, time.UTC)
+	l := open(t, path, 0, &now)
+
+	if err := l.Add("app", map[string]Counts{"gmail.com": {Sent: 2, Bytes: 200}, "example.com": {Deferred: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Add("app", map[string]Counts{"gmail.com": {Sent: 1, Failed: 1, Bytes: 100}})
+	now = now.Add(2 * time.Hour)
+	_ = l.Add("billing user", map[string]Counts{"gmail.com": {Sent: 1, Bytes: 50}})
+
+	want := []Row{
+		{"2026-10-15", "app", "example.com", Counts{Deferred: 1}},
+		{"2026-10-15", "app", "gmail.com", Counts{Sent: 3, Failed: 1, Bytes: 300}},
+		{"2026-10-16", "billing user", "gmail.com", Counts{Sent: 1, Bytes: 50}},
+	}
+	if got := l.Rows(Filter{}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Rows = %v, want %v", got, want)
+	}
+	if got, _ := Read(path); !reflect.DeepEqual(got, want) {
+		t.Errorf("Read = %v, want %v", got, want)
+	}
+	if got := l.Rows(Filter{From: "2026-10-16"}); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("Rows from 2026-10-16 = %v", got)
+	}
+	if got := l.Rows(Filter{To: "2026-10-15", Domain: "Gmail.com"}); !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("Rows for gmail.com to 2026-10-15 = %v", got)
+	}
+	if got := Select(want, Filter{User: "billing user"}); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("Select for billing user = %v", got)
+	}
+
+	// The file survives a restart and is compacted; old days expire
+	l = open(t, path, 0, &now)
+	if got := l.Rows(Filter{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the rows after reloading, got %v", got)
+	}
+	if data, _ := os.ReadFile(path); bytes.Count(data, []byte("\n")) != 3 {
+		t.Errorf("expected one line per row, got %q", data)
+	}
+	now = now.AddDate(0, 0, 30)
+	l = open(t, path, 30, &now)
+	if got := l.Rows(Filter{}); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("expected days before the retention dropped, got %v", got)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	rows := []Row{
+		{"2026-10-15", "app", "example.com", Counts{Deferred: 1}},
+		{"2026-10-15", "app", "gmail.com", Counts{Sent: 3, Bytes: 300}},
+		{"2026-10-16", "billing", "gmail.com", Counts{Sent: 1, Failed: 1, Bytes: 50}},
+	}
+	got, err := Rollup(rows, []string{"user"})
+	want := []Row{
+		{User: "app", Counts: Counts{Sent: 3, Deferred: 1, Bytes: 300}},
+		{User: "billing", Counts: Counts{Sent: 1, Failed: 1, Bytes: 50}},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Rollup by user = %v, %v, want %v", got, err, want)
+	}
+	got, _ = Rollup(rows, nil)
+	if want := []Row{{Counts: Counts{Sent: 4, Deferred: 1, Failed: 1, Bytes: 350}}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Rollup of everything = %v, want %v", got, want)
+	}
+	if _, err := Rollup(rows, []string{"month"}); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestParseDay(t *testing.T) {
+	if day, err := ParseDay("2026-10-16"); day != "2026-10-16" || err != nil {
+		t.Errorf("ParseDay = %q, %v", day, err)
+	}
+	if _, err := ParseDay("16/10/2026"); err == nil {
+		t.Error("expected an error for a malformed day")
+	}
+}
@@ -0,0 +1,99 @@
+// Package admin serves the runtime endpoints of a running proxy:
+// net/http/pprof profiles, expvar variables and the accounting counters.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+)
+
+// Handler serves pprof under /debug/pprof/, expvar under /debug/vars and,
+// with a non-nil ledger, its counters under /accounting. Every request
+// needs HTTP basic auth with the username and password login returns at
+// the time, since profiles reveal memory contents such as message data.
+func Handler(login func() (username, password string), ledger *accounting.Ledger) http.Handler {
+	mux := http.NewServeMux()
+	if ledger != nil {
+		mux.Handle("GET /accounting", accountingHandler(ledger))
+	}
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password := login()
+		user, pass, ok := r.BasicAuth()
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userMatch || !passMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="smtp-proxy admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Publish adds v to /debug/vars under name, unless a variable of that
+// name exists already, e.g. from an earlier server in the same process.
+func Publish(name string, v expvar.Var) {
+	if expvar.Get(name) == nil {
+		expvar.Publish(name, v)
+	}
+}
+
+// IntFunc is a /debug/vars integer read at each request.
+type IntFunc func() int64
+
+// String returns the value as JSON, for expvar.
+func (f IntFunc) String() string {
+	return strconv.FormatInt(f(), 10)
+}
+
+// accountingHandler serves the ledger's rows as JSON, selected by the
+// from, to (YYYY-MM-DD), user and domain query parameters and summed over
+// the fields missing from the comma-separated by parameter (default
+// day,user,domain).
+func accountingHandler(ledger *accounting.Ledger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := accounting.Filter{User: q.Get("user"), Domain: q.Get("domain")}
+		for _, day := range []struct {
+			param string
+			dst   *string
+		}{{"from", &f.From}, {"to", &f.To}} {
+			if v := q.Get(day.param); v != "" {
+				var err error
+				if *day.dst, err = accounting.ParseDay(v); err != nil {
+					http.Error(w, day.param+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		by := []string{"day", "user", "domain"}
+		if v := q.Get("by"); v != "" {
+			by = strings.Split(v, ",")
+		}
+		rows, err := accounting.Rollup(ledger.Rows(f), by)
+		if err != nil {
+			http.Error(w, "by: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rows == nil {
+			rows = []accounting.Row{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+	})
+}
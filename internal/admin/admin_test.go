@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+)
+
+func testLogin() (string, string) { return "admin", "secret" }
+
+func TestHandler(t *testing.T) {
+	Publish("admin_test", IntFunc(func() int64 { return 42 }))
+	Publish("admin_test", IntFunc(func() int64 { return 0 })) // ignored, no panic
+	srv := httptest.NewServer(Handler(testLogin, nil))
+	defer srv.Close()
+
+	get := func(path, user, pass string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/"} {
+		if resp := get(path, "", ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 without credentials, got %d", path, resp.StatusCode)
+		}
+		if resp := get(path, "admin", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 with a wrong password, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp := get("/debug/vars", "admin", "secret")
+	var vars struct {
+		AdminTest int64           `json:"admin_test"`
+		Memstats  json.RawMessage `json:"memstats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.AdminTest != 42 || vars.Memstats == nil {
+		t.Errorf("unexpected vars: admin_test=%d memstats present=%v", vars.AdminTest, vars.Memstats != nil)
+	}
+
+	resp = get("/debug/pprof/goroutine?debug=1", "admin", "secret")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Fatalf("expected the goroutine profile, got %d", resp.StatusCode)
+	}
+
+	if resp := get("/", "admin", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 outside /debug, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_Accounting(t *testing.T) {
+	ledger, err := accounting.Load(filepath.Join(t.TempDir(), "accounting"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ledger.Add("app", map[string]accounting.Counts{"gmail.com": {Sent: 2, Bytes: 200}, "example.com": {Failed: 1}})
+	_ = ledger.Add("billing", map[string]accounting.Counts{"gmail.com": {Deferred: 1}})
+	srv := httptest.NewServer(Handler(testLogin, ledger))
+	defer srv.Close()
+
+	get := func(query string) (*http.Response, []accounting.Row) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/accounting"+query, nil)
+		req.SetBasicAuth("admin", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var rows []accounting.Row
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, rows
+	}
+
+	if _, rows := get(""); len(rows) != 3 || rows[0].User != "app" || rows[0].Domain != "example.com" || rows[0].Day == "" {
+		t.Errorf("expected a row per day, user and domain, got %+v", rows)
+	}
+	_, rows := get("?by=user&domain=gmail.com")
+	want := []accounting.Row{
+		{User: "app", Counts: accounting.Counts{Sent: 2, Bytes: 200}},
+		{User: "billing", Counts: accounting.Counts{Deferred: 1}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected gmail.com rows by user, got %+v", rows)
+	}
+	if _, rows := get("?from=2000-01-01&to=2000-12-31"); rows == nil || len(rows) != 0 {
+		t.Errorf("expected an empty list outside the range, got %+v", rows)
+	}
+	for _, query := range []string{"?from=yesterday", "?by=month"} {
+		if resp, _ := get(query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+
+	srv = httptest.NewServer(Handler(testLogin, nil))
+	defer srv.Close()
+	if resp, _ := get(""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no /accounting without a ledger, got %d", resp.StatusCode)
+	}
+}
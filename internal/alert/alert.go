@@ -0,0 +1,338 @@
+// Package alert watches the relay error rate, the AUTH failure rate and
+// the queue depth, and notifies the operator when one stays over its
+// threshold for a sustained window, and again when it recovers. Critical
+// events, a failing upstream login and an expiring listener certificate,
+// are notified as soon as they are seen.
+package alert
+
+import (
+	"cmp"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// checkInterval is how often the metrics are compared with the
+// thresholds.
+const checkInterval = 10 * time.Second
+
+// minRelays is the fewest relays in the last minute that give a
+// meaningful error rate; with fewer, the rate is not over any threshold.
+const minRelays = 5
+
+// Thresholds are the alerting limits. A zero threshold is off.
+type Thresholds struct {
+	// RelayErrorRate is the percentage of relays in the last minute that
+	// failed.
+	RelayErrorRate int
+	// AuthFailures is the number of failed AUTH attempts in the last
+	// minute.
+	AuthFailures int
+	// QueueDepth is the number of messages being relayed at once.
+	QueueDepth int
+	// Window is how long a metric must stay over its threshold before the
+	// alert fires.
+	Window time.Duration
+}
+
+// Alert is a change of state of one metric or event.
+type Alert struct {
+	Name      string    `json:"alert"` // relay_error_rate, auth_failures, queue_depth, upstream_auth or cert_expiry
+	Firing    bool      `json:"firing"`
+	Value     int       `json:"value"`
+	Threshold int       `json:"threshold"`
+	Window    string    `json:"window,omitempty"` // empty for events
+	Detail    string    `json:"detail,omitempty"` // the upstream's error or the certificate
+	Host      string    `json:"host"`             // SMTP_SERVER_DOMAIN
+	At        time.Time `json:"at"`
+}
+
+// State returns "FIRING" or "RESOLVED".
+func (a Alert) State() string {
+	if a.Firing {
+		return "FIRING"
+	}
+	return "RESOLVED"
+}
+
+// Text describes a in one line.
+func (a Alert) Text() string {
+	var metric string
+	switch a.Name {
+	case "relay_error_rate":
+		metric = fmt.Sprintf("relay error rate %d%% (threshold %d%%)", a.Value, a.Threshold)
+	case "auth_failures":
+		metric = fmt.Sprintf("AUTH failures %d/min (threshold %d/min)", a.Value, a.Threshold)
+	case "queue_depth":
+		metric = fmt.Sprintf("queue depth %d (threshold %d)", a.Value, a.Threshold)
+	case "upstream_auth":
+		metric = "upstream authentication failing"
+		if !a.Firing {
+			metric = "upstream authentication succeeded"
+		}
+	case "cert_expiry":
+		switch {
+		case !a.Firing:
+			metric = "certificate renewed"
+		case a.Value < 0:
+			metric = fmt.Sprintf("certificate expired %d days ago", -a.Value)
+		default:
+			metric = fmt.Sprintf("certificate expires in %d days", a.Value)
+		}
+	default:
+		metric = fmt.Sprintf("%s %d (threshold %d)", a.Name, a.Value, a.Threshold)
+	}
+	if a.Firing && a.Window != "" {
+		metric += " for " + a.Window
+	}
+	if a.Detail != "" {
+		metric += ": " + a.Detail
+	}
+	return fmt.Sprintf("[%s] %s on %s", a.State(), metric, a.Host)
+}
+
+// bucket counts the events of one second.
+type bucket struct {
+	sec                         int64
+	relays, errors, authFailure int
+}
+
+type rule struct {
+	name      string
+	threshold int
+	window    time.Duration // 0 fires at the first check over the threshold
+	value     func(now time.Time) (value int, over bool)
+	detail    func() string // nil for none
+	since     time.Time     // first check over the threshold
+	firing    bool
+}
+
+// Monitor counts events reported by the proxy and checks them against
+// the thresholds. A nil *Monitor ignores events.
+type Monitor struct {
+	thresholds Thresholds
+	queueDepth func() int
+	host       string
+	now        func() time.Time
+
+	mu      sync.Mutex
+	sinks   []Sink
+	buckets [60]bucket
+	rules   []*rule
+
+	// The outcome of the latest relay that got as far as the upstream
+	// login
+	upstreamAuthFailed bool
+	upstreamAuthError  string
+}
+
+// New returns a monitor that notifies sinks, reading the queue depth from
+// queueDepth and naming host in alerts. The upstream_auth event is always
+// watched, whatever the thresholds.
+func New(t Thresholds, sinks []Sink, queueDepth func() int, host string) *Monitor {
+	m := &Monitor{thresholds: t, sinks: sinks, queueDepth: queueDepth, host: host, now: time.Now}
+	if t.RelayErrorRate > 0 {
+		m.rules = append(m.rules, &rule{name: "relay_error_rate", threshold: t.RelayErrorRate, window: t.Window, value: m.relayErrorRate})
+	}
+	if t.AuthFailures > 0 {
+		m.rules = append(m.rules, &rule{name: "auth_failures", threshold: t.AuthFailures, window: t.Window, value: m.authFailures})
+	}
+	if t.QueueDepth > 0 {
+		m.rules = append(m.rules, &rule{name: "queue_depth", threshold: t.QueueDepth, window: t.Window, value: func(time.Time) (int, bool) {
+			depth := m.queueDepth()
+			return depth, depth >= t.QueueDepth
+		}})
+	}
+	m.rules = append(m.rules, &rule{
+		name:   "upstream_auth",
+		value:  func(time.Time) (int, bool) { return 0, m.upstreamAuthFailed },
+		detail: func() string { return m.upstreamAuthError },
+	})
+	return m
+}
+
+// SetSinks replaces the sinks notified from now on, e.g. after their URLs
+// were reloaded.
+func (m *Monitor) SetSinks(sinks []Sink) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinks = sinks
+}
+
+// WatchCert alerts when cert, loaded from file, comes within warnDays of
+// its expiry, or with warnDays 0 once it has expired. Certificates are
+// loaded once, so the alert resolves only when a restart loads a renewed
+// one. A nil *Monitor watches nothing.
+func (m *Monitor) WatchCert(file string, cert *x509.Certificate, warnDays int) {
+	if m == nil || cert == nil {
+		return
+	}
+	name := cmp.Or(cert.Subject.CommonName, file)
+	if len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, &rule{
+		name:      "cert_expiry",
+		threshold: warnDays,
+		value: func(now time.Time) (int, bool) {
+			left := cert.NotAfter.Sub(now)
+			return int(left / (24 * time.Hour)), left < time.Duration(warnDays)*24*time.Hour
+		},
+		detail: func() string {
+			return fmt.Sprintf("%s (%s) not after %s", name, file, cert.NotAfter.UTC().Format(time.RFC3339))
+		},
+	})
+}
+
+// Relay records the outcome of a relay.
+func (m *Monitor) Relay(failed bool) {
+	if m == nil {
+		return
+	}
+	m.record(func(b *bucket) {
+		b.relays++
+		if failed {
+			b.errors++
+		}
+	})
+}
+
+// UpstreamAuth records the outcome of logging in to the upstream: the
+// error when it failed, or nil. The alert fires at the next check after a
+// failure and resolves at the next check after a success.
+func (m *Monitor) UpstreamAuth(err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstreamAuthFailed = err != nil
+	m.upstreamAuthError = ""
+	if err != nil {
+		m.upstreamAuthError = err.Error()
+	}
+}
+
+// AuthFailed records a failed AUTH attempt.
+func (m *Monitor) AuthFailed() {
+	if m == nil {
+		return
+	}
+	m.record(func(b *bucket) { b.authFailure++ })
+}
+
+func (m *Monitor) record(f func(*bucket)) {
+	sec := m.now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := &m.buckets[sec%int64(len(m.buckets))]
+	if b.sec != sec {
+		*b = bucket{sec: sec}
+	}
+	f(b)
+}
+
+// lastMinute sums the buckets of the minute before now. Call with m.mu
+// held.
+func (m *Monitor) lastMinute(now time.Time) bucket {
+	var sum bucket
+	oldest := now.Unix() - int64(len(m.buckets))
+	for _, b := range m.buckets {
+		if b.sec > oldest {
+			sum.relays += b.relays
+			sum.errors += b.errors
+			sum.authFailure += b.authFailure
+		}
+	}
+	return sum
+}
+
+func (m *Monitor) relayErrorRate(now time.Time) (int, bool) {
+	sum := m.lastMinute(now)
+	if sum.relays < minRelays {
+		return 0, false
+	}
+	rate := sum.errors * 100 / sum.relays
+	return rate, rate >= m.thresholds.RelayErrorRate
+}
+
+func (m *Monitor) authFailures(now time.Time) (int, bool) {
+	failures := m.lastMinute(now).authFailure
+	return failures, failures >= m.thresholds.AuthFailures
+}
+
+// Run checks the thresholds every few seconds until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// check fires each rule whose metric has been over its threshold for the
+// window, and resolves each firing rule whose metric is back under it.
+func (m *Monitor) check() {
+	now := m.now()
+	var alerts []Alert
+	m.mu.Lock()
+	for _, r := range m.rules {
+		value, over := r.value(now)
+		switch {
+		case over && r.since.IsZero():
+			r.since = now
+		case !over:
+			r.since = time.Time{}
+		}
+		if over && !r.firing && now.Sub(r.since) >= r.window {
+			r.firing = true
+		} else if !over && r.firing {
+			r.firing = false
+		} else {
+			continue
+		}
+		a := Alert{
+			Name:      r.name,
+			Firing:    r.firing,
+			Value:     value,
+			Threshold: r.threshold,
+			Host:      m.host,
+			At:        now,
+		}
+		if r.window > 0 {
+			a.Window = r.window.String()
+		}
+		if r.detail != nil {
+			a.Detail = r.detail()
+		}
+		alerts = append(alerts, a)
+	}
+	sinks := m.sinks
+	m.mu.Unlock()
+
+	for _, a := range alerts {
+		if a.Firing {
+			slog.Warn("alert firing", "alert", a.Name, "value", a.Value, "threshold", a.Threshold, "window", a.Window, "detail", a.Detail)
+		} else {
+			slog.Info("alert resolved", "alert", a.Name, "value", a.Value, "threshold", a.Threshold)
+		}
+		for _, s := range sinks {
+			if err := s.Notify(a); err != nil {
+				slog.Error("alert notification failed", "alert", a.Name, "sink", s.Name(), "error", err)
+			}
+		}
+	}
+}
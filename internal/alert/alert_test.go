@@ -0,0 +1,254 @@
+package alert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recorder struct{ alerts []Alert }
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Notify(a Alert) error {
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	rec := &recorder{}
+	depth := 0
+	m := New(Thresholds{RelayErrorRate: 50, AuthFailures: 3, QueueDepth: 10, Window: time.Minute},
+		[]Sink{rec}, func() int { return depth }, "mx.example.com")
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+	step := func(d time.Duration) {
+		now = now.Add(d)
+		m.check()
+	}
+
+	// Too few relays for a rate
+	m.Relay(true)
+	m.Relay(true)
+	step(time.Minute)
+	if len(rec.alerts) != 0 {
+		t.Fatalf("expected no alert below the sample minimum, got %v", rec.alerts)
+	}
+
+	depth = 12
+	step(10 * time.Second)
+	step(30 * time.Second)
+	if len(rec.alerts) != 0 {
+		t.Fatalf("expected no alert before the window passed, got %v", rec.alerts)
+	}
+	step(30 * time.Second)
+	if len(rec.alerts) != 1 || rec.alerts[0].Name != "queue_depth" || !rec.alerts[0].Firing || rec.alerts[0].Value != 12 {
+		t.Fatalf("expected queue_depth firing after the window, got %v", rec.alerts)
+	}
+	step(10 * time.Second)
+	if len(rec.alerts) != 1 {
+		t.Errorf("expected a firing alert sent once, got %v", rec.alerts)
+	}
+	depth = 0
+	step(10 * time.Second)
+	if len(rec.alerts) != 2 || rec.alerts[1].Firing {
+		t.Fatalf("expected queue_depth resolved, got %v", rec.alerts)
+	}
+
+	// A dip under the threshold restarts the window
+	rec.alerts = nil
+	for range 4 {
+		m.AuthFailed()
+	}
+	step(time.Second)
+	step(30 * time.Second)
+	step(31 * time.Second) // the failures left the last minute
+	for range 3 {
+		m.AuthFailed()
+	}
+	step(30 * time.Second)
+	if len(rec.alerts) != 0 {
+		t.Fatalf("expected the window to restart after a dip, got %v", rec.alerts)
+	}
+
+	relays := func() {
+		for range 3 {
+			m.Relay(false)
+		}
+		for range 4 {
+			m.Relay(true)
+		}
+	}
+	relays()
+	step(0)
+	step(30 * time.Second)
+	relays()
+	step(30 * time.Second)
+	if len(rec.alerts) != 1 || rec.alerts[0].Name != "relay_error_rate" || rec.alerts[0].Value != 57 {
+		t.Fatalf("expected relay_error_rate firing at 57%%, got %v", rec.alerts)
+	}
+	if got := rec.alerts[0].Text(); got != "[FIRING] relay error rate 57% (threshold 50%) for 1m0s on mx.example.com" {
+		t.Errorf("unexpected alert text %q", got)
+	}
+
+	var nilMonitor *Monitor
+	nilMonitor.Relay(true)
+	nilMonitor.AuthFailed()
+}
+
+func TestMonitor_Events(t *testing.T) {
+	rec := &recorder{}
+	m := New(Thresholds{}, []Sink{rec}, nil, "mx.example.com")
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	m.WatchCert("/etc/ssl/mx.pem", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "Proxy"},
+		DNSNames: []string{"mx.example.com"},
+		NotAfter: now.Add(14*24*time.Hour + 36*time.Hour),
+	}, 14)
+	m.WatchCert("/etc/ssl/old.pem", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "old.example.com"},
+		NotAfter: now.Add(-50 * time.Hour),
+	}, 14)
+	// With no warning days, only an expired certificate alerts
+	m.WatchCert("/etc/ssl/soon.pem", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "soon.example.com"},
+		NotAfter: now.Add(time.Hour),
+	}, 0)
+	m.UpstreamAuth(errors.New("535 5.7.8 Authentication credentials invalid"))
+	m.check()
+	want := []string{
+		"[FIRING] upstream authentication failing: 535 5.7.8 Authentication credentials invalid on mx.example.com",
+		"[FIRING] certificate expired 2 days ago: old.example.com (/etc/ssl/old.pem) not after 2026-10-14T10:00:00Z on mx.example.com",
+	}
+	if len(rec.alerts) != len(want) {
+		t.Fatalf("expected events to fire at the first check, got %v", rec.alerts)
+	}
+	for i, a := range rec.alerts {
+		if a.Text() != want[i] || a.Window != "" {
+			t.Errorf("unexpected alert %q, want %q", a.Text(), want[i])
+		}
+	}
+
+	rec.alerts = nil
+	m.UpstreamAuth(nil)
+	now = now.Add(2 * 24 * time.Hour)
+	m.check()
+	want = []string{
+		"[RESOLVED] upstream authentication succeeded on mx.example.com",
+		"[FIRING] certificate expires in 13 days: mx.example.com (/etc/ssl/mx.pem) not after 2026-11-01T00:00:00Z on mx.example.com",
+		"[FIRING] certificate expired 1 days ago: soon.example.com (/etc/ssl/soon.pem) not after 2026-10-16T13:00:00Z on mx.example.com",
+	}
+	if len(rec.alerts) != len(want) {
+		t.Fatalf("unexpected alerts %v", rec.alerts)
+	}
+	for i, a := range rec.alerts {
+		if a.Text() != want[i] {
+			t.Errorf("unexpected alert %q, want %q", a.Text(), want[i])
+		}
+	}
+
+	// Sinks replaced after a secret reload get the next alerts
+	reloaded := &recorder{}
+	m.SetSinks([]Sink{reloaded})
+	rec.alerts = nil
+	m.UpstreamAuth(errors.New("535 5.7.8 Authentication credentials invalid"))
+	m.check()
+	if len(rec.alerts) != 0 || len(reloaded.alerts) != 1 {
+		t.Errorf("expected only the new sink notified, got %v and %v", rec.alerts, reloaded.alerts)
+	}
+
+	var nilMonitor *Monitor
+	nilMonitor.UpstreamAuth(nil)
+	nilMonitor.WatchCert("/etc/ssl/mx.pem", &x509.Certificate{}, 30)
+	nilMonitor.SetSinks(nil)
+}
+
+func TestSinks(t *testing.T) {
+	var got [][]byte
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/json" || !json.Valid(body) {
+			t.Errorf("expected a JSON request, got %s", r.Header.Get("Content-Type"))
+		}
+		got = append(got, body)
+		w.WriteHeader(status)
+		w.Write([]byte("invalid_token"))
+	}))
+	defer srv.Close()
+
+	a := Alert{Name: "auth_failures", Firing: true, Value: 40, Threshold: 30, Window: "5m0s", Host: "mx.example.com", At: time.Unix(1700000000, 0)}
+	if err := (&Webhook{URL: srv.URL}).Notify(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Slack{URL: srv.URL}).Notify(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Teams{URL: srv.URL}).Notify(a); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(got))
+	}
+
+	var webhook struct {
+		Alert   string `json:"alert"`
+		State   string `json:"state"`
+		Value   int    `json:"value"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(got[0], &webhook); err != nil || webhook.Alert != "auth_failures" || webhook.State != "firing" || webhook.Value != 40 || webhook.Message != a.Text() {
+		t.Errorf("unexpected webhook payload %s (%v)", got[0], err)
+	}
+	var slack struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(got[1], &slack); err != nil || slack.Text != "[FIRING] AUTH failures 40/min (threshold 30/min) for 5m0s on mx.example.com" {
+		t.Errorf("unexpected Slack payload %s (%v)", got[1], err)
+	}
+	var teams struct {
+		Type        string `json:"type"`
+		Attachments []struct {
+			Content struct {
+				Type string `json:"type"`
+				Body []struct {
+					Text string `json:"text"`
+				} `json:"body"`
+			} `json:"content"`
+		} `json:"attachments"`
+	}
+	err := json.Unmarshal(got[2], &teams)
+	if err != nil || teams.Type != "message" || len(teams.Attachments) != 1 {
+		t.Fatalf("unexpected Teams payload %s (%v)", got[2], err)
+	}
+	card := teams.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) == 0 || card.Body[0].Text != a.Text() {
+		t.Errorf("unexpected Teams card %s", got[2])
+	}
+
+	status = http.StatusForbidden
+	if err := (&Slack{URL: srv.URL}).Notify(a); err == nil || !strings.Contains(err.Error(), "403 Forbidden: invalid_token") {
+		t.Errorf("expected the rejection reported, got %v", err)
+	}
+
+	var sent []byte
+	email := &Email{From: "relay@example.com", To: []string{"ops@example.com"}, Submit: func(to []string, message []byte) error {
+		sent = message
+		return nil
+	}}
+	if err := email.Notify(a); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sent), "\r\nSubject: "+a.Text()+"\r\n") || !strings.HasPrefix(string(sent), "From: relay@example.com\r\nTo: ops@example.com\r\n") {
+		t.Errorf("unexpected alert email %q", sent)
+	}
+}
@@ -0,0 +1,154 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds one webhook request.
+const notifyTimeout = 10 * time.Second
+
+// Sink delivers alerts to the operator.
+type Sink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	Notify(Alert) error
+}
+
+// Webhook posts each alert as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client // nil uses a client with a 10s timeout
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+func (w *Webhook) Notify(a Alert) error {
+	type payload struct {
+		Alert
+		State   string `json:"state"`
+		Message string `json:"message"`
+	}
+	body, err := json.Marshal(payload{a, strings.ToLower(a.State()), a.Text()})
+	if err != nil {
+		return err
+	}
+	return post(w.Client, w.URL, body)
+}
+
+// Slack posts each alert's text to a Slack incoming webhook.
+type Slack struct {
+	URL    string
+	Client *http.Client // nil uses a client with a 10s timeout
+}
+
+func (s *Slack) Name() string { return "slack" }
+
+func (s *Slack) Notify(a Alert) error {
+	type payload struct {
+		Text string `json:"text"`
+	}
+	body, err := json.Marshal(payload{a.Text()})
+	if err != nil {
+		return err
+	}
+	return post(s.Client, s.URL, body)
+}
+
+// Teams posts each alert as an Adaptive Card to a Microsoft Teams
+// workflow or incoming webhook.
+type Teams struct {
+	URL    string
+	Client *http.Client // nil uses a client with a 10s timeout
+}
+
+func (t *Teams) Name() string { return "teams" }
+
+func (t *Teams) Notify(a Alert) error {
+	type textBlock struct {
+		Type   string `json:"type"`
+		Text   string `json:"text"`
+		Wrap   bool   `json:"wrap"`
+		Weight string `json:"weight"`
+		Color  string `json:"color"`
+	}
+	type card struct {
+		Schema  string      `json:"$schema"`
+		Type    string      `json:"type"`
+		Version string      `json:"version"`
+		Body    []textBlock `json:"body"`
+	}
+	type attachment struct {
+		ContentType string `json:"contentType"`
+		Content     card   `json:"content"`
+	}
+	type message struct {
+		Type        string       `json:"type"`
+		Attachments []attachment `json:"attachments"`
+	}
+	color := "Good"
+	if a.Firing {
+		color = "Attention"
+	}
+	body, err := json.Marshal(message{
+		Type: "message",
+		Attachments: []attachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: card{
+				Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+				Type:    "AdaptiveCard",
+				Version: "1.4",
+				Body:    []textBlock{{Type: "TextBlock", Text: a.Text(), Wrap: true, Weight: "Bolder", Color: color}},
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return post(t.Client, t.URL, body)
+}
+
+// Email mails each alert to To through Submit, which the caller points at
+// the proxy's own pipeline.
+type Email struct {
+	From   string
+	To     []string
+	Submit func(recipients []string, message []byte) error
+}
+
+func (e *Email) Name() string { return "email" }
+
+func (e *Email) Notify(a Alert) error {
+	message := "From: " + e.From + "\r\n" +
+		"To: " + strings.Join(e.To, ", ") + "\r\n" +
+		"Subject: " + a.Text() + "\r\n" +
+		"Date: " + a.At.Format(time.RFC1123Z) + "\r\n" +
+		"Auto-Submitted: auto-generated\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		a.Text() + "\r\n"
+	return e.Submit(e.To, []byte(message))
+}
+
+// post sends the JSON body to url, failing on a non-2xx reply.
+func post(client *http.Client, url string, body []byte) error {
+	if client == nil {
+		client = &http.Client{Timeout: notifyTimeout}
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
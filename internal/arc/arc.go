@@ -0,0 +1,257 @@
+// Package arc adds an ARC (RFC 8617) seal to outbound messages, so the
+// authentication results recorded before the proxy modified a message
+// stay verifiable downstream.
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// Chain validation results, as carried in the cv= tag.
+const (
+	ChainNone = "none"
+	ChainPass = "pass"
+	ChainFail = "fail"
+)
+
+// maxInstance is the highest ARC instance RFC 8617 allows.
+const maxInstance = 50
+
+// signedHeaders are signed by the ARC-Message-Signature when present.
+var signedHeaders = []string{
+	"from", "to", "cc", "reply-to", "subject", "date", "message-id",
+	"in-reply-to", "references", "mime-version", "content-type", "content-transfer-encoding",
+}
+
+// Sealer validates incoming ARC chains and seals outgoing messages.
+type Sealer struct {
+	domain     string
+	selector   string
+	authServID string
+	key        crypto.Signer
+	algorithm  string // "rsa-sha256" or "ed25519-sha256"
+
+	now       func() time.Time
+	lookupTXT func(name string) ([]string, error)
+}
+
+// New creates a sealer from cfg, or returns nil when no key is configured.
+// The key file holds a PEM RSA (PKCS #1 or #8) or Ed25519 (PKCS #8)
+// private key.
+func New(cfg *config.Config) (*Sealer, error) {
+	if cfg.ARCKeyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.ARCKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("arc key: %w", err)
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("arc key %s: %w", cfg.ARCKeyFile, err)
+	}
+	return NewSealer(cfg.ARCDomain, cfg.ARCSelector, cfg.ARCAuthServID, key)
+}
+
+// NewSealer creates a sealer signing as selector._domainkey.domain.
+func NewSealer(domain, selector, authServID string, key crypto.Signer) (*Sealer, error) {
+	s := &Sealer{
+		domain:     domain,
+		selector:   selector,
+		authServID: authServID,
+		key:        key,
+		now:        time.Now,
+		lookupTXT:  net.LookupTXT,
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("arc key: unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// Seal adds the next ARC set to msg: an ARC-Authentication-Results
+// carrying results, an ARC-Message-Signature over msg, and an ARC-Seal
+// over the whole chain with cv set to the validation result of the chain
+// the message arrived with. msg must already be in its final form.
+func (s *Sealer) Seal(msg []byte, cv, results string) ([]byte, error) {
+	fields, body := splitMessage(msg)
+	sets, err := collectSets(fields)
+	if err != nil {
+		// A seal covers every earlier set, so a broken chain cannot be extended
+		return nil, fmt.Errorf("arc: %w", err)
+	}
+	instance := 1
+	for i := range sets {
+		instance = max(instance, i+1)
+	}
+	if instance > maxInstance {
+		return nil, fmt.Errorf("arc: chain already has %d instances", maxInstance)
+	}
+	if instance == 1 {
+		cv = ChainNone
+	}
+	t := s.now().Unix()
+
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s; %s; arc=%s\r\n", instance, s.authServID, results, cv)
+
+	var names []string
+	for _, name := range signedHeaders {
+		for _, f := range fields {
+			if f.name == name {
+				names = append(names, name)
+			}
+		}
+	}
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		instance, s.algorithm, s.domain, s.selector, t, strings.Join(names, ":"), bodyHash(body))
+	var signed strings.Builder
+	for _, raw := range selectHeaders(fields, names) {
+		signed.WriteString(canonHeader(raw))
+	}
+	signed.WriteString(strings.TrimSuffix(canonHeader(ams), "\r\n"))
+	sig, err := s.sign(signed.String())
+	if err != nil {
+		return nil, err
+	}
+	ams += sig + "\r\n"
+
+	as := fmt.Sprintf("ARC-Seal: i=%d; a=%s; cv=%s; d=%s; s=%s; t=%d; b=", instance, s.algorithm, cv, s.domain, s.selector, t)
+	sets[instance] = &set{aar: aar, ams: ams, as: as}
+	sig, err = s.sign(sealInput(sets, instance))
+	if err != nil {
+		return nil, err
+	}
+	as += sig + "\r\n"
+
+	out := make([]byte, 0, len(as)+len(ams)+len(aar)+len(msg))
+	out = append(out, as...)
+	out = append(out, ams...)
+	out = append(out, aar...)
+	return append(out, msg...), nil
+}
+
+func (s *Sealer) sign(data string) (string, error) {
+	sum := sha256.Sum256([]byte(data))
+	opts := crypto.Hash(0)
+	if s.algorithm == "rsa-sha256" {
+		opts = crypto.SHA256
+	}
+	sig, err := s.key.Sign(rand.Reader, sum[:], opts)
+	if err != nil {
+		return "", fmt.Errorf("arc sign: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// set is one ARC set: the three fields sharing an instance number.
+type set struct {
+	aar, ams, as string
+}
+
+// collectSets groups the ARC fields by instance. It fails when an
+// instance is out of range or has a missing or duplicated field.
+func collectSets(fields []field) (map[int]*set, error) {
+	sets := make(map[int]*set)
+	for _, f := range fields {
+		var slot func(*set) *string
+		switch f.name {
+		case "arc-authentication-results":
+			slot = func(s *set) *string { return &s.aar }
+		case "arc-message-signature":
+			slot = func(s *set) *string { return &s.ams }
+		case "arc-seal":
+			slot = func(s *set) *string { return &s.as }
+		default:
+			continue
+		}
+		i, err := instanceOf(f)
+		if err != nil {
+			return sets, err
+		}
+		if sets[i] == nil {
+			sets[i] = &set{}
+		}
+		p := slot(sets[i])
+		if *p != "" {
+			return sets, fmt.Errorf("duplicate %s for instance %d", f.name, i)
+		}
+		*p = f.raw
+	}
+	for i := 1; i <= len(sets); i++ {
+		s, ok := sets[i]
+		if !ok || s.aar == "" || s.ams == "" || s.as == "" {
+			return sets, fmt.Errorf("incomplete ARC set %d", i)
+		}
+	}
+	return sets, nil
+}
+
+// instanceOf reads the i= tag, which leads every ARC field.
+func instanceOf(f field) (int, error) {
+	v := strings.TrimSpace(f.value())
+	spec, _, _ := strings.Cut(v, ";")
+	k, num, ok := strings.Cut(spec, "=")
+	if !ok || strings.TrimSpace(k) != "i" {
+		return 0, fmt.Errorf("%s without instance", f.name)
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(num))
+	if err != nil || i < 1 || i > maxInstance {
+		return 0, fmt.Errorf("%s: invalid instance %q", f.name, num)
+	}
+	return i, nil
+}
+
+// sealInput is the data signed by the ARC-Seal of instance n: every set up
+// to n, each in AAR, AMS, AS order, with the final seal's b= empty.
+func sealInput(sets map[int]*set, n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		b.WriteString(canonHeader(sets[i].aar))
+		b.WriteString(canonHeader(sets[i].ams))
+		if i < n {
+			b.WriteString(canonHeader(sets[i].as))
+		}
+	}
+	b.WriteString(strings.TrimSuffix(canonHeader(withoutSignature(sets[n].as)), "\r\n"))
+	return b.String()
+}
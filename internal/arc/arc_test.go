@@ -0,0 +1,209 @@
+package arc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+const message = "From: App <app@example.com>\r\n" +
+	"To: user@example.org\r\n" +
+	"Subject: Monthly  report\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"\r\n" +
+	"Hello,\r\n\r\nthe report is attached.  \r\n\r\n"
+
+// keyring serves DKIM key records for sealers created with newSealer.
+type keyring map[string]string
+
+func (k keyring) lookup(name string) ([]string, error) {
+	if rec, ok := k[name]; ok {
+		return []string{rec}, nil
+	}
+	return nil, errors.New("no such record")
+}
+
+func newSealer(t *testing.T, keys keyring, domain string, ed bool) *Sealer {
+	t.Helper()
+	var s *Sealer
+	var err error
+	if ed {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		s, err = NewSealer(domain, "arc", "mx."+domain, priv)
+		keys["arc._domainkey."+domain] = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	} else {
+		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+		der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		s, err = NewSealer(domain, "arc", "mx."+domain, priv)
+		// Long records arrive split into several strings
+		p := base64.StdEncoding.EncodeToString(der)
+		keys["arc._domainkey."+domain] = "v=DKIM1; k=rsa; p=" + p[:100] + " " + p[100:]
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lookupTXT = keys.lookup
+	s.now = func() time.Time { return time.Unix(1700000000, 0) }
+	return s
+}
+
+func TestSeal_FirstHop(t *testing.T) {
+	keys := keyring{}
+	s := newSealer(t, keys, "proxy.example.com", false)
+
+	if cv := s.Validate([]byte(message)); cv != ChainNone {
+		t.Fatalf("expected no chain, got %s", cv)
+	}
+	sealed, err := s.Seal([]byte(message), ChainNone, "auth=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(sealed)
+	if !strings.HasPrefix(out, "ARC-Seal: i=1; a=rsa-sha256; cv=none; d=proxy.example.com; s=arc; t=1700000000; b=") {
+		t.Errorf("unexpected seal: %q", out[:120])
+	}
+	if !strings.Contains(out, "ARC-Authentication-Results: i=1; mx.proxy.example.com; auth=pass; arc=none\r\n") {
+		t.Errorf("missing AAR in %q", out)
+	}
+	if !strings.Contains(out, "h=from:to:subject:message-id;") {
+		t.Errorf("expected present headers signed, got %q", out)
+	}
+	if !strings.HasSuffix(out, message) {
+		t.Error("expected original message after the ARC set")
+	}
+
+	// The next hop sees a valid chain
+	if cv := s.Validate(sealed); cv != ChainPass {
+		t.Errorf("expected pass for own seal, got %s", cv)
+	}
+}
+
+func TestSeal_ExtendsChain(t *testing.T) {
+	keys := keyring{}
+	first := newSealer(t, keys, "first.example", true)
+	second := newSealer(t, keys, "second.example", false)
+
+	sealed, err := first.Seal([]byte(message), ChainNone, "spf=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An intermediary modifies the message after sealing, as the proxy
+	// does when sanitizing: the chain still validates on the raw input
+	cv := second.Validate(sealed)
+	if cv != ChainPass {
+		t.Fatalf("expected pass, got %s", cv)
+	}
+	modified := strings.Replace(string(sealed), "Subject: Monthly  report", "Subject: [ext] Monthly report", 1)
+	sealed2, err := second.Seal([]byte(modified), cv, "auth=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(sealed2), "ARC-Seal: i=2; a=rsa-sha256; cv=pass; d=second.example;") {
+		t.Errorf("unexpected second seal %q", string(sealed2)[:80])
+	}
+	if cv := second.Validate(sealed2); cv != ChainPass {
+		t.Errorf("expected two-hop chain to pass, got %s", cv)
+	}
+}
+
+func TestValidate_Failures(t *testing.T) {
+	keys := keyring{}
+	s := newSealer(t, keys, "proxy.example.com", false)
+	sealed, err := s.Seal([]byte(message), ChainNone, "auth=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(string) string
+	}{
+		{"body changed", func(m string) string { return strings.Replace(m, "attached", "missing", 1) }},
+		{"signed header changed", func(m string) string { return strings.Replace(m, "To: user@example.org", "To: other@example.org", 1) }},
+		{"seal tampered", func(m string) string {
+			return strings.Replace(m, "ARC-Seal: i=1; a=rsa-sha256; cv=none", "ARC-Seal: i=1; a=rsa-sha256; cv=pass", 1)
+		}},
+		{"incomplete set", func(m string) string {
+			i := strings.Index(m, "ARC-Authentication-Results:")
+			j := strings.Index(m[i:], "\r\n")
+			return m[:i] + m[i+j+2:]
+		}},
+	}
+	for _, tt := range tests {
+		if cv := s.Validate([]byte(tt.mutate(string(sealed)))); cv != ChainFail {
+			t.Errorf("%s: expected fail, got %s", tt.name, cv)
+		}
+	}
+
+	// Relaxed canonicalization tolerates whitespace changes
+	relaxed := strings.Replace(string(sealed), "the report is attached.  ", "the report  is attached.", 1)
+	if cv := s.Validate([]byte(relaxed)); cv != ChainPass {
+		t.Errorf("expected whitespace change to pass, got %s", cv)
+	}
+
+	// A missing key fails the chain
+	delete(keys, "arc._domainkey.proxy.example.com")
+	if cv := s.Validate(sealed); cv != ChainFail {
+		t.Errorf("expected fail without key, got %s", cv)
+	}
+
+	// A broken chain cannot be extended
+	broken := tests[3].mutate(string(sealed))
+	if _, err := s.Seal([]byte(broken), ChainFail, "auth=pass"); err == nil {
+		t.Error("expected error sealing a broken chain")
+	}
+}
+
+func TestCanonBody(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"\r\n\r\n", ""},
+		{"a  b \t\r\nc\r\n\r\n", "a b\r\nc\r\n"},
+		{"no newline", "no newline\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(canonBody([]byte(tt.in))); got != tt.want {
+			t.Errorf("canonBody(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New(&config.Config{}); s != nil || err != nil {
+		t.Errorf("expected nil sealer without a key, got %v, %v", s, err)
+	}
+
+	dir := t.TempDir()
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs1 := filepath.Join(dir, "pkcs1.pem")
+	_ = os.WriteFile(pkcs1, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0o600)
+	_, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edPriv)
+	pkcs8 := filepath.Join(dir, "ed25519.pem")
+	_ = os.WriteFile(pkcs8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}), 0o600)
+	garbage := filepath.Join(dir, "garbage.pem")
+	_ = os.WriteFile(garbage, []byte("not a key"), 0o600)
+
+	for path, alg := range map[string]string{pkcs1: "rsa-sha256", pkcs8: "ed25519-sha256"} {
+		s, err := New(&config.Config{ARCKeyFile: path, ARCSelector: "arc", ARCDomain: "example.com"})
+		if err != nil || s.algorithm != alg {
+			t.Errorf("%s: expected %s sealer, got %v, %v", filepath.Base(path), alg, s, err)
+		}
+	}
+	for _, path := range []string{garbage, filepath.Join(dir, "missing.pem")} {
+		if _, err := New(&config.Config{ARCKeyFile: path, ARCSelector: "arc"}); err == nil {
+			t.Errorf("%s: expected error", filepath.Base(path))
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package arc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// field is one header field as it appears in the message, including
+// folded continuation lines and the final CRLF.
+type field struct {
+	name string // lowercase
+	raw  string
+}
+
+func (f field) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	return v
+}
+
+// splitMessage separates a CRLF message into its header fields and body.
+func splitMessage(msg []byte) ([]field, []byte) {
+	headerPart, body := msg, []byte(nil)
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i != -1 {
+		headerPart, body = msg[:i+2], msg[i+4:]
+	}
+	var fields []field
+	for _, line := range strings.SplitAfter(string(headerPart), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, field{name: strings.ToLower(strings.TrimSpace(name)), raw: line})
+	}
+	return fields, body
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// canonHeader applies relaxed header canonicalization (RFC 6376 3.4.2)
+// and returns "name:value\r\n".
+func canonHeader(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonBody applies relaxed body canonicalization (RFC 6376 3.4.4).
+func canonBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(l, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(canonBody(body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selectHeaders returns the fields named in names for signing: each name
+// takes the last instance not yet used, working upwards. Names with no
+// remaining instance contribute nothing.
+func selectHeaders(fields []field, names []string) []string {
+	used := make(map[int]bool)
+	var out []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fields[i].name == name && !used[i] {
+				used[i] = true
+				out = append(out, fields[i].raw)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// parseTags parses a DKIM-style tag list ("a=1; b=2"). Whitespace inside
+// values is removed, which is what base64 tags need.
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		k = strings.TrimSpace(k)
+		if _, dup := tags[k]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", k)
+		}
+		tags[k] = strings.Join(strings.Fields(v), "")
+	}
+	return tags, nil
+}
+
+var sigTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// withoutSignature empties the b= tag of a raw signature field, as it was
+// when the signature was computed.
+func withoutSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return name + ":" + sigTag.ReplaceAllString(value, "${1}${2}")
+}
@@ -0,0 +1,152 @@
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Validate checks the ARC chain raw arrived with (RFC 8617 section 5.2)
+// and returns ChainNone, ChainPass or ChainFail. It must see the message
+// as the client sent it, before any modification.
+func (s *Sealer) Validate(raw []byte) string {
+	fields, body := splitMessage(raw)
+	sets, err := collectSets(fields)
+	if len(sets) == 0 && err == nil {
+		return ChainNone
+	}
+	if err == nil {
+		err = s.validate(fields, body, sets)
+	}
+	if err != nil {
+		slog.Info("arc chain failed validation", "error", err)
+		return ChainFail
+	}
+	return ChainPass
+}
+
+func (s *Sealer) validate(fields []field, body []byte, sets map[int]*set) error {
+	n := len(sets)
+	for i := 1; i <= n; i++ {
+		tags, err := parseTags(field{raw: sets[i].as}.value())
+		if err != nil {
+			return fmt.Errorf("seal %d: %w", i, err)
+		}
+		want := ChainPass
+		if i == 1 {
+			want = ChainNone
+		}
+		if tags["cv"] != want {
+			return fmt.Errorf("seal %d: cv=%s", i, tags["cv"])
+		}
+	}
+
+	// Only the most recent message signature has to verify; earlier ones
+	// were broken by the hops that sealed after them.
+	if err := s.verifyMessageSignature(fields, body, sets[n].ams); err != nil {
+		return fmt.Errorf("message signature %d: %w", n, err)
+	}
+	for i := n; i >= 1; i-- {
+		tags, _ := parseTags(field{raw: sets[i].as}.value())
+		if err := s.verify(tags, sealInput(sets, i)); err != nil {
+			return fmt.Errorf("seal %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *Sealer) verifyMessageSignature(fields []field, body []byte, ams string) error {
+	tags, err := parseTags(field{raw: ams}.value())
+	if err != nil {
+		return err
+	}
+	if c := tags["c"]; c != "" && c != "relaxed/relaxed" {
+		return fmt.Errorf("unsupported canonicalization %q", c)
+	}
+	if tags["bh"] != bodyHash(body) {
+		return errors.New("body hash mismatch")
+	}
+	names := strings.Split(tags["h"], ":")
+	if slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(strings.TrimSpace(n), "arc-seal") }) {
+		return errors.New("signs ARC-Seal")
+	}
+	var signed strings.Builder
+	for _, raw := range selectHeaders(fields, names) {
+		signed.WriteString(canonHeader(raw))
+	}
+	signed.WriteString(strings.TrimSuffix(canonHeader(withoutSignature(ams)), "\r\n"))
+	return s.verify(tags, signed.String())
+}
+
+// verify checks the b= signature of tags over data with the public key
+// published at s=._domainkey.d=.
+func (s *Sealer) verify(tags map[string]string, data string) error {
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("signature: %w", err)
+	}
+	key, err := s.publicKey(tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(data))
+	switch tags["a"] {
+	case "rsa-sha256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("rsa-sha256 signature with a non-RSA key")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+	case "ed25519-sha256":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("ed25519-sha256 signature with a non-Ed25519 key")
+		}
+		if !ed25519.Verify(k, sum[:], sig) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", tags["a"])
+}
+
+// publicKey fetches and parses a DKIM key record.
+func (s *Sealer) publicKey(selector, domain string) (crypto.PublicKey, error) {
+	if selector == "" || domain == "" {
+		return nil, errors.New("missing s= or d=")
+	}
+	name := selector + "._domainkey." + domain
+	txts, err := s.lookupTXT(name)
+	if err != nil {
+		return nil, fmt.Errorf("key lookup %s: %w", name, err)
+	}
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, fmt.Errorf("key record %s: %w", name, err)
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, fmt.Errorf("key record %s: missing or revoked key", name)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(der)
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key record %s: bad ed25519 key length", name)
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, fmt.Errorf("key record %s: unsupported key type %q", name, tags["k"])
+}
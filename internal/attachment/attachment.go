@@ -0,0 +1,263 @@
+// Package attachment enforces outbound attachment rules: a size limit and
+// banned file extensions or MIME types. Offending attachments either fail
+// the message or are replaced by a short notice.
+package attachment
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/mimepart"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// maxDepth bounds how deeply nested multiparts are searched.
+const maxDepth = 10
+
+// Policy is a set of attachment rules. It implements processor.Processor.
+type Policy struct {
+	MaxSize          int64    // decoded bytes per attachment; 0 = no limit
+	BannedExtensions []string // lowercase, with the leading dot
+	BannedTypes      []string // lowercase media types; a trailing "*" matches a prefix, e.g. "video/*"
+	Strip            bool     // replace offending attachments instead of rejecting
+}
+
+// New creates the policy configured in cfg, or returns nil when no rule is
+// set.
+func New(cfg *config.Config) *Policy {
+	if cfg.AttachmentMaxSize == 0 && len(cfg.AttachmentBannedExtensions) == 0 && len(cfg.AttachmentBannedTypes) == 0 {
+		return nil
+	}
+	return &Policy{
+		MaxSize:          cfg.AttachmentMaxSize,
+		BannedExtensions: cfg.AttachmentBannedExtensions,
+		BannedTypes:      cfg.AttachmentBannedTypes,
+		Strip:            cfg.AttachmentAction == "strip",
+	}
+}
+
+// violation is an attachment that breaks a rule. start and end locate the
+// whole body part, headers included, or are -1 when it cannot be removed
+// (the top-level body, or content under a signature).
+type violation struct {
+	start, end int
+	name       string
+	reason     string
+	tooLarge   bool
+}
+
+// ProcessEnvelope implements processor.Processor; the rules need the
+// message, so it does nothing.
+func (p *Policy) ProcessEnvelope(*relay.Envelope) error {
+	return nil
+}
+
+// ProcessMessage checks every attachment in env.Message. Violations fail
+// the message, or with Strip are replaced by a text notice; content that
+// cannot be changed without breaking the message still fails it.
+func (p *Policy) ProcessMessage(env *relay.Envelope) ([]byte, error) {
+	violations := p.check(env.Message)
+	if len(violations) == 0 {
+		return env.Message, nil
+	}
+
+	strip := p.Strip
+	for _, v := range violations {
+		if v.start < 0 {
+			strip = false
+		}
+	}
+	action := "reject"
+	if strip {
+		action = "strip"
+	}
+	for _, v := range violations {
+		slog.Warn("attachment policy violation", "msg_id", env.ID, "attachment", v.name, "reason", v.reason, "action", action)
+	}
+
+	if !strip {
+		v := violations[0]
+		if v.tooLarge {
+			return nil, &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      fmt.Sprintf("Attachment %q too large", v.name),
+			}
+		}
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Attachment %q not allowed: %s", v.name, v.reason),
+		}
+	}
+
+	spans := make([]mimepart.Part, len(violations))
+	notices := make(map[mimepart.Part]string, len(violations))
+	for i, v := range violations {
+		spans[i] = mimepart.Part{Start: v.start, End: v.end}
+		notices[spans[i]] = notice(v)
+	}
+	return mimepart.Replace(env.Message, spans, func(p mimepart.Part) ([]byte, error) {
+		return []byte(notices[p]), nil
+	})
+}
+
+// notice is the body part that replaces a stripped attachment.
+func notice(v violation) string {
+	return "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"\r\n" +
+		fmt.Sprintf("[Attachment %q was removed: %s]", v.name, v.reason)
+}
+
+// check returns the violations in msg in message order.
+func (p *Policy) check(msg []byte) []violation {
+	header, bodyStart, ok := readHeader(msg)
+	if !ok {
+		return nil
+	}
+	var out []violation
+	mediaType, params := contentType(header)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		p.walk(msg, bodyStart, len(msg), params["boundary"], mediaType == "multipart/signed", 0, &out)
+	} else if v, bad := p.evaluate(header, msg[bodyStart:]); bad {
+		v.start, v.end = -1, -1
+		out = append(out, v)
+	}
+	return out
+}
+
+// walk checks the parts of the multipart body msg[start:end].
+func (p *Policy) walk(msg []byte, start, end int, boundary string, signed bool, depth int, out *[]violation) {
+	if boundary == "" || depth >= maxDepth {
+		return
+	}
+	for _, pt := range mimepart.Split(msg[start:end], boundary) {
+		pStart, pEnd := start+pt.Start, start+pt.End
+		header, bodyStart, ok := readHeader(msg[pStart:pEnd])
+		if !ok {
+			continue
+		}
+		mediaType, params := contentType(header)
+		if strings.HasPrefix(mediaType, "multipart/") {
+			p.walk(msg, pStart+bodyStart, pEnd, params["boundary"], signed || mediaType == "multipart/signed", depth+1, out)
+			continue
+		}
+		v, bad := p.evaluate(header, msg[pStart+bodyStart:pEnd])
+		if !bad {
+			continue
+		}
+		v.start, v.end = pStart, pEnd
+		if signed {
+			v.start, v.end = -1, -1
+		}
+		*out = append(*out, v)
+	}
+}
+
+// evaluate applies the rules to one leaf part. Only attachments (parts
+// with a filename or an attachment disposition) are checked.
+func (p *Policy) evaluate(header textproto.MIMEHeader, body []byte) (violation, bool) {
+	mediaType, params := contentType(header)
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if name == "" && disposition != "attachment" {
+		return violation{}, false
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	v := violation{name: name}
+	if v.name == "" {
+		v.name = "unnamed " + mediaType
+	}
+
+	ext := strings.ToLower(path.Ext(strings.TrimSpace(name)))
+	for _, banned := range p.BannedExtensions {
+		if ext != "" && ext == banned {
+			v.reason = "file type " + ext + " is not allowed"
+			return v, true
+		}
+	}
+	for _, banned := range p.BannedTypes {
+		if mediaType == banned || (strings.HasSuffix(banned, "*") && strings.HasPrefix(mediaType, strings.TrimSuffix(banned, "*"))) {
+			v.reason = "content type " + mediaType + " is not allowed"
+			return v, true
+		}
+	}
+	if p.MaxSize > 0 {
+		if size := decodedSize(body, header.Get("Content-Transfer-Encoding")); size > p.MaxSize {
+			v.reason = fmt.Sprintf("size %d bytes exceeds the %d byte limit", size, p.MaxSize)
+			v.tooLarge = true
+			return v, true
+		}
+	}
+	return violation{}, false
+}
+
+// readHeader parses the header block at the start of part. The body starts
+// after the blank line; a part beginning with CRLF has no header fields.
+func readHeader(part []byte) (textproto.MIMEHeader, int, bool) {
+	if bytes.HasPrefix(part, []byte("\r\n")) {
+		return textproto.MIMEHeader{}, 2, true
+	}
+	end := bytes.Index(part, []byte("\r\n\r\n"))
+	if end == -1 {
+		return nil, 0, false
+	}
+	header := make(textproto.MIMEHeader)
+	var name string
+	for _, line := range strings.Split(string(part[:end]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if vals := header[name]; len(vals) > 0 {
+				vals[len(vals)-1] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		n, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(n))
+		header.Add(name, strings.TrimSpace(v))
+	}
+	return header, end + 4, true
+}
+
+// contentType returns the lowercase media type and parameters, defaulting
+// to text/plain.
+func contentType(header textproto.MIMEHeader) (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return "text/plain", map[string]string{}
+	}
+	return mediaType, params
+}
+
+// decodedSize estimates the attachment size after transfer decoding.
+func decodedSize(body []byte, encoding string) int64 {
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		n := 0
+		for _, c := range body {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' && c != '=' {
+				n++
+			}
+		}
+		return int64(n) * 3 / 4
+	}
+	return int64(len(body))
+}
@@ -0,0 +1,145 @@
+package attachment
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+func mixed(parts ...string) string {
+	var b strings.Builder
+	b.WriteString("Subject: Files\r\nContent-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n")
+	for _, p := range parts {
+		b.WriteString("--b1\r\n" + p + "\r\n")
+	}
+	b.WriteString("--b1--\r\n")
+	return b.String()
+}
+
+const textPart = "Content-Type: text/plain\r\n\r\nSee attached."
+
+func attachmentPart(name, mediaType, content string) string {
+	return "Content-Type: " + mediaType + "; name=\"" + name + "\"\r\n" +
+		"Content-Disposition: attachment; filename=\"" + name + "\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(content))
+}
+
+func process(p *Policy, msg string) (string, error) {
+	out, err := p.ProcessMessage(&relay.Envelope{ID: "test", Message: []byte(msg)})
+	return string(out), err
+}
+
+func TestNew(t *testing.T) {
+	if p := New(&config.Config{AttachmentAction: "strip"}); p != nil {
+		t.Error("expected nil policy without rules")
+	}
+	p := New(&config.Config{AttachmentBannedExtensions: []string{".exe"}, AttachmentAction: "strip"})
+	if p == nil || !p.Strip {
+		t.Errorf("unexpected policy %+v", p)
+	}
+}
+
+func TestPolicy_Allows(t *testing.T) {
+	p := &Policy{MaxSize: 100, BannedExtensions: []string{".exe"}, BannedTypes: []string{"application/x-msdownload"}}
+	msg := mixed(textPart, attachmentPart("report.pdf", "application/pdf", "small"))
+	out, err := process(p, msg)
+	if err != nil || out != msg {
+		t.Errorf("expected message unchanged, got %q, %v", out, err)
+	}
+
+	// Plain messages and inline text are not attachments
+	plain := "Subject: Hi\r\n\r\n" + strings.Repeat("x", 500)
+	if _, err := process(p, plain); err != nil {
+		t.Errorf("unexpected error for plain message: %v", err)
+	}
+}
+
+func TestPolicy_Reject(t *testing.T) {
+	p := &Policy{MaxSize: 10, BannedExtensions: []string{".exe"}, BannedTypes: []string{"application/x-*", "video/*"}}
+	tests := []struct {
+		name string
+		part string
+		code int
+		want string
+	}{
+		{"extension", attachmentPart("Setup.EXE", "application/octet-stream", "MZ"), 550, "file type .exe"},
+		{"type wildcard", attachmentPart("run.bin", "application/x-sh", "#!"), 550, "content type application/x-sh"},
+		{"whole type", attachmentPart("clip.mov", "video/quicktime", "v"), 550, "content type video/quicktime"},
+		{"size", attachmentPart("big.pdf", "application/pdf", strings.Repeat("x", 11)), 552, "too large"},
+	}
+	for _, tt := range tests {
+		_, err := process(p, mixed(textPart, tt.part))
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.code || !strings.Contains(smtpErr.Message, tt.want) {
+			t.Errorf("%s: expected %d containing %q, got %v", tt.name, tt.code, tt.want, err)
+		}
+	}
+
+	// Exactly at the limit is allowed
+	if _, err := process(p, mixed(textPart, attachmentPart("ok.pdf", "application/pdf", strings.Repeat("x", 10)))); err != nil {
+		t.Errorf("expected attachment at the size limit to pass, got %v", err)
+	}
+}
+
+func TestPolicy_Nested(t *testing.T) {
+	p := &Policy{BannedExtensions: []string{".js"}}
+	inner := "Content-Type: multipart/mixed; boundary=\"b2\"\r\n\r\n" +
+		"--b2\r\n" + attachmentPart("invoice.pdf.js", "text/javascript", "x") + "\r\n--b2--"
+	if _, err := process(p, mixed(textPart, inner)); err == nil {
+		t.Error("expected nested attachment to be checked")
+	}
+}
+
+func TestPolicy_Strip(t *testing.T) {
+	p := &Policy{BannedExtensions: []string{".exe", ".bat"}, Strip: true}
+	msg := mixed(textPart, attachmentPart("a.exe", "application/octet-stream", "MZ"), attachmentPart("ok.pdf", "application/pdf", "pdf"), attachmentPart("b.bat", "text/plain", "echo"))
+	out, err := process(p, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := mixed(textPart,
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Disposition: inline\r\n\r\n[Attachment \"a.exe\" was removed: file type .exe is not allowed]",
+		attachmentPart("ok.pdf", "application/pdf", "pdf"),
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Disposition: inline\r\n\r\n[Attachment \"b.bat\" was removed: file type .bat is not allowed]",
+	)
+	if out != want {
+		t.Errorf("unexpected result:\n%q\nwant\n%q", out, want)
+	}
+}
+
+func TestPolicy_StripFallsBackToReject(t *testing.T) {
+	p := &Policy{BannedExtensions: []string{".exe"}, Strip: true}
+
+	// A top-level attachment cannot be removed without emptying the message
+	top := "Subject: x\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"a.exe\"\r\n\r\nMZ"
+	if _, err := process(p, top); err == nil {
+		t.Error("expected top-level attachment to be rejected")
+	}
+
+	// Removing a part under a signature would invalidate it
+	signed := "Subject: x\r\nContent-Type: multipart/signed; boundary=\"s\"; protocol=\"application/pkcs7-signature\"\r\n\r\n" +
+		"--s\r\nContent-Type: multipart/mixed; boundary=\"b2\"\r\n\r\n--b2\r\n" + textPart + "\r\n--b2\r\n" +
+		attachmentPart("a.exe", "application/octet-stream", "MZ") + "\r\n--b2--\r\n" +
+		"--s\r\nContent-Type: application/pkcs7-signature\r\n\r\nsig\r\n--s--\r\n"
+	if _, err := process(p, signed); err == nil {
+		t.Error("expected signed content to be rejected instead of stripped")
+	}
+}
+
+func TestPolicy_EncodedFilename(t *testing.T) {
+	p := &Policy{BannedExtensions: []string{".exe"}}
+	part := "Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment;\r\n filename*=UTF-8''r%C3%A9sum%C3%A9.exe\r\n\r\nMZ"
+	_, err := process(p, mixed(textPart, part))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || !strings.Contains(smtpErr.Message, "résumé.exe") {
+		t.Errorf("expected RFC 2231 filename to be decoded and rejected, got %v", err)
+	}
+}
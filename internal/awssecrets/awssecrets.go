@@ -0,0 +1,228 @@
+// Package awssecrets reads secrets from AWS Secrets Manager and SSM
+// Parameter Store, with credentials from the environment, a web identity
+// token, the ECS container endpoint or the EC2 instance profile.
+package awssecrets
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/sigv4"
+)
+
+// The reference schemes: aws-sm://<name or ARN>[#<JSON key>] for a
+// Secrets Manager secret, aws-ssm://<parameter name or ARN> for a
+// parameter.
+const (
+	SecretsManagerScheme = "aws-sm://"
+	ParameterScheme      = "aws-ssm://"
+)
+
+// requestTimeout bounds one request to AWS.
+const requestTimeout = 10 * time.Second
+
+// maxReply bounds the API reply read.
+const maxReply = 1 << 20
+
+// IsRef reports whether v is a Secrets Manager or Parameter Store
+// reference.
+func IsRef(v string) bool {
+	return strings.HasPrefix(v, SecretsManagerScheme) || strings.HasPrefix(v, ParameterScheme)
+}
+
+// Config is where to send requests and the credentials to sign them
+// with, as the AWS SDKs read them from the environment.
+type Config struct {
+	Region string // for references that are not ARNs
+
+	// Endpoint overrides, e.g. for VPC endpoints; "" for the public one
+	SecretsManagerEndpoint string
+	SSMEndpoint            string
+	STSEndpoint            string
+
+	// Credential sources, tried in this order
+	AccessKeyID, SecretAccessKey, SessionToken string
+	WebIdentityTokenFile, RoleARN, SessionName string
+	ContainerCredentialsURL                    string // ECS task role or EKS Pod Identity
+	ContainerAuthToken, ContainerAuthTokenFile string
+	MetadataEndpoint                           string // EC2 instance metadata, "" when disabled
+}
+
+// FromEnv returns the configuration from the standard AWS_* variables.
+func FromEnv() Config {
+	endpoint := func(service string) string {
+		return cmp.Or(os.Getenv("AWS_ENDPOINT_URL_"+service), os.Getenv("AWS_ENDPOINT_URL"))
+	}
+	cfg := Config{
+		Region:                 cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+		SecretsManagerEndpoint: endpoint("SECRETS_MANAGER"),
+		SSMEndpoint:            endpoint("SSM"),
+		STSEndpoint:            endpoint("STS"),
+		AccessKeyID:            os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey:        os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:           os.Getenv("AWS_SESSION_TOKEN"),
+		WebIdentityTokenFile:   os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+		RoleARN:                os.Getenv("AWS_ROLE_ARN"),
+		SessionName:            cmp.Or(os.Getenv("AWS_ROLE_SESSION_NAME"), "smtp-proxy"),
+		ContainerAuthToken:     os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+		ContainerAuthTokenFile: os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+	}
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		cfg.ContainerCredentialsURL = "http://169.254.170.2" + rel
+	} else {
+		cfg.ContainerCredentialsURL = os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	}
+	if !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		cfg.MetadataEndpoint = cmp.Or(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "http://169.254.169.254")
+	}
+	return cfg
+}
+
+// Client reads secrets, fetching and refreshing credentials as needed.
+// It is safe for concurrent use.
+type Client struct {
+	cfg  Config
+	http *http.Client
+	now  func() time.Time
+
+	mu    sync.Mutex
+	creds credentials
+}
+
+// New returns a client for cfg. It does not contact AWS until the first
+// Read.
+func New(cfg Config) *Client {
+	return &Client{
+		cfg:  cfg,
+		http: &http.Client{Timeout: requestTimeout},
+		now:  time.Now,
+	}
+}
+
+// Read resolves ref, a Secrets Manager or Parameter Store reference, to
+// its value. A Secrets Manager reference with a #key reads that key of a
+// secret holding a JSON object; parameters are decrypted.
+func (c *Client) Read(ref string) (string, error) {
+	if name, ok := strings.CutPrefix(ref, ParameterScheme); ok {
+		if name == "" {
+			return "", fmt.Errorf("aws: invalid reference %q (expected aws-ssm://name)", ref)
+		}
+		req, err := json.Marshal(struct {
+			Name           string
+			WithDecryption bool
+		}{name, true})
+		if err != nil {
+			return "", err
+		}
+		reply, err := c.call("ssm", c.cfg.SSMEndpoint, "AmazonSSM.GetParameter", name, req)
+		if err != nil {
+			return "", err
+		}
+		var resp struct {
+			Parameter struct{ Value string }
+		}
+		if err := json.Unmarshal(reply, &resp); err != nil {
+			return "", fmt.Errorf("aws: ssm %s: %w", name, err)
+		}
+		return resp.Parameter.Value, nil
+	}
+
+	id, key, _ := strings.Cut(strings.TrimPrefix(ref, SecretsManagerScheme), "#")
+	if id == "" {
+		return "", fmt.Errorf("aws: invalid reference %q (expected aws-sm://name[#key])", ref)
+	}
+	req, err := json.Marshal(struct{ SecretId string }{id})
+	if err != nil {
+		return "", err
+	}
+	reply, err := c.call("secretsmanager", c.cfg.SecretsManagerEndpoint, "secretsmanager.GetSecretValue", id, req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		SecretString *string
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return "", fmt.Errorf("aws: secretsmanager %s: %w", id, err)
+	}
+	if resp.SecretString == nil {
+		return "", fmt.Errorf("aws: secret %s is binary, not a string", id)
+	}
+	if key == "" {
+		return *resp.SecretString, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*resp.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("aws: secret %s is not a JSON object", id)
+	}
+	v, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("aws: secret %s has no key %q", id, key)
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return "", fmt.Errorf("aws: secret %s key %q is not a string", id, key)
+	}
+	return s, nil
+}
+
+// call sends the JSON API request payload for the resource named (by
+// name or ARN) to service, signed with the current credentials, and
+// returns the reply.
+func (c *Client) call(service, endpoint, target, name string, payload []byte) ([]byte, error) {
+	region := c.cfg.Region
+	if parts := strings.Split(name, ":"); len(parts) > 5 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("aws: no region for %s: set AWS_REGION or use an ARN", name)
+	}
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	url := cmp.Or(endpoint, "https://"+service+"."+region+".amazonaws.com")
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	sigv4.Sign(req, payload, creds.AccessKeyID, creds.SecretAccessKey, region, service, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("aws: %s: %w", service, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+			Upper   string `json:"Message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		// __type may be namespaced: com.amazonaws.ssm#ParameterNotFound
+		reason := cmp.Or(e.Type[strings.LastIndex(e.Type, "#")+1:], resp.Status)
+		if msg := cmp.Or(e.Message, e.Upper); msg != "" {
+			reason += ": " + msg
+		}
+		return nil, fmt.Errorf("aws: %s %s: %s", service, name, reason)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, maxReply))
+	if err != nil {
+		return nil, fmt.Errorf("aws: %s %s: %w", service, name, err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,219 @@
+package awssecrets
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAWS answers Secrets Manager, Parameter Store, STS, container and
+// instance metadata credential requests, recording what it saw.
+type fakeAWS struct {
+	requests []string
+	auth     []string // Authorization of the API requests
+	tokens   []string // X-Amz-Security-Token of the API requests
+	expires  time.Time
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	target := r.Header.Get("X-Amz-Target")
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+target))
+	reply := func(s string) { io.WriteString(w, s) }
+	temporary := `{"AccessKeyId":"ASIATEMP","SecretAccessKey":"temp-secret","Token":"session-token","Expiration":"` + f.expires.Format(time.RFC3339) + `"}`
+
+	switch {
+	case target != "":
+		f.auth = append(f.auth, r.Header.Get("Authorization"))
+		f.tokens = append(f.tokens, r.Header.Get("X-Amz-Security-Token"))
+		var in struct {
+			SecretId       string
+			Name           string
+			WithDecryption bool
+		}
+		json.Unmarshal(body, &in)
+		switch {
+		case target == "secretsmanager.GetSecretValue" && in.SecretId == "smtp/dest":
+			reply(`{"SecretString":"{\"password\":\"sm-json\",\"port\":587}"}`)
+		case target == "secretsmanager.GetSecretValue" && strings.HasSuffix(in.SecretId, ":secret:smtp/plain"):
+			reply(`{"SecretString":"sm-plain"}`)
+		case target == "AmazonSSM.GetParameter" && in.Name == "/smtp/password" && in.WithDecryption:
+			reply(`{"Parameter":{"Value":"ssm-value"}}`)
+		case target == "AmazonSSM.GetParameter":
+			w.WriteHeader(http.StatusBadRequest)
+			reply(`{"__type":"com.amazonaws.ssm#ParameterNotFound"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			reply(`{"__type":"ResourceNotFoundException","Message":"Secrets Manager can't find the specified secret."}`)
+		}
+	case r.URL.Path == "/" && r.Method == http.MethodPost: // STS
+		if !strings.Contains(string(body), "WebIdentityToken=eks-jwt") {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<ErrorResponse><Error><Code>InvalidIdentityToken</Code><Message>bad token</Message></Error></ErrorResponse>`)
+			return
+		}
+		io.WriteString(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>`+
+			`<AccessKeyId>ASIAWEB</AccessKeyId><SecretAccessKey>web-secret</SecretAccessKey><SessionToken>web-token</SessionToken>`+
+			`<Expiration>`+f.expires.Format(time.RFC3339)+`</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`)
+	case r.URL.Path == "/v2/credentials/task":
+		if r.Header.Get("Authorization") != "pod-identity" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reply(temporary)
+	case r.URL.Path == "/latest/api/token" && r.Method == http.MethodPut:
+		io.WriteString(w, "imds-token")
+	case strings.HasPrefix(r.URL.Path, "/latest/meta-data/iam/security-credentials/"):
+		if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			io.WriteString(w, "smtp-proxy-role\n")
+			return
+		}
+		reply(temporary)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFake(t *testing.T) (*fakeAWS, string) {
+	t.Helper()
+	fake := &fakeAWS{expires: time.Unix(1700000000, 0).Add(time.Hour).UTC()}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv.URL
+}
+
+func TestClient_Read(t *testing.T) {
+	fake, url := newFake(t)
+	c := New(Config{
+		Region:                 "eu-west-1",
+		SecretsManagerEndpoint: url,
+		SSMEndpoint:            url,
+		AccessKeyID:            "AKIDEXAMPLE",
+		SecretAccessKey:        "secret",
+	})
+
+	for ref, want := range map[string]string{
+		"aws-sm://smtp/dest#password": "sm-json",
+		"aws-sm://arn:aws:secretsmanager:us-east-2:123456789012:secret:smtp/plain": "sm-plain",
+		"aws-ssm:///smtp/password": "ssm-value",
+	} {
+		if got, err := c.Read(ref); err != nil || got != want {
+			t.Errorf("Read(%q) = %q, %v, want %q", ref, got, err, want)
+		}
+	}
+	for _, auth := range fake.auth {
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "x-amz-target") {
+			t.Errorf("expected a signed request, got %q", auth)
+		}
+	}
+	scopes := strings.Join(fake.auth, ",")
+	if len(fake.auth) != 3 || !strings.Contains(scopes, "/eu-west-1/secretsmanager/") || !strings.Contains(scopes, "/us-east-2/secretsmanager/") || !strings.Contains(scopes, "/eu-west-1/ssm/") {
+		t.Errorf("expected AWS_REGION, or the ARN's region, in the signing scopes, got %v", fake.auth)
+	}
+
+	for ref, want := range map[string]string{
+		"aws-sm://":               "invalid reference",
+		"aws-ssm://":              "invalid reference",
+		"aws-sm://smtp/dest#user": `has no key "user"`,
+		"aws-sm://smtp/dest#port": "is not a string",
+		"aws-sm://arn:aws:secretsmanager:us-east-2:123456789012:secret:smtp/plain#password": "is not a JSON object",
+		"aws-sm://smtp/missing":   "ResourceNotFoundException: Secrets Manager can't find the specified secret.",
+		"aws-ssm:///smtp/missing": "ParameterNotFound",
+	} {
+		if _, err := c.Read(ref); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Read(%q): expected error containing %q, got %v", ref, want, err)
+		}
+	}
+
+	noRegion := New(Config{SecretsManagerEndpoint: url, AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"})
+	if _, err := noRegion.Read("aws-sm://smtp/dest"); err == nil || !strings.Contains(err.Error(), "set AWS_REGION") {
+		t.Errorf("expected error without a region, got %v", err)
+	}
+}
+
+func TestClient_Credentials(t *testing.T) {
+	fake, url := newFake(t)
+	jwt := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwt, []byte("eks-jwt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	base := Config{Region: "eu-west-1", SSMEndpoint: url}
+
+	for name, tc := range map[string]struct {
+		cfg   func(Config) Config
+		token string
+	}{
+		"web identity": {func(c Config) Config {
+			c.WebIdentityTokenFile, c.RoleARN, c.STSEndpoint = jwt, "arn:aws:iam::123456789012:role/smtp-proxy", url
+			return c
+		}, "web-token"},
+		"container": {func(c Config) Config {
+			c.ContainerCredentialsURL, c.ContainerAuthToken = url+"/v2/credentials/task", "pod-identity"
+			return c
+		}, "session-token"},
+		"instance profile": {func(c Config) Config {
+			c.MetadataEndpoint = url
+			return c
+		}, "session-token"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake.tokens = nil
+			c := New(tc.cfg(base))
+			now := time.Unix(1700000000, 0)
+			c.now = func() time.Time { return now }
+			if _, err := c.Read("aws-ssm:///smtp/password"); err != nil {
+				t.Fatal(err)
+			}
+			fake.requests = nil
+			if _, err := c.Read("aws-ssm:///smtp/password"); err != nil || len(fake.requests) != 1 {
+				t.Errorf("expected the credentials reused, got %v, %v", fake.requests, err)
+			}
+			now = now.Add(56 * time.Minute)
+			fake.requests = nil
+			if _, err := c.Read("aws-ssm:///smtp/password"); err != nil || len(fake.requests) < 2 {
+				t.Errorf("expected the credentials refreshed before they expire, got %v, %v", fake.requests, err)
+			}
+			for _, token := range fake.tokens {
+				if token != tc.token {
+					t.Errorf("expected session token %q, got %q", tc.token, token)
+				}
+			}
+		})
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad")
+	os.WriteFile(bad, []byte("other"), 0o600)
+	c := New(Config{Region: "eu-west-1", SSMEndpoint: url, STSEndpoint: url, WebIdentityTokenFile: bad, RoleARN: "arn:aws:iam::123456789012:role/smtp-proxy"})
+	if _, err := c.Read("aws-ssm:///smtp/password"); err == nil || !strings.Contains(err.Error(), "InvalidIdentityToken: bad token") {
+		t.Errorf("expected the STS error, got %v", err)
+	}
+	if _, err := New(base).Read("aws-ssm:///smtp/password"); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("expected error without credentials, got %v", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "ap-south-1")
+	t.Setenv("AWS_ENDPOINT_URL", "http://localhost:4566")
+	t.Setenv("AWS_ENDPOINT_URL_SSM", "https://ssm.internal")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/abc")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	cfg := FromEnv()
+	if cfg.Region != "ap-south-1" || cfg.SecretsManagerEndpoint != "http://localhost:4566" || cfg.SSMEndpoint != "https://ssm.internal" {
+		t.Errorf("unexpected region or endpoints %+v", cfg)
+	}
+	if cfg.ContainerCredentialsURL != "http://169.254.170.2/v2/credentials/abc" || cfg.MetadataEndpoint != "" || cfg.SessionName != "smtp-proxy" {
+		t.Errorf("unexpected credential sources %+v", cfg)
+	}
+}
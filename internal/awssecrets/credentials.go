@@ -0,0 +1,198 @@
+package awssecrets
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// refreshBefore is how long before they expire temporary credentials
+// are fetched again.
+const refreshBefore = 5 * time.Minute
+
+// metadataTimeout bounds the EC2 instance metadata requests, which hang
+// rather than fail outside EC2.
+const metadataTimeout = 3 * time.Second
+
+// credentials sign requests. Expiration is zero for long-term keys.
+type credentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string `json:"Token"`
+	Expiration      time.Time
+}
+
+// credentials returns the credentials held, or fresh ones once they are
+// about to expire.
+func (c *Client) credentials() (credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && (c.creds.Expiration.IsZero() || c.now().Before(c.creds.Expiration.Add(-refreshBefore))) {
+		return c.creds, nil
+	}
+	creds, err := c.fetchCredentials()
+	if err != nil {
+		return credentials{}, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// fetchCredentials gets credentials from the first source configured:
+// access keys, a web identity token, the container endpoint, or the EC2
+// instance profile.
+func (c *Client) fetchCredentials() (credentials, error) {
+	switch {
+	case c.cfg.AccessKeyID != "" && c.cfg.SecretAccessKey != "":
+		return credentials{AccessKeyID: c.cfg.AccessKeyID, SecretAccessKey: c.cfg.SecretAccessKey, SessionToken: c.cfg.SessionToken}, nil
+	case c.cfg.WebIdentityTokenFile != "" && c.cfg.RoleARN != "":
+		return c.webIdentity()
+	case c.cfg.ContainerCredentialsURL != "":
+		return c.container()
+	case c.cfg.MetadataEndpoint != "":
+		return c.instanceProfile()
+	}
+	return credentials{}, errors.New("aws: no credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or run with an IAM role")
+}
+
+// webIdentity exchanges the web identity token, such as the one EKS
+// mounts for IAM roles for service accounts, for credentials of RoleARN.
+func (c *Client) webIdentity() (credentials, error) {
+	token, err := os.ReadFile(c.cfg.WebIdentityTokenFile)
+	if err != nil {
+		return credentials{}, fmt.Errorf("aws: web identity: %w", err)
+	}
+	endpoint := "https://sts.amazonaws.com"
+	if c.cfg.Region != "" {
+		endpoint = "https://sts." + c.cfg.Region + ".amazonaws.com"
+	}
+	if c.cfg.STSEndpoint != "" {
+		endpoint = c.cfg.STSEndpoint
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {c.cfg.RoleARN},
+		"RoleSessionName":  {c.cfg.SessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := c.fetch(req)
+	if err != nil {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+			err = fmt.Errorf("%s: %s", e.Code, e.Message)
+		}
+		return credentials{}, fmt.Errorf("aws: web identity: %w", err)
+	}
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return credentials{}, fmt.Errorf("aws: web identity: %w", err)
+	}
+	return credentials(resp.Credentials), nil
+}
+
+// container gets the credentials of the ECS task role or EKS Pod
+// Identity association.
+func (c *Client) container() (credentials, error) {
+	req, err := http.NewRequest(http.MethodGet, c.cfg.ContainerCredentialsURL, nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	token := c.cfg.ContainerAuthToken
+	if c.cfg.ContainerAuthTokenFile != "" {
+		b, err := os.ReadFile(c.cfg.ContainerAuthTokenFile)
+		if err != nil {
+			return credentials{}, fmt.Errorf("aws: container credentials: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	body, err := c.fetch(req)
+	if err != nil {
+		return credentials{}, fmt.Errorf("aws: container credentials: %w", err)
+	}
+	var creds credentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return credentials{}, fmt.Errorf("aws: container credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// instanceProfile gets the credentials of the EC2 instance's role through
+// the instance metadata service, version 2.
+func (c *Client) instanceProfile() (credentials, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	get := func(method, path string, header http.Header) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.cfg.MetadataEndpoint, "/")+path, nil)
+		if err != nil {
+			return "", err
+		}
+		maps.Copy(req.Header, header)
+		body, err := c.fetch(req)
+		return strings.TrimSpace(string(body)), err
+	}
+	token, err := get(http.MethodPut, "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		return credentials{}, fmt.Errorf("aws: instance metadata: %w", err)
+	}
+	auth := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+	roles, err := get(http.MethodGet, "/latest/meta-data/iam/security-credentials/", auth)
+	if err != nil {
+		return credentials{}, fmt.Errorf("aws: instance metadata: no instance role: %w", err)
+	}
+	role, _, _ := strings.Cut(roles, "\n")
+	body, err := get(http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, auth)
+	if err != nil {
+		return credentials{}, fmt.Errorf("aws: instance metadata: %w", err)
+	}
+	var creds credentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return credentials{}, fmt.Errorf("aws: instance metadata: %w", err)
+	}
+	return creds, nil
+}
+
+// fetch sends req and returns the body of a 200 reply. For any other
+// status it returns the body along with the error.
+func (c *Client) fetch(req *http.Request) ([]byte, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return body, errors.New(resp.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,112 @@
+package bounce
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/suppression"
+	"github.com/VahanMargaryan/smtp-proxy/internal/verp"
+)
+
+// Backend implements smtp.Backend for the inbound bounce listener. It
+// accepts DSNs addressed to the relay's envelope sender and adds hard
+// bounces to the suppression list.
+type Backend struct {
+	bounceAddr string
+	verpKey    string
+	maxSize    int64
+	list       *suppression.List
+	relayed    *Relayed
+}
+
+// NewBackend creates a bounce backend. It accepts mail with the null
+// sender DSNs use, to bounceAddr (the envelope sender the proxy relays
+// with) or a VERP address derived from it and signed with verpKey. The
+// listener cannot tell a forged DSN from a real one, so a hard bounce
+// only suppresses the recipient of a signed VERP address, which only the
+// proxy can mint, or one that relayed shows the proxy sent to recently.
+func NewBackend(bounceAddr, verpKey string, maxSize int64, list *suppression.List, relayed *Relayed) *Backend {
+	return &Backend{bounceAddr: bounceAddr, verpKey: verpKey, maxSize: maxSize, list: list, relayed: relayed}
+}
+
+func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &session{backend: b}, nil
+}
+
+type session struct {
+	backend *Backend
+	// verpRcpt is the original recipient decoded from a VERP address.
+	verpRcpt string
+}
+
+func (s *session) Mail(from string, _ *smtp.MailOptions) error {
+	if from != "" {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Only delivery status notifications are accepted",
+		}
+	}
+	return nil
+}
+
+func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
+	if rcpt, ok := verp.Decode(s.backend.verpKey, to, s.backend.bounceAddr); ok {
+		s.verpRcpt = rcpt
+		return nil
+	}
+	if !strings.EqualFold(to, s.backend.bounceAddr) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Mailbox unavailable",
+		}
+	}
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	raw, err := io.ReadAll(io.LimitReader(r, s.backend.maxSize))
+	if err != nil {
+		return err
+	}
+
+	results, err := ParseDSN(raw)
+	if err != nil {
+		slog.Debug("bounce: ignoring message", "error", err)
+		return nil
+	}
+
+	for _, res := range results {
+		// A VERP bounce belongs to the single recipient its transaction
+		// was sent to, whatever address the reporting MTA names.
+		if s.verpRcpt != "" && res.Recipient != s.verpRcpt {
+			slog.Debug("bounce: attributing via VERP", "reported", res.Recipient, "recipient", s.verpRcpt)
+			res.Recipient = s.verpRcpt
+		}
+		switch {
+		case res.Hard() && s.verpRcpt == "" && !s.backend.relayed.Contains(res.Recipient):
+			slog.Warn("bounce: ignoring hard bounce for a recipient not relayed to", "recipient", res.Recipient, "status", res.Status)
+		case res.Hard():
+			if err := s.backend.list.Add(res.Recipient, res.Status+" "+res.Diagnostic); err != nil {
+				slog.Error("bounce: suppress failed", "recipient", res.Recipient, "error", err)
+				continue
+			}
+			slog.Info("bounce: hard bounce, recipient suppressed", "recipient", res.Recipient, "status", res.Status)
+		case res.Soft():
+			slog.Info("bounce: soft bounce", "recipient", res.Recipient, "status", res.Status)
+		}
+	}
+	return nil
+}
+
+func (s *session) Reset() {
+	s.verpRcpt = ""
+}
+
+func (s *session) Logout() error {
+	return nil
+}
@@ -0,0 +1,193 @@
+package bounce
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/suppression"
+	"github.com/VahanMargaryan/smtp-proxy/internal/verp"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+const sampleDSN = "From: MAILER-DAEMON@mx.example.net\r\n" +
+	"To: relay@example.com\r\n" +
+	"Subject: Delivery Status Notification (Failure)\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"BOUNDARY\"\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Delivery to the following recipients failed.\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.net\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; gone@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; <full@example.org>\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"\r\n" +
+	"--BOUNDARY--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	results, err := ParseDSN([]byte(sampleDSN))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+
+	hard := results[0]
+	if hard.Recipient != "gone@example.org" || !hard.Hard() || hard.Soft() {
+		t.Errorf("expected hard bounce for gone@example.org, got %+v", hard)
+	}
+	if !strings.Contains(hard.Diagnostic, "User unknown") {
+		t.Errorf("expected diagnostic to be captured, got %q", hard.Diagnostic)
+	}
+
+	soft := results[1]
+	if soft.Recipient != "full@example.org" || soft.Hard() || !soft.Soft() {
+		t.Errorf("expected soft bounce for full@example.org, got %+v", soft)
+	}
+}
+
+func TestParseDSN_NotDSN(t *testing.T) {
+	raw := "From: someone@example.com\r\nSubject: Out of office\r\n\r\nI am away."
+	if _, err := ParseDSN([]byte(raw)); !errors.Is(err, ErrNotDSN) {
+		t.Errorf("expected ErrNotDSN, got %v", err)
+	}
+}
+
+func TestSession_SuppressesHardBounces(t *testing.T) {
+	list, err := suppression.Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := NewRelayed()
+	relayed.Add("Gone@example.org", "full@example.org")
+	b := NewBackend("relay@example.com", "", 1024*1024, list, relayed)
+	sess, _ := b.NewSession(nil)
+
+	if err := sess.Mail("", nil); err != nil {
+		t.Fatalf("expected the null sender to be accepted, got %v", err)
+	}
+	if err := sess.Rcpt("Relay@Example.com", nil); err != nil {
+		t.Fatalf("expected bounce address to be accepted, got %v", err)
+	}
+	if err := sess.Data(strings.NewReader(sampleDSN)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !list.Contains("gone@example.org") {
+		t.Error("expected hard bounce to be suppressed")
+	}
+	if list.Contains("full@example.org") {
+		t.Error("expected soft bounce not to be suppressed")
+	}
+}
+
+func TestSession_IgnoresRecipientsNotRelayedTo(t *testing.T) {
+	list, err := suppression.Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBackend("relay@example.com", "", 1024*1024, list, NewRelayed())
+	sess, _ := b.NewSession(nil)
+
+	_ = sess.Mail("", nil)
+	_ = sess.Rcpt("relay@example.com", nil)
+	if err := sess.Data(strings.NewReader(sampleDSN)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if list.Contains("gone@example.org") {
+		t.Error("expected a DSN for an address never relayed to be ignored")
+	}
+}
+
+func TestSession_RequiresNullSender(t *testing.T) {
+	b := NewBackend("relay@example.com", "", 1024, nil, nil)
+	sess, _ := b.NewSession(nil)
+
+	err := sess.Mail("attacker@example.net", nil)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("expected 550 for a non-null sender, got %v", err)
+	}
+}
+
+func TestSession_RejectsOtherRecipients(t *testing.T) {
+	b := NewBackend("relay@example.com", "key", 1024, nil, nil)
+	sess, _ := b.NewSession(nil)
+
+	for _, to := range []string{
+		"victim@example.com",
+		"relay+victim=example.net@example.com",
+		"relay+0123456789.victim=example.net@example.com",
+		verp.Encode("other-key", "relay@example.com", "victim@example.net"),
+	} {
+		err := sess.Rcpt(to, nil)
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+			t.Errorf("expected 550 for %s, got %v", to, err)
+		}
+	}
+}
+
+func TestSession_AttributesVERPBounces(t *testing.T) {
+	list, err := suppression.Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No record of the send survives a restart; the signature is enough
+	b := NewBackend("relay@example.com", "key", 1024*1024, list, NewRelayed())
+	sess, _ := b.NewSession(nil)
+
+	// The DSN reports a forwarding target; VERP names the address we sent to
+	_ = sess.Mail("", nil)
+	if err := sess.Rcpt(verp.Encode("key", "relay@example.com", "alias@example.net"), nil); err != nil {
+		t.Fatalf("expected VERP address to be accepted, got %v", err)
+	}
+	if err := sess.Data(strings.NewReader(sampleDSN)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !list.Contains("alias@example.net") {
+		t.Error("expected VERP recipient to be suppressed")
+	}
+	if list.Contains("gone@example.org") {
+		t.Error("expected reported address not to be suppressed")
+	}
+}
+
+func TestRelayed_Wrap(t *testing.T) {
+	r := NewRelayed()
+	send := r.Wrap(func(_ *config.Config, env *relay.Envelope) error {
+		return &relay.DeliveryError{
+			Delivered: []string{"ok@example.org"},
+			Failed:    []relay.RecipientError{{Recipient: "no@example.org", Err: errors.New("550 no such user")}},
+		}
+	})
+	env := &relay.Envelope{Recipients: []relay.Recipient{{Address: "ok@example.org"}, {Address: "no@example.org"}}}
+	_ = send(nil, env)
+
+	if !r.Contains("OK@example.org") || r.Contains("no@example.org") {
+		t.Error("expected only the accepted recipient recorded")
+	}
+	r.now = func() time.Time { return time.Now().Add(relayedWindow + time.Hour) }
+	if r.Contains("ok@example.org") {
+		t.Error("expected the record to expire")
+	}
+}
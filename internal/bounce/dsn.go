@@ -0,0 +1,115 @@
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ErrNotDSN is returned for messages that are not RFC 3464 delivery status
+// notifications.
+var ErrNotDSN = errors.New("bounce: not a delivery status notification")
+
+// Result is the outcome reported for one recipient in a DSN.
+type Result struct {
+	Recipient  string
+	Action     string // failed, delayed, delivered, relayed, expanded
+	Status     string // enhanced status code, e.g. 5.1.1
+	Diagnostic string
+}
+
+// Hard reports a permanent failure: the address should be suppressed.
+func (r Result) Hard() bool {
+	return r.Action == "failed" && strings.HasPrefix(r.Status, "5.")
+}
+
+// Soft reports a transient failure worth noting but not suppressing.
+func (r Result) Soft() bool {
+	return r.Action == "delayed" || strings.HasPrefix(r.Status, "4.")
+}
+
+// ParseDSN extracts per-recipient results from a multipart/report
+// delivery status notification.
+func ParseDSN(raw []byte) ([]Result, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("bounce: parse message: %w", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ErrNotDSN
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, ErrNotDSN
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bounce: read report: %w", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType != "message/delivery-status" && partType != "message/global-delivery-status" {
+			continue
+		}
+		status, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("bounce: read delivery status: %w", err)
+		}
+		return parseDeliveryStatus(status)
+	}
+}
+
+// parseDeliveryStatus parses the message/delivery-status body: one
+// per-message field block followed by one block per recipient.
+func parseDeliveryStatus(body []byte) ([]Result, error) {
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+
+	var results []Result
+	for i, block := range bytes.Split(body, []byte("\n\n")) {
+		block = bytes.TrimSpace(block)
+		if i == 0 || len(block) == 0 {
+			continue // per-message fields
+		}
+		r := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(block, '\n', '\n'))))
+		fields, err := r.ReadMIMEHeader()
+		if err != nil && len(fields) == 0 {
+			return nil, fmt.Errorf("bounce: parse recipient fields: %w", err)
+		}
+
+		recipient := addressValue(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = addressValue(fields.Get("Original-Recipient"))
+		}
+		if recipient == "" {
+			continue
+		}
+		results = append(results, Result{
+			Recipient:  recipient,
+			Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:     strings.TrimSpace(fields.Get("Status")),
+			Diagnostic: strings.TrimSpace(fields.Get("Diagnostic-Code")),
+		})
+	}
+	if len(results) == 0 {
+		return nil, ErrNotDSN
+	}
+	return results, nil
+}
+
+// addressValue strips the address-type prefix, e.g. "rfc822; a@b.com".
+func addressValue(v string) string {
+	if _, addr, ok := strings.Cut(v, ";"); ok {
+		v = addr
+	}
+	return strings.Trim(strings.TrimSpace(v), "<>")
+}
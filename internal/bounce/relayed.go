@@ -0,0 +1,79 @@
+package bounce
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// relayedWindow is how long a relayed recipient is remembered: longer
+// than the five days most MTAs retry before giving up and bouncing.
+const relayedWindow = 7 * 24 * time.Hour
+
+// Relayed remembers, in memory, the recipients the proxy relayed to in
+// the last week, so a DSN can only suppress an address that was
+// actually sent to. It is safe for concurrent use; a nil *Relayed
+// remembers nothing.
+type Relayed struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// NewRelayed returns an empty record.
+func NewRelayed() *Relayed {
+	return &Relayed{now: time.Now, seen: make(map[string]time.Time)}
+}
+
+// Wrap returns a SendFunc that records the recipients the upstream
+// accepts from send.
+func (r *Relayed) Wrap(send relay.SendFunc) relay.SendFunc {
+	return func(cfg *config.Config, env *relay.Envelope) error {
+		err := send(cfg, env)
+		var delivery *relay.DeliveryError
+		switch {
+		case err == nil:
+			r.Add(env.Addresses()...)
+		case errors.As(err, &delivery):
+			r.Add(delivery.Delivered...)
+		}
+		return err
+	}
+}
+
+// Add records that rcpts were relayed to now.
+func (r *Relayed) Add(rcpts ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, rcpt := range rcpts {
+		r.seen[strings.ToLower(rcpt)] = now
+	}
+	if now.Sub(r.pruned) > time.Hour {
+		for rcpt, at := range r.seen {
+			if now.Sub(at) > relayedWindow {
+				delete(r.seen, rcpt)
+			}
+		}
+		r.pruned = now
+	}
+}
+
+// Contains reports whether rcpt was relayed to within the window.
+func (r *Relayed) Contains(rcpt string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	at, ok := r.seen[strings.ToLower(rcpt)]
+	return ok && r.now().Sub(at) <= relayedWindow
+}
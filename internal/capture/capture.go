@@ -0,0 +1,170 @@
+// Package capture keeps the messages accepted in sink mode in memory and
+// serves a small web UI to browse them, download them as .eml files and
+// release them to the real upstream, so staging setups need no separate
+// mail catcher.
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/mail"
+	"sync"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// Errors Release returns for a message that must not be sent again.
+var (
+	ErrReleased  = errors.New("capture: message already released")
+	ErrReleasing = errors.New("capture: message release in progress")
+)
+
+// Message is a captured message with the config it would have been relayed
+// with, so a release goes to the same route.
+type Message struct {
+	ID         string
+	Subject    string
+	From       string
+	Recipients []string
+	CapturedAt time.Time
+	Raw        []byte
+
+	// Releasing is set while the message is being sent to the upstream,
+	// Released once it was; ReleaseError holds the outcome of the last
+	// attempt.
+	Releasing    bool
+	Released     bool
+	ReleaseError string
+
+	cfg *config.Config
+	env *relay.Envelope
+}
+
+// Store holds the most recent captured messages, newest first.
+type Store struct {
+	limit    int
+	maxBytes int64
+
+	mu    sync.Mutex
+	msgs  []*Message
+	bytes int64 // total size of msgs
+}
+
+// NewStore returns a store keeping at most limit messages totalling at
+// most maxBytes; the oldest are dropped as new ones arrive. The newest
+// message is kept even when it alone is larger than maxBytes.
+func NewStore(limit int, maxBytes int64) *Store {
+	return &Store{limit: limit, maxBytes: maxBytes}
+}
+
+// Wrap returns a SendFunc that captures each message before calling send.
+func (s *Store) Wrap(send relay.SendFunc) relay.SendFunc {
+	return func(cfg *config.Config, env *relay.Envelope) error {
+		s.add(cfg, env)
+		return send(cfg, env)
+	}
+}
+
+func (s *Store) add(cfg *config.Config, env *relay.Envelope) {
+	m := &Message{
+		ID:         env.ID,
+		Recipients: env.Addresses(),
+		CapturedAt: time.Now(),
+		Raw:        env.Message,
+		cfg:        cfg,
+		env:        env,
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(env.Message)); err == nil {
+		dec := new(mime.WordDecoder)
+		for field, dst := range map[string]*string{"Subject": &m.Subject, "From": &m.From} {
+			v := parsed.Header.Get(field)
+			if decoded, err := dec.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			*dst = v
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append([]*Message{m}, s.msgs...)
+	s.bytes += int64(len(m.Raw))
+	for len(s.msgs) > 1 && (len(s.msgs) > s.limit || s.bytes > s.maxBytes) {
+		s.bytes -= int64(len(s.msgs[len(s.msgs)-1].Raw))
+		s.msgs = s.msgs[:len(s.msgs)-1]
+	}
+}
+
+// List returns copies of the captured messages, newest first.
+func (s *Store) List() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Message, 0, len(s.msgs))
+	for _, m := range s.msgs {
+		list = append(list, *m)
+	}
+	return list
+}
+
+// Get returns a copy of the message with id.
+func (s *Store) Get(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.msgs {
+		if m.ID == id {
+			return *m, true
+		}
+	}
+	return Message{}, false
+}
+
+// Clear drops every captured message.
+func (s *Store) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = nil
+	s.bytes = 0
+}
+
+// Release sends the message with id through send, recording the outcome.
+// It reports false when no such message is stored. A message is sent once:
+// while a release is in progress, or after one succeeded, it fails with
+// ErrReleasing or ErrReleased without sending.
+func (s *Store) Release(id string, send relay.SendFunc) (bool, error) {
+	s.mu.Lock()
+	var m *Message
+	for _, c := range s.msgs {
+		if c.ID == id {
+			m = c
+		}
+	}
+	switch {
+	case m == nil:
+		s.mu.Unlock()
+		return false, nil
+	case m.Released:
+		s.mu.Unlock()
+		return true, ErrReleased
+	case m.Releasing:
+		s.mu.Unlock()
+		return true, ErrReleasing
+	}
+	m.Releasing = true
+	s.mu.Unlock()
+
+	err := send(m.cfg, m.env)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Releasing = false
+	m.ReleaseError = ""
+	if err != nil {
+		m.ReleaseError = err.Error()
+	} else {
+		m.Released = true
+	}
+	return true, err
+}
@@ -0,0 +1,191 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+func sink(_ *config.Config, _ *relay.Envelope) error { return nil }
+
+func capture(t *testing.T, store *Store, subject string) *relay.Envelope {
+	t.Helper()
+	env := &relay.Envelope{
+		ID:         relay.NewID(),
+		Recipients: []relay.Recipient{{Address: "a@dest.org"}},
+		Message:    []byte("From: App <app@example.com>\r\nSubject: " + subject + "\r\n\r\nHello <b>world</b>\r\n"),
+	}
+	if err := store.Wrap(sink)(&config.Config{DestHost: "smtp.example.com"}, env); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestStore_KeepsNewest(t *testing.T) {
+	store := NewStore(2, 1<<20)
+	capture(t, store, "one")
+	capture(t, store, "two")
+	capture(t, store, "=?utf-8?q?thr=C3=A9e?=")
+
+	list := store.List()
+	if len(list) != 2 || list[0].Subject != "thrée" || list[1].Subject != "two" {
+		t.Fatalf("unexpected messages %+v", list)
+	}
+	if list[0].From != "App <app@example.com>" {
+		t.Errorf("unexpected From %q", list[0].From)
+	}
+}
+
+func TestStore_ByteBudget(t *testing.T) {
+	size := int64(len(capture(t, NewStore(10, 1<<20), "x").Message))
+	store := NewStore(10, 2*size)
+	capture(t, store, "a")
+	capture(t, store, "b")
+	capture(t, store, "c")
+	if list := store.List(); len(list) != 2 || list[0].Subject != "c" || list[1].Subject != "b" {
+		t.Fatalf("expected the oldest evicted over the byte budget, got %+v", list)
+	}
+
+	tiny := NewStore(10, 1)
+	capture(t, tiny, "a")
+	capture(t, tiny, "b")
+	if list := tiny.List(); len(list) != 1 || list[0].Subject != "b" {
+		t.Errorf("expected only the newest kept, got %+v", list)
+	}
+	store.Clear()
+	capture(t, store, "d")
+	capture(t, store, "e")
+	if len(store.List()) != 2 {
+		t.Error("expected Clear to reset the byte count")
+	}
+}
+
+func do(t *testing.T, h http.Handler, method, path string, auth bool, header ...string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if auth {
+		req.SetBasicAuth("user", "pass")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func body(resp *http.Response) string {
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestHandler(t *testing.T) {
+	store := NewStore(10, 1<<20)
+	env := capture(t, store, "Invoice")
+
+	var released []string
+	release := func(cfg *config.Config, e *relay.Envelope) error {
+		if cfg.DestHost != "smtp.example.com" {
+			t.Errorf("expected the captured config, got %s", cfg.DestHost)
+		}
+		released = append(released, e.ID)
+		return nil
+	}
+	h := Handler(store, release, func() (string, string) { return "user", "pass" })
+
+	if resp := do(t, h, "GET", "/", false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+
+	resp := do(t, h, "GET", "/", true)
+	if got := body(resp); resp.StatusCode != http.StatusOK || !strings.Contains(got, "Invoice") || !strings.Contains(got, "messages/"+env.ID) {
+		t.Errorf("unexpected list %d: %s", resp.StatusCode, got)
+	}
+
+	resp = do(t, h, "GET", "/messages/"+env.ID, true)
+	if got := body(resp); !strings.Contains(got, "Hello &lt;b&gt;world&lt;/b&gt;") || !strings.Contains(got, "Subject: Invoice") {
+		t.Errorf("expected the escaped message, got: %s", got)
+	}
+
+	resp = do(t, h, "GET", "/messages/"+env.ID+"/eml", true)
+	if got := body(resp); got != string(env.Message) || resp.Header.Get("Content-Type") != "message/rfc822" {
+		t.Errorf("unexpected download %q", got)
+	}
+
+	if resp := do(t, h, "POST", "/messages/"+env.ID+"/release", true, "Sec-Fetch-Site", "cross-site"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a cross-site release to be refused, got %d", resp.StatusCode)
+	}
+	resp = do(t, h, "POST", "/messages/"+env.ID+"/release", true, "Sec-Fetch-Site", "same-origin")
+	if resp.StatusCode != http.StatusSeeOther || len(released) != 1 || released[0] != env.ID {
+		t.Errorf("expected the message released, got %d %v", resp.StatusCode, released)
+	}
+	if m, _ := store.Get(env.ID); !m.Released {
+		t.Error("expected the message marked released")
+	}
+	resp = do(t, h, "POST", "/messages/"+env.ID+"/release", true)
+	if resp.StatusCode != http.StatusConflict || len(released) != 1 {
+		t.Errorf("expected a second release refused, got %d %v", resp.StatusCode, released)
+	}
+
+	if resp := do(t, h, "GET", "/messages/unknown", true); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+
+	do(t, h, "POST", "/clear", true)
+	if len(store.List()) != 0 {
+		t.Error("expected the store cleared")
+	}
+}
+
+func TestStore_ReleaseError(t *testing.T) {
+	store := NewStore(10, 1<<20)
+	env := capture(t, store, "Test")
+
+	found, err := store.Release(env.ID, func(*config.Config, *relay.Envelope) error { return errors.New("upstream down") })
+	if !found || err == nil {
+		t.Fatalf("expected the release error, got %v %v", found, err)
+	}
+	if m, _ := store.Get(env.ID); m.Released || m.ReleaseError != "upstream down" {
+		t.Errorf("unexpected state %+v", m)
+	}
+}
+
+func TestStore_ConcurrentRelease(t *testing.T) {
+	store := NewStore(10, 1<<20)
+	env := capture(t, store, "Test")
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	var sent atomic.Int32
+	slow := func(*config.Config, *relay.Envelope) error {
+		sent.Add(1)
+		close(started)
+		<-finish
+		return nil
+	}
+	done := make(chan error)
+	go func() {
+		_, err := store.Release(env.ID, slow)
+		done <- err
+	}()
+	<-started
+	if m, _ := store.Get(env.ID); !m.Releasing {
+		t.Error("expected the message marked releasing")
+	}
+	if _, err := store.Release(env.ID, slow); !errors.Is(err, ErrReleasing) {
+		t.Errorf("expected ErrReleasing during a release, got %v", err)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Release(env.ID, slow); !errors.Is(err, ErrReleased) || sent.Load() != 1 {
+		t.Errorf("expected the message sent once, got %v after %d sends", err, sent.Load())
+	}
+}
@@ -0,0 +1,148 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+var listPage = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>smtp-proxy capture</title>
+<style>
+body{font-family:sans-serif;margin:2em}table{border-collapse:collapse;width:100%}
+td,th{text-align:left;padding:.3em .6em;border-bottom:1px solid #ddd}
+pre{background:#f6f6f6;padding:1em;white-space:pre-wrap;word-break:break-all}
+.err{color:#b00}
+</style></head><body>
+<h1>Captured messages</h1>
+<p>Sink mode: these messages were accepted but not relayed. Only the most recent are kept, in memory.</p>
+<form method="post" action="clear"><button>Clear all</button></form>
+<table><tr><th>Captured</th><th>From</th><th>Recipients</th><th>Subject</th><th></th></tr>
+{{range .}}<tr>
+<td>{{.CapturedAt.Format "2006-01-02 15:04:05"}}</td><td>{{.From}}</td>
+<td>{{range $i, $r := .Recipients}}{{if $i}}, {{end}}{{$r}}{{end}}</td>
+<td><a href="messages/{{.ID}}">{{or .Subject "(no subject)"}}</a></td>
+<td>{{if .Released}}released{{end}}</td>
+</tr>{{else}}<tr><td colspan="5">No messages captured yet.</td></tr>{{end}}
+</table></body></html>
+`))
+
+var messagePage = template.Must(template.New("message").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{or .Subject "(no subject)"}}</title>
+<style>
+body{font-family:sans-serif;margin:2em}
+pre{background:#f6f6f6;padding:1em;white-space:pre-wrap;word-break:break-all}
+.err{color:#b00}
+</style></head><body>
+<p><a href="../">&larr; All messages</a> · <a href="{{.ID}}/eml">Download .eml</a></p>
+<h1>{{or .Subject "(no subject)"}}</h1>
+<p>Envelope recipients: {{range $i, $r := .Recipients}}{{if $i}}, {{end}}{{$r}}{{end}}</p>
+{{if .Released}}<p>Released to the upstream.</p>{{else if .Releasing}}<p>Release in progress.</p>{{else}}
+<form method="post" action="{{.ID}}/release"><button>Release to upstream</button></form>{{end}}
+{{with .ReleaseError}}<p class="err">Release failed: {{.}}</p>{{end}}
+<h2>Headers</h2><pre>{{.Header}}</pre>
+<h2>Body</h2><pre>{{.Body}}</pre>
+</body></html>
+`))
+
+// Handler serves the capture UI for store. Every request needs HTTP basic
+// auth with the username and password login returns at the time, so a
+// secret reload takes effect; released messages go through release.
+func Handler(store *Store, release relay.SendFunc, login func() (username, password string)) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := listPage.Execute(w, store.List()); err != nil {
+			slog.Error("capture: render list", "error", err)
+		}
+	})
+
+	mux.HandleFunc("GET /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		m, ok := store.Get(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		header, body := m.Raw, []byte(nil)
+		if i := bytes.Index(m.Raw, []byte("\r\n\r\n")); i >= 0 {
+			header, body = m.Raw[:i], m.Raw[i+4:]
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := messagePage.Execute(w, struct {
+			Message
+			Header, Body string
+		}{m, string(header), string(body)})
+		if err != nil {
+			slog.Error("capture: render message", "error", err)
+		}
+	})
+
+	mux.HandleFunc("GET /messages/{id}/eml", func(w http.ResponseWriter, r *http.Request) {
+		m, ok := store.Get(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+m.ID+`.eml"`)
+		_, _ = w.Write(m.Raw)
+	})
+
+	mux.HandleFunc("POST /messages/{id}/release", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		found, err := store.Release(id, release)
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, ErrReleased) || errors.Is(err, ErrReleasing) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Warn("capture: release failed", "msg_id", id, "error", err)
+		} else {
+			slog.Info("capture: message released", "msg_id", id)
+		}
+		http.Redirect(w, r, "../"+id, http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("POST /clear", func(w http.ResponseWriter, r *http.Request) {
+		store.Clear()
+		http.Redirect(w, r, "./", http.StatusSeeOther)
+	})
+
+	return requireAuth(mux, login)
+}
+
+// requireAuth wraps next with HTTP basic auth, and refuses cross-site
+// POSTs, which a browser would send with the cached credentials.
+func requireAuth(next http.Handler, login func() (username, password string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password := login()
+		user, pass, ok := r.BasicAuth()
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userMatch || !passMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="smtp-proxy capture", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost {
+			switch strings.ToLower(r.Header.Get("Sec-Fetch-Site")) {
+			case "", "same-origin", "none":
+			default:
+				http.Error(w, "Cross-site request refused", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,141 @@
+// Package clamav scans outbound messages with clamd before they are
+// relayed, so a compromised client cannot spread malware under our domain.
+package clamav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// chunkSize is the INSTREAM chunk length; clamd accepts any size up to its
+// StreamMaxLength in total.
+const chunkSize = 64 * 1024
+
+// Scanner streams messages to clamd. It implements processor.Processor,
+// rejecting infected messages with 554 5.7.1; a clamd that cannot be
+// reached fails the message temporarily.
+type Scanner struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// New creates a scanner for cfg.ClamAVAddr, or returns nil when it is
+// unset. The address is "unix:/path", an absolute socket path, or a TCP
+// host:port.
+func New(cfg *config.Config) (*Scanner, error) {
+	if cfg.ClamAVAddr == "" {
+		return nil, nil
+	}
+	s := &Scanner{network: "tcp", addr: cfg.ClamAVAddr, timeout: cfg.ClamAVTimeout}
+	switch {
+	case strings.HasPrefix(cfg.ClamAVAddr, "unix:"):
+		s.network, s.addr = "unix", strings.TrimPrefix(cfg.ClamAVAddr, "unix:")
+	case strings.HasPrefix(cfg.ClamAVAddr, "/"):
+		s.network = "unix"
+	default:
+		if _, _, err := net.SplitHostPort(cfg.ClamAVAddr); err != nil {
+			return nil, fmt.Errorf("clamav address %q: %w", cfg.ClamAVAddr, err)
+		}
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("clamav address %q: empty socket path", cfg.ClamAVAddr)
+	}
+	return s, nil
+}
+
+// Scan sends data to clamd and returns the name of the signature it
+// matched, or "" for a clean message.
+func (s *Scanner) Scan(data []byte) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.addr, s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("clamd dial: %w", err)
+	}
+	defer conn.Close()
+	if s.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("clamd write: %w", err)
+	}
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		if _, err := conn.Write(size[:]); err != nil {
+			return "", fmt.Errorf("clamd write: %w", err)
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return "", fmt.Errorf("clamd write: %w", err)
+		}
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return "", fmt.Errorf("clamd write: %w", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("clamd read: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// parseReply interprets "stream: OK", "stream: <name> FOUND" and
+// "<message> ERROR" replies.
+func parseReply(reply []byte) (string, error) {
+	line := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+	result, ok := strings.CutPrefix(line, "stream: ")
+	switch {
+	case line == "":
+		return "", errors.New("clamd: empty reply")
+	case ok && result == "OK":
+		return "", nil
+	case ok && strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", line)
+}
+
+// ProcessEnvelope implements processor.Processor; scanning needs the
+// message, so it does nothing.
+func (s *Scanner) ProcessEnvelope(*relay.Envelope) error {
+	return nil
+}
+
+// ProcessMessage scans the message, returning it unchanged when clean.
+func (s *Scanner) ProcessMessage(env *relay.Envelope) ([]byte, error) {
+	virus, err := s.Scan(env.Message)
+	if err != nil {
+		return nil, err
+	}
+	if virus != "" {
+		slog.Warn("virus detected",
+			"msg_id", env.ID,
+			"virus", virus,
+			"user", env.Username,
+			"remote_ip", env.RemoteIP,
+			"recipients", env.Addresses(),
+		)
+		return nil, &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected: virus detected (" + virus + ")",
+		}
+	}
+	return env.Message, nil
+}
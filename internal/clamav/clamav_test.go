@@ -0,0 +1,164 @@
+package clamav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// fakeClamd serves INSTREAM requests on ln, reporting a virus for any
+// stream containing the EICAR marker. It returns the streams it received.
+func fakeClamd(t *testing.T, ln net.Listener) <-chan []byte {
+	t.Helper()
+	streams := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var stream bytes.Buffer
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, conn, int64(n)); err != nil {
+						return
+					}
+				}
+				streams <- stream.Bytes()
+				if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					_, _ = conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return streams
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New(&config.Config{}); s != nil || err != nil {
+		t.Errorf("expected nil scanner when unset, got %v, %v", s, err)
+	}
+	tests := []struct {
+		addr, network, path string
+	}{
+		{"unix:/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"clamd:3310", "tcp", "clamd:3310"},
+	}
+	for _, tt := range tests {
+		s, err := New(&config.Config{ClamAVAddr: tt.addr})
+		if err != nil || s.network != tt.network || s.addr != tt.path {
+			t.Errorf("%s: unexpected scanner %+v, %v", tt.addr, s, err)
+		}
+	}
+	for _, bad := range []string{"clamd", "unix:"} {
+		if _, err := New(&config.Config{ClamAVAddr: bad}); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := fakeClamd(t, ln)
+	s, err := New(&config.Config{ClamAVAddr: ln.Addr().String(), ClamAVTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Larger than one chunk, to exercise chunking
+	clean := bytes.Repeat([]byte("clean message line\r\n"), chunkSize/10)
+	virus, err := s.Scan(clean)
+	if err != nil || virus != "" {
+		t.Fatalf("expected clean result, got %q, %v", virus, err)
+	}
+	if got := <-streams; !bytes.Equal(got, clean) {
+		t.Errorf("clamd received %d bytes, want %d", len(got), len(clean))
+	}
+
+	virus, err = s.Scan([]byte("Subject: hi\r\n\r\nEICAR"))
+	if err != nil || virus != "Eicar-Test-Signature" {
+		t.Errorf("expected EICAR detection, got %q, %v", virus, err)
+	}
+}
+
+func TestScan_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	fakeClamd(t, ln)
+	s, _ := New(&config.Config{ClamAVAddr: "unix:" + path, ClamAVTimeout: 5 * time.Second})
+	if virus, err := s.Scan([]byte("hello")); err != nil || virus != "" {
+		t.Errorf("expected clean result, got %q, %v", virus, err)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	if _, err := parseReply([]byte("INSTREAM size limit exceeded. ERROR\x00")); err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Errorf("expected clamd error, got %v", err)
+	}
+	if _, err := parseReply(nil); err == nil {
+		t.Error("expected error for empty reply")
+	}
+}
+
+func TestProcessMessage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeClamd(t, ln)
+	s, _ := New(&config.Config{ClamAVAddr: ln.Addr().String(), ClamAVTimeout: 5 * time.Second})
+
+	msg := []byte("Subject: hi\r\n\r\nBody")
+	out, err := s.ProcessMessage(&relay.Envelope{Message: msg})
+	if err != nil || !bytes.Equal(out, msg) {
+		t.Errorf("expected clean message passed through, got %q, %v", out, err)
+	}
+
+	_, err = s.ProcessMessage(&relay.Envelope{Message: []byte("Subject: hi\r\n\r\nEICAR")})
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 || !strings.Contains(smtpErr.Message, "Eicar-Test-Signature") {
+		t.Errorf("expected 554 rejection naming the virus, got %v", err)
+	}
+
+	// clamd down: a plain error, which the proxy turns into a 451
+	ln.Close()
+	_, err = s.ProcessMessage(&relay.Envelope{Message: msg})
+	if err == nil || errors.As(err, &smtpErr) {
+		t.Errorf("expected non-SMTP error with clamd down, got %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+// Package dkim verifies the DKIM signatures (RFC 6376) a message arrived
+// with, so the verdict can be recorded before the sanitizer rewrites the
+// headers the signatures cover.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verification results, as used in Authentication-Results (RFC 8601).
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// maxSignatures caps how many signatures of one message are checked, since
+// each costs a DNS lookup.
+const maxSignatures = 5
+
+// minRSABits is the smallest RSA key accepted (RFC 8301 section 3.2).
+const minRSABits = 1024
+
+// Result is the outcome of checking one DKIM-Signature field.
+type Result struct {
+	Domain   string // d=
+	Selector string // s=
+	Status   string // Pass, Fail, TempError or PermError
+	Err      error  // why the signature did not pass
+}
+
+// Verifier checks DKIM signatures, fetching keys from DNS.
+type Verifier struct {
+	now       func() time.Time
+	lookupTXT func(name string) ([]string, error)
+}
+
+// NewVerifier returns a verifier using the system resolver.
+func NewVerifier() *Verifier {
+	return &Verifier{now: time.Now, lookupTXT: net.LookupTXT}
+}
+
+// Verify checks each DKIM-Signature of raw, a CRLF message as the client
+// sent it, returning one result per signature in header order. A message
+// without signatures has no results.
+func (v *Verifier) Verify(raw []byte) []Result {
+	fields, body := splitMessage(raw)
+	var results []Result
+	for _, f := range fields {
+		if f.name != "dkim-signature" {
+			continue
+		}
+		if len(results) == maxSignatures {
+			break
+		}
+		results = append(results, v.verify(fields, body, f))
+	}
+	return results
+}
+
+// Aligned reports whether results hold a passing signature whose domain
+// is domain or a parent of it (relaxed alignment, RFC 7489 section 3.1.1).
+func Aligned(results []Result, domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, r := range results {
+		d := strings.ToLower(r.Domain)
+		if r.Status == Pass && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// temporary marks key lookup failures that may succeed later.
+type temporary struct{ err error }
+
+func (t temporary) Error() string { return t.err.Error() }
+func (t temporary) Unwrap() error { return t.err }
+
+// permanent marks signatures that cannot be evaluated at all, as opposed
+// to ones that evaluate and do not match.
+type permanent struct{ err error }
+
+func (p permanent) Error() string { return p.err.Error() }
+func (p permanent) Unwrap() error { return p.err }
+
+func (v *Verifier) verify(fields []field, body []byte, sig field) Result {
+	tags, err := parseTags(sig.value())
+	if err != nil {
+		return Result{Status: PermError, Err: err}
+	}
+	r := Result{Domain: tags["d"], Selector: tags["s"]}
+	if err := v.check(fields, body, sig, tags); err != nil {
+		r.Err = err
+		var tmp temporary
+		var perm permanent
+		switch {
+		case errors.As(err, &tmp):
+			r.Status = TempError
+		case errors.As(err, &perm):
+			r.Status = PermError
+		default:
+			r.Status = Fail
+		}
+		return r
+	}
+	r.Status = Pass
+	return r
+}
+
+func (v *Verifier) check(fields []field, body []byte, sig field, tags map[string]string) error {
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[required] == "" {
+			return permanent{fmt.Errorf("missing %s= tag", required)}
+		}
+	}
+	if tags["v"] != "1" {
+		return permanent{fmt.Errorf("unsupported version %q", tags["v"])}
+	}
+	if tags["a"] != "rsa-sha256" && tags["a"] != "ed25519-sha256" {
+		return permanent{fmt.Errorf("unsupported algorithm %q", tags["a"])}
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if !validCanon(headerCanon) || !validCanon(bodyCanon) {
+		return permanent{fmt.Errorf("unsupported canonicalization %q", tags["c"])}
+	}
+	names := strings.Split(tags["h"], ":")
+	if !slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(strings.TrimSpace(n), "from") }) {
+		return permanent{errors.New("From is not signed")}
+	}
+	if i := tags["i"]; i != "" {
+		_, idomain, _ := strings.Cut(i, "@")
+		idomain, d := strings.ToLower(idomain), strings.ToLower(tags["d"])
+		if idomain != d && !strings.HasSuffix(idomain, "."+d) {
+			return permanent{fmt.Errorf("i= domain %s is not within d=%s", idomain, d)}
+		}
+	}
+	if x := tags["x"]; x != "" {
+		expiry, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permanent{errors.New("malformed x= tag")}
+		}
+		if v.now().Unix() > expiry {
+			return errors.New("signature expired")
+		}
+	}
+
+	canonical := canonBodySimple(body)
+	if bodyCanon == "relaxed" {
+		canonical = canonBodyRelaxed(body)
+	}
+	if l := tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return permanent{errors.New("malformed l= tag")}
+		}
+		if n > len(canonical) {
+			return errors.New("body shorter than l=")
+		}
+		canonical = canonical[:n]
+	}
+	sum := sha256.Sum256(canonical)
+	if tags["bh"] != base64.StdEncoding.EncodeToString(sum[:]) {
+		return errors.New("body hash mismatch")
+	}
+
+	canonHeader := func(raw string) string { return raw }
+	if headerCanon == "relaxed" {
+		canonHeader = canonHeaderRelaxed
+	}
+	var signed strings.Builder
+	for _, raw := range selectHeaders(fields, names) {
+		signed.WriteString(canonHeader(raw))
+	}
+	signed.WriteString(strings.TrimSuffix(canonHeader(withoutSignature(sig.raw)), "\r\n"))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return permanent{fmt.Errorf("signature: %w", err)}
+	}
+	key, err := v.publicKey(tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(signed.String()))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return permanent{fmt.Errorf("%s signature with an RSA key", tags["a"])}
+		}
+		if k.N.BitLen() < minRSABits {
+			return permanent{fmt.Errorf("RSA key shorter than %d bits", minRSABits)}
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], signature)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return permanent{fmt.Errorf("%s signature with an Ed25519 key", tags["a"])}
+		}
+		if !ed25519.Verify(k, hashed[:], signature) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	}
+	return permanent{fmt.Errorf("unsupported key type %T", key)}
+}
+
+func validCanon(c string) bool {
+	return c == "simple" || c == "relaxed"
+}
+
+// publicKey fetches and parses the key record at selector._domainkey.domain.
+func (v *Verifier) publicKey(selector, domain string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := v.lookupTXT(name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, permanent{fmt.Errorf("no key record %s", name)}
+		}
+		return nil, temporary{fmt.Errorf("key lookup %s: %w", name, err)}
+	}
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, permanent{fmt.Errorf("key record %s: %w", name, err)}
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, permanent{fmt.Errorf("key record %s: missing or revoked key", name)}
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+			return key, nil
+		}
+		key, err := x509.ParsePKCS1PublicKey(der)
+		if err != nil {
+			return nil, permanent{fmt.Errorf("key record %s: %w", name, err)}
+		}
+		return key, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permanent{fmt.Errorf("key record %s: bad ed25519 key length", name)}
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, permanent{fmt.Errorf("key record %s: unsupported key type %q", name, tags["k"])}
+}
+
+// field is one header field as it appears in the message, including
+// folded continuation lines and the final CRLF.
+type field struct {
+	name string // lowercase
+	raw  string
+}
+
+func (f field) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	return v
+}
+
+// splitMessage separates a CRLF message into its header fields and body.
+func splitMessage(msg []byte) ([]field, []byte) {
+	headerPart, body := msg, []byte(nil)
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i != -1 {
+		headerPart, body = msg[:i+2], msg[i+4:]
+	}
+	var fields []field
+	for _, line := range strings.SplitAfter(string(headerPart), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, field{name: strings.ToLower(strings.TrimSpace(name)), raw: line})
+	}
+	return fields, body
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// canonHeaderRelaxed applies relaxed header canonicalization (RFC 6376
+// section 3.4.2).
+func canonHeaderRelaxed(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonBodySimple applies simple body canonicalization (RFC 6376 section
+// 3.4.3): trailing empty lines are removed, an empty body becomes CRLF.
+func canonBodySimple(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 {
+		return []byte("\r\n")
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(slices.Clip(body), "\r\n"...)
+	}
+	return body
+}
+
+// canonBodyRelaxed applies relaxed body canonicalization (RFC 6376
+// section 3.4.4).
+func canonBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(l, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// selectHeaders returns the fields named in names for signing: each name
+// takes the last instance not yet used, working upwards. Names with no
+// remaining instance contribute nothing.
+func selectHeaders(fields []field, names []string) []string {
+	used := make(map[int]bool)
+	var out []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fields[i].name == name && !used[i] {
+				used[i] = true
+				out = append(out, fields[i].raw)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// parseTags parses a DKIM tag list ("a=1; b=2"). Whitespace inside values
+// is removed, which is what base64 tags need.
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		k = strings.TrimSpace(k)
+		if _, dup := tags[k]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", k)
+		}
+		tags[k] = strings.Join(strings.Fields(v), "")
+	}
+	return tags, nil
+}
+
+var sigTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// withoutSignature empties the b= tag of a raw signature field, as it was
+// when the signature was computed.
+func withoutSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return name + ":" + sigTag.ReplaceAllString(value, "${1}${2}")
+}
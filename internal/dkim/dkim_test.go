@@ -0,0 +1,190 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const message = "From: App <app@example.com>\r\n" +
+	"To: user@example.org\r\n" +
+	"Subject: Monthly  report\r\n" +
+	"\r\n" +
+	"Hello,\r\n\r\nthe report is attached.  \r\n\r\n"
+
+// keyring serves DKIM key records to a verifier.
+type keyring map[string]string
+
+func (k keyring) lookup(name string) ([]string, error) {
+	if rec, ok := k[name]; ok {
+		return []string{rec}, nil
+	}
+	if strings.HasSuffix(name, ".down.example") {
+		return nil, errors.New("i/o timeout")
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func newVerifier(keys keyring) *Verifier {
+	v := NewVerifier()
+	v.lookupTXT = keys.lookup
+	v.now = func() time.Time { return time.Unix(1700000000, 0) }
+	return v
+}
+
+// sign prepends a DKIM-Signature for msg with the given canonicalization
+// and extra tags, publishing the key in keys.
+func sign(t *testing.T, keys keyring, msg, domain, canon, extra string, ed bool) string {
+	t.Helper()
+	var key crypto.Signer
+	algorithm := "rsa-sha256"
+	if ed {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		key, algorithm = priv, "ed25519-sha256"
+		keys["sel._domainkey."+domain] = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	} else {
+		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+		der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		key = priv
+		keys["sel._domainkey."+domain] = "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+
+	fields, body := splitMessage([]byte(msg))
+	headerCanon, bodyCanon, _ := strings.Cut(canon, "/")
+	canonical := canonBodySimple(body)
+	canonHeader := func(raw string) string { return raw }
+	if bodyCanon == "relaxed" {
+		canonical = canonBodyRelaxed(body)
+	}
+	if headerCanon == "relaxed" {
+		canonHeader = canonHeaderRelaxed
+	}
+	bh := sha256.Sum256(canonical)
+	sig := "DKIM-Signature: v=1; a=" + algorithm + "; c=" + canon + "; d=" + domain + "; s=sel;" + extra +
+		"\r\n\th=from:to:subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="
+	var signed strings.Builder
+	for _, raw := range selectHeaders(fields, []string{"from", "to", "subject"}) {
+		signed.WriteString(canonHeader(raw))
+	}
+	signed.WriteString(strings.TrimSuffix(canonHeader(sig), "\r\n"))
+	hashed := sha256.Sum256([]byte(signed.String()))
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if ed {
+		opts = crypto.Hash(0)
+	}
+	b, err := key.Sign(rand.Reader, hashed[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig + base64.StdEncoding.EncodeToString(b) + "\r\n" + msg
+}
+
+func TestVerify_Pass(t *testing.T) {
+	for _, tc := range []struct {
+		canon string
+		ed    bool
+	}{
+		{"relaxed/relaxed", false},
+		{"simple/simple", false},
+		{"relaxed/simple", true},
+	} {
+		keys := keyring{}
+		signed := sign(t, keys, message, "example.com", tc.canon, "", tc.ed)
+		results := newVerifier(keys).Verify([]byte(signed))
+		if len(results) != 1 || results[0].Status != Pass {
+			t.Errorf("%s: expected pass, got %+v", tc.canon, results)
+			continue
+		}
+		if results[0].Domain != "example.com" || results[0].Selector != "sel" {
+			t.Errorf("%s: unexpected signer %+v", tc.canon, results[0])
+		}
+	}
+}
+
+func TestVerify_RelaxedToleratesWhitespace(t *testing.T) {
+	keys := keyring{}
+	signed := sign(t, keys, message, "example.com", "relaxed/relaxed", "", false)
+	reformatted := strings.Replace(signed, "Subject: Monthly  report", "Subject:  Monthly report", 1)
+	reformatted = strings.Replace(reformatted, "attached.  \r\n", "attached.\r\n", 1)
+	if r := newVerifier(keys).Verify([]byte(reformatted)); r[0].Status != Pass {
+		t.Errorf("expected pass, got %+v", r[0])
+	}
+
+	signed = sign(t, keys, message, "example.com", "simple/simple", "", false)
+	reformatted = strings.Replace(signed, "attached.  \r\n", "attached.\r\n", 1)
+	if r := newVerifier(keys).Verify([]byte(reformatted)); r[0].Status != Fail {
+		t.Errorf("expected simple canonicalization to fail, got %+v", r[0])
+	}
+}
+
+func TestVerify_Fail(t *testing.T) {
+	keys := keyring{}
+	signed := sign(t, keys, message, "example.com", "relaxed/relaxed", "", false)
+	v := newVerifier(keys)
+
+	for name, modified := range map[string]string{
+		"body":    strings.Replace(signed, "the report", "a report", 1),
+		"subject": strings.Replace(signed, "Monthly", "Weekly", 1),
+	} {
+		r := v.Verify([]byte(modified))
+		if len(r) != 1 || r[0].Status != Fail || r[0].Err == nil {
+			t.Errorf("%s: expected fail, got %+v", name, r)
+		}
+	}
+}
+
+func TestVerify_Errors(t *testing.T) {
+	keys := keyring{}
+	v := newVerifier(keys)
+
+	// The key is published under the signing domain only
+	signed := sign(t, keys, message, "example.com", "relaxed/relaxed", "", false)
+	if r := v.Verify([]byte(strings.Replace(signed, "d=example.com", "d=other.example", 1))); r[0].Status != PermError {
+		t.Errorf("expected permerror for a missing key, got %+v", r[0])
+	}
+	if r := v.Verify([]byte(strings.Replace(signed, "d=example.com", "d=down.example", 1))); r[0].Status != TempError {
+		t.Errorf("expected temperror for a failed lookup, got %+v", r[0])
+	}
+
+	expired := sign(t, keys, message, "example.com", "relaxed/relaxed", " x=1600000000;", false)
+	if r := v.Verify([]byte(expired)); r[0].Status != Fail || !strings.Contains(r[0].Err.Error(), "expired") {
+		t.Errorf("expected an expired signature to fail, got %+v", r[0])
+	}
+
+	sha1 := strings.Replace(signed, "a=rsa-sha256", "a=rsa-sha1", 1)
+	if r := v.Verify([]byte(sha1)); r[0].Status != PermError {
+		t.Errorf("expected permerror for rsa-sha1, got %+v", r[0])
+	}
+
+	if r := v.Verify([]byte(message)); len(r) != 0 {
+		t.Errorf("expected no results for an unsigned message, got %+v", r)
+	}
+}
+
+func TestAligned(t *testing.T) {
+	results := []Result{
+		{Domain: "other.example", Status: Pass},
+		{Domain: "Example.com", Status: Pass},
+		{Domain: "fail.example", Status: Fail},
+	}
+	for domain, want := range map[string]bool{
+		"example.com":      true,
+		"mail.example.com": true,
+		"badexample.com":   false,
+		"fail.example":     false,
+		"com":              false,
+	} {
+		if got := Aligned(results, domain); got != want {
+			t.Errorf("Aligned(%s) = %v, want %v", domain, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package dmarc looks up DMARC policies (RFC 7489) and checks whether a
+// From domain aligns with the domains that authenticate a relayed
+// message: the envelope sender for SPF and the signing domain for DKIM.
+package dmarc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Policy is a published DMARC record, as it applies to one From domain.
+type Policy struct {
+	// Domain is where the record was found: the From domain itself or a
+	// parent of it.
+	Domain string
+	// Action is "none", "quarantine" or "reject" (sp= for subdomains).
+	Action string
+	// StrictDKIM and StrictSPF require exact domain matches (adkim=s,
+	// aspf=s) instead of relaxed alignment.
+	StrictDKIM bool
+	StrictSPF  bool
+}
+
+// Enforced reports whether failing the policy affects delivery.
+func (p *Policy) Enforced() bool {
+	return p != nil && p.Action != "none"
+}
+
+// Passes reports whether a message from a domain under p passes DMARC
+// when the envelope sender domain passes SPF and dkimDomain, if not
+// empty, has a valid DKIM signature.
+func (p *Policy) Passes(from, mailFrom, dkimDomain string) bool {
+	return Aligned(from, mailFrom, p.StrictSPF) || (dkimDomain != "" && Aligned(from, dkimDomain, p.StrictDKIM))
+}
+
+// Aligned reports whether domain aligns with from. Strict alignment needs
+// the same domain. Relaxed alignment also accepts a parent or subdomain;
+// without a public suffix list, sibling subdomains of one organization
+// are not recognized as aligned.
+func Aligned(from, domain string, strict bool) bool {
+	from, domain = strings.ToLower(from), strings.ToLower(domain)
+	if from == domain {
+		return true
+	}
+	if strict || from == "" || domain == "" {
+		return false
+	}
+	return strings.HasSuffix(from, "."+domain) || strings.HasSuffix(domain, "."+from)
+}
+
+// Resolver fetches DMARC records from DNS.
+type Resolver struct {
+	lookupTXT func(name string) ([]string, error)
+}
+
+// NewResolver returns a resolver using the system resolver.
+func NewResolver() *Resolver {
+	return &Resolver{lookupTXT: net.LookupTXT}
+}
+
+// Lookup returns the policy for from, checking _dmarc.<from> and then
+// each parent domain below the top level, as an approximation of the
+// organizational domain. It returns nil when no record is published.
+func (r *Resolver) Lookup(from string) (*Policy, error) {
+	from = strings.TrimSuffix(strings.ToLower(from), ".")
+	labels := strings.Split(from, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		domain := strings.Join(labels[i:], ".")
+		record, err := r.record(domain)
+		if err != nil {
+			return nil, err
+		}
+		if record == "" {
+			continue
+		}
+		p, err := parse(record, i > 0)
+		if err != nil {
+			return nil, fmt.Errorf("_dmarc.%s: %w", domain, err)
+		}
+		p.Domain = domain
+		return p, nil
+	}
+	return nil, nil
+}
+
+// record returns the DMARC record at _dmarc.domain, or "" if there is
+// none or more than one (RFC 7489 section 6.6.3).
+func (r *Resolver) record(domain string) (string, error) {
+	txts, err := r.lookupTXT("_dmarc." + domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("lookup _dmarc.%s: %w", domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if v, _, _ := strings.Cut(txt, ";"); strings.EqualFold(strings.TrimSpace(v), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+// parse reads the tags of a record that matter for alignment. For a
+// record found at a parent domain, sp= overrides p=.
+func parse(record string, parent bool) (*Policy, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(record, ";") {
+		k, v, ok := strings.Cut(spec, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.ToLower(strings.TrimSpace(k))] = strings.ToLower(strings.TrimSpace(v))
+	}
+	p := &Policy{Action: tags["p"], StrictDKIM: tags["adkim"] == "s", StrictSPF: tags["aspf"] == "s"}
+	if sp := tags["sp"]; parent && sp != "" {
+		p.Action = sp
+	}
+	switch p.Action {
+	case "none", "quarantine", "reject":
+		return p, nil
+	}
+	return nil, fmt.Errorf("invalid policy %q", p.Action)
+}
@@ -0,0 +1,76 @@
+package dmarc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func resolver(records map[string][]string) *Resolver {
+	return &Resolver{lookupTXT: func(name string) ([]string, error) {
+		if strings.HasSuffix(name, ".down.example") {
+			return nil, errors.New("i/o timeout")
+		}
+		if txts, ok := records[name]; ok {
+			return txts, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}}
+}
+
+func TestLookup(t *testing.T) {
+	r := resolver(map[string][]string{
+		"_dmarc.example.com":   {"v=DMARC1; p=reject; sp=quarantine; adkim=s"},
+		"_dmarc.none.example":  {"v=DMARC1; p=none; rua=mailto:dmarc@none.example"},
+		"_dmarc.twice.example": {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.bad.example":   {"v=DMARC1; p=discard"},
+		"_dmarc.spf.example":   {"v=spf1 -all"},
+	})
+
+	p, err := r.Lookup("Example.com")
+	if err != nil || p.Action != "reject" || p.Domain != "example.com" || !p.StrictDKIM || p.StrictSPF {
+		t.Errorf("unexpected policy %+v (%v)", p, err)
+	}
+	p, err = r.Lookup("mail.example.com")
+	if err != nil || p.Action != "quarantine" || p.Domain != "example.com" {
+		t.Errorf("expected the subdomain policy of the parent, got %+v (%v)", p, err)
+	}
+	if p, _ := r.Lookup("none.example"); p.Enforced() {
+		t.Errorf("expected p=none not to be enforced, got %+v", p)
+	}
+	for _, domain := range []string{"nodmarc.example", "twice.example", "spf.example"} {
+		if p, err := r.Lookup(domain); p != nil || err != nil {
+			t.Errorf("%s: expected no policy, got %+v (%v)", domain, p, err)
+		}
+	}
+	if _, err := r.Lookup("bad.example"); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+	if _, err := r.Lookup("mail.down.example"); err == nil {
+		t.Error("expected an error for a failed lookup")
+	}
+}
+
+func TestPasses(t *testing.T) {
+	relaxed := &Policy{Action: "reject"}
+	strict := &Policy{Action: "reject", StrictDKIM: true, StrictSPF: true}
+	for _, tc := range []struct {
+		policy                 *Policy
+		from, mailFrom, signer string
+		want                   bool
+	}{
+		{relaxed, "example.com", "example.com", "", true},
+		{relaxed, "example.com", "bounces.example.com", "", true},
+		{relaxed, "news.example.com", "example.com", "", true},
+		{relaxed, "example.com", "relay.example", "", false},
+		{relaxed, "example.com", "relay.example", "Example.COM", true},
+		{relaxed, "example.com", "badexample.com", "", false},
+		{strict, "example.com", "bounces.example.com", "mail.example.com", false},
+		{strict, "example.com", "relay.example", "example.com", true},
+	} {
+		if got := tc.policy.Passes(tc.from, tc.mailFrom, tc.signer); got != tc.want {
+			t.Errorf("Passes(%s, %s, %q) strict=%v = %v, want %v", tc.from, tc.mailFrom, tc.signer, tc.policy.StrictSPF, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package dnsbl looks up client IP addresses in DNS blocklists such as
+// Spamhaus ZEN (RFC 5782).
+package dnsbl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Listing is a blocklist that lists an address, with the codes it
+// answered (127.0.0.x, whose meaning depends on the list).
+type Listing struct {
+	Zone  string
+	Codes []string
+}
+
+// Checker queries a set of blocklist zones.
+type Checker struct {
+	zones      []string
+	lookupHost func(host string) ([]string, error)
+}
+
+// NewChecker returns a checker for zones using the system resolver.
+func NewChecker(zones []string) *Checker {
+	return &Checker{zones: zones, lookupHost: net.LookupHost}
+}
+
+// Check queries every zone for ip concurrently and returns the listings,
+// in zone order. Zones that could not be queried are left out and their
+// errors joined; an address absent from a zone is not an error.
+func (c *Checker) Check(ip net.IP) ([]Listing, error) {
+	name := reverse(ip)
+	if name == "" {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	listings := make([]*Listing, len(c.zones))
+	errs := make([]error, len(c.zones))
+	var wg sync.WaitGroup
+	for i, zone := range c.zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listings[i], errs[i] = c.query(name, zone)
+		}()
+	}
+	wg.Wait()
+
+	var listed []Listing
+	for _, l := range listings {
+		if l != nil {
+			listed = append(listed, *l)
+		}
+	}
+	return listed, errors.Join(errs...)
+}
+
+// query looks up name in zone. Answers outside 127.0.0.0/8 and the
+// 127.255.255.0/24 codes Spamhaus uses to refuse a query (e.g. from an
+// open resolver) do not count as listings.
+func (c *Checker) query(name, zone string) (*Listing, error) {
+	addrs, err := c.lookupHost(name + "." + zone)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", zone, err)
+	}
+	var codes []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr).To4()
+		switch {
+		case ip == nil || ip[0] != 127:
+		case ip[1] == 255 && ip[2] == 255:
+			return nil, fmt.Errorf("%s: query refused with %s", zone, addr)
+		default:
+			codes = append(codes, addr)
+		}
+	}
+	if len(codes) == 0 {
+		return nil, nil
+	}
+	return &Listing{Zone: zone, Codes: codes}, nil
+}
+
+// reverse returns the query label for ip: its octets reversed for IPv4,
+// its nibbles reversed for IPv6.
+func reverse(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	labels := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[v6[i]&0x0f]), string(hex[v6[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,58 @@
+package dnsbl
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func checker(zones []string, answers map[string][]string) *Checker {
+	c := NewChecker(zones)
+	c.lookupHost = func(host string) ([]string, error) {
+		if strings.HasSuffix(host, ".down.example") {
+			return nil, errors.New("i/o timeout")
+		}
+		if addrs, ok := answers[host]; ok {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return c
+}
+
+func TestCheck(t *testing.T) {
+	c := checker([]string{"zen.example", "other.example", "refused.example", "down.example"}, map[string][]string{
+		"2.0.0.127.zen.example":      {"127.0.0.2", "127.0.0.10"},
+		"2.0.0.127.other.example":    {"192.0.2.1"},
+		"2.0.0.127.refused.example":  {"127.255.255.254"},
+		"10.2.0.192.refused.example": {"127.0.0.4"},
+	})
+
+	listed, err := c.Check(net.ParseIP("127.0.0.2"))
+	if len(listed) != 1 || listed[0].Zone != "zen.example" || len(listed[0].Codes) != 2 {
+		t.Errorf("unexpected listings %+v", listed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "refused.example") || !strings.Contains(err.Error(), "down.example") {
+		t.Errorf("expected errors for the refused and failed zones, got %v", err)
+	}
+
+	listed, _ = c.Check(net.ParseIP("192.0.2.10"))
+	if len(listed) != 1 || listed[0].Zone != "refused.example" {
+		t.Errorf("unexpected listings %+v", listed)
+	}
+	if listed, _ := c.Check(net.ParseIP("192.0.2.11")); len(listed) != 0 {
+		t.Errorf("expected no listings, got %+v", listed)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.99":  "99.2.0.192",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+	} {
+		if got := reverse(net.ParseIP(ip)); got != want {
+			t.Errorf("reverse(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
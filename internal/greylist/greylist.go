@@ -0,0 +1,217 @@
+// Package greylist implements greylisting: the first delivery attempt for
+// a (client network, sender, recipient) triplet is deferred, and a retry
+// after a delay is accepted. Legitimate servers retry; most spamware
+// does not.
+package greylist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options are the greylisting timings.
+type Options struct {
+	// Delay is how long after the first attempt a retry is accepted.
+	Delay time.Duration
+	// RetryWindow is how long the first attempt is remembered; a retry
+	// after it starts over.
+	RetryWindow time.Duration
+	// Expiry is how long a triplet that passed stays accepted without
+	// further mail.
+	Expiry time.Duration
+}
+
+// refreshInterval limits how often a passed triplet's last-seen time is
+// written to the file, so busy triplets don't grow it on every message.
+const refreshInterval = time.Hour
+
+type entry struct {
+	first  time.Time // first deferred attempt
+	last   time.Time // last accepted message, zero until passed
+	passed bool
+}
+
+// Store holds the known triplets, persisted as an append-only log with
+// one "seen" or "pass" record per line. The last record for a triplet
+// wins; Load compacts the file to the live entries.
+type Store struct {
+	path string
+	opts Options
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// Load reads the store at path, dropping expired triplets. A missing file
+// yields an empty store that is created on the first write.
+func Load(path string, opts Options) (*Store, error) {
+	return load(path, opts, time.Now)
+}
+
+func load(path string, opts Options, now func() time.Time) (*Store, error) {
+	s := &Store{path: path, opts: opts, now: now, entries: make(map[string]*entry)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("greylist: open %s: %w", path, err)
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 {
+			continue
+		}
+		unix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Unix(unix, 0)
+		key := strings.Join(fields[2:], " ")
+		switch fields[0] {
+		case "seen":
+			s.entries[key] = &entry{first: at}
+		case "pass":
+			s.entries[key] = &entry{last: at, passed: true}
+		}
+	}
+	err = scanner.Err()
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("greylist: read %s: %w", path, err)
+	}
+
+	for key, e := range s.entries {
+		if s.expired(e, s.now()) {
+			delete(s.entries, key)
+		}
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check reports whether a message from sender to rcpt, sent by a client
+// at ip, may be accepted. If not, it returns how long the client should
+// wait before retrying. A write error is returned along with the
+// decision, which stands.
+func (s *Store) Check(ip net.IP, sender, rcpt string) (bool, time.Duration, error) {
+	key := triplet(ip, sender, rcpt)
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if ok && s.expired(e, now) {
+		ok = false
+	}
+	switch {
+	case !ok:
+		s.entries[key] = &entry{first: now}
+		return false, s.opts.Delay, s.append("seen", now, key)
+	case e.passed:
+		if now.Sub(e.last) < refreshInterval {
+			return true, 0, nil
+		}
+		e.last = now
+		return true, 0, s.append("pass", now, key)
+	case now.Sub(e.first) < s.opts.Delay:
+		return false, s.opts.Delay - now.Sub(e.first), nil
+	}
+	*e = entry{last: now, passed: true}
+	return true, 0, s.append("pass", now, key)
+}
+
+// Len returns the number of live triplets.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *Store) expired(e *entry, now time.Time) bool {
+	if e.passed {
+		return now.Sub(e.last) > s.opts.Expiry
+	}
+	return now.Sub(e.first) > s.opts.RetryWindow
+}
+
+func (s *Store) append(state string, at time.Time, key string) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("greylist: open %s: %w", s.path, err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %d %s\n", state, at.Unix(), key); err != nil {
+		return fmt.Errorf("greylist: write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// compact rewrites the file with one record per live triplet, replacing
+// it atomically.
+func (s *Store) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".greylist-*")
+	if err != nil {
+		return fmt.Errorf("greylist: compact %s: %w", s.path, err)
+	}
+	w := bufio.NewWriter(tmp)
+	for key, e := range s.entries {
+		if e.passed {
+			fmt.Fprintf(w, "pass %d %s\n", e.last.Unix(), key)
+		} else {
+			fmt.Fprintf(w, "seen %d %s\n", e.first.Unix(), key)
+		}
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("greylist: compact %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// triplet returns the store key for a message: the client's /24 (IPv4)
+// or /64 (IPv6) network, since senders often retry from another host of
+// the same pool, and the lowercase addresses, "<>" for a null sender.
+func triplet(ip net.IP, sender, rcpt string) string {
+	network := ip.String()
+	if v4 := ip.To4(); v4 != nil {
+		network = v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	} else if v6 := ip.To16(); v6 != nil {
+		network = v6.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return network + " " + address(sender) + " " + address(rcpt)
+}
+
+// address normalizes an address for the store, whose records are split
+// on whitespace.
+func address(addr string) string {
+	addr = strings.ToLower(strings.Join(strings.Fields(addr), ""))
+	if addr = strings.Trim(addr, "<>"); addr == "" {
+		return "<>"
+	}
+	return addr
+}
@@ -0,0 +1,98 @@
+package greylist
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var opts = Options{Delay: 5 * time.Minute, RetryWindow: 24 * time.Hour, Expiry: 30 * 24 * time.Hour}
+
+func open(t *testing.T, path string, now *time.Time) *Store {
+	t.Helper()
+	s, err := load(path, opts, func() time.Time { return *now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist")
+	now := time.Unix(1700000000, 0)
+	s := open(t, path, &now)
+	ip := net.ParseIP("192.0.2.10")
+
+	if ok, wait, err := s.Check(ip, "App@Example.com", "user@example.org"); ok || wait != opts.Delay || err != nil {
+		t.Fatalf("expected the first attempt deferred for the delay, got %v %s %v", ok, wait, err)
+	}
+	now = now.Add(time.Minute)
+	if ok, wait, _ := s.Check(ip, "app@example.com", "user@example.org"); ok || wait != 4*time.Minute {
+		t.Fatalf("expected an early retry deferred for the rest of the delay, got %v %s", ok, wait)
+	}
+	now = now.Add(5 * time.Minute)
+	// Another host of the same /24
+	if ok, _, _ := s.Check(net.ParseIP("192.0.2.20"), "app@example.com", "user@example.org"); !ok {
+		t.Fatal("expected a retry after the delay accepted")
+	}
+	if ok, _, _ := s.Check(ip, "app@example.com", "other@example.org"); ok {
+		t.Error("expected a new recipient deferred")
+	}
+
+	// The file survives a restart
+	now = now.Add(25 * time.Hour)
+	s = open(t, path, &now)
+	if ok, _, _ := s.Check(ip, "app@example.com", "user@example.org"); !ok {
+		t.Error("expected the passed triplet accepted after reloading")
+	}
+	// The first attempt for other@ is past the retry window
+	if ok, _, _ := s.Check(ip, "app@example.com", "other@example.org"); ok {
+		t.Error("expected a retry after the window to start over")
+	}
+
+	now = now.Add(31 * 24 * time.Hour)
+	if ok, _, _ := s.Check(ip, "app@example.com", "user@example.org"); ok {
+		t.Error("expected an expired triplet deferred again")
+	}
+}
+
+func TestLoad_Compacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist")
+	now := time.Now()
+	log := strings.Join([]string{
+		"seen 100 192.0.2.0/24 old@example.com user@example.org",
+		"seen " + unix(now.Add(-time.Hour)) + " 192.0.2.0/24 app@example.com user@example.org",
+		"pass " + unix(now) + " 192.0.2.0/24 app@example.com user@example.org",
+		"garbage",
+	}, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(log), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := open(t, path, &now)
+	if s.Len() != 1 {
+		t.Errorf("expected one live triplet, got %d", s.Len())
+	}
+	data, _ := os.ReadFile(path)
+	if want := "pass " + unix(now) + " 192.0.2.0/24 app@example.com user@example.org\n"; string(data) != want {
+		t.Errorf("unexpected compacted file %q", data)
+	}
+}
+
+func TestTriplet(t *testing.T) {
+	for _, tc := range []struct{ ip, sender, want string }{
+		{"192.0.2.77", "<App@Example.com>", "192.0.2.0/24 app@example.com r@example.org"},
+		{"2001:db8:1:2:3::9", "", "2001:db8:1:2::/64 <> r@example.org"},
+	} {
+		if got := triplet(net.ParseIP(tc.ip), tc.sender, "r@example.org"); got != tc.want {
+			t.Errorf("triplet(%s, %q) = %q, want %q", tc.ip, tc.sender, got, tc.want)
+		}
+	}
+}
+
+func unix(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
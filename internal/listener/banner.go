@@ -0,0 +1,66 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"slices"
+)
+
+// WithBannerDomains wraps ln so that a connection to one of the local
+// addresses in byAddr is greeted with that address's domain instead of
+// domain, the one the server was configured with. The greeting is the
+// first thing the server writes: "220 <domain> ...".
+func WithBannerDomains(ln net.Listener, domain string, byAddr map[string]string) net.Listener {
+	return &bannerListener{Listener: ln, greeting: []byte("220 " + domain + " "), byAddr: byAddr}
+}
+
+type bannerListener struct {
+	net.Listener
+	greeting []byte
+	byAddr   map[string]string
+}
+
+func (l *bannerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	domain, ok := l.byAddr[localIP(conn)]
+	if !ok {
+		return conn, nil
+	}
+	return &bannerConn{Conn: conn, from: l.greeting, to: []byte("220 " + domain + " ")}, nil
+}
+
+// bannerConn replaces the domain in the greeting it writes first. The
+// server writes from one goroutine, so done needs no lock.
+type bannerConn struct {
+	net.Conn
+	done     bool
+	from, to []byte
+}
+
+func (c *bannerConn) Write(p []byte) (int, error) {
+	if c.done || !bytes.HasPrefix(p, c.from) {
+		c.done = true
+		return c.Conn.Write(p)
+	}
+	c.done = true
+	if _, err := c.Conn.Write(append(slices.Clip(c.to), p[len(c.from):]...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NetConn returns the wrapped connection.
+func (c *bannerConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// localIP returns the address conn was accepted on, without the port.
+func localIP(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,43 @@
+package listener
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestWithBannerDomains(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1": "220 mail.example.org ESMTP Service Ready\r\n",
+		"192.0.2.1": "220 localhost ESMTP Service Ready\r\n",
+	} {
+		ln, err := Listen("127.0.0.1:0", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bl := WithBannerDomains(ln, "localhost", map[string]string{addr: "mail.example.org"})
+		go func() {
+			conn, err := bl.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("220 localhost ESMTP Service Ready\r\n"))
+			conn.Write([]byte("220 localhost is not the greeting\r\n"))
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		if line, _ := r.ReadString('\n'); line != want {
+			t.Errorf("%s: expected greeting %q, got %q", addr, want, line)
+		}
+		if line, _ := r.ReadString('\n'); line != "220 localhost is not the greeting\r\n" {
+			t.Errorf("%s: expected later writes unchanged, got %q", addr, line)
+		}
+		conn.Close()
+		bl.Close()
+	}
+}
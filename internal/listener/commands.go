@@ -0,0 +1,62 @@
+package listener
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// errTooManyCommands is returned by SetReadDeadline on a connection that
+// has sent more commands than the limit.
+var errTooManyCommands = errors.New("too many commands")
+
+type limited struct {
+	net.Listener
+	max int
+}
+
+// WithCommandLimit wraps ln so that a client sending more than max SMTP
+// commands on one connection is disconnected. It counts the read
+// deadlines the server sets: go-smtp, with ReadTimeout set, sets one
+// before reading each command line, and a TLS connection passes it on to
+// the socket, so commands sent after STARTTLS are counted as well.
+// Message content sent with DATA or BDAT is read without a new deadline
+// and is not counted. Over the limit, SetReadDeadline fails, and go-smtp
+// answers 421 and closes the connection.
+func WithCommandLimit(ln net.Listener, max int) net.Listener {
+	return &limited{Listener: ln, max: max}
+}
+
+func (l *limited) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &commandConn{Conn: conn, max: l.max}, nil
+}
+
+// commandConn counts the commands the server reads from it.
+type commandConn struct {
+	net.Conn
+	max      int
+	commands int
+}
+
+// SetReadDeadline counts a command, unless t is zero, which clears the
+// deadline without reading one.
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		return c.Conn.SetReadDeadline(t)
+	}
+	if c.commands++; c.commands > c.max {
+		slog.Warn("command limit reached", "remote_ip", remoteIP(c.Conn), "limit", c.max)
+		return errTooManyCommands
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// NetConn returns the wrapped connection.
+func (c *commandConn) NetConn() net.Conn {
+	return c.Conn
+}
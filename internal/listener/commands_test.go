@@ -0,0 +1,48 @@
+package listener
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWithCommandLimit(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := WithCommandLimit(ln, 3)
+	defer cl.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := cl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	deadline := time.Now().Add(time.Minute)
+	for i := range 2 {
+		if err := server.SetReadDeadline(deadline); err != nil {
+			t.Fatalf("command %d: unexpected error: %v", i+1, err)
+		}
+	}
+	// Clearing the deadline does not read a command
+	if err := server.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// After STARTTLS the server sets deadlines through the TLS connection
+	tlsConn := tls.Server(server, &tls.Config{})
+	if err := tlsConn.SetReadDeadline(deadline); err != nil {
+		t.Fatalf("command 3: unexpected error: %v", err)
+	}
+	if err := tlsConn.SetReadDeadline(deadline); !errors.Is(err, errTooManyCommands) {
+		t.Errorf("expected errTooManyCommands for the fourth command, got %v", err)
+	}
+}
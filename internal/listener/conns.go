@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// tooManyConnectionsReply is written to clients over a connection cap.
+const tooManyConnectionsReply = "421 4.7.0 Too many connections, try again later\r\n"
+
+type capped struct {
+	net.Listener
+	max, perIP int
+	refused    func(ip string)
+
+	mu    sync.Mutex
+	conns int
+	byIP  map[string]int
+}
+
+// WithConnLimit wraps ln so that at most max connections, and at most
+// perIP from one address, are open at once (0 = no limit). A connection
+// counts from Accept until it is closed, whether or not the client ever
+// says EHLO. One over a cap is answered with 421 and closed right away;
+// refused, if not nil, is called with its address.
+func WithConnLimit(ln net.Listener, max, perIP int, refused func(ip string)) net.Listener {
+	return &capped{Listener: ln, max: max, perIP: perIP, refused: refused, byIP: make(map[string]int)}
+}
+
+func (l *capped) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn)
+		if l.acquire(ip) {
+			return &countedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		slog.Warn("connection limit reached", "remote_ip", ip)
+		if l.refused != nil {
+			l.refused(ip)
+		}
+		go func() {
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, _ = conn.Write([]byte(tooManyConnectionsReply))
+			conn.Close()
+		}()
+	}
+}
+
+// acquire reserves a slot for ip, reporting false when a cap is reached.
+func (l *capped) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.conns >= l.max {
+		return false
+	}
+	if l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return false
+	}
+	l.conns++
+	l.byIP[ip]++
+	return true
+}
+
+func (l *capped) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	if l.byIP[ip] <= 1 {
+		delete(l.byIP, ip)
+	} else {
+		l.byIP[ip]--
+	}
+}
+
+// countedConn gives its slot back when closed.
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *countedConn) NetConn() net.Conn {
+	return c.Conn
+}
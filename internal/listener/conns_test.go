@@ -0,0 +1,75 @@
+package listener
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// greetAndHold greets every connection and closes it once the client
+// hangs up, like a server waiting for EHLO.
+func greetAndHold(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.Write([]byte("220 ready\r\n"))
+			io.Copy(io.Discard, conn)
+		}()
+	}
+}
+
+func TestWithConnLimit(t *testing.T) {
+	for name, limits := range map[string][2]int{"global": {1, 0}, "per ip": {0, 1}} {
+		t.Run(name, func(t *testing.T) {
+			ln, err := Listen("127.0.0.1:0", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refused := make(chan string, 1)
+			cl := WithConnLimit(ln, limits[0], limits[1], func(ip string) { refused <- ip })
+			defer cl.Close()
+			go greetAndHold(cl)
+
+			greeting := func() string {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				return line
+			}
+			first, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line, _ := bufio.NewReader(first).ReadString('\n'); line != "220 ready\r\n" {
+				t.Fatalf("expected the first connection greeted, got %q", line)
+			}
+
+			// The first client never says EHLO and still holds its slot
+			if line := greeting(); line != tooManyConnectionsReply {
+				t.Errorf("expected 421 over the cap, got %q", line)
+			}
+			if ip := <-refused; ip != "127.0.0.1" {
+				t.Errorf("expected the refused address reported, got %q", ip)
+			}
+
+			first.Close()
+			deadline := time.Now().Add(2 * time.Second)
+			for greeting() != "220 ready\r\n" {
+				<-refused
+				if time.Now().After(deadline) {
+					t.Fatal("expected the slot freed once the connection closed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
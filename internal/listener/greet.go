@@ -0,0 +1,105 @@
+package listener
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// earlyTalkerReply is written to clients that send before the greeting.
+const earlyTalkerReply = "554 5.5.1 Protocol error: data sent before greeting\r\n"
+
+// accepted is a connection that passed the banner delay, or an error
+// from the wrapped listener.
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+type delayed struct {
+	net.Listener
+	delay time.Duration
+	ready chan accepted
+	done  chan struct{}
+	once  sync.Once
+}
+
+// WithBannerDelay wraps ln so that each accepted connection is held for
+// delay before being handed to the server, which then sends its greeting.
+// An SMTP client must wait for the greeting; one that sends anything
+// during the delay is almost certainly a bot, so it is answered with 554
+// and disconnected. Connections are screened concurrently, so a slow one
+// does not hold up the others.
+func WithBannerDelay(ln net.Listener, delay time.Duration) net.Listener {
+	d := &delayed{Listener: ln, delay: delay, ready: make(chan accepted), done: make(chan struct{})}
+	go d.acceptLoop()
+	return d
+}
+
+func (d *delayed) acceptLoop() {
+	for {
+		conn, err := d.Listener.Accept()
+		if err != nil {
+			select {
+			case d.ready <- accepted{err: err}:
+			case <-d.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Other errors (e.g. too many open files) are usually
+			// transient; the server backs off before accepting again
+			continue
+		}
+		go d.screen(conn)
+	}
+}
+
+// screen waits out the delay on conn and passes it on unless the client
+// talked early or hung up.
+func (d *delayed) screen(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(d.delay))
+	n, err := conn.Read(make([]byte, 1))
+	if n > 0 {
+		slog.Warn("early talker rejected", "remote_ip", remoteIP(conn))
+		_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write([]byte(earlyTalkerReply))
+		conn.Close()
+		return
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	select {
+	case d.ready <- accepted{conn: conn}:
+	case <-d.done:
+		conn.Close()
+	}
+}
+
+func (d *delayed) Accept() (net.Conn, error) {
+	select {
+	case a := <-d.ready:
+		return a.conn, a.err
+	case <-d.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (d *delayed) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return d.Listener.Close()
+}
+
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.RemoteAddr().String()
+}
@@ -0,0 +1,79 @@
+package listener
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWithBannerDelay(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const delay = 100 * time.Millisecond
+	dl := WithBannerDelay(ln, delay)
+	defer dl.Close()
+
+	go func() {
+		for {
+			conn, err := dl.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 ready\r\n"))
+			conn.Close()
+		}
+	}()
+
+	// A patient client gets the greeting after the delay
+	start := time.Now()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || line != "220 ready\r\n" {
+		t.Fatalf("expected the greeting, got %q (%v)", line, err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("greeting sent after %s, before the delay", elapsed)
+	}
+
+	// An early talker is rejected instead
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("EHLO bot\r\n"))
+	line, _ = bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if line != earlyTalkerReply {
+		t.Errorf("expected the early talker reply, got %q", line)
+	}
+}
+
+func TestWithBannerDelay_Close(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := WithBannerDelay(ln, time.Second)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := dl.Accept()
+		errCh <- err
+	}()
+	dl.Close()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+}
@@ -0,0 +1,32 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Listen opens a TCP listener on addr. When reusePort is true the socket is
+// created with SO_REUSEPORT so that a replacement process can bind the same
+// address while the current one drains in-flight sessions.
+func Listen(addr string, reusePort bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listener: listen on %s: %w", addr, err)
+	}
+	return ln, nil
+}
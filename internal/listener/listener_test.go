@@ -0,0 +1,44 @@
+package listener
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestListen_NoReusePortConflicts(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	// A second plain bind on the same address must fail
+	ln2, err := Listen(ln.Addr().String(), false)
+	if err == nil {
+		ln2.Close()
+		t.Fatal("expected bind conflict without SO_REUSEPORT")
+	}
+}
+
+func TestListen_ReusePortSharesAddress(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT not supported on windows")
+	}
+
+	ln, err := Listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	// The replacement process binds the same address while the old one is still open
+	ln2, err := Listen(ln.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("expected second listener to bind with SO_REUSEPORT, got %v", err)
+	}
+	defer ln2.Close()
+
+	if ln.Addr().String() != ln2.Addr().String() {
+		t.Errorf("expected same address, got %s and %s", ln.Addr(), ln2.Addr())
+	}
+}
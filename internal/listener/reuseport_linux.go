@@ -0,0 +1,13 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package listener
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT from <asm-generic/socket.h>; the frozen syscall
+// package does not export it on Linux.
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
@@ -0,0 +1,68 @@
+// Package mimepart locates the body parts of a multipart MIME body and
+// rewrites them in place, leaving the delimiters, preamble and epilogue
+// byte for byte as they were.
+package mimepart
+
+import "bytes"
+
+// Part locates one body part of a multipart body: Start is just after its
+// delimiter line, End at the CRLF preceding the next delimiter.
+type Part struct {
+	Start, End int
+}
+
+// Split finds the body parts delimited by boundary. Content after the
+// closing delimiter, or an unterminated final part, is left alone.
+func Split(content []byte, boundary string) []Part {
+	delim := []byte("--" + boundary)
+	var parts []Part
+	open := -1
+	for pos := 0; pos < len(content); {
+		lineEnd := bytes.Index(content[pos:], []byte("\r\n"))
+		if lineEnd == -1 {
+			lineEnd = len(content)
+		} else {
+			lineEnd += pos
+		}
+		line := content[pos:lineEnd]
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t")
+			closing := bytes.Equal(rest, []byte("--"))
+			if closing || len(rest) == 0 {
+				if open >= 0 && pos >= 2 {
+					parts = append(parts, Part{Start: open, End: pos - 2})
+				}
+				if closing {
+					return parts
+				}
+				open = min(lineEnd+2, len(content))
+			}
+		}
+		pos = lineEnd + 2
+	}
+	return parts
+}
+
+// Replace returns content with each of parts, which must be in order and
+// not overlap, replaced by what with returns for it. Parts need not come
+// from one Split: nested parts located against the same content work too.
+// The first error from with is returned.
+func Replace(content []byte, parts []Part, with func(p Part) ([]byte, error)) ([]byte, error) {
+	if len(parts) == 0 {
+		return content, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(content))
+	prev := 0
+	for _, p := range parts {
+		replacement, err := with(p)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(content[prev:p.Start])
+		buf.Write(replacement)
+		prev = p.End
+	}
+	buf.Write(content[prev:])
+	return buf.Bytes(), nil
+}
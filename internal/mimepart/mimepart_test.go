@@ -0,0 +1,48 @@
+package mimepart
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const body = "preamble\r\n" +
+	"--B\r\n" +
+	"Content-Type: text/plain\r\n\r\none\r\n" +
+	"--B \r\n" +
+	"\r\ntwo\r\n" +
+	"--B--\r\n" +
+	"epilogue\r\n"
+
+func TestSplit(t *testing.T) {
+	parts := Split([]byte(body), "B")
+	var got []string
+	for _, p := range parts {
+		got = append(got, body[p.Start:p.End])
+	}
+	if len(got) != 2 || got[0] != "Content-Type: text/plain\r\n\r\none" || got[1] != "\r\ntwo" {
+		t.Errorf("unexpected parts %q", got)
+	}
+	if parts := Split([]byte("--B\r\nunterminated\r\n"), "B"); len(parts) != 0 {
+		t.Errorf("expected an unterminated part left alone, got %v", parts)
+	}
+	if parts := Split([]byte(body), "other"); len(parts) != 0 {
+		t.Errorf("expected no parts for another boundary, got %v", parts)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	content := []byte(body)
+	out, err := Replace(content, Split(content, "B"), func(p Part) ([]byte, error) {
+		return bytes.ToUpper(content[p.Start:p.End]), nil
+	})
+	want := "preamble\r\n--B\r\nCONTENT-TYPE: TEXT/PLAIN\r\n\r\nONE\r\n--B \r\n\r\nTWO\r\n--B--\r\nepilogue\r\n"
+	if err != nil || string(out) != want {
+		t.Errorf("Replace = %q, %v; want %q", out, err, want)
+	}
+
+	failure := errors.New("cannot convert")
+	if _, err := Replace(content, Split(content, "B"), func(Part) ([]byte, error) { return nil, failure }); !errors.Is(err, failure) {
+		t.Errorf("expected the error returned, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Package redact keeps secrets out of the logs: a slog.Handler that
+// scrubs known secret values and SMTP AUTH arguments from every record
+// before passing it on, and optionally pseudonymizes email addresses.
+package redact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Mask replaces scrubbed text.
+const Mask = "[redacted]"
+
+// minSecretLen is the shortest secret scrubbed. Shorter values would mask
+// unrelated text all over the logs, and are too weak to protect anyway.
+const minSecretLen = 4
+
+// authArgs matches the initial response of an AUTH command. Mechanisms
+// are listed so that prose such as "auth refused without tls" is left
+// alone.
+var authArgs = regexp.MustCompile(`(?i)\b(AUTH\s+(?:PLAIN|LOGIN|XOAUTH2|OAUTHBEARER|CRAM-MD5|SCRAM-SHA-[0-9A-Z-]+|EXTERNAL|ANONYMOUS))\s+\S+`)
+
+// How email addresses are logged.
+const (
+	AddressesFull       = "full"
+	AddressesHash       = "hash"
+	AddressesDomainOnly = "domain-only"
+)
+
+// address matches an email address in free text, such as a transcript
+// line or an error.
+var address = regexp.MustCompile(`[A-Za-z0-9!#$%&'*+/=?^_\x60{|}~.-]+@([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+)`)
+
+// Address returns addr as it may be recorded under mode: unchanged with
+// full, a short SHA-256 of the lowercased address with hash, so that one
+// recipient's messages can be correlated, or only the domain with
+// domain-only.
+func Address(mode, addr string) string {
+	at := strings.LastIndex(addr, "@")
+	switch {
+	case mode == AddressesHash:
+		sum := sha256.Sum256([]byte(strings.ToLower(addr)))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case mode == AddressesDomainOnly && at >= 0:
+		return "*@" + strings.ToLower(addr[at+1:])
+	}
+	return addr
+}
+
+// Handler passes records to the wrapped handler with secrets masked in
+// the message and in attribute values, including errors and other values
+// that render as text.
+type Handler struct {
+	next      slog.Handler
+	secrets   *secretSet // shared with the handlers derived from this one
+	addresses string
+}
+
+// secretSet is the secrets a Handler masks.
+type secretSet struct {
+	mu       sync.Mutex
+	pairs    []string // old, new pairs for strings.NewReplacer
+	replacer atomic.Pointer[strings.Replacer]
+}
+
+func (s *secretSet) add(secrets []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, secret := range secrets {
+		if len(secret) < minSecretLen {
+			continue
+		}
+		s.pairs = append(s.pairs, secret, Mask, base64.StdEncoding.EncodeToString([]byte(secret)), Mask)
+	}
+	s.replacer.Store(strings.NewReplacer(s.pairs...))
+}
+
+// NewHandler wraps next, masking each secret, its base64 encoding (as
+// sent in SASL LOGIN) and AUTH command arguments, and rewriting email
+// addresses as Address does under the addresses mode.
+func NewHandler(next slog.Handler, secrets []string, addresses string) *Handler {
+	h := &Handler{next: next, secrets: new(secretSet), addresses: addresses}
+	h.secrets.add(secrets)
+	return h
+}
+
+// AddSecrets masks secrets as well, in h and the handlers derived from it
+// with WithAttrs and WithGroup, for credentials loaded after startup.
+// Secrets masked before stay masked.
+func (h *Handler) AddSecrets(secrets []string) {
+	h.secrets.add(secrets)
+}
+
+// String returns s with secrets and AUTH arguments masked and addresses
+// rewritten.
+func (h *Handler) String(s string) string {
+	s = h.secrets.replacer.Load().Replace(s)
+	s = authArgs.ReplaceAllString(s, "$1 "+Mask)
+	if h.addresses == AddressesHash || h.addresses == AddressesDomainOnly {
+		s = address.ReplaceAllStringFunc(s, func(addr string) string {
+			return Address(h.addresses, addr)
+		})
+	}
+	return s
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	clean := slog.NewRecord(r.Time, r.Level, h.String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		clean.AddAttrs(h.attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, clean)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = h.attr(a)
+	}
+	return &Handler{next: h.next.WithAttrs(clean), secrets: h.secrets, addresses: h.addresses}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), secrets: h.secrets, addresses: h.addresses}
+}
+
+func (h *Handler) attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.String(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		clean := make([]slog.Attr, len(group))
+		for i, g := range group {
+			clean[i] = h.attr(g)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(clean...)}
+	case slog.KindAny:
+		if list, ok := v.Any().([]string); ok {
+			clean := make([]string, len(list))
+			for i, item := range list {
+				clean[i] = h.String(item)
+			}
+			return slog.Any(a.Key, clean)
+		}
+		// Other values are only turned into text when that text needs masking,
+		// so lists and the like keep their form otherwise
+		text := fmt.Sprint(v.Any())
+		if masked := h.String(text); masked != text {
+			return slog.String(a.Key, masked)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
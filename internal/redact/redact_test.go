@@ -0,0 +1,95 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newLogger(buf *bytes.Buffer, secrets ...string) *slog.Logger {
+	return slog.New(NewHandler(slog.NewTextHandler(buf, nil), secrets, AddressesFull))
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, "hunter22", "\x00user\x00hunter22", "ab")
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00hunter22"))
+
+	log.Info("login with hunter22 failed",
+		"password", "hunter22",
+		"error", fmt.Errorf("dial: auth %s rejected", base64.StdEncoding.EncodeToString([]byte("hunter22"))),
+		slog.Group("upstream", "line", "AUTH PLAIN "+plain),
+		"client", "auth login dXNlcg==",
+		"tab", "ab",
+		"note", "auth refused without tls",
+	)
+	log.With("pass", "hunter22").WithGroup("g").Warn("retry", "blob", plain, "count", 3)
+
+	out := buf.String()
+	if strings.Contains(out, "hunter22") || strings.Contains(out, plain) || strings.Contains(out, "aHVudGVyMjI=") || strings.Contains(out, "dXNlcg==") {
+		t.Fatalf("secret leaked:\n%s", out)
+	}
+	for _, want := range []string{
+		`msg="login with [redacted] failed"`,
+		`password=[redacted]`,
+		`error="dial: auth [redacted] rejected"`,
+		`upstream.line="AUTH PLAIN [redacted]"`,
+		`client="auth login [redacted]"`,
+		`tab=ab`, // too short to be treated as a secret
+		`note="auth refused without tls"`,
+		`pass=[redacted]`,
+		`g.blob=[redacted]`,
+		`g.count=3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in:\n%s", want, out)
+		}
+	}
+}
+
+func TestHandler_AddSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewHandler(slog.NewTextHandler(&buf, nil), []string{"hunter22"}, AddressesFull)
+	derived := slog.New(h).With("component", "relay")
+
+	h.AddSecrets([]string{"rotated-pass"})
+	derived.Info("login", "old", "hunter22", "new", "rotated-pass")
+	if out := buf.String(); !strings.Contains(out, "old=[redacted] new=[redacted]") {
+		t.Errorf("expected old and added secrets masked in derived handlers, got %q", out)
+	}
+}
+
+func TestHandler_KeepsCleanValues(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, "hunter22")
+
+	log.Info("sent", "to", []string{"a@example.com", "b@example.com"}, "error", errors.New("connection refused"))
+	out := buf.String()
+	if !strings.Contains(out, `to="[a@example.com b@example.com]"`) || !strings.Contains(out, `error="connection refused"`) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestHandler_Addresses(t *testing.T) {
+	hash := Address(AddressesHash, "user@example.com")
+	if hash != Address(AddressesHash, "User@Example.COM") || !strings.HasPrefix(hash, "sha256:") || len(hash) != len("sha256:")+16 {
+		t.Fatalf("unexpected hash %q", hash)
+	}
+
+	for _, tc := range []struct{ mode, want string }{
+		{AddressesFull, `to="[user@example.com b@example.org]" line="RCPT TO:<user@example.com>"`},
+		{AddressesHash, `to="[` + hash + ` ` + Address(AddressesHash, "b@example.org") + `]" line="RCPT TO:<` + hash + `>"`},
+		{AddressesDomainOnly, `to="[*@example.com *@example.org]" line="RCPT TO:<*@example.com>"`},
+	} {
+		var buf bytes.Buffer
+		log := slog.New(NewHandler(slog.NewTextHandler(&buf, nil), nil, tc.mode))
+		log.Info("relayed", "to", []string{"user@example.com", "b@example.org"}, "line", "RCPT TO:<user@example.com>", "msg_id", "4f2a9c1b0d4e")
+		if out := buf.String(); !strings.Contains(out, tc.want) || !strings.Contains(out, "msg_id=4f2a9c1b0d4e") {
+			t.Errorf("%s: expected %s in:\n%s", tc.mode, tc.want, out)
+		}
+	}
+}
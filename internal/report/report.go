@@ -0,0 +1,127 @@
+// Package report builds the operator's daily summary email from the
+// accounting counters and schedules it.
+package report
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// topN is how many senders and recipient domains the report lists.
+const topN = 10
+
+// Summary is what a report covers: the accounting rows of one day (UTC)
+// and the messages in flight when it was built.
+type Summary struct {
+	Day      string
+	Rows     []accounting.Row
+	InFlight int
+}
+
+// Body renders s as the plain-text body of the report: the day's totals,
+// the senders and recipient domains with the most mail, and the domains
+// with failed or deferred recipients.
+func (s Summary) Body() string {
+	var t accounting.Counts
+	if total, _ := accounting.Rollup(s.Rows, nil); len(total) > 0 {
+		t = total[0].Counts
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Mail relayed on %s (UTC)\r\n\r\n", s.Day)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Sent\t%d\r\n", t.Sent)
+	fmt.Fprintf(w, "Deferred\t%d\r\n", t.Deferred)
+	fmt.Fprintf(w, "Failed\t%d\r\n", t.Failed)
+	fmt.Fprintf(w, "Bytes\t%d\r\n", t.Bytes)
+	fmt.Fprintf(w, "In flight now\t%d\r\n", s.InFlight)
+	w.Flush()
+
+	users, _ := accounting.Rollup(s.Rows, []string{"user"})
+	domains, _ := accounting.Rollup(s.Rows, []string{"domain"})
+	bySent := func(a, b accounting.Row) int { return cmp.Compare(b.Sent, a.Sent) }
+	slices.SortStableFunc(users, bySent)
+	slices.SortStableFunc(domains, bySent)
+	var failing []accounting.Row
+	for _, r := range domains {
+		if r.Failed > 0 || r.Deferred > 0 {
+			failing = append(failing, r)
+		}
+	}
+	slices.SortStableFunc(failing, func(a, b accounting.Row) int {
+		return cmp.Or(cmp.Compare(b.Failed, a.Failed), cmp.Compare(b.Deferred, a.Deferred))
+	})
+
+	table(&b, "Top senders", users, func(r accounting.Row) string { return r.User })
+	table(&b, "Top recipient domains", domains, func(r accounting.Row) string { return r.Domain })
+	table(&b, "Failures by recipient domain", failing, func(r accounting.Row) string { return r.Domain })
+	return b.String()
+}
+
+// table writes the first topN rows under title, each named by name.
+func table(b *strings.Builder, title string, rows []accounting.Row, name func(accounting.Row) string) {
+	fmt.Fprintf(b, "\r\n%s\r\n\r\n", title)
+	if len(rows) == 0 {
+		b.WriteString("None.\r\n")
+		return
+	}
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "\tSent\tDeferred\tFailed\tBytes\t\r\n")
+	for _, r := range rows[:min(len(rows), topN)] {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\r\n", name(r), r.Sent, r.Deferred, r.Failed, r.Bytes)
+	}
+	w.Flush()
+	if len(rows) > topN {
+		fmt.Fprintf(b, "... and %d more\r\n", len(rows)-topN)
+	}
+}
+
+// Message returns s as an email from from to recipients, naming host,
+// the proxy's SMTP_SERVER_DOMAIN, in the subject.
+func (s Summary) Message(from string, recipients []string, host string, now time.Time) []byte {
+	hostname, _ := os.Hostname()
+	return []byte("From: " + from + "\r\n" +
+		"To: " + strings.Join(recipients, ", ") + "\r\n" +
+		"Subject: smtp-proxy daily report for " + s.Day + " (" + host + ")\r\n" +
+		"Date: " + now.Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <report." + relay.NewID() + "@" + cmp.Or(hostname, host) + ">\r\n" +
+		"Auto-Submitted: auto-generated\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		s.Body())
+}
+
+// Next returns the first time after now that is at past a midnight UTC.
+func Next(now time.Time, at time.Duration) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(at)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Run calls send at each day's at past midnight UTC with the previous day
+// (YYYY-MM-DD) until ctx is done.
+func Run(ctx context.Context, at time.Duration, send func(day string)) {
+	for {
+		next := Next(time.Now(), at)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			send(next.AddDate(0, 0, -1).Format("2006-01-02"))
+		}
+	}
+}
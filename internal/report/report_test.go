@@ -0,0 +1,69 @@
+package report
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+)
+
+func TestNext(t *testing.T) {
+	at := 6 * time.Hour
+	for _, tc := range []struct{ now, want string }{
+		{"2026-10-16T05:00:00Z", "2026-10-16T06:00:00Z"},
+		{"2026-10-16T06:00:00Z", "2026-10-17T06:00:00Z"},
+		{"2026-10-16T23:30:00Z", "2026-10-17T06:00:00Z"},
+		{"2026-10-16T07:00:00+02:00", "2026-10-16T06:00:00Z"},
+	} {
+		now, _ := time.Parse(time.RFC3339, tc.now)
+		if got := Next(now, at).Format(time.RFC3339); got != tc.want {
+			t.Errorf("Next(%s) = %s, want %s", tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	rows := []accounting.Row{
+		{Day: "2026-10-15", User: "app", Domain: "gmail.com", Counts: accounting.Counts{Sent: 40, Bytes: 4000}},
+		{Day: "2026-10-15", User: "app", Domain: "example.com", Counts: accounting.Counts{Sent: 5, Failed: 2, Bytes: 500}},
+		{Day: "2026-10-15", User: "billing", Domain: "yahoo.com", Counts: accounting.Counts{Sent: 60, Deferred: 3, Bytes: 6000}},
+	}
+	for i := range 12 {
+		rows = append(rows, accounting.Row{Day: "2026-10-15", User: "app", Domain: fmt.Sprintf("d%d.example", i), Counts: accounting.Counts{Sent: 1}})
+	}
+	s := Summary{Day: "2026-10-15", Rows: rows, InFlight: 2}
+	msg, err := mail.ReadMessage(strings.NewReader(string(s.Message("relay@example.com", []string{"ops@example.com"}, "mx.example.com", time.Now()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != "smtp-proxy daily report for 2026-10-15 (mx.example.com)" {
+		t.Errorf("unexpected subject %q", got)
+	}
+	body := s.Body()
+	for _, want := range []string{
+		"Sent           117",
+		"Deferred       3",
+		"Failed         2",
+		"In flight now  2",
+		"... and 5 more",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the report:\n%s", want, body)
+		}
+	}
+	// Senders by volume, failing domains by failures
+	if strings.Index(body, "billing") > strings.Index(body, "app") {
+		t.Errorf("expected billing listed before app:\n%s", body)
+	}
+	failures := body[strings.Index(body, "Failures by recipient domain"):]
+	if !strings.Contains(failures, "example.com") || strings.Index(failures, "example.com") > strings.Index(failures, "yahoo.com") || strings.Contains(failures, "gmail.com") {
+		t.Errorf("expected example.com then yahoo.com under failures:\n%s", failures)
+	}
+
+	if body := (Summary{Day: "2026-10-15"}).Body(); !strings.Contains(body, "Sent           0") || strings.Count(body, "None.") != 3 {
+		t.Errorf("unexpected empty report:\n%s", body)
+	}
+}
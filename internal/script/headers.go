@@ -0,0 +1,93 @@
+package script
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+)
+
+// Headers returns the header fields of a CRLF message as seen by the hook:
+// lowercase names mapped to the first value of each field, unfolded.
+func Headers(msg []byte) map[string]string {
+	headers := make(map[string]string)
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end == -1 {
+		end = len(msg)
+	}
+	var name string
+	var value strings.Builder
+	flush := func() {
+		if name != "" {
+			if _, seen := headers[name]; !seen {
+				headers[name] = strings.TrimSpace(value.String())
+			}
+		}
+		name = ""
+		value.Reset()
+	}
+	for _, line := range strings.Split(string(msg[:end]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if name != "" {
+				value.WriteString(" ")
+				value.WriteString(strings.TrimSpace(line))
+			}
+			continue
+		}
+		flush()
+		n, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(n))
+		value.WriteString(v)
+	}
+	flush()
+	return headers
+}
+
+// Apply rewrites the header block of a CRLF message: fields named by
+// RemoveHeaders or SetHeaders are dropped, then SetHeaders are appended.
+func (d *Decision) Apply(msg []byte) []byte {
+	if len(d.SetHeaders) == 0 && len(d.RemoveHeaders) == 0 {
+		return msg
+	}
+	drop := make(map[string]bool)
+	for _, name := range d.RemoveHeaders {
+		drop[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	for _, h := range d.SetHeaders {
+		drop[textproto.CanonicalMIMEHeaderKey(h.Name)] = true
+	}
+
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	headerPart, body := msg, []byte("\r\n")
+	if end != -1 {
+		headerPart, body = msg[:end+2], msg[end+2:]
+	}
+
+	var out bytes.Buffer
+	skipping := false
+	for _, line := range bytes.SplitAfter(headerPart, []byte("\r\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = drop[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(string(name)))]
+		}
+		if !skipping {
+			out.Write(line)
+		}
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\r\n")) {
+		out.WriteString("\r\n")
+	}
+	for _, h := range d.SetHeaders {
+		out.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	out.Write(body)
+	return out.Bytes()
+}
@@ -0,0 +1,295 @@
+// Package script runs a user-supplied Starlark hook on every message, so
+// site-specific policy (rejecting, editing headers, rerouting) can live in
+// a file instead of a fork of the proxy.
+//
+// The script must define on_message(msg). msg has the fields id, sender,
+// recipients, user, remote_ip, size and headers (a dict from lowercase
+// field name to the first value of that field). The hook acts through
+// these builtins:
+//
+//	reject(code, message, enhanced="")  refuse the message (4xx or 5xx)
+//	set_header(name, value)             replace or add a header field
+//	remove_header(name)                 drop every field with that name
+//	reroute(recipients)                 relay to these addresses instead
+//
+// Returning without calling reject accepts the message.
+package script
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// maxSteps bounds the work one hook call may do, so a runaway loop fails
+// the message instead of hanging the session.
+const maxSteps = 1_000_000
+
+const decisionKey = "decision"
+
+// Message is the view of a message passed to the hook.
+type Message struct {
+	ID         string
+	Sender     string // client MAIL FROM
+	Recipients []string
+	Username   string
+	RemoteIP   string
+	Size       int
+	Headers    map[string]string // lowercase name -> first value
+}
+
+// Rejection is a refusal requested by the hook.
+type Rejection struct {
+	Code         int
+	EnhancedCode [3]int
+	Message      string
+}
+
+// Header is a header field set by the hook.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Decision collects what the hook asked for. The zero value accepts the
+// message unchanged.
+type Decision struct {
+	Reject        *Rejection
+	SetHeaders    []Header
+	RemoveHeaders []string
+	Recipients    []string // non-nil reroutes the message
+}
+
+// Hook is a loaded script. It is safe for concurrent use; a nil *Hook
+// accepts everything.
+type Hook struct {
+	path string
+	fn   *starlark.Function
+}
+
+// Load reads and initializes the script at path. Syntax errors, errors
+// while running top-level statements, and a missing or mistyped
+// on_message are reported here rather than on the first message.
+func Load(path string) (*Hook, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read script: %w", err)
+	}
+	thread := newThread(path)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, src, builtins)
+	if err != nil {
+		return nil, fmt.Errorf("load script %s: %w", path, errorDetail(err))
+	}
+	globals.Freeze()
+	fn, ok := globals["on_message"].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("load script %s: on_message(msg) is not defined", path)
+	}
+	if fn.NumParams() != 1 {
+		return nil, fmt.Errorf("load script %s: on_message must take exactly one parameter", path)
+	}
+	return &Hook{path: path, fn: fn}, nil
+}
+
+// Run calls on_message for m and returns the decision it made.
+func (h *Hook) Run(m *Message) (*Decision, error) {
+	d := &Decision{}
+	if h == nil {
+		return d, nil
+	}
+	thread := newThread(h.path)
+	thread.SetLocal(decisionKey, d)
+	if _, err := starlark.Call(thread, h.fn, starlark.Tuple{messageValue(m)}, nil); err != nil {
+		return nil, fmt.Errorf("script %s: %w", h.path, errorDetail(err))
+	}
+	return d, nil
+}
+
+func newThread(path string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: path,
+		Print: func(_ *starlark.Thread, msg string) {
+			slog.Info("script output", "script", path, "output", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxSteps)
+	return thread
+}
+
+// errorDetail includes the Starlark backtrace, which names the line that
+// failed.
+func errorDetail(err error) error {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("%s", evalErr.Backtrace())
+	}
+	return err
+}
+
+func messageValue(m *Message) starlark.Value {
+	recipients := make([]starlark.Value, len(m.Recipients))
+	for i, r := range m.Recipients {
+		recipients[i] = starlark.String(r)
+	}
+	headers := starlark.NewDict(len(m.Headers))
+	for name, value := range m.Headers {
+		_ = headers.SetKey(starlark.String(name), starlark.String(value))
+	}
+	v := starlarkstruct.FromStringDict(starlark.String("message"), starlark.StringDict{
+		"id":         starlark.String(m.ID),
+		"sender":     starlark.String(m.Sender),
+		"recipients": starlark.NewList(recipients),
+		"user":       starlark.String(m.Username),
+		"remote_ip":  starlark.String(m.RemoteIP),
+		"size":       starlark.MakeInt(m.Size),
+		"headers":    headers,
+	})
+	v.Freeze()
+	return v
+}
+
+var builtins = starlark.StringDict{
+	"reject":        starlark.NewBuiltin("reject", reject),
+	"set_header":    starlark.NewBuiltin("set_header", setHeader),
+	"remove_header": starlark.NewBuiltin("remove_header", removeHeader),
+	"reroute":       starlark.NewBuiltin("reroute", reroute),
+}
+
+// decision returns the decision being built by the current call. Builtins
+// called at load time, outside on_message, have none.
+func decision(thread *starlark.Thread, b *starlark.Builtin) (*Decision, error) {
+	d, ok := thread.Local(decisionKey).(*Decision)
+	if !ok {
+		return nil, fmt.Errorf("%s: only allowed inside on_message", b.Name())
+	}
+	return d, nil
+}
+
+func reject(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var code int
+	var message, enhanced string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "code", &code, "message", &message, "enhanced?", &enhanced); err != nil {
+		return nil, err
+	}
+	d, err := decision(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	if code < 400 || code > 599 {
+		return nil, fmt.Errorf("%s: code %d is not a 4xx or 5xx reply", b.Name(), code)
+	}
+	if strings.ContainsAny(message, "\r\n") {
+		return nil, fmt.Errorf("%s: message must be a single line", b.Name())
+	}
+	r := &Rejection{Code: code, EnhancedCode: [3]int{code / 100, 7, 1}, Message: message}
+	if enhanced != "" {
+		if r.EnhancedCode, err = parseEnhancedCode(enhanced, code/100); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+	d.Reject = r
+	return starlark.None, nil
+}
+
+// parseEnhancedCode parses an RFC 3463 status code such as "5.7.1" whose
+// class must match the reply code.
+func parseEnhancedCode(s string, class int) ([3]int, error) {
+	var code [3]int
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return code, fmt.Errorf("enhanced code %q: expected class.subject.detail", s)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 999 {
+			return code, fmt.Errorf("enhanced code %q: invalid number %q", s, p)
+		}
+		code[i] = n
+	}
+	if code[0] != class {
+		return code, fmt.Errorf("enhanced code %q does not match reply class %d", s, class)
+	}
+	return code, nil
+}
+
+func setHeader(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, value string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "value", &value); err != nil {
+		return nil, err
+	}
+	d, err := decision(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	if !validFieldName(name) {
+		return nil, fmt.Errorf("%s: invalid header name %q", b.Name(), name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return nil, fmt.Errorf("%s: value for %s must be a single line", b.Name(), name)
+	}
+	// A later set_header for the same field wins
+	d.SetHeaders = slices.DeleteFunc(d.SetHeaders, func(h Header) bool { return strings.EqualFold(h.Name, name) })
+	d.SetHeaders = append(d.SetHeaders, Header{Name: name, Value: value})
+	return starlark.None, nil
+}
+
+func removeHeader(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name); err != nil {
+		return nil, err
+	}
+	d, err := decision(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	if !validFieldName(name) {
+		return nil, fmt.Errorf("%s: invalid header name %q", b.Name(), name)
+	}
+	d.RemoveHeaders = append(d.RemoveHeaders, name)
+	return starlark.None, nil
+}
+
+func reroute(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var list *starlark.List
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "recipients", &list); err != nil {
+		return nil, err
+	}
+	d, err := decision(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	if list.Len() == 0 {
+		return nil, fmt.Errorf("%s: no recipients", b.Name())
+	}
+	recipients := make([]string, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		addr, ok := starlark.AsString(list.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("%s: recipient %d is %s, not a string", b.Name(), i, list.Index(i).Type())
+		}
+		if !strings.Contains(addr, "@") || strings.ContainsAny(addr, " \t\r\n<>") {
+			return nil, fmt.Errorf("%s: invalid address %q", b.Name(), addr)
+		}
+		recipients = append(recipients, addr)
+	}
+	d.Recipients = recipients
+	return starlark.None, nil
+}
+
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
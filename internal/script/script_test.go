@@ -0,0 +1,167 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeScript(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.star")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(t *testing.T, src string) *Hook {
+	t.Helper()
+	h, err := Load(writeScript(t, src))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return h
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"syntax", "def on_message(msg)\n", "want ':'"},
+		{"missing hook", "x = 1\n", "on_message(msg) is not defined"},
+		{"arity", "def on_message(a, b):\n    pass\n", "exactly one parameter"},
+		{"builtin at load", "reject(550, 'no')\n", "only allowed inside on_message"},
+	}
+	for _, tt := range tests {
+		_, err := Load(writeScript(t, tt.src))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.star")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestRun_NilHookAccepts(t *testing.T) {
+	var h *Hook
+	d, err := h.Run(&Message{})
+	if err != nil || d.Reject != nil || d.Recipients != nil {
+		t.Errorf("expected empty decision, got %+v, %v", d, err)
+	}
+}
+
+func TestRun_Reject(t *testing.T) {
+	h := load(t, `
+def on_message(msg):
+    if msg.headers.get("subject", "").startswith("[spam]"):
+        reject(554, "Spam not accepted", enhanced="5.7.0")
+    if msg.user == "intern":
+        reject(450, "Try later")
+`)
+	d, err := h.Run(&Message{Headers: map[string]string{"subject": "[spam] offer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := d.Reject; r == nil || r.Code != 554 || r.EnhancedCode != [3]int{5, 7, 0} || r.Message != "Spam not accepted" {
+		t.Errorf("unexpected rejection %+v", d.Reject)
+	}
+
+	d, _ = h.Run(&Message{Username: "intern"})
+	if r := d.Reject; r == nil || r.EnhancedCode != [3]int{4, 7, 1} {
+		t.Errorf("expected default enhanced code 4.7.1, got %+v", d.Reject)
+	}
+
+	d, _ = h.Run(&Message{Username: "ops"})
+	if d.Reject != nil {
+		t.Errorf("expected accept, got %+v", d.Reject)
+	}
+}
+
+func TestRun_InvalidReject(t *testing.T) {
+	for _, call := range []string{`reject(250, "ok")`, `reject(550, "no", enhanced="4.7.1")`, `reject(550, "a\nb")`} {
+		h := load(t, "def on_message(msg):\n    "+call+"\n")
+		if _, err := h.Run(&Message{}); err == nil {
+			t.Errorf("%s: expected error", call)
+		}
+	}
+}
+
+func TestRun_HeadersAndReroute(t *testing.T) {
+	h := load(t, `
+def on_message(msg):
+    remove_header("X-Internal")
+    set_header("X-Route", "first")
+    set_header("x-route", msg.id)
+    if len(msg.recipients) > 1:
+        reroute(["archive@example.com"])
+`)
+	d, err := h.Run(&Message{ID: "abc", Recipients: []string{"a@example.com", "b@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.SetHeaders) != 1 || d.SetHeaders[0] != (Header{Name: "x-route", Value: "abc"}) {
+		t.Errorf("expected last set_header to win, got %+v", d.SetHeaders)
+	}
+	if len(d.RemoveHeaders) != 1 || d.RemoveHeaders[0] != "X-Internal" {
+		t.Errorf("unexpected removals %v", d.RemoveHeaders)
+	}
+	if len(d.Recipients) != 1 || d.Recipients[0] != "archive@example.com" {
+		t.Errorf("unexpected reroute %v", d.Recipients)
+	}
+
+	for _, call := range []string{`set_header("Bad Name", "x")`, `set_header("X-A", "a\r\nBcc: x")`, `reroute([])`, `reroute(["nobody"])`} {
+		h := load(t, "def on_message(msg):\n    "+call+"\n")
+		if _, err := h.Run(&Message{}); err == nil {
+			t.Errorf("%s: expected error", call)
+		}
+	}
+}
+
+func TestRun_StepLimit(t *testing.T) {
+	h := load(t, `
+def on_message(msg):
+    n = 0
+    for i in range(100000000):
+        n += i
+`)
+	if _, err := h.Run(&Message{}); err == nil {
+		t.Error("expected runaway script to be cancelled")
+	}
+}
+
+func TestRun_MessageIsFrozen(t *testing.T) {
+	h := load(t, `
+def on_message(msg):
+    msg.recipients.append("extra@example.com")
+`)
+	if _, err := h.Run(&Message{Recipients: []string{"a@example.com"}}); err == nil {
+		t.Error("expected error modifying the message view")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	msg := []byte("Subject: Hello\r\n world\r\nX-Tag: one\r\nX-Tag: two\r\n\r\nBody: not a header\r\n")
+	h := Headers(msg)
+	if h["subject"] != "Hello world" || h["x-tag"] != "one" || len(h) != 2 {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestDecision_Apply(t *testing.T) {
+	msg := []byte("Subject: Hi\r\nX-Internal: a\r\n b\r\nX-Route: old\r\nTo: x@example.com\r\n\r\nBody\r\n")
+	d := &Decision{
+		SetHeaders:    []Header{{Name: "X-Route", Value: "new"}},
+		RemoveHeaders: []string{"x-internal"},
+	}
+	want := "Subject: Hi\r\nTo: x@example.com\r\nX-Route: new\r\n\r\nBody\r\n"
+	if got := string(d.Apply(msg)); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if got := (&Decision{}).Apply(msg); string(got) != string(msg) {
+		t.Error("empty decision should leave the message unchanged")
+	}
+}
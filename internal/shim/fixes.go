@@ -0,0 +1,127 @@
+package shim
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// foldContinuations indents header lines that are neither a new field nor
+// folded, turning them back into continuations of the previous field.
+func foldContinuations(raw []byte) []byte {
+	header, rest := splitHeader(raw)
+	if len(header) == 0 {
+		return raw
+	}
+	lines, crlf := headerLines(header)
+	changed := false
+	for i, line := range lines {
+		if i == 0 || len(line) == 0 || line[0] == ' ' || line[0] == '\t' || isFieldStart(line) {
+			continue
+		}
+		lines[i] = append([]byte(" "), line...)
+		changed = true
+	}
+	if !changed {
+		return raw
+	}
+	return append(joinLines(lines, crlf), rest...)
+}
+
+// addressFields hold address lists whose display names may need encoding.
+var addressFields = map[string]bool{
+	"from":     true,
+	"to":       true,
+	"cc":       true,
+	"reply-to": true,
+	"sender":   true,
+}
+
+// encodeHeaders rewrites raw 8-bit text in Subject and address display
+// names as RFC 2047 encoded-words. Text that is not valid UTF-8 is taken
+// to be ISO-8859-1, the usual culprit.
+func encodeHeaders(raw []byte) []byte {
+	header, rest := splitHeader(raw)
+	if len(header) == 0 {
+		return raw
+	}
+	lines, crlf := headerLines(header)
+
+	var out [][]byte
+	changed := false
+	for i := 0; i < len(lines); i++ {
+		// Gather the field with its continuation lines
+		start := i
+		field := slices.Clone(lines[i])
+		for i+1 < len(lines) && len(lines[i+1]) > 0 && (lines[i+1][0] == ' ' || lines[i+1][0] == '\t') {
+			i++
+			field = append(append(field, ' '), bytes.TrimLeft(lines[i], " \t")...)
+		}
+		if encoded, ok := encodeField(field); ok {
+			out = append(out, encoded)
+			changed = true
+			continue
+		}
+		// Keep untouched fields exactly as they were, folding included
+		out = append(out, lines[start:i+1]...)
+	}
+	if !changed {
+		return raw
+	}
+	return append(joinLines(out, crlf), rest...)
+}
+
+// encodeField returns field with 8-bit text encoded, or false if it needs
+// no change or cannot be handled.
+func encodeField(field []byte) ([]byte, bool) {
+	if isASCII(field) {
+		return nil, false
+	}
+	name, value, ok := bytes.Cut(field, []byte(":"))
+	if !ok {
+		return nil, false
+	}
+	text := toUTF8(bytes.TrimSpace(value))
+	key := strings.ToLower(string(bytes.TrimSpace(name)))
+
+	switch {
+	case key == "subject":
+		return []byte(string(name) + ": " + mime.QEncoding.Encode("utf-8", text)), true
+	case addressFields[key]:
+		addrs, err := mail.ParseAddressList(text)
+		if err != nil {
+			return nil, false
+		}
+		parts := make([]string, len(addrs))
+		for i, a := range addrs {
+			parts[i] = a.String() // encodes non-ASCII display names
+		}
+		return []byte(string(name) + ": " + strings.Join(parts, ", ")), true
+	}
+	return nil, false
+}
+
+// toUTF8 returns b as UTF-8, converting from ISO-8859-1 when b is not
+// already valid UTF-8.
+func toUTF8(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
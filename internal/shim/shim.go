@@ -0,0 +1,144 @@
+// Package shim applies targeted compatibility fixes to messages from
+// clients known to misbehave, identified by their EHLO hostname, so one
+// broken appliance does not force lenient handling for every client.
+package shim
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// fixes maps shim names to the message rewrite each one performs.
+var fixes = map[string]func(raw []byte) []byte{
+	// Devices that wrap long headers without indenting the continuation
+	"fold-continuations": foldContinuations,
+	// Clients (old PHPMailer among them) that put raw 8-bit text in headers
+	"encode-headers": encodeHeaders,
+}
+
+// Rule enables shims for clients whose EHLO hostname matches Pattern, a
+// case-insensitive glob as in path.Match.
+type Rule struct {
+	Pattern string
+	Shims   []string
+}
+
+// ParseRules parses "pattern=shim+shim,pattern=shim".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, names, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("entry %q: expected pattern=shim[+shim]", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("entry %q: invalid pattern", entry)
+		}
+		rule := Rule{Pattern: pattern}
+		for _, name := range strings.Split(names, "+") {
+			name = strings.TrimSpace(name)
+			if fixes[name] == nil {
+				return nil, fmt.Errorf("entry %q: unknown shim %q (must be one of %s)", entry, name, strings.Join(Names(), ", "))
+			}
+			rule.Shims = append(rule.Shims, name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Names returns the available shim names, sorted.
+func Names() []string {
+	names := make([]string, 0, len(fixes))
+	for name := range fixes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Set is the shims enabled for one client, in the order they apply.
+type Set []string
+
+// Match returns the shims of every rule matching the EHLO hostname, without
+// duplicates. It returns nil when none match.
+func Match(rules []Rule, ehlo string) Set {
+	ehlo = strings.ToLower(ehlo)
+	var set Set
+	for _, r := range rules {
+		if ok, _ := path.Match(r.Pattern, ehlo); !ok {
+			continue
+		}
+		for _, name := range r.Shims {
+			if !slices.Contains(set, name) {
+				set = append(set, name)
+			}
+		}
+	}
+	return set
+}
+
+// Apply runs each shim over raw in order.
+func (s Set) Apply(raw []byte) []byte {
+	for _, name := range s {
+		raw = fixes[name](raw)
+	}
+	return raw
+}
+
+// splitHeader returns the header block and the rest of the message
+// (starting with the blank line), accepting LF or CRLF line endings.
+func splitHeader(raw []byte) (header, rest []byte) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end == -1 {
+			return raw, nil
+		}
+		line := bytes.TrimSuffix(raw[i:i+end], []byte("\r"))
+		if len(line) == 0 {
+			return raw[:i], raw[i:]
+		}
+		i += end + 1
+	}
+	return raw, nil
+}
+
+// headerLines splits a header block into lines without their endings,
+// reporting whether it used CRLF.
+func headerLines(header []byte) (lines [][]byte, crlf bool) {
+	crlf = bytes.Contains(header, []byte("\r\n"))
+	header = bytes.ReplaceAll(header, []byte("\r\n"), []byte("\n"))
+	header = bytes.TrimSuffix(header, []byte("\n"))
+	return bytes.Split(header, []byte("\n")), crlf
+}
+
+func joinLines(lines [][]byte, crlf bool) []byte {
+	sep := []byte("\n")
+	if crlf {
+		sep = []byte("\r\n")
+	}
+	out := bytes.Join(lines, sep)
+	return append(out, sep...)
+}
+
+// isFieldStart reports whether line begins a header field ("Name:").
+func isFieldStart(line []byte) bool {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return false
+	}
+	for _, c := range line[:colon] {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package shim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("printer-*.local=fold-continuations, PHPMAILER*=encode-headers+fold-continuations")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 2 || rules[1].Pattern != "phpmailer*" || len(rules[1].Shims) != 2 {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	for _, bad := range []string{"printer=", "=fold-continuations", "printer=unknown", "[=fold-continuations"} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{Pattern: "printer-*", Shims: []string{"fold-continuations"}},
+		{Pattern: "*", Shims: []string{"encode-headers", "fold-continuations"}},
+	}
+	set := Match(rules, "Printer-3F")
+	if len(set) != 2 || set[0] != "fold-continuations" || set[1] != "encode-headers" {
+		t.Errorf("expected deduplicated shims in rule order, got %v", set)
+	}
+	if set := Match(rules[:1], "mail.example.com"); set != nil {
+		t.Errorf("expected no shims, got %v", set)
+	}
+}
+
+func TestFoldContinuations(t *testing.T) {
+	raw := "Subject: A very long subject that the device\r\nwrapped without indenting\r\nFrom: dev@example.com\r\n\r\nbody line\r\nno colon here\r\n"
+	got := string(Set{"fold-continuations"}.Apply([]byte(raw)))
+	want := "Subject: A very long subject that the device\r\n wrapped without indenting\r\nFrom: dev@example.com\r\n\r\nbody line\r\nno colon here\r\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	clean := "Subject: Fine\r\n\tfolded\r\n\r\nBody"
+	if got := string(Set{"fold-continuations"}.Apply([]byte(clean))); got != clean {
+		t.Errorf("expected well-formed message unchanged, got %q", got)
+	}
+}
+
+func TestEncodeHeaders(t *testing.T) {
+	raw := "From: Jos\xe9 <jose@example.com>\nSubject: Caf\xc3\xa9\n menu\nTo: plain@example.com\n\nBody \xe9\n"
+	got := string(Set{"encode-headers"}.Apply([]byte(raw)))
+
+	if !strings.Contains(got, "From: =?utf-8?q?Jos=C3=A9?= <jose@example.com>\n") {
+		t.Errorf("expected Latin-1 display name encoded, got %q", got)
+	}
+	if !strings.Contains(got, "Subject: =?utf-8?q?Caf=C3=A9_menu?=\n") {
+		t.Errorf("expected folded UTF-8 subject encoded, got %q", got)
+	}
+	if !strings.Contains(got, "To: plain@example.com\n\nBody \xe9\n") {
+		t.Errorf("expected ASCII fields and body untouched, got %q", got)
+	}
+}
@@ -0,0 +1,30 @@
+package sigv4
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// post-x-www-form-urlencoded from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodPost, "https://example.amazonaws.com/", strings.NewReader("Param1=value1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	when := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	Sign(req, []byte("Param1=value1"), "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", when)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	req.Header.Set("X-Amz-Security-Token", "session")
+	Sign(req, []byte("Param1=value1"), "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", when)
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target,") {
+		t.Errorf("expected the x-amz headers signed, got %s", got)
+	}
+}
@@ -0,0 +1,157 @@
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// The CMS (RFC 5652) structures needed for a detached SignedData with one
+// signer.
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signedDataContent struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+var sha256Algorithm = algorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+// signedData returns the DER encoded ContentInfo of a detached SignedData
+// over content, signed by id at signingTime.
+func signedData(id *identity, content []byte, signingTime time.Time) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	attrs, err := signedAttributes(digest[:], signingTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the attributes with their universal SET tag,
+	// not the [0] IMPLICIT tag they carry in SignerInfo.
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	attrDigest := sha256.Sum256(set)
+	sigAlg := algorithmIdentifier{Algorithm: oidECDSASHA256}
+	if _, ok := id.key.(*rsa.PrivateKey); ok {
+		sigAlg = algorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	}
+	sig, err := id.key.Sign(rand.Reader, attrDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("smime sign: %w", err)
+	}
+
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{id.cert}, id.chain...) {
+		certs = append(certs, c.Raw...)
+	}
+	sd := signedDataContent{
+		Version:          1,
+		DigestAlgorithms: []algorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: encapContentInfo{EContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: id.cert.RawIssuer}, Serial: id.cert.SerialNumber},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          sig,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	out, err := asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}})
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	return out, nil
+}
+
+// signedAttributes returns the encoded content-type, signing-time and
+// message-digest attributes in DER SET OF order, without the SET header.
+func signedAttributes(digest []byte, signingTime time.Time) ([]byte, error) {
+	contentType, err := asn1.Marshal(oidData)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	when, err := asn1.Marshal(signingTime.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	sum, err := asn1.Marshal(digest)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	var encoded [][]byte
+	for _, a := range []attribute{
+		{Type: oidContentType, Values: []asn1.RawValue{{FullBytes: contentType}}},
+		{Type: oidSigningTime, Values: []asn1.RawValue{{FullBytes: when}}},
+		{Type: oidMessageDigest, Values: []asn1.RawValue{{FullBytes: sum}}},
+	} {
+		attr, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, fmt.Errorf("smime: %w", err)
+		}
+		encoded = append(encoded, attr)
+	}
+	slices.SortFunc(encoded, bytes.Compare)
+	return bytes.Join(encoded, nil), nil
+}
@@ -0,0 +1,274 @@
+// Package smime signs outbound messages with S/MIME (RFC 8551), so
+// recipients can verify that a message passed through the relay. Each
+// sending identity has its own certificate and key; the identity is the
+// address in the message's From header.
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// ErrNoIdentity is returned by Sign when no certificate covers the
+// message's From address.
+var ErrNoIdentity = errors.New("smime: no certificate for sender")
+
+// identity is a signing certificate, its private key and the intermediate
+// certificates sent along so recipients can build the chain.
+type identity struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.Signer
+}
+
+// Signer signs messages with the identity matching their From address.
+type Signer struct {
+	identities map[string]*identity // lowercase address -> identity
+
+	now func() time.Time
+}
+
+// New creates a signer from cfg, or returns nil when no key file is
+// configured. Each file holds a PEM certificate, optionally followed by
+// intermediates, and its RSA or ECDSA private key. A certificate signs for
+// every email address in its subject alternative names.
+func New(cfg *config.Config) (*Signer, error) {
+	if len(cfg.SMIMEKeyFiles) == 0 {
+		return nil, nil
+	}
+	s := &Signer{identities: make(map[string]*identity), now: time.Now}
+	for _, path := range cfg.SMIMEKeyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("smime key: %w", err)
+		}
+		id, err := parseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("smime key %s: %w", path, err)
+		}
+		if err := s.add(id); err != nil {
+			return nil, fmt.Errorf("smime key %s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *Signer) add(id *identity) error {
+	if len(id.cert.EmailAddresses) == 0 {
+		return errors.New("certificate has no email address")
+	}
+	for _, addr := range id.cert.EmailAddresses {
+		addr = strings.ToLower(addr)
+		if _, dup := s.identities[addr]; dup {
+			return fmt.Errorf("duplicate certificate for %s", addr)
+		}
+		s.identities[addr] = id
+	}
+	return nil
+}
+
+func parseIdentity(data []byte) (*identity, error) {
+	id := &identity{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse certificate: %w", err)
+			}
+			if id.cert == nil {
+				id.cert = cert
+			} else {
+				id.chain = append(id.chain, cert)
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			key, err := parseKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			id.key = key
+		}
+	}
+	if id.cert == nil {
+		return nil, errors.New("no certificate found")
+	}
+	if id.key == nil {
+		return nil, errors.New("no private key found")
+	}
+	switch pub := id.cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if k, ok := id.key.(*rsa.PrivateKey); !ok || !k.PublicKey.Equal(pub) {
+			return nil, errors.New("private key does not match certificate")
+		}
+	case *ecdsa.PublicKey:
+		if k, ok := id.key.(*ecdsa.PrivateKey); !ok || !k.PublicKey.Equal(pub) {
+			return nil, errors.New("private key does not match certificate")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return id, nil
+}
+
+func parseKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// Sign wraps msg in a multipart/signed entity signed by the identity of
+// its From address. The Content-* header fields move into the signed part;
+// every other field stays on the outer message. msg must already be in
+// its final form: any later change breaks the signature.
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	header, body := splitMessage(msg)
+	id, err := s.identityFor(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var outer, inner []byte
+	hasMIMEVersion := false
+	for _, f := range header {
+		name, _, _ := strings.Cut(f, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case strings.HasPrefix(name, "content-"):
+			inner = append(inner, f...)
+		case name == "mime-version":
+			hasMIMEVersion = true
+			outer = append(outer, f...)
+		default:
+			outer = append(outer, f...)
+		}
+	}
+	if len(inner) == 0 {
+		inner = []byte("Content-Type: text/plain; charset=us-ascii\r\n")
+	}
+	inner = append(inner, "\r\n"...)
+	inner = canonical(append(inner, body...))
+
+	sig, err := signedData(id, inner, s.now())
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := newBoundary()
+	var b bytes.Buffer
+	b.Write(outer)
+	if !hasMIMEVersion {
+		b.WriteString("MIME-Version: 1.0\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\r\n micalg=sha-256; boundary=\"%s\"\r\n\r\n", boundary)
+	b.WriteString("This is a cryptographically signed message in MIME format.\r\n\r\n")
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.Write(inner)
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	enc := base64.StdEncoding.EncodeToString(sig)
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc + "\r\n")
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// identityFor returns the identity of the first From address.
+func (s *Signer) identityFor(header []string) (*identity, error) {
+	for _, f := range header {
+		name, value, _ := strings.Cut(f, ":")
+		if !strings.EqualFold(strings.TrimSpace(name), "from") {
+			continue
+		}
+		value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil || len(addrs) == 0 {
+			return nil, fmt.Errorf("smime: invalid From header: %q", strings.TrimSpace(value))
+		}
+		if id, ok := s.identities[strings.ToLower(addrs[0].Address)]; ok {
+			return id, nil
+		}
+		return nil, fmt.Errorf("%w %s", ErrNoIdentity, addrs[0].Address)
+	}
+	return nil, fmt.Errorf("%w: no From header", ErrNoIdentity)
+}
+
+// splitMessage separates msg into header fields, each with its folded
+// continuation lines and line ending, and the body.
+func splitMessage(msg []byte) ([]string, []byte) {
+	var fields []string
+	rest := msg
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		rest = rest[end:]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, rest
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += string(line)
+			continue
+		}
+		fields = append(fields, string(line))
+	}
+	return fields, nil
+}
+
+// canonical converts bare LF line endings to CRLF, as the signed content
+// must be in canonical form (RFC 8551 section 3.1.1).
+func canonical(entity []byte) []byte {
+	var b bytes.Buffer
+	b.Grow(len(entity))
+	for i, c := range entity {
+		if c == '\n' && (i == 0 || entity[i-1] != '\r') {
+			b.WriteByte('\r')
+		}
+		b.WriteByte(c)
+	}
+	return b.Bytes()
+}
+
+func newBoundary() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return "----=_smime_" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,228 @@
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+const message = "From: App <App@example.com>\r\n" +
+	"To: user@example.org\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: 7bit\r\n" +
+	"\r\n" +
+	"Hello,\r\nthe report is attached.\r\n"
+
+// newIdentity returns a self-signed certificate for addr with its key in
+// PEM form.
+func newIdentity(t *testing.T, addr string, ec bool) []byte {
+	t.Helper()
+	var key crypto.Signer
+	var keyDER []byte
+	var err error
+	if ec {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		key = k
+		keyDER, err = x509.MarshalPKCS8PrivateKey(k)
+	} else {
+		k, _ := rsa.GenerateKey(rand.Reader, 2048)
+		key = k
+		keyDER = x509.MarshalPKCS1PrivateKey(k)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: addr},
+		EmailAddresses: []string{addr},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+}
+
+func newSigner(t *testing.T, files ...[]byte) *Signer {
+	t.Helper()
+	cfg := &config.Config{}
+	for i, data := range files {
+		path := filepath.Join(t.TempDir(), "id"+string(rune('a'+i))+".pem")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg.SMIMEKeyFiles = append(cfg.SMIMEKeyFiles, path)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// verify checks the detached signature in signed and returns the signed
+// part.
+func verify(t *testing.T, signed []byte) string {
+	t.Helper()
+	header, body := splitMessage(signed)
+	var boundary string
+	for _, f := range header {
+		if name, value, _ := strings.Cut(f, ":"); strings.EqualFold(name, "content-type") {
+			mediaType, params, err := mime.ParseMediaType(strings.ReplaceAll(value, "\r\n", ""))
+			if err != nil || mediaType != "multipart/signed" || params["micalg"] != "sha-256" {
+				t.Fatalf("unexpected Content-Type %q", value)
+			}
+			boundary = params["boundary"]
+		}
+	}
+	// Preamble, signed part, signature, closing delimiter
+	parts := strings.Split(string(body), "\r\n--"+boundary)
+	if len(parts) != 4 || !strings.HasPrefix(parts[3], "--") {
+		t.Fatalf("expected two parts, got %q", body)
+	}
+	content := strings.TrimPrefix(parts[1], "\r\n")
+	_, sigPart := splitMessage([]byte(strings.TrimPrefix(parts[2], "\r\n")))
+	der, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(sigPart), "\r\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("bad ContentInfo: %v", err)
+	}
+	var sd signedDataContent
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("bad SignedData: %v", err)
+	}
+	cert, err := x509.ParseCertificate(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := sd.SignerInfos[0]
+	if si.SID.Serial.Cmp(cert.SerialNumber) != 0 {
+		t.Error("signer does not identify the certificate")
+	}
+
+	rest := si.SignedAttrs.Bytes
+	digest := sha256.Sum256([]byte(content))
+	found := false
+	for len(rest) > 0 {
+		var a attribute
+		if rest, err = asn1.Unmarshal(rest, &a); err != nil {
+			t.Fatal(err)
+		}
+		if a.Type.Equal(oidMessageDigest) {
+			var got []byte
+			_, _ = asn1.Unmarshal(a.Values[0].FullBytes, &got)
+			found = bytes.Equal(got, digest[:])
+		}
+	}
+	if !found {
+		t.Fatal("message digest attribute does not match the signed part")
+	}
+	set, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	alg := x509.SHA256WithRSA
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); ok {
+		alg = x509.ECDSAWithSHA256
+	}
+	if err := cert.CheckSignature(alg, set, si.Signature); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	return content
+}
+
+func TestSign(t *testing.T) {
+	for _, ec := range []bool{false, true} {
+		s := newSigner(t, newIdentity(t, "app@example.com", ec))
+		signed, err := s.Sign([]byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := verify(t, signed)
+		if content != "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 7bit\r\n\r\nHello,\r\nthe report is attached.\r\n" {
+			t.Errorf("unexpected signed part %q", content)
+		}
+		if !strings.HasPrefix(string(signed), "From: App <App@example.com>\r\nTo: user@example.org\r\nSubject: Report\r\nMIME-Version: 1.0\r\nContent-Type: multipart/signed;") {
+			t.Errorf("unexpected outer header:\n%s", signed)
+		}
+	}
+}
+
+func TestSign_Canonicalizes(t *testing.T) {
+	s := newSigner(t, newIdentity(t, "app@example.com", true))
+	signed, err := s.Sign([]byte("From: app@example.com\nSubject: Hi\n\nline one\nline two\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := verify(t, signed); content != "Content-Type: text/plain; charset=us-ascii\r\n\r\nline one\r\nline two\r\n" {
+		t.Errorf("unexpected signed part %q", content)
+	}
+	if !strings.Contains(string(signed), "MIME-Version: 1.0\r\n") {
+		t.Error("expected MIME-Version added")
+	}
+}
+
+func TestSign_NoIdentity(t *testing.T) {
+	s := newSigner(t, newIdentity(t, "app@example.com", true))
+	for _, msg := range []string{
+		"From: other@example.com\r\n\r\nbody\r\n",
+		"Subject: no sender\r\n\r\nbody\r\n",
+	} {
+		if _, err := s.Sign([]byte(msg)); !errors.Is(err, ErrNoIdentity) {
+			t.Errorf("%q: expected ErrNoIdentity, got %v", msg, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New(&config.Config{}); s != nil || err != nil {
+		t.Errorf("expected nil signer without key files, got %v, %v", s, err)
+	}
+
+	a := newIdentity(t, "a@example.com", false)
+	b := newIdentity(t, "b@example.com", true)
+	s := newSigner(t, a, b)
+	if len(s.identities) != 2 {
+		t.Errorf("expected two identities, got %d", len(s.identities))
+	}
+
+	// A certificate paired with another identity's key
+	certA, _ := pem.Decode(a)
+	_, keyB := pem.Decode(b)
+	mismatched := append(pem.EncodeToMemory(certA), keyB...)
+	path := filepath.Join(t.TempDir(), "bad.pem")
+	if err := os.WriteFile(path, mismatched, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(&config.Config{SMIMEKeyFiles: []string{path}}); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected key mismatch error, got %v", err)
+	}
+}
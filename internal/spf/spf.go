@@ -0,0 +1,503 @@
+// Package spf evaluates the SPF policy (RFC 7208) of a MAIL FROM domain
+// for a client IP, for sessions submitting without authentication.
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Result is an SPF evaluation result (RFC 7208 section 2.6).
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Limits from RFC 7208 section 4.6.4.
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxMXHosts     = 10
+)
+
+// Checker evaluates SPF records fetched from DNS.
+type Checker struct {
+	lookupTXT  func(name string) ([]string, error)
+	lookupIP   func(host string) ([]net.IP, error)
+	lookupMX   func(name string) ([]*net.MX, error)
+	lookupAddr func(addr string) ([]string, error)
+}
+
+// NewChecker returns a checker using the system resolver.
+func NewChecker() *Checker {
+	return &Checker{
+		lookupTXT:  net.LookupTXT,
+		lookupIP:   net.LookupIP,
+		lookupMX:   net.LookupMX,
+		lookupAddr: net.LookupAddr,
+	}
+}
+
+// Check evaluates the policy of sender's domain for ip. An empty sender
+// (a bounce) is checked as postmaster@helo. The error explains a
+// TempError or PermError result.
+func (c *Checker) Check(ip net.IP, sender, helo string) (Result, error) {
+	domain := Domain(sender, helo)
+	if !strings.Contains(domain, ".") {
+		return None, nil
+	}
+	local, _, ok := strings.Cut(sender, "@")
+	if !ok || local == "" {
+		local = "postmaster"
+	}
+	e := &eval{c: c, ip: ip, local: local, sender: local + "@" + domain, helo: helo}
+	return e.checkHost(domain)
+}
+
+// Domain returns the domain Check evaluates for sender and helo.
+func Domain(sender, helo string) string {
+	domain := helo
+	if sender != "" {
+		_, domain, _ = strings.Cut(sender, "@")
+	}
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// eval is one check_host evaluation, including nested include and
+// redirect evaluations, which share the lookup limits.
+type eval struct {
+	c      *Checker
+	ip     net.IP
+	local  string
+	sender string
+	helo   string
+
+	lookups int
+	voids   int
+}
+
+var errTooManyLookups = errors.New("more than 10 DNS lookups")
+
+func (e *eval) checkHost(domain string) (Result, error) {
+	record, res, err := e.record(domain)
+	if record == "" {
+		return res, err
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := modifier(term); ok {
+			if name == "redirect" {
+				if redirect != "" {
+					return PermError, errors.New("duplicate redirect modifier")
+				}
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+		match, res, err := e.mechanism(term, domain)
+		if err != nil {
+			return res, err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect == "" {
+		return Neutral, nil
+	}
+	if err := e.count(); err != nil {
+		return PermError, err
+	}
+	target, err := e.expand(redirect, domain)
+	if err != nil {
+		return PermError, err
+	}
+	res, err = e.checkHost(target)
+	if res == None {
+		return PermError, fmt.Errorf("redirect to %s: no SPF record", target)
+	}
+	return res, err
+}
+
+// record returns the SPF record of domain. When there is none it returns
+// "" with the result to use.
+func (e *eval) record(domain string) (string, Result, error) {
+	txts, err := e.c.lookupTXT(domain)
+	if err != nil {
+		if notFound(err) {
+			return "", None, nil
+		}
+		return "", TempError, fmt.Errorf("lookup %s: %w", domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", None, nil
+	case 1:
+		return records[0], "", nil
+	}
+	return "", PermError, fmt.Errorf("%s has %d SPF records", domain, len(records))
+}
+
+// modifier splits a name=value term. Mechanisms never have "=" before a
+// ":" or "/".
+func modifier(term string) (string, string, bool) {
+	i := strings.IndexAny(term, "=:/")
+	if i <= 0 || term[i] != '=' {
+		return "", "", false
+	}
+	return strings.ToLower(term[:i]), term[i+1:], true
+}
+
+// mechanism reports whether term matches the client. A non-nil error
+// aborts the evaluation with the returned result.
+func (e *eval) mechanism(term, domain string) (bool, Result, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, "", nil
+
+	case "ip4", "ip6":
+		cidr, ok := strings.CutPrefix(arg, ":")
+		if !ok {
+			return false, PermError, fmt.Errorf("%s without a network", name)
+		}
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil || (name == "ip4") != (network.IP.To4() != nil) {
+			return false, PermError, fmt.Errorf("invalid %s network %q", name, cidr)
+		}
+		return network.Contains(e.ip), "", nil
+
+	case "include", "exists":
+		spec, ok := strings.CutPrefix(arg, ":")
+		if !ok || spec == "" {
+			return false, PermError, fmt.Errorf("%s without a domain", name)
+		}
+		if err := e.count(); err != nil {
+			return false, PermError, err
+		}
+		target, err := e.expand(spec, domain)
+		if err != nil {
+			return false, PermError, err
+		}
+		if name == "exists" {
+			ips, err := e.c.lookupIP(target)
+			if err != nil {
+				res, err := e.lookupFailed(target, err)
+				return false, res, err
+			}
+			return slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.To4() != nil }), "", nil
+		}
+		res, err := e.checkHost(target)
+		switch res {
+		case Pass:
+			return true, "", nil
+		case Fail, SoftFail, Neutral:
+			return false, "", nil
+		case None:
+			return false, PermError, fmt.Errorf("include of %s: no SPF record", target)
+		}
+		return false, res, err
+
+	case "a", "mx", "ptr":
+		spec, masks := arg, ""
+		if i := strings.Index(arg, "/"); i >= 0 {
+			spec, masks = arg[:i], arg[i:]
+		}
+		target := domain
+		if s, ok := strings.CutPrefix(spec, ":"); ok {
+			var err error
+			if target, err = e.expand(s, domain); err != nil {
+				return false, PermError, err
+			}
+		}
+		if err := e.count(); err != nil {
+			return false, PermError, err
+		}
+		if name == "ptr" {
+			return e.ptr(target), "", nil
+		}
+		mask4, mask6, err := parseMasks(masks)
+		if err != nil {
+			return false, PermError, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := e.c.lookupMX(target)
+			if err != nil {
+				res, err := e.lookupFailed(target, err)
+				return false, res, err
+			}
+			if len(mxs) > maxMXHosts {
+				return false, PermError, fmt.Errorf("%s has more than %d MX hosts", target, maxMXHosts)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			ips, err := e.c.lookupIP(host)
+			if err != nil {
+				if name == "mx" && notFound(err) {
+					continue
+				}
+				res, err := e.lookupFailed(host, err)
+				return false, res, err
+			}
+			for _, ip := range ips {
+				if matches(e.ip, ip, mask4, mask6) {
+					return true, "", nil
+				}
+			}
+		}
+		return false, "", nil
+	}
+	return false, PermError, fmt.Errorf("unknown mechanism %q", name)
+}
+
+// lookupFailed turns a failed lookup into the evaluation's outcome: a
+// missing name is a void lookup, anything else a TempError.
+func (e *eval) lookupFailed(name string, err error) (Result, error) {
+	if notFound(err) {
+		e.voids++
+		if e.voids > maxVoidLookups {
+			return PermError, errors.New("more than 2 void DNS lookups")
+		}
+		return "", nil
+	}
+	return TempError, fmt.Errorf("lookup %s: %w", name, err)
+}
+
+// ptr implements the deprecated ptr mechanism: a validated reverse name of
+// the client within target.
+func (e *eval) ptr(target string) bool {
+	names, err := e.c.lookupAddr(e.ip.String())
+	if err != nil {
+		return false
+	}
+	for _, name := range names[:min(len(names), maxMXHosts)] {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, err := e.c.lookupIP(name)
+		if err == nil && slices.ContainsFunc(ips, e.ip.Equal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *eval) count() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return errTooManyLookups
+	}
+	return nil
+}
+
+// parseMasks parses the "/n" and "//n" CIDR lengths of an a or mx
+// mechanism, defaulting to whole addresses.
+func parseMasks(s string) (int, int, error) {
+	mask4, mask6 := 32, 128
+	if s == "" {
+		return mask4, mask6, nil
+	}
+	v4, v6, dual := strings.Cut(s, "//")
+	if dual {
+		n, err := strconv.Atoi(v6)
+		if err != nil || n < 0 || n > 128 {
+			return 0, 0, fmt.Errorf("invalid ip6 prefix length %q", v6)
+		}
+		mask6 = n
+	}
+	if v4 != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(v4, "/"))
+		if err != nil || n < 0 || n > 32 {
+			return 0, 0, fmt.Errorf("invalid ip4 prefix length %q", v4)
+		}
+		mask4 = n
+	}
+	return mask4, mask6, nil
+}
+
+// matches reports whether client is within the network of addr.
+func matches(client, addr net.IP, mask4, mask6 int) bool {
+	if c4, a4 := client.To4(), addr.To4(); c4 != nil || a4 != nil {
+		if c4 == nil || a4 == nil {
+			return false
+		}
+		m := net.CIDRMask(mask4, 32)
+		return c4.Mask(m).Equal(a4.Mask(m))
+	}
+	m := net.CIDRMask(mask6, 128)
+	return client.Mask(m).Equal(addr.Mask(m))
+}
+
+// expand applies macro expansion (RFC 7208 section 7) to a domain-spec.
+func (e *eval) expand(spec, domain string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 == len(spec) {
+			return "", fmt.Errorf("invalid macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 2 {
+				return "", fmt.Errorf("invalid macro in %q", spec)
+			}
+			v, err := e.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(v)
+			i += end
+		default:
+			return "", fmt.Errorf("invalid macro in %q", spec)
+		}
+	}
+	return strings.TrimSuffix(strings.ToLower(out.String()), "."), nil
+}
+
+// macro expands the body of one %{...} macro: a letter, an optional
+// number of labels to keep, an optional "r" to reverse, and delimiters.
+func (e *eval) macro(m, domain string) (string, error) {
+	letter := m[0]
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = e.sender
+	case 'l':
+		value = e.local
+	case 'o':
+		_, value, _ = strings.Cut(e.sender, "@")
+	case 'd':
+		value = domain
+	case 'i':
+		value = dotted(e.ip)
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "in-addr"
+		if e.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = e.helo
+	default:
+		return "", fmt.Errorf("unknown macro letter %q", letter)
+	}
+
+	rest := m[1:]
+	digits := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if digits < 0 {
+		digits = len(rest)
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("invalid macro %%{%s}", m)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("invalid macro %%{%s}", m)
+		}
+		delims = rest
+	}
+
+	labels := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		slices.Reverse(labels)
+	}
+	if keep > 0 && keep < len(labels) {
+		labels = labels[len(labels)-keep:]
+	}
+	value = strings.Join(labels, ".")
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.PathEscape(value)
+	}
+	return value, nil
+}
+
+// dotted formats ip for the i macro: dotted quad for IPv4, dot-separated
+// nibbles for IPv6.
+func dotted(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
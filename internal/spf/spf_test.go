@@ -0,0 +1,159 @@
+package spf
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// zone is a fake DNS: TXT records, addresses and MX hosts by name.
+type zone struct {
+	txt  map[string][]string
+	ips  map[string][]string
+	mx   map[string][]string
+	ptrs map[string][]string
+}
+
+func notFoundErr(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z zone) checker() *Checker {
+	return &Checker{
+		lookupTXT: func(name string) ([]string, error) {
+			if strings.HasPrefix(name, "down.") {
+				return nil, errors.New("i/o timeout")
+			}
+			if v, ok := z.txt[name]; ok {
+				return v, nil
+			}
+			return nil, notFoundErr(name)
+		},
+		lookupIP: func(host string) ([]net.IP, error) {
+			var ips []net.IP
+			for _, s := range z.ips[strings.TrimSuffix(host, ".")] {
+				ips = append(ips, net.ParseIP(s))
+			}
+			if ips == nil {
+				return nil, notFoundErr(host)
+			}
+			return ips, nil
+		},
+		lookupMX: func(name string) ([]*net.MX, error) {
+			var mxs []*net.MX
+			for _, h := range z.mx[name] {
+				mxs = append(mxs, &net.MX{Host: h + "."})
+			}
+			if mxs == nil {
+				return nil, notFoundErr(name)
+			}
+			return mxs, nil
+		},
+		lookupAddr: func(addr string) ([]string, error) {
+			if names, ok := z.ptrs[addr]; ok {
+				return names, nil
+			}
+			return nil, notFoundErr(addr)
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	z := zone{
+		txt: map[string][]string{
+			"example.com":         {"some verification token", "v=spf1 ip4:192.0.2.0/24 a:web.example.com mx include:_spf.mailer.example -all"},
+			"_spf.mailer.example": {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.example":        {"v=spf1 ?ip4:192.0.2.1 ~all"},
+			"redirected.example":  {"v=spf1 redirect=example.com"},
+			"neutral.example":     {"v=spf1 ip4:198.51.100.1"},
+			"twice.example":       {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":      {"v=spf1 include:missing.example -all"},
+			"macro.example":       {"v=spf1 exists:%{i}.%{l}._spf.%{d} -all"},
+			"ptr.example":         {"v=spf1 ptr -all"},
+			"bounce.example":      {"v=spf1 ip4:203.0.113.9 -all"},
+		},
+		ips: map[string][]string{
+			"web.example.com":                       {"198.51.100.7"},
+			"mx1.example.com":                       {"203.0.113.5", "2001:db8:1::25"},
+			"203.0.113.77.alice._spf.macro.example": {"127.0.0.2"},
+			"host.ptr.example":                      {"203.0.113.50"},
+		},
+		mx:   map[string][]string{"example.com": {"mx1.example.com"}},
+		ptrs: map[string][]string{"203.0.113.50": {"host.ptr.example."}},
+	}
+	c := z.checker()
+
+	for _, tc := range []struct {
+		ip, sender, helo string
+		want             Result
+	}{
+		{"192.0.2.10", "app@example.com", "", Pass},
+		{"198.51.100.7", "app@example.com", "", Pass},      // a:
+		{"203.0.113.5", "app@Example.COM", "", Pass},       // mx
+		{"2001:db8:1::25", "app@example.com", "", Pass},    // mx, IPv6
+		{"2001:db8:ff::1", "app@example.com", "", Pass},    // include
+		{"203.0.113.6", "app@example.com", "", Fail},       // -all
+		{"192.0.2.1", "app@soft.example", "", Neutral},     // ?ip4
+		{"192.0.2.2", "app@soft.example", "", SoftFail},    // ~all
+		{"192.0.2.10", "app@redirected.example", "", Pass}, // redirect=
+		{"192.0.2.10", "app@neutral.example", "", Neutral}, // no match, no all
+		{"192.0.2.10", "app@nospf.example", "", None},
+		{"192.0.2.10", "app@twice.example", "", PermError},
+		{"192.0.2.10", "app@broken.example", "", PermError},
+		{"192.0.2.10", "app@down.example", "", TempError},
+		{"203.0.113.77", "alice@macro.example", "", Pass},
+		{"203.0.113.78", "alice@macro.example", "", Fail},
+		{"203.0.113.50", "app@ptr.example", "", Pass},
+		{"203.0.113.9", "", "bounce.example", Pass}, // null sender: HELO
+	} {
+		got, err := c.Check(net.ParseIP(tc.ip), tc.sender, tc.helo)
+		if got != tc.want {
+			t.Errorf("Check(%s, %q, %q) = %s (%v), want %s", tc.ip, tc.sender, tc.helo, got, err, tc.want)
+		}
+	}
+}
+
+func TestCheck_LookupLimit(t *testing.T) {
+	z := zone{txt: map[string][]string{}}
+	// Each record includes the next, eleven deep
+	for i := 0; i < 11; i++ {
+		z.txt[string(rune('a'+i))+".example"] = []string{"v=spf1 include:" + string(rune('a'+i+1)) + ".example -all"}
+	}
+	z.txt["l.example"] = []string{"v=spf1 +all"}
+	got, err := z.checker().Check(net.ParseIP("192.0.2.1"), "app@a.example", "")
+	if got != PermError || !errors.Is(err, errTooManyLookups) {
+		t.Errorf("expected permerror for too many lookups, got %s (%v)", got, err)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	e := &eval{ip: net.ParseIP("192.0.2.3"), local: "strong-bad", sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	for spec, want := range map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l-}":                 "strong.bad",
+		"%{lr-}":                "bad.strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{h}%%":                "mx.example.org%",
+	} {
+		got, err := e.expand(spec, "email.example.com")
+		if err != nil || got != want {
+			t.Errorf("expand(%q) = %q (%v), want %q", spec, got, err, want)
+		}
+	}
+	if _, err := e.expand("%{x}", "email.example.com"); err == nil {
+		t.Error("expected an error for an unknown macro letter")
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	got, _ := e.expand("%{ir}.%{v}", "email.example.com")
+	if want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6"; got != want {
+		t.Errorf("expand IPv6 = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+// Package statsd sends metrics over UDP in the statsd line protocol, with
+// DogStatsD tags when enabled.
+package statsd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client writes one datagram per metric. Writes are fire-and-forget: a
+// missing agent never slows down or fails mail. All methods are no-ops on
+// a nil *Client, so callers need not check whether metrics are enabled.
+type Client struct {
+	conn   net.Conn
+	prefix string
+	tags   string // formatted constant tags, "" without tags
+	dog    bool
+}
+
+// tagEscaper replaces the characters that delimit DogStatsD fields.
+var tagEscaper = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// New returns a client sending to addr. Every metric name starts with
+// prefix. With dogstatsd, tags ("key:value") are attached to every metric
+// along with those given per call; plain statsd has no tags, so they are
+// dropped.
+func New(addr, prefix string, tags []string, dogstatsd bool) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, prefix: prefix, dog: dogstatsd}
+	if dogstatsd {
+		c.tags = formatTags(tags)
+	}
+	return c, nil
+}
+
+// Count adds n to a counter.
+func (c *Client) Count(name string, n int64, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatInt(n, 10), "c", tags)
+}
+
+// Histogram records a value, such as a message size, for distribution
+// statistics. Plain statsd gets it as a timer, which aggregates the same
+// way.
+func (c *Client) Histogram(name string, v float64, tags ...string) {
+	if c == nil {
+		return
+	}
+	kind := "ms"
+	if c.dog {
+		kind = "h"
+	}
+	c.send(name, strconv.FormatFloat(v, 'f', -1, 64), kind, tags)
+}
+
+// Gauge sets a value that holds until the next one, such as the days a
+// certificate has left.
+func (c *Client) Gauge(name string, v float64, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(v, 'f', -1, 64), "g", tags)
+}
+
+// Timing records a duration in milliseconds.
+func (c *Client) Timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", tags)
+}
+
+// Close closes the socket.
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *Client) send(name, value, kind string, tags []string) {
+	var b strings.Builder
+	b.WriteString(c.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if c.dog {
+		all := c.tags
+		if extra := formatTags(tags); extra != "" {
+			if all != "" {
+				all += ","
+			}
+			all += extra
+		}
+		if all != "" {
+			b.WriteString("|#")
+			b.WriteString(all)
+		}
+	}
+	_, _ = c.conn.Write([]byte(b.String()))
+}
+
+func formatTags(tags []string) string {
+	escaped := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != "" {
+			escaped = append(escaped, tagEscaper.Replace(t))
+		}
+	}
+	return strings.Join(escaped, ",")
+}
@@ -0,0 +1,82 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	buf := make([]byte, 1500)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestClient_DogStatsD(t *testing.T) {
+	agent := listen(t)
+	c, err := New(agent.LocalAddr().String(), "smtp_proxy.", []string{"env:prod", "team:a|b"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Count("messages", 1, "result:relayed")
+	if got := receive(t, agent); got != "smtp_proxy.messages:1|c|#env:prod,team:a_b,result:relayed" {
+		t.Errorf("unexpected count %q", got)
+	}
+	c.Histogram("message.size", 2048)
+	if got := receive(t, agent); got != "smtp_proxy.message.size:2048|h|#env:prod,team:a_b" {
+		t.Errorf("unexpected histogram %q", got)
+	}
+	c.Timing("relay.duration", 1500*time.Microsecond, "stage:relay")
+	if got := receive(t, agent); got != "smtp_proxy.relay.duration:1.500|ms|#env:prod,team:a_b,stage:relay" {
+		t.Errorf("unexpected timing %q", got)
+	}
+}
+
+func TestClient_Statsd(t *testing.T) {
+	agent := listen(t)
+	c, err := New(agent.LocalAddr().String(), "", []string{"env:prod"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Count("messages", 2, "result:relayed")
+	if got := receive(t, agent); got != "messages:2|c" {
+		t.Errorf("unexpected count %q", got)
+	}
+	c.Histogram("message.size", 10)
+	if got := receive(t, agent); got != "message.size:10|ms" {
+		t.Errorf("unexpected histogram %q", got)
+	}
+	c.Gauge("tls.cert_expiry_days", 12.5)
+	if got := receive(t, agent); got != "tls.cert_expiry_days:12.5|g" {
+		t.Errorf("unexpected gauge %q", got)
+	}
+}
+
+func TestClient_Nil(t *testing.T) {
+	var c *Client
+	c.Count("messages", 1)
+	c.Histogram("message.size", 1)
+	c.Timing("relay.duration", time.Second)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
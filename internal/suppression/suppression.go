@@ -0,0 +1,104 @@
+package suppression
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// List is a set of recipient addresses that must not be relayed to,
+// persisted as an append-only text file with one address per line. Lines
+// starting with '#' are comments and anything after the first whitespace
+// on a line (e.g. the recorded reason) is ignored.
+type List struct {
+	path string
+
+	mu    sync.RWMutex
+	addrs map[string]bool
+}
+
+// Load reads the list at path. A missing file yields an empty list that
+// is created on the first Add.
+func Load(path string) (*List, error) {
+	l := &List{path: path, addrs: make(map[string]bool)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("suppression: open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l.addrs[normalize(strings.Fields(line)[0])] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("suppression: read %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Contains reports whether addr is suppressed. A nil *List suppresses
+// nothing.
+func (l *List) Contains(addr string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.addrs[normalize(addr)]
+}
+
+// Add suppresses addr and appends it with reason to the file. Adding an
+// address that is already present is a no-op.
+func (l *List) Add(addr, reason string) error {
+	addr = normalize(addr)
+	if addr == "" {
+		return errors.New("suppression: empty address")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.addrs[addr] {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("suppression: open %s: %w", l.path, err)
+	}
+	defer f.Close()
+
+	// Keep the reason on one line so it cannot inject entries
+	reason = strings.Join(strings.Fields(reason), " ")
+	if _, err := fmt.Fprintf(f, "%s %s\n", addr, reason); err != nil {
+		return fmt.Errorf("suppression: write %s: %w", l.path, err)
+	}
+	l.addrs[addr] = true
+	return nil
+}
+
+// Len returns the number of suppressed addresses.
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.addrs)
+}
+
+func normalize(addr string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(addr), "<>"))
+}
@@ -0,0 +1,75 @@
+package suppression
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad_MissingFile(t *testing.T) {
+	l, err := Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l.Len() != 0 {
+		t.Errorf("expected empty list, got %d", l.Len())
+	}
+}
+
+func TestList_AddPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressed.txt")
+	l, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := l.Add("<Bounced@Example.com>", "5.1.1 user unknown\nevil@example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Add("bounced@example.com", "duplicate"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !l.Contains("BOUNCED@example.com") {
+		t.Error("expected case-insensitive match")
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Count(string(data), "\n") != 1 {
+		t.Errorf("expected one line in file, got %q", data)
+	}
+
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reloaded.Contains("bounced@example.com") {
+		t.Error("expected address to persist across reload")
+	}
+	if reloaded.Contains("evil@example.com") {
+		t.Error("expected reason text not to create entries")
+	}
+}
+
+func TestLoad_SkipsComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressed.txt")
+	content := "# manual entries\nmanual@example.com\n\n  other@example.com  spam complaint\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l.Len() != 2 || !l.Contains("manual@example.com") || !l.Contains("other@example.com") {
+		t.Errorf("unexpected list contents, len %d", l.Len())
+	}
+}
+
+func TestList_NilSuppressesNothing(t *testing.T) {
+	var l *List
+	if l.Contains("anyone@example.com") {
+		t.Error("expected nil list to suppress nothing")
+	}
+}
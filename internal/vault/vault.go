@@ -0,0 +1,303 @@
+// Package vault reads secrets from HashiCorp Vault over its HTTP API,
+// logging in with AppRole, a Kubernetes service account or a static token
+// and renewing the token before it expires.
+package vault
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheme prefixes a secret reference: vault://<path>#<field>.
+const Scheme = "vault://"
+
+// requestTimeout bounds one request to Vault.
+const requestTimeout = 10 * time.Second
+
+// maxReply bounds the reply read from Vault.
+const maxReply = 1 << 20
+
+// The login methods.
+const (
+	AuthAppRole    = "approle"
+	AuthKubernetes = "kubernetes"
+	AuthToken      = "token"
+)
+
+// Config is how to reach and log in to Vault.
+type Config struct {
+	Addr      string // e.g. https://vault.example.com:8200
+	Namespace string // Vault Enterprise namespace, "" for none
+	CAFile    string // PEM bundle to verify Vault with, "" for the system roots
+
+	Auth  string // AuthAppRole, AuthKubernetes or AuthToken
+	Mount string // path the auth method is mounted at, defaults to its name
+
+	RoleID, SecretID string // AppRole
+	Role, JWTFile    string // Kubernetes: role and service account token file
+	Token            string // static token
+}
+
+// Client reads secrets with a token it obtains and renews as needed. It
+// is safe for concurrent use.
+type Client struct {
+	cfg  Config
+	http *http.Client
+	now  func() time.Time
+
+	mu        sync.Mutex
+	looked    bool // the static token's TTL has been looked up
+	token     string
+	ttl       time.Duration // 0: the token does not expire
+	expires   time.Time
+	renewable bool
+}
+
+// New returns a client for cfg. It does not contact Vault until the first
+// Read.
+func New(cfg Config) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("vault: ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("vault: ca: no certificates in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	c := &Client{
+		cfg:  cfg,
+		http: &http.Client{Transport: transport, Timeout: requestTimeout},
+		now:  time.Now,
+	}
+	if cfg.Auth == AuthToken {
+		c.token = cfg.Token
+	}
+	return c, nil
+}
+
+// Read resolves ref, a vault://<path>#<field> reference, to the field of
+// the secret at path. The secret may come from a KV version 1 or 2 engine
+// (for version 2, path includes data/), or any engine answering reads
+// with a data object.
+func (c *Client) Read(ref string) (string, error) {
+	path, field, ok := strings.Cut(strings.TrimPrefix(ref, Scheme), "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("vault: invalid reference %q (expected vault://path#field)", ref)
+	}
+	token, err := c.currentToken()
+	if err != nil {
+		return "", err
+	}
+	reply, err := c.do(http.MethodGet, strings.TrimPrefix(path, "/"), token, nil)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return "", fmt.Errorf("vault: %s: %w", path, err)
+	}
+	data := resp.Data
+	if _, kv2 := data["metadata"]; kv2 {
+		// KV version 2 nests the secret's fields one level down
+		var inner map[string]json.RawMessage
+		if json.Unmarshal(data["data"], &inner) == nil && inner != nil {
+			data = inner
+		}
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault: %s has no field %q", path, field)
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return "", fmt.Errorf("vault: %s field %q is not a string", path, field)
+	}
+	return s, nil
+}
+
+// currentToken returns a token that is valid for a while yet: the one
+// held, renewed once two thirds of its TTL have passed, or a new one from
+// logging in again when it cannot be renewed.
+func (c *Client) currentToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.cfg.Auth == AuthToken && !c.looked {
+		if err := c.lookup(now); err != nil {
+			return "", err
+		}
+	}
+	if c.token != "" && (c.ttl == 0 || now.Before(c.expires.Add(-c.ttl/3))) {
+		return c.token, nil
+	}
+	if c.token != "" && c.renewable {
+		if err := c.renew(now); err == nil {
+			return c.token, nil
+		}
+	}
+	if c.cfg.Auth == AuthToken {
+		if c.token != "" && now.Before(c.expires) {
+			return c.token, nil
+		}
+		return "", errors.New("vault: token expired and cannot be renewed")
+	}
+	if err := c.login(now); err != nil {
+		return "", err
+	}
+	return c.token, nil
+}
+
+// authResponse is the part of a login or renewal reply that matters.
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"` // seconds, 0 for none
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// appRoleLogin and kubernetesLogin are the login request bodies.
+type appRoleLogin struct {
+	RoleID   string `json:"role_id"`
+	SecretID string `json:"secret_id"`
+}
+
+type kubernetesLogin struct {
+	Role string `json:"role"`
+	JWT  string `json:"jwt"`
+}
+
+func (c *Client) login(now time.Time) error {
+	var body []byte
+	var err error
+	switch c.cfg.Auth {
+	case AuthAppRole:
+		body, err = json.Marshal(appRoleLogin{RoleID: c.cfg.RoleID, SecretID: c.cfg.SecretID})
+	case AuthKubernetes:
+		jwt, readErr := os.ReadFile(c.cfg.JWTFile)
+		if readErr != nil {
+			return fmt.Errorf("vault: kubernetes login: %w", readErr)
+		}
+		body, err = json.Marshal(kubernetesLogin{Role: c.cfg.Role, JWT: strings.TrimSpace(string(jwt))})
+	default:
+		return fmt.Errorf("vault: unknown auth method %q", c.cfg.Auth)
+	}
+	if err != nil {
+		return err
+	}
+	reply, err := c.do(http.MethodPost, "auth/"+cmp.Or(c.cfg.Mount, c.cfg.Auth)+"/login", "", body)
+	if err != nil {
+		return fmt.Errorf("vault: %s login: %w", c.cfg.Auth, err)
+	}
+	var resp authResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return fmt.Errorf("vault: %s login: %w", c.cfg.Auth, err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return fmt.Errorf("vault: %s login: no token in the reply", c.cfg.Auth)
+	}
+	c.token = resp.Auth.ClientToken
+	c.setLease(now, resp)
+	return nil
+}
+
+// lookup reads the TTL of the static token, so that it is renewed in
+// time.
+func (c *Client) lookup(now time.Time) error {
+	reply, err := c.do(http.MethodGet, "auth/token/lookup-self", c.token, nil)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return fmt.Errorf("vault: token lookup: %w", err)
+	}
+	c.looked = true
+	c.ttl = time.Duration(resp.Data.TTL) * time.Second
+	c.expires = now.Add(c.ttl)
+	c.renewable = resp.Data.Renewable
+	return nil
+}
+
+func (c *Client) renew(now time.Time) error {
+	reply, err := c.do(http.MethodPost, "auth/token/renew-self", c.token, []byte("{}"))
+	if err != nil {
+		return err
+	}
+	var resp authResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return fmt.Errorf("vault: token renewal: %w", err)
+	}
+	c.setLease(now, resp)
+	return nil
+}
+
+func (c *Client) setLease(now time.Time, resp authResponse) {
+	c.ttl = time.Duration(resp.Auth.LeaseDuration) * time.Second
+	c.expires = now.Add(c.ttl)
+	c.renewable = resp.Auth.Renewable
+}
+
+// do sends a request with the JSON body, if any, to the API at /v1/path
+// and returns the reply, turning Vault's error list into an error.
+func (c *Client) do(method, path, token string, body []byte) ([]byte, error) {
+	var payload io.Reader
+	if body != nil {
+		payload = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.cfg.Addr, "/")+"/v1/"+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		if len(e.Errors) > 0 {
+			return nil, fmt.Errorf("vault: %s %s: %s: %s", method, path, resp.Status, strings.Join(e.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vault: %s %s: %s", method, path, resp.Status)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, maxReply))
+	if err != nil {
+		return nil, fmt.Errorf("vault: %s %s: %w", method, path, err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,218 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replies of the fake Vault server.
+type (
+	authReply struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+			Renewable     bool   `json:"renewable"`
+		} `json:"auth"`
+	}
+	lookupReply struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	kv1Reply struct {
+		Data struct {
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	kv2Reply struct {
+		Data struct {
+			Data struct {
+				Password string `json:"password"`
+				Port     int    `json:"port"`
+			} `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	errorsReply struct {
+		Errors []string `json:"errors"`
+	}
+)
+
+// fakeVault answers logins, renewals, lookups and reads of two secrets,
+// recording the requests it saw.
+type fakeVault struct {
+	paths     []string
+	token     string
+	ttl       int
+	renewable bool
+	failRenew bool
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.paths = append(f.paths, r.Method+" "+r.URL.Path)
+	enc := json.NewEncoder(w)
+	auth := func() {
+		var reply authReply
+		reply.Auth.ClientToken, reply.Auth.LeaseDuration, reply.Auth.Renewable = f.token, f.ttl, f.renewable
+		enc.Encode(reply)
+	}
+	fail := func(code int, errs ...string) {
+		w.WriteHeader(code)
+		enc.Encode(errorsReply{Errors: errs})
+	}
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			fail(http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		auth()
+	case "/v1/auth/k8s/login":
+		if body["role"] != "smtp-proxy" || body["jwt"] != "service-account-jwt" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		auth()
+	case "/v1/auth/token/renew-self":
+		if f.failRenew {
+			fail(http.StatusForbidden, "permission denied")
+			return
+		}
+		auth()
+	case "/v1/auth/token/lookup-self":
+		var reply lookupReply
+		reply.Data.TTL, reply.Data.Renewable = f.ttl, f.renewable
+		enc.Encode(reply)
+	case "/v1/secret/data/smtp":
+		if r.Header.Get("X-Vault-Token") != f.token {
+			fail(http.StatusForbidden, "permission denied")
+			return
+		}
+		var reply kv2Reply
+		reply.Data.Data.Password, reply.Data.Data.Port = "kv2-secret", 587
+		reply.Data.Metadata.Version = 3
+		enc.Encode(reply)
+	case "/v1/kv/smtp":
+		var reply kv1Reply
+		reply.Data.Password = "kv1-secret"
+		enc.Encode(reply)
+	default:
+		fail(http.StatusNotFound)
+	}
+}
+
+func TestClient_AppRole(t *testing.T) {
+	fake := &fakeVault{token: "t1", ttl: 3600, renewable: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c, err := New(Config{Addr: srv.URL, Auth: AuthAppRole, RoleID: "role", SecretID: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+
+	if v, err := c.Read("vault://secret/data/smtp#password"); err != nil || v != "kv2-secret" {
+		t.Fatalf("expected the KV v2 field, got %q, %v", v, err)
+	}
+	if v, err := c.Read("vault://kv/smtp#password"); err != nil || v != "kv1-secret" {
+		t.Fatalf("expected the KV v1 field, got %q, %v", v, err)
+	}
+	if fake.paths[0] != "POST /v1/auth/approle/login" || strings.Count(strings.Join(fake.paths, ","), "login") != 1 {
+		t.Errorf("expected one login, got %v", fake.paths)
+	}
+
+	// Renewed once two thirds of the TTL have passed
+	now = now.Add(41 * time.Minute)
+	fake.paths = nil
+	if _, err := c.Read("vault://secret/data/smtp#password"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.paths) != 2 || fake.paths[0] != "POST /v1/auth/token/renew-self" {
+		t.Errorf("expected a renewal, got %v", fake.paths)
+	}
+
+	// Logged in again when renewal fails
+	now = now.Add(41 * time.Minute)
+	fake.paths = nil
+	fake.failRenew = true
+	fake.token = "t2"
+	if _, err := c.Read("vault://secret/data/smtp#password"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.paths) != 3 || fake.paths[1] != "POST /v1/auth/approle/login" {
+		t.Errorf("expected a login after the failed renewal, got %v", fake.paths)
+	}
+
+	for ref, want := range map[string]string{
+		"vault://secret/data/smtp":         "invalid reference",
+		"vault://secret/data/smtp#user":    `has no field "user"`,
+		"vault://secret/data/smtp#port":    "is not a string",
+		"vault://secret/data/missing#user": "404 Not Found",
+	} {
+		if _, err := c.Read(ref); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Read(%q): expected error containing %q, got %v", ref, want, err)
+		}
+	}
+
+	bad, _ := New(Config{Addr: srv.URL, Auth: AuthAppRole, RoleID: "role", SecretID: "wrong"})
+	if _, err := bad.Read("vault://kv/smtp#password"); err == nil || !strings.Contains(err.Error(), "approle login") || !strings.Contains(err.Error(), "invalid role or secret ID") {
+		t.Errorf("expected the login error from Vault, got %v", err)
+	}
+}
+
+func TestClient_Kubernetes(t *testing.T) {
+	fake := &fakeVault{token: "k8s-token", ttl: 600}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	jwt := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwt, []byte("service-account-jwt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := New(Config{Addr: srv.URL, Auth: AuthKubernetes, Mount: "k8s", Role: "smtp-proxy", JWTFile: jwt})
+	if v, err := c.Read("vault://secret/data/smtp#password"); err != nil || v != "kv2-secret" {
+		t.Fatalf("expected a read after a Kubernetes login, got %q, %v", v, err)
+	}
+	if fake.paths[0] != "POST /v1/auth/k8s/login" {
+		t.Errorf("expected a login at the configured mount, got %v", fake.paths)
+	}
+}
+
+func TestClient_Token(t *testing.T) {
+	fake := &fakeVault{token: "static", ttl: 300, renewable: true, failRenew: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c, _ := New(Config{Addr: srv.URL, Auth: AuthToken, Token: "static"})
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+	if _, err := c.Read("vault://secret/data/smtp#password"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.paths[0] != "GET /v1/auth/token/lookup-self" {
+		t.Errorf("expected the token's TTL looked up, got %v", fake.paths)
+	}
+
+	// Used until it expires when it cannot be renewed, then an error
+	now = now.Add(4 * time.Minute)
+	if _, err := c.Read("vault://secret/data/smtp#password"); err != nil {
+		t.Errorf("expected the token used until it expires, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := c.Read("vault://secret/data/smtp#password"); err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Errorf("expected an expired token error, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Package verp implements variable envelope return paths: the original
+// recipient is encoded into the envelope sender so a bounce identifies
+// exactly which recipient failed, even when the bounce itself does not.
+// The encoded recipient is signed, so only the proxy can mint addresses
+// that Decode accepts.
+package verp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// tagLen is the length of the hex signature in front of the recipient.
+const tagLen = 10
+
+// Encode returns the VERP sender for rcpt based on sender, in the form
+// local+tag.user=domain@senderdomain, where tag signs rcpt with key.
+// Either address lacking an "@" leaves sender unchanged.
+func Encode(key, sender, rcpt string) string {
+	local, domain, ok := split(sender)
+	if !ok {
+		return sender
+	}
+	user, rcptDomain, ok := split(rcpt)
+	if !ok {
+		return sender
+	}
+	return local + "+" + tag(key, rcpt) + "." + user + "=" + rcptDomain + "@" + domain
+}
+
+// Decode extracts the original recipient from addr if it is a VERP address
+// derived from sender and signed with key. An empty key accepts nothing.
+func Decode(key, addr, sender string) (rcpt string, ok bool) {
+	if key == "" {
+		return "", false
+	}
+	local, domain, ok := split(sender)
+	if !ok {
+		return "", false
+	}
+	addrLocal, addrDomain, ok := split(addr)
+	if !ok || !strings.EqualFold(addrDomain, domain) {
+		return "", false
+	}
+	prefix := local + "+"
+	if len(addrLocal) <= len(prefix)+tagLen+1 || !strings.EqualFold(addrLocal[:len(prefix)], prefix) {
+		return "", false
+	}
+	signature, tail := addrLocal[len(prefix):len(prefix)+tagLen], addrLocal[len(prefix)+tagLen:]
+	if tail[0] != '.' {
+		return "", false
+	}
+	tail = tail[1:]
+	i := strings.LastIndexByte(tail, '=')
+	if i <= 0 || i == len(tail)-1 {
+		return "", false
+	}
+	rcpt = tail[:i] + "@" + tail[i+1:]
+	// Some MTAs change the case of the address, so compare in lower case
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(tag(key, rcpt))) {
+		return "", false
+	}
+	return rcpt, true
+}
+
+// tag signs rcpt, ignoring its case.
+func tag(key, rcpt string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.ToLower(rcpt)))
+	return hex.EncodeToString(mac.Sum(nil))[:tagLen]
+}
+
+func split(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
@@ -0,0 +1,58 @@
+package verp
+
+import "testing"
+
+const key = "test-key"
+
+func TestEncode(t *testing.T) {
+	got := Encode(key, "bounce@mail.example.com", "user@dest.org")
+	if got != "bounce+"+tag(key, "user@dest.org")+".user=dest.org@mail.example.com" {
+		t.Errorf("unexpected VERP sender: %s", got)
+	}
+	if got == Encode("other-key", "bounce@mail.example.com", "user@dest.org") {
+		t.Error("expected the tag to depend on the key")
+	}
+	if got := Encode(key, "nodomain", "user@dest.org"); got != "nodomain" {
+		t.Errorf("expected sender unchanged without domain, got %s", got)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	signed := func(rcpt string) string { return tag(key, rcpt) + "." }
+	tests := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{"bounce+" + signed("user@dest.org") + "user=dest.org@mail.example.com", "user@dest.org", true},
+		{"Bounce+" + signed("first.last@dest.org") + "first.last=dest.org@MAIL.example.com", "first.last@dest.org", true},
+		{"BOUNCE+" + signed("user@dest.org") + "USER=DEST.ORG@mail.example.com", "USER@DEST.ORG", true},
+		{"bounce+" + signed("a=b@dest.org") + "a=b=dest.org@mail.example.com", "a=b@dest.org", true},
+		{"bounce@mail.example.com", "", false},
+		{"bounce+user=dest.org@mail.example.com", "", false},
+		{"bounce+" + signed("user@dest.org") + "victim=dest.org@mail.example.com", "", false},
+		{"bounce+" + tag("other-key", "user@dest.org") + ".user=dest.org@mail.example.com", "", false},
+		{"bounce+" + signed("user@dest.org") + "user=dest.org@other.example.com", "", false},
+		{"bounce+" + signed("userdest.org") + "userdest.org@mail.example.com", "", false},
+		{"other+" + signed("user@dest.org") + "user=dest.org@mail.example.com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Decode(key, tt.addr, "bounce@mail.example.com")
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Decode(%q) = %q, %v; want %q, %v", tt.addr, got, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := Decode("", Encode("", "bounce@mail.example.com", "user@dest.org"), "bounce@mail.example.com"); ok {
+		t.Error("expected nothing accepted without a key")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	sender := "bounce@mail.example.com"
+	for _, rcpt := range []string{"user@dest.org", "a+tag@dest.org", "x=y@dest.org"} {
+		got, ok := Decode(key, Encode(key, sender, rcpt), sender)
+		if !ok || got != rcpt {
+			t.Errorf("round trip of %q gave %q, %v", rcpt, got, ok)
+		}
+	}
+}
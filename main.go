@@ -8,14 +8,12 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/emersion/go-smtp"
 	"github.com/joho/godotenv"
 
-	"smtp-proxy/internal/config"
-	"smtp-proxy/internal/proxy"
-	"smtp-proxy/internal/relay"
+	"github.com/VahanMargaryan/smtp-proxy/internal/redact"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/smtpproxy"
 )
 
 // version is set at build time via -ldflags.
@@ -23,6 +21,10 @@ var version = "dev"
 
 func main() {
 	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-version]\n       %s check [-connect]\n       %s test-send -to address\n       %s bench [-pipeline] [-c clients] [-n messages] [-size bytes]\n       %s stats [-from day] [-to day] [-user user] [-domain domain] [-by fields] [-json]\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if *showVersion {
 		fmt.Println(version)
@@ -32,59 +34,42 @@ func main() {
 	// Load .env file if present (ignore error if missing)
 	_ = godotenv.Load()
 
+	if flag.Arg(0) == "check" {
+		os.Exit(runCheck(flag.Args()[1:], os.Stdout))
+	}
+	if flag.Arg(0) == "test-send" {
+		os.Exit(runTestSend(flag.Args()[1:], os.Stdout))
+	}
+	if flag.Arg(0) == "bench" {
+		os.Exit(runBench(flag.Args()[1:], os.Stdout))
+	}
+	if flag.Arg(0) == "stats" {
+		os.Exit(runStats(flag.Args()[1:], os.Stdout))
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		slog.Error("configuration error", "error", err)
 		os.Exit(1)
 	}
 
-	// Set up structured logging
+	// Set up structured logging, with credentials masked in every record
 	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.LogLevel})
-	slog.SetDefault(slog.New(handler))
-
-	backend := proxy.NewBackend(cfg, relay.Send)
-
-	s := smtp.NewServer(backend)
-	s.Addr = cfg.ListenAddr
-	s.Domain = cfg.ServerDomain
-	s.AllowInsecureAuth = true
-	s.MaxMessageBytes = cfg.MaxMessageSize
-	s.MaxRecipients = 100
-	s.ReadTimeout = 60 * time.Second
-	s.WriteTimeout = 60 * time.Second
-
-	slog.Info("starting smtp proxy",
-		"listen", cfg.ListenAddr,
-		"upstream", cfg.DestHost,
-		"upstream_port", cfg.DestPort,
-		"from", cfg.DestFrom,
-	)
+	slog.SetDefault(slog.New(redact.NewHandler(handler, cfg.Secrets(), cfg.LogAddresses)))
 
-	// Start server in goroutine
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- s.ListenAndServe()
-	}()
+	srv, err := smtpproxy.New(cfg)
+	if err != nil {
+		slog.Error("configuration error", "error", err)
+		os.Exit(1)
+	}
 
-	// Wait for signal or server error
+	// Run until a signal, then shut down gracefully
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	select {
-	case err := <-errCh:
+	if err := srv.Run(ctx); err != nil {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
-	case <-ctx.Done():
-		slog.Info("shutting down...")
-	}
-
-	// Graceful shutdown with 30s timeout
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := s.Shutdown(shutdownCtx); err != nil {
-		slog.Error("shutdown error", "error", err)
-		os.Exit(1)
 	}
 
 	slog.Info("shutdown complete")
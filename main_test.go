@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// fakeSMTP is an SMTP server taking PLAIN logins for user and pass and
+// recording every message it accepts.
+type fakeSMTP struct {
+	user, pass string
+
+	mu       sync.Mutex
+	messages []fakeMessage
+}
+
+// fakeMessage is one transaction a fakeSMTP accepted.
+type fakeMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+func (f *fakeSMTP) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &fakeSession{server: f}, nil
+}
+
+func (f *fakeSMTP) received() []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMessage(nil), f.messages...)
+}
+
+type fakeSession struct {
+	server *fakeSMTP
+	msg    fakeMessage
+}
+
+func (s *fakeSession) AuthMechanisms() []string { return []string{sasl.Plain} }
+
+func (s *fakeSession) Auth(_ string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(_, user, pass string) error {
+		if user != s.server.user || pass != s.server.pass {
+			return errors.New("invalid credentials")
+		}
+		return nil
+	}), nil
+}
+
+func (s *fakeSession) Mail(from string, _ *smtp.MailOptions) error {
+	s.msg.from = from
+	return nil
+}
+
+func (s *fakeSession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	s.msg.to = append(s.msg.to, to)
+	return nil
+}
+
+func (s *fakeSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = data
+	s.server.mu.Lock()
+	s.server.messages = append(s.server.messages, s.msg)
+	s.server.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSession) Reset() { s.msg = fakeMessage{} }
+
+func (s *fakeSession) Logout() error { return nil }
+
+// startFakeSMTP runs a plaintext fakeSMTP and returns it with its address.
+func startFakeSMTP(t *testing.T, user, pass string) (*fakeSMTP, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeSMTP{user: user, pass: pass}
+	s := smtp.NewServer(fake)
+	s.Domain = "fake.local"
+	s.AllowInsecureAuth = true
+	s.ReadTimeout = 10 * time.Second
+	s.WriteTimeout = 10 * time.Second
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return fake, ln.Addr().String()
+}
+
+// setTestEnv sets the variables config.Load requires, with the upstream
+// at addr, and restores the default logger the subcommands replace.
+func setTestEnv(t *testing.T, addr string) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMTP_PROXY_USERNAME", "testuser")
+	t.Setenv("SMTP_PROXY_PASSWORD", "testpass")
+	t.Setenv("SMTP_DEST_HOST", host)
+	t.Setenv("SMTP_DEST_PORT", port)
+	t.Setenv("SMTP_DEST_USERNAME", "upstream@example.com")
+	t.Setenv("SMTP_DEST_PASSWORD", "upstreampass")
+	orig := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(orig) })
+}
@@ -0,0 +1,78 @@
+// Package processor defines middleware that runs between the proxy
+// receiving a message and relaying it, so scanners and transformers can
+// be added without changing the proxy package.
+package processor
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// Processor inspects or transforms messages. Returning an error stops the
+// message: an *smtp.SMTPError is sent to the client as is, any other
+// error becomes a temporary failure.
+type Processor interface {
+	// ProcessEnvelope runs before the message is sanitized. It may change
+	// env.Recipients; env.Message is not yet set.
+	ProcessEnvelope(env *relay.Envelope) error
+	// ProcessMessage runs on the sanitized message in env.Message and
+	// returns the message to relay.
+	ProcessMessage(env *relay.Envelope) ([]byte, error)
+}
+
+// Chain runs processors in order.
+type Chain []Processor
+
+// Envelope calls ProcessEnvelope on each processor, stopping at the first
+// error.
+func (c Chain) Envelope(env *relay.Envelope) error {
+	for _, p := range c {
+		if err := p.ProcessEnvelope(env); err != nil {
+			return fmt.Errorf("%T: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Message calls ProcessMessage on each processor, each seeing the output
+// of the one before, and stores the result in env.Message.
+func (c Chain) Message(env *relay.Envelope) error {
+	for _, p := range c {
+		msg, err := p.ProcessMessage(env)
+		if err != nil {
+			return fmt.Errorf("%T: %w", p, err)
+		}
+		env.Message = msg
+	}
+	return nil
+}
+
+// NewFunc is the constructor a plugin exports as NewProcessor.
+type NewFunc = func() (Processor, error)
+
+// Open loads a Go plugin built with -buildmode=plugin and returns the
+// processor made by its exported NewProcessor function. Plugins must be
+// built from this module tree with the same toolchain and dependency
+// versions as the proxy, and only load where the runtime supports plugins
+// (cgo on Linux, FreeBSD or macOS).
+func Open(path string) (Processor, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open plugin: %w", err)
+	}
+	sym, err := p.Lookup("NewProcessor")
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	newFunc, ok := sym.(NewFunc)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: NewProcessor is %T, want func() (processor.Processor, error)", path, sym)
+	}
+	proc, err := newFunc()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: NewProcessor: %w", path, err)
+	}
+	return proc, nil
+}
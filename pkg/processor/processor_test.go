@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+type stamp struct {
+	tag         string
+	envelopeErr error
+	calls       *[]string
+}
+
+func (p stamp) ProcessEnvelope(env *relay.Envelope) error {
+	*p.calls = append(*p.calls, p.tag)
+	return p.envelopeErr
+}
+
+func (p stamp) ProcessMessage(env *relay.Envelope) ([]byte, error) {
+	return append(bytes.Clone(env.Message), p.tag...), nil
+}
+
+func TestChain_Envelope(t *testing.T) {
+	var calls []string
+	errStop := errors.New("stop")
+	c := Chain{stamp{tag: "a", calls: &calls}, stamp{tag: "b", envelopeErr: errStop, calls: &calls}, stamp{tag: "c", calls: &calls}}
+
+	err := c.Envelope(&relay.Envelope{})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected wrapped stop error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "processor.stamp") {
+		t.Errorf("expected processor type in error, got %v", err)
+	}
+	if strings.Join(calls, "") != "ab" {
+		t.Errorf("expected chain to stop after b, got %v", calls)
+	}
+}
+
+func TestChain_Message(t *testing.T) {
+	var calls []string
+	env := &relay.Envelope{Message: []byte("msg:")}
+	if err := (Chain{stamp{tag: "a", calls: &calls}, stamp{tag: "b", calls: &calls}}).Message(env); err != nil {
+		t.Fatal(err)
+	}
+	if string(env.Message) != "msg:ab" {
+		t.Errorf("expected processors applied in order, got %q", env.Message)
+	}
+
+	// An empty chain leaves the message alone
+	if err := Chain(nil).Message(env); err != nil || string(env.Message) != "msg:ab" {
+		t.Errorf("unexpected result %q, %v", env.Message, err)
+	}
+}
+
+func TestOpen_Missing(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.so")); err == nil {
+		t.Error("expected error for missing plugin")
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"log/slog"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/abuse"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+var (
+	errAbuseDeferred = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Message deferred by policy, try again later",
+	}
+	errAbuseBlocked = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected by policy",
+	}
+)
+
+// screen scores the message for abuse. It returns the SMTP error for the
+// defer and block verdicts; tagging is left to the caller, after the
+// message is sanitized.
+func (s *Session) screen(env *relay.Envelope, raw []byte) (abuse.Result, error) {
+	if s.scorer == nil {
+		return abuse.Result{}, nil
+	}
+	res := s.scorer.Evaluate(&abuse.Message{
+		Username:     s.username,
+		RemoteIP:     s.remoteIP,
+		AuthFailures: s.authFailures,
+		Recipients:   env.Addresses(),
+		Raw:          raw,
+		Time:         env.ReceivedAt,
+	})
+	if res.Verdict == abuse.Accept {
+		return res, nil
+	}
+	slog.Warn("abuse score threshold reached",
+		"msg_id", env.ID,
+		"remote_ip", s.remoteIP,
+		"score", res.Score,
+		"reasons", res.Reasons,
+		"verdict", res.Verdict.String(),
+	)
+	switch res.Verdict {
+	case abuse.Defer:
+		return res, errAbuseDeferred
+	case abuse.Block:
+		return res, errAbuseBlocked
+	}
+	return res, nil
+}
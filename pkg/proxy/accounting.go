@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// SetAccounting makes sessions created afterwards count their relayed
+// messages in l.
+func (b *Backend) SetAccounting(l *accounting.Ledger) {
+	b.ledger = l
+}
+
+// account counts the outcome of relaying env for each recipient domain:
+// recipients the upstream accepted as sent, along with the message size,
+// those it rejected with a 5xx as failed, and the rest as deferred. A
+// ledger write error is logged; the message is not affected.
+func (s *Session) account(env *relay.Envelope, err error) {
+	if s.ledger == nil {
+		return
+	}
+	counts := make(map[string]accounting.Counts)
+	count := func(rcpt string, f func(*accounting.Counts)) {
+		domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		c := counts[domain]
+		f(&c)
+		counts[domain] = c
+	}
+	sent := func(c *accounting.Counts) { c.Sent++; c.Bytes += int64(len(env.Message)) }
+	deferred := func(c *accounting.Counts) { c.Deferred++ }
+	failed := func(c *accounting.Counts) { c.Failed++ }
+
+	var delivery *relay.DeliveryError
+	switch {
+	case err == nil:
+		for _, rcpt := range env.Addresses() {
+			count(rcpt, sent)
+		}
+	case errors.As(err, &delivery):
+		for _, rcpt := range delivery.Delivered {
+			count(rcpt, sent)
+		}
+		for _, f := range delivery.Failed {
+			var upstream *smtp.SMTPError
+			if errors.As(f.Err, &upstream) && upstream.Code >= 500 {
+				count(f.Recipient, failed)
+			} else {
+				count(f.Recipient, deferred)
+			}
+		}
+	default:
+		for _, rcpt := range env.Addresses() {
+			count(rcpt, deferred)
+		}
+	}
+	if err := s.ledger.Add(s.username, counts); err != nil {
+		slog.Warn("accounting write failed", "msg_id", env.ID, "error", err)
+	}
+}
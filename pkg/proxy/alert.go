@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/alert"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// SetAlerts makes sessions created afterwards report relay outcomes and
+// AUTH failures to m.
+func (b *Backend) SetAlerts(m *alert.Monitor) {
+	b.alerts = m
+}
+
+// relayFailed reports whether a relay ending in err points at a problem
+// with the upstream rather than the message: the message reached no
+// recipient and was not rejected outright.
+func relayFailed(err error) bool {
+	var delivery *relay.DeliveryError
+	if errors.As(err, &delivery) {
+		_, permanent := delivery.Permanent()
+		return !delivery.Partial() && !permanent
+	}
+	return err != nil
+}
+
+// reportUpstreamAuth tells the monitor whether a relay ending in err
+// logged in to the upstream, when it got that far: a failure at the
+// connection or TLS stage, or an open breaker, says nothing either way.
+func (s *Session) reportUpstreamAuth(err error) {
+	switch relay.Stage(err) {
+	case "auth":
+		s.alerts.UpstreamAuth(err)
+		return
+	case "mail", "rcpt", "data":
+		s.alerts.UpstreamAuth(nil)
+		return
+	}
+	var delivery *relay.DeliveryError
+	if err == nil || errors.As(err, &delivery) {
+		s.alerts.UpstreamAuth(nil)
+	}
+}
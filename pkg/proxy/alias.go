@@ -0,0 +1,57 @@
+package proxy
+
+import "strings"
+
+// rewriteRecipient applies the SMTP_RECIPIENT_REWRITE table to a RCPT TO
+// address: an entry for the whole address wins over a *@domain one. A
+// *@domain target keeps the local part as the client sent it. Rewritten
+// addresses are not looked up again.
+func rewriteRecipient(rewrites map[string]string, addr string) string {
+	if len(rewrites) == 0 {
+		return addr
+	}
+	if to, ok := rewrites[strings.ToLower(addr)]; ok {
+		return to
+	}
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok {
+		return addr
+	}
+	to, ok := rewrites["*@"+strings.ToLower(domain)]
+	if !ok {
+		return addr
+	}
+	if newDomain, wildcard := strings.CutPrefix(to, "*@"); wildcard {
+		return local + "@" + newDomain
+	}
+	return to
+}
+
+// expandGroup returns the members of the SMTP_RECIPIENT_GROUPS group addr,
+// with nested groups expanded and duplicates dropped, or addr itself if it
+// is not a group. A group met again on the way down is skipped, so even a
+// Config filled in without Load's loop check cannot expand forever.
+func expandGroup(groups map[string][]string, addr string) []string {
+	if _, ok := groups[strings.ToLower(addr)]; !ok {
+		return []string{addr}
+	}
+	var members []string
+	seen := make(map[string]bool)
+	var expand func(group string)
+	expand = func(group string) {
+		seen[group] = true
+		for _, m := range groups[group] {
+			if seen[m] {
+				continue
+			}
+			if _, ok := groups[m]; ok {
+				expand(m)
+				continue
+			}
+			seen[m] = true
+			members = append(members, m)
+		}
+	}
+	expand(strings.ToLower(addr))
+	return members
+}
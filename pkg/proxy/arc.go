@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/arc"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// seal adds the proxy's ARC set to the final message. chain is the
+// validation result of the chain the message arrived with, results the
+// authentication results to record. A message that cannot be sealed, or
+// whose chain failed validation, is relayed as is.
+func (s *Session) seal(env *relay.Envelope, chain, results string) {
+	if chain == arc.ChainFail {
+		slog.Warn("arc seal skipped", "msg_id", env.ID, "error", "incoming chain failed validation")
+		return
+	}
+	sealed, err := s.sealer.Seal(env.Message, chain, results)
+	if err != nil {
+		slog.Warn("arc seal skipped", "msg_id", env.ID, "error", err)
+		return
+	}
+	env.Message = sealed
+}
+
+// authResults lists the session's authentication results for the ARC
+// seal: SMTP AUTH, unless the client submitted from a trusted network,
+// the SPF result of such a client, and the incoming DKIM verdicts.
+func (s *Session) authResults(dkimResults string) string {
+	var methods []string
+	if !s.trusted {
+		methods = append(methods, "auth=pass")
+	}
+	if s.spfResult != "" {
+		methods = append(methods, "spf="+string(s.spfResult)+" smtp.mailfrom="+s.spfDomain)
+	}
+	if dkimResults != "" {
+		methods = append(methods, dkimResults)
+	}
+	if len(methods) == 0 {
+		return "none"
+	}
+	return strings.Join(methods, "; ")
+}
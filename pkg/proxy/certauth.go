@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"strings"
+)
+
+// certUser returns the proxy user a verified client certificate maps to in
+// SMTP_TLS_CLIENT_USERS, trying its subject CN, then its DNS and email
+// SANs, and the identity that matched. It returns "" for connections
+// without a verified certificate or whose certificate is not mapped.
+func certUser(users map[string]string, state tls.ConnectionState) (user, identity string) {
+	if len(users) == 0 || len(state.VerifiedChains) == 0 {
+		return "", ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	identities := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	for _, id := range append(identities, leaf.EmailAddresses...) {
+		if user, ok := users[strings.ToLower(id)]; ok {
+			return user, id
+		}
+	}
+	return "", ""
+}
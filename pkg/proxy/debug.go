@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// debugHeader asks for the upstream dialogue of a message to be logged.
+// It is honoured only with SMTP_DEBUG_HEADER and always stripped by the
+// sanitizer before relay.
+const debugHeader = "X-Debug"
+
+// debugRequested reports whether raw carries an X-Debug header with a value
+// other than "0", "false", "no" or "off".
+func debugRequested(raw []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	switch v := strings.ToLower(strings.TrimSpace(msg.Header.Get(debugHeader))); v {
+	case "", "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
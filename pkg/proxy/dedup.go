@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/mail"
+	"slices"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader lets a client name a message so that its retries
+// are recognized whatever else changed. It is stripped by the sanitizer
+// before relay.
+const idempotencyKeyHeader = "X-Idempotency-Key"
+
+// dedupWindow remembers the queue ID of each message relayed within the
+// last window, so a client resubmitting one after a crash gets the
+// original reply instead of sending it twice. A message is reserved while
+// it is relayed, so a resubmission arriving meanwhile waits for the
+// outcome instead of relaying it a second time.
+type dedupWindow struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	seen  map[string]dedupEntry
+	swept time.Time
+}
+
+type dedupEntry struct {
+	id      string
+	at      time.Time
+	pending chan struct{} // closed when the relay under way ends, nil once relayed
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{window: window, now: time.Now, seen: make(map[string]dedupEntry)}
+}
+
+// reserve returns the queue ID of the message relayed under key within
+// the window. When there is none, it reserves key for the message id about
+// to be relayed and returns false; the caller then records or releases
+// it. While another message with key is being relayed, reserve waits for
+// its outcome. A nil *dedupWindow remembers nothing.
+func (w *dedupWindow) reserve(key, id string) (string, bool) {
+	if w == nil {
+		return "", false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		e, ok := w.seen[key]
+		if ok && e.pending != nil {
+			w.mu.Unlock()
+			<-e.pending
+			w.mu.Lock()
+			continue
+		}
+		if ok && w.now().Sub(e.at) <= w.window {
+			return e.id, true
+		}
+		w.seen[key] = dedupEntry{id: id, at: w.now(), pending: make(chan struct{})}
+		return "", false
+	}
+}
+
+// record remembers that the message with key was relayed as id, ending
+// its reservation. Expired entries are dropped at most once per window.
+func (w *dedupWindow) record(key, id string) {
+	if w == nil {
+		return
+	}
+	now := w.now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.swept) > w.window {
+		for k, e := range w.seen {
+			if e.pending == nil && now.Sub(e.at) > w.window {
+				delete(w.seen, k)
+			}
+		}
+		w.swept = now
+	}
+	if e, ok := w.seen[key]; ok && e.pending != nil {
+		close(e.pending)
+	}
+	w.seen[key] = dedupEntry{id: id, at: now}
+}
+
+// release drops the reservation of key by id when its message was not
+// relayed, so that a waiting resubmission is relayed instead. It does
+// nothing once the message is recorded.
+func (w *dedupWindow) release(key, id string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.seen[key]; ok && e.pending != nil && e.id == id {
+		close(e.pending)
+		delete(w.seen, key)
+	}
+}
+
+// dedupMessageKey identifies a message for deduplication among the user's
+// own submissions: by its X-Idempotency-Key header when present, otherwise
+// by a hash of the envelope sender, the recipients and the body. The
+// header is left out of the hash since clients regenerate Date and
+// Message-ID on every attempt.
+func dedupMessageKey(username, from string, recipients []string, raw []byte) string {
+	h := sha256.New()
+	h.Write([]byte(username + "\x00"))
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if key := msg.Header.Get(idempotencyKeyHeader); key != "" {
+			h.Write([]byte("key\x00" + key))
+			return hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	h.Write([]byte("message\x00" + from + "\x00"))
+	rcpts := slices.Sorted(slices.Values(recipients))
+	for _, r := range rcpts {
+		h.Write([]byte(r + "\x00"))
+	}
+	h.Write(messageBody(raw))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// messageBody returns the part of raw after the blank line ending the
+// header, or nothing if there is none.
+func messageBody(raw []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i != -1 {
+			return raw[i+len(sep):]
+		}
+	}
+	return nil
+}
+
+// checkDuplicate returns the queue ID under which the message with key
+// was already relayed, or "" if it was not. In that case key is reserved
+// for id until the caller records or releases it.
+func (s *Session) checkDuplicate(id, key string) string {
+	original, ok := s.dedup.reserve(key, id)
+	if !ok {
+		return ""
+	}
+	slog.Info("duplicate message not relayed", "msg_id", id, "original_msg_id", original, "user", s.username)
+	s.stats.Count("messages.duplicate", 1)
+	return original
+}
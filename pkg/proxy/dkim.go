@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/dkim"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// errDKIMRequired refuses a message from a domain in SMTP_DKIM_REQUIRE_DOMAINS
+// without a passing aligned signature (RFC 7372 section 3.1).
+var errDKIMRequired = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 20},
+	Message:      "No passing DKIM signature found",
+}
+
+// errDKIMTempFail defers such a message when a key lookup failed, since
+// the signature may verify once DNS answers.
+var errDKIMTempFail = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+	Message:      "DKIM key lookup failed, try again later",
+}
+
+// verifyDKIM checks the signatures raw arrived with and logs each verdict.
+// It returns them as an Authentication-Results method list for the ARC
+// seal, or an error if the From domain requires a passing signature and
+// none aligned with it passed.
+func (s *Session) verifyDKIM(env *relay.Envelope, raw []byte) (string, error) {
+	results := s.dkim.Verify(raw)
+	from := fromDomain(raw)
+
+	if len(results) == 0 {
+		slog.Info("dkim verification", "msg_id", env.ID, "from_domain", from, "result", "none")
+	}
+	methods := make([]string, 0, len(results))
+	tempFail := false
+	for _, r := range results {
+		attrs := []slog.Attr{
+			slog.String("msg_id", env.ID),
+			slog.String("from_domain", from),
+			slog.String("domain", r.Domain),
+			slog.String("selector", r.Selector),
+			slog.String("result", r.Status),
+		}
+		if r.Err != nil {
+			attrs = append(attrs, slog.String("error", r.Err.Error()))
+		}
+		slog.LogAttrs(context.Background(), slog.LevelInfo, "dkim verification", attrs...)
+		method := "dkim=" + r.Status
+		if r.Domain != "" {
+			method += " header.d=" + r.Domain + " header.s=" + r.Selector
+		}
+		methods = append(methods, method)
+		tempFail = tempFail || r.Status == dkim.TempError
+	}
+
+	if from != "" && slices.Contains(s.config.DKIMRequireDomains, from) && !dkim.Aligned(results, from) {
+		if tempFail {
+			slog.Warn("dkim verification deferred", "msg_id", env.ID, "from_domain", from)
+			return "", errDKIMTempFail
+		}
+		slog.Warn("dkim verification required", "msg_id", env.ID, "from_domain", from)
+		return "", errDKIMRequired
+	}
+	if len(methods) == 0 {
+		return "dkim=none", nil
+	}
+	return strings.Join(methods, "; "), nil
+}
+
+// fromDomain returns the lowercase domain of the From address of raw, or
+// "" if there is none.
+func fromDomain(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	addr, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+	_, domain, _ := strings.Cut(addr.Address, "@")
+	return strings.ToLower(domain)
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+// errDMARCMisaligned refuses a message whose From domain enforces DMARC
+// when neither the envelope sender nor the upstream's signing domain
+// aligns with it, so it would be quarantined or rejected downstream.
+var errDMARCMisaligned = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "From domain's DMARC policy does not allow relaying through this server",
+}
+
+// guardAction returns the SMTP_DMARC_GUARD action for a From domain: the
+// entry for the domain or its closest parent, else the "*" entry.
+func guardAction(guard map[string]string, domain string) string {
+	for d := domain; d != ""; {
+		if action, ok := guard[d]; ok {
+			return action
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return guard["*"]
+}
+
+// guardDMARC checks whether the sanitized message would fail the DMARC
+// policy of its From domain once relayed with cfg's envelope sender and
+// signing domain. Depending on the domain's action it logs the failure,
+// refuses the message, or rewrites From to the envelope sender, keeping
+// the original in X-Original-From and, unless one is set, Reply-To.
+// Policy lookup errors are logged and let the message through.
+func (s *Session) guardDMARC(cfg *config.Config, env *relay.Envelope) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(env.Message))
+	if err != nil {
+		return nil
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+	domain = strings.ToLower(domain)
+	action := guardAction(cfg.DMARCGuard, domain)
+	if domain == "" || action == "" {
+		return nil
+	}
+
+	policy, err := s.dmarc(domain)
+	if err != nil {
+		slog.Warn("dmarc policy lookup failed", "msg_id", env.ID, "from_domain", domain, "error", err)
+		return nil
+	}
+	_, envelopeDomain, _ := strings.Cut(cfg.DestFrom, "@")
+	if !policy.Enforced() || policy.Passes(domain, envelopeDomain, cfg.DMARCSigningDomain) {
+		return nil
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelWarn, "dmarc alignment would fail",
+		slog.String("msg_id", env.ID),
+		slog.String("from_domain", domain),
+		slog.String("policy", policy.Action),
+		slog.String("policy_domain", policy.Domain),
+		slog.String("envelope_domain", envelopeDomain),
+		slog.String("signing_domain", cfg.DMARCSigningDomain),
+		slog.String("action", action),
+	)
+	switch action {
+	case "reject":
+		return errDMARCMisaligned
+	case "rewrite":
+		name := from.Name
+		if name == "" {
+			name = from.Address
+		}
+		fields := []sanitizer.Field{
+			{Name: "From", Value: (&mail.Address{Name: name + " via " + cfg.DestDomain, Address: cfg.DestFrom}).String()},
+			{Name: "X-Original-From", Value: msg.Header.Get("From")},
+		}
+		if msg.Header.Get("Reply-To") == "" {
+			fields = append(fields, sanitizer.Field{Name: "Reply-To", Value: from.String()})
+		}
+		env.Message = sanitizer.SetFields(env.Message, fields...)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// checkDNSBL looks the session's client up in SMTP_DNSBL_LISTS, once per
+// connection, and logs any listing. With SMTP_DNSBL_ACTION=reject a
+// listed client is refused. Lookup failures are logged and ignored, so an
+// unreachable list never blocks mail.
+func (s *Session) checkDNSBL() error {
+	if !s.dnsblChecked {
+		s.dnsblChecked = true
+		ip := net.ParseIP(s.remoteIP)
+		if ip == nil {
+			return nil
+		}
+		listings, err := s.dnsbl.Check(ip)
+		if err != nil {
+			slog.Warn("dnsbl lookup failed", "remote_ip", s.remoteIP, "error", err)
+		}
+		for _, l := range listings {
+			s.dnsblListed = append(s.dnsblListed, l.Zone)
+			slog.LogAttrs(context.Background(), slog.LevelWarn, "client listed in dnsbl",
+				slog.String("remote_ip", s.remoteIP),
+				slog.String("zone", l.Zone),
+				slog.String("codes", strings.Join(l.Codes, ",")),
+				slog.String("action", s.config.DNSBLAction),
+			)
+		}
+	}
+	if len(s.dnsblListed) == 0 || s.config.DNSBLAction != "reject" {
+		return nil
+	}
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Client host [" + s.remoteIP + "] blocked using " + s.dnsblListed[0],
+	}
+}
+
+// dnsblHeader returns the X-DNSBL field naming the lists the client is
+// on, or "" if it is on none or tagging is off.
+func (s *Session) dnsblHeader() string {
+	if len(s.dnsblListed) == 0 || s.config.DNSBLAction != "tag" {
+		return ""
+	}
+	return "X-DNSBL: " + strings.Join(s.dnsblListed, ", ") + "\r\n"
+}
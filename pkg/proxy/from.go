@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/mail"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+// errFromNotAllowed refuses a message whose From header names an address
+// the authenticated user may not send as (SMTP_FROM_ALLOWED).
+var errFromNotAllowed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "From address not allowed for this user",
+}
+
+// checkFrom enforces SMTP_FROM_ALLOWED for the session's user on the
+// client's message. Every From mailbox must be allowed; a missing or
+// unparsable From is not. It returns the identity to rewrite From to,
+// or "" to leave the message alone.
+func (s *Session) checkFrom(id string, raw []byte) (string, error) {
+	allowed, ok := s.config.FromAllowed[s.username]
+	if !ok {
+		return "", nil
+	}
+	var from []string
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		list, _ := msg.Header.AddressList("From")
+		for _, a := range list {
+			from = append(from, a.Address)
+		}
+	}
+	disallowed := len(from) == 0
+	for _, addr := range from {
+		disallowed = disallowed || !allowed.Allows(addr)
+	}
+	if !disallowed {
+		return "", nil
+	}
+
+	slog.Warn("from address not allowed", "msg_id", id, "user", s.username, "from", from, "action", s.config.FromAction)
+	if s.config.FromAction == "rewrite" {
+		return allowed.Addresses[0], nil
+	}
+	return "", errFromNotAllowed
+}
+
+// rewriteFrom replaces the From field of the sanitized message with
+// identity, keeping the original in X-Original-From.
+func rewriteFrom(env *relay.Envelope, identity string) {
+	fields := []sanitizer.Field{{Name: "From", Value: identity}}
+	if msg, err := mail.ReadMessage(bytes.NewReader(env.Message)); err == nil {
+		if original := msg.Header.Get("From"); original != "" {
+			fields = append(fields, sanitizer.Field{Name: "X-Original-From", Value: original})
+		}
+	}
+	env.Message = sanitizer.SetFields(env.Message, fields...)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/greylist"
+)
+
+// SetGreylist makes unauthenticated sessions from SMTP_TRUSTED_NETWORKS
+// created afterwards greylist their recipients at RCPT.
+func (b *Backend) SetGreylist(g *greylist.Store) {
+	b.grey = g
+}
+
+// checkGreylist defers a recipient whose triplet has not been seen long
+// enough, telling the client when to retry. A store write error is
+// logged; the decision stands.
+func (s *Session) checkGreylist(to string) error {
+	ip := net.ParseIP(s.remoteIP)
+	if ip == nil {
+		return nil
+	}
+	ok, wait, err := s.grey.Check(ip, s.from, to)
+	if err != nil {
+		slog.Warn("greylist write failed", "error", err)
+	}
+	if ok {
+		return nil
+	}
+	slog.Info("greylisted", "msg_id", s.queueID, "remote_ip", s.remoteIP, "client_from", s.from, "to", to, "retry_in", wait)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, please try again in " + strconv.Itoa(int(wait.Seconds())) + " seconds",
+	}
+}
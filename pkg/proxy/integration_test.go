@@ -1,9 +1,12 @@
 package proxy_test
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/textproto"
 	"strconv"
 	"strings"
 	"testing"
@@ -12,8 +15,9 @@ import (
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 
-	"smtp-proxy/internal/config"
-	"smtp-proxy/internal/proxy"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/proxy"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
 )
 
 // mockUpstream captures messages received by a mock upstream SMTP server.
@@ -105,6 +109,12 @@ func startMockUpstream(t *testing.T) (*mockUpstream, string) {
 
 func startProxy(t *testing.T, upstreamAddr string) string {
 	t.Helper()
+	return startProxyWith(t, upstreamAddr, nil)
+}
+
+// startProxyWith starts a proxy whose config is adjusted by configure.
+func startProxyWith(t *testing.T, upstreamAddr string, configure func(*config.Config)) string {
+	t.Helper()
 
 	host, portStr, _ := net.SplitHostPort(upstreamAddr)
 	destPort, err := strconv.Atoi(portStr)
@@ -125,9 +135,12 @@ func startProxy(t *testing.T, upstreamAddr string) string {
 		ServerDomain:   "proxy.local",
 		MaxMessageSize: 1024 * 1024,
 	}
+	if configure != nil {
+		configure(cfg)
+	}
 
 	// Use a plaintext relay for testing (mock upstream has no TLS)
-	plainSend := func(cfg *config.Config, recipients []string, message []byte) error {
+	plainSend := func(cfg *config.Config, env *relay.Envelope) error {
 		addr := net.JoinHostPort(cfg.DestHost, portStr)
 		client, err := smtp.Dial(addr)
 		if err != nil {
@@ -140,14 +153,17 @@ func startProxy(t *testing.T, upstreamAddr string) string {
 			return err
 		}
 
-		if err := client.SendMail(cfg.DestFrom, recipients, strings.NewReader(string(message))); err != nil {
+		if err := client.SendMail(cfg.DestFrom, env.Addresses(), strings.NewReader(string(env.Message))); err != nil {
 			return err
 		}
 
 		return client.Quit()
 	}
 
-	backend := proxy.NewBackend(cfg, plainSend)
+	backend, err := proxy.NewBackend(cfg, plainSend)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -320,3 +336,193 @@ func TestIntegration_MultipleRecipients(t *testing.T) {
 		t.Errorf("expected 3 recipients, got %d: %v", len(mock.recipients), mock.recipients)
 	}
 }
+
+func TestIntegration_BDAT(t *testing.T) {
+	mock, upstreamAddr := startMockUpstream(t)
+	proxyAddr := startProxy(t, upstreamAddr)
+
+	conn, err := textproto.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	expect := func(code int) string {
+		t.Helper()
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	cmd := func(code int, line string) string {
+		t.Helper()
+		if err := conn.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		return expect(code)
+	}
+	bdat := func(chunk string, last bool) {
+		t.Helper()
+		suffix := ""
+		if last {
+			suffix = " LAST"
+		}
+		fmt.Fprintf(conn.W, "BDAT %d%s\r\n%s", len(chunk), suffix, chunk)
+		if err := conn.W.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		expect(250)
+	}
+
+	expect(220)
+	if ehlo := cmd(250, "EHLO client.test"); !strings.Contains(ehlo, "CHUNKING") {
+		t.Fatalf("expected CHUNKING advertised, got %q", ehlo)
+	}
+	cmd(235, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00proxyuser\x00proxypass")))
+	cmd(250, "MAIL FROM:<sender@test.com>")
+	cmd(250, "RCPT TO:<r1@example.com>")
+	bdat("From: sender@test.com\r\nSubject: Chunked\r\n\r\n", false)
+	bdat(".dot line\r\nBody\r\n", true)
+
+	select {
+	case <-mock.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	if !strings.Contains(mock.data, "Subject: Chunked") || !strings.Contains(mock.data, "\r\n.dot line\r\nBody") {
+		t.Errorf("unexpected upstream message %q", mock.data)
+	}
+}
+
+func TestIntegration_SessionLimits(t *testing.T) {
+	_, upstreamAddr := startMockUpstream(t)
+	proxyAddr := startProxyWith(t, upstreamAddr, func(cfg *config.Config) {
+		cfg.MaxMessagesPerConn = 1
+		cfg.MaxRcptsPerSession = 2
+	})
+
+	dial := func() *textproto.Conn {
+		t.Helper()
+		conn, err := textproto.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("failed to connect to proxy: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	cmd := func(conn *textproto.Conn, code int, line string) {
+		t.Helper()
+		if err := conn.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("%s: %v (%s)", line, err, msg)
+		}
+	}
+	open := func() *textproto.Conn {
+		t.Helper()
+		conn := dial()
+		if _, _, err := conn.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		cmd(conn, 250, "EHLO client.test")
+		cmd(conn, 235, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00proxyuser\x00proxypass")))
+		return conn
+	}
+	closed := func(conn *textproto.Conn) {
+		t.Helper()
+		if _, err := conn.ReadLine(); !errors.Is(err, io.EOF) {
+			t.Errorf("expected the connection closed, got %v", err)
+		}
+	}
+
+	conn := open()
+	cmd(conn, 250, "MAIL FROM:<sender@test.com>")
+	cmd(conn, 250, "RCPT TO:<r1@example.com>")
+	cmd(conn, 250, "RCPT TO:<r2@example.com>")
+	cmd(conn, 421, "RCPT TO:<r3@example.com>")
+	closed(conn)
+
+	conn = open()
+	cmd(conn, 250, "MAIL FROM:<sender@test.com>")
+	cmd(conn, 250, "RSET")
+	cmd(conn, 421, "MAIL FROM:<sender@test.com>")
+	closed(conn)
+}
+
+func TestIntegration_LMTP(t *testing.T) {
+	cfg := &config.Config{
+		DestFrom:       "upstream@example.com",
+		DestDomain:     "example.com",
+		ServerDomain:   "proxy.local",
+		MaxMessageSize: 1024 * 1024,
+		// Statuses are reported for the addresses the client gave
+		RecipientRewrites: map[string]string{"*@old.example": "*@example.org"},
+	}
+	var relayed *relay.Envelope
+	send := func(_ *config.Config, env *relay.Envelope) error {
+		relayed = env
+		return &relay.DeliveryError{
+			Delivered: []string{"ok@example.org"},
+			Failed: []relay.RecipientError{{
+				Recipient: "gone@example.org",
+				Err:       &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+			}},
+		}
+	}
+	backend, err := proxy.NewBackend(cfg, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := smtp.NewServer(backend.LMTP())
+	s.LMTP = true
+	s.Domain = cfg.ServerDomain
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClientLMTP(conn)
+	defer c.Close()
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("expected no AUTH on the LMTP listener")
+	}
+	// No AUTH: local agents are trusted
+	if err := c.Mail("mda@localhost", nil); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	for _, rcpt := range []string{"ok@example.org", "gone@old.example"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("RCPT %s: %v", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	_, _ = io.WriteString(w, "Subject: LMTP\r\n\r\nBody\r\n")
+	err = w.Close()
+
+	var statuses smtp.LMTPDataError
+	if !errors.As(err, &statuses) {
+		t.Fatalf("expected per-recipient errors, got %v", err)
+	}
+	if len(statuses) != 1 || statuses["gone@old.example"] == nil || statuses["gone@old.example"].Code != 550 {
+		t.Errorf("expected only gone@old.example rejected with 550, got %v", statuses)
+	}
+	if relayed == nil || relayed.Username != "lmtp" {
+		t.Errorf("expected message relayed as lmtp, got %+v", relayed)
+	}
+}
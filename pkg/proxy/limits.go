@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errTooManyRelays = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Too many messages in flight, try again later",
+	}
+	errTooManyMessages = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many messages in this session, closing connection",
+	}
+	errTooManySessionRcpts = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients in this session, closing connection",
+	}
+)
+
+// limiter enforces the in-flight relay cap across sessions. A zero limit
+// means unlimited. A nil *limiter allows everything, which keeps sessions
+// built directly in tests working without one. Connection caps are
+// enforced where connections are accepted, by listener.WithConnLimit.
+type limiter struct {
+	maxRelays int
+
+	mu     sync.Mutex
+	relays int
+}
+
+func newLimiter(maxRelays int) *limiter {
+	return &limiter{maxRelays: maxRelays}
+}
+
+// acquireRelay reserves an in-flight DATA slot. It never blocks: callers
+// answer with a temporary failure so clients retry instead of piling up.
+func (l *limiter) acquireRelay() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxRelays > 0 && l.relays >= l.maxRelays {
+		return false
+	}
+	l.relays++
+	return true
+}
+
+func (l *limiter) releaseRelay() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.relays--
+}
+
+// inFlight returns the number of DATA slots in use.
+func (l *limiter) inFlight() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.relays
+}
+
+// checkTransaction counts a MAIL command against the per-connection
+// message limit.
+func (s *Session) checkTransaction() error {
+	if s.transactions++; s.maxMessages > 0 && s.transactions > s.maxMessages {
+		slog.Warn("session message limit reached", "remote_ip", s.remoteIP, "limit", s.maxMessages)
+		s.hangUp()
+		return errTooManyMessages
+	}
+	return nil
+}
+
+// checkSessionRcpt counts a RCPT command against the per-session
+// recipient limit.
+func (s *Session) checkSessionRcpt() error {
+	if s.rcpts++; s.maxRcpts > 0 && s.rcpts > s.maxRcpts {
+		slog.Warn("session recipient limit reached", "remote_ip", s.remoteIP, "limit", s.maxRcpts)
+		s.hangUp()
+		return errTooManySessionRcpts
+	}
+	return nil
+}
+
+// hangUp shuts down the reading side of the client connection, so go-smtp
+// still writes the pending 421 and then sees end of input and closes.
+// It unwraps TLS and listener wrappers to reach the socket.
+func (s *Session) hangUp() {
+	if s.conn == nil {
+		return
+	}
+	conn := s.conn.Conn()
+	for conn != nil {
+		if cr, ok := conn.(interface{ CloseRead() error }); ok {
+			_ = cr.CloseRead()
+			return
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// remoteIP returns the host part of the connection's remote address.
+func remoteIP(c *smtp.Conn) string {
+	if c == nil || c.Conn() == nil {
+		return ""
+	}
+	addr := c.Conn().RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+// lmtpUser is the client identity of LMTP sessions, e.g. in {user}
+// header rule variables.
+const lmtpUser = "lmtp"
+
+// LMTP returns a backend for an LMTP listener (RFC 2033) sharing b's
+// pipeline. Its sessions are trusted local submitters: AUTH is neither
+// offered nor required, and each recipient gets its own reply to DATA.
+func (b *Backend) LMTP() smtp.Backend {
+	return lmtpBackend{b}
+}
+
+type lmtpBackend struct {
+	*Backend
+}
+
+func (b lmtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := b.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	s := sess.(*Session)
+	s.auth = true
+	s.trusted = false
+	s.username = lmtpUser
+	s.maxMessages, s.maxRcpts = 0, 0
+	return &lmtpSession{s}, nil
+}
+
+// lmtpSession forwards to a Session without exposing its AUTH methods.
+type lmtpSession struct {
+	s *Session
+}
+
+var _ smtp.LMTPSession = (*lmtpSession)(nil)
+
+func (l *lmtpSession) Mail(from string, opts *smtp.MailOptions) error {
+	return l.s.Mail(from, opts)
+}
+
+func (l *lmtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return l.s.Rcpt(to, opts)
+}
+
+func (l *lmtpSession) Data(r io.Reader) error {
+	return l.s.Data(r)
+}
+
+func (l *lmtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	return l.s.data(r, status)
+}
+
+func (l *lmtpSession) Reset() {
+	l.s.Reset()
+}
+
+func (l *lmtpSession) Logout() error {
+	return l.s.Logout()
+}
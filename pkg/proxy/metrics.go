@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/statsd"
+)
+
+// SetMetrics makes sessions created afterwards report to m.
+func (b *Backend) SetMetrics(m *statsd.Client) {
+	b.stats = m
+}
+
+// countMessage records the outcome of a DATA command by the class of its
+// reply: relayed (2xx, including partial deliveries), deferred (4xx) or
+// rejected (5xx). Use it deferred before recoverMessage, so a recovered
+// panic counts as deferred.
+func (s *Session) countMessage(err *error) {
+	if s.stats == nil {
+		return
+	}
+	result := "relayed"
+	var reply *smtp.SMTPError
+	switch {
+	case *err == nil:
+	case !errors.As(*err, &reply):
+		// go-smtp answers other errors with 554
+		result = "rejected"
+	case reply.Code >= 500:
+		result = "rejected"
+	case reply.Code >= 400:
+		result = "deferred"
+	}
+	s.stats.Count("messages", 1, "result:"+result)
+}
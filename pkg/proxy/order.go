@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"net/mail"
+	"sync"
+)
+
+// orderingKeyHeader lets a client choose the FIFO stream a message belongs
+// to. It is stripped by the sanitizer before relay.
+const orderingKeyHeader = "X-Ordering-Key"
+
+// sequencer relays messages sharing a key strictly in the order they
+// arrive. Each acquire queues behind the previous holder of the same key, so
+// unlike a plain mutex the hand-off order is FIFO.
+type sequencer struct {
+	mu    sync.Mutex
+	tails map[string]chan struct{}
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{tails: make(map[string]chan struct{})}
+}
+
+// acquire blocks until every earlier message with the same key has been
+// relayed, and returns the function that releases the next one. A nil
+// *sequencer never blocks.
+func (q *sequencer) acquire(key string) (release func()) {
+	if q == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	q.mu.Lock()
+	prev := q.tails[key]
+	q.tails[key] = done
+	q.mu.Unlock()
+
+	if prev != nil {
+		<-prev
+	}
+
+	return func() {
+		q.mu.Lock()
+		if q.tails[key] == done {
+			delete(q.tails, key)
+		}
+		q.mu.Unlock()
+		close(done)
+	}
+}
+
+// orderingKey returns the X-Ordering-Key header value, falling back to the
+// authenticated username.
+func orderingKey(raw []byte, username string) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err == nil {
+		if key := msg.Header.Get(orderingKeyHeader); key != "" {
+			return key
+		}
+	}
+	return username
+}
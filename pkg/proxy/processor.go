@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// errProcessingFailed is returned when a processor fails without choosing
+// its own reply.
+var errProcessingFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Message processing failed, try again later",
+}
+
+// processEnvelope runs the processor chain before sanitization.
+func (s *Session) processEnvelope(env *relay.Envelope) error {
+	return processorError(env, s.procs.Envelope(env))
+}
+
+// processMessage runs the processor chain on the sanitized message, then
+// the message script, which has the last word.
+func (s *Session) processMessage(env *relay.Envelope) error {
+	if err := processorError(env, s.procs.Message(env)); err != nil {
+		return err
+	}
+	return s.runScript(env)
+}
+
+// processorError maps a processor error to the SMTP reply: processors may
+// return an *smtp.SMTPError to reject with their own code.
+func processorError(env *relay.Envelope, err error) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		slog.Info("message rejected by processor", "msg_id", env.ID, "error", err)
+		return smtpErr
+	}
+	slog.Error("message processor failed", "msg_id", env.ID, "error", err)
+	return errProcessingFailed
+}
@@ -0,0 +1,860 @@
+// Package proxy implements the SMTP side of the relay: a go-smtp Backend
+// that authenticates clients, screens and sanitizes their messages and
+// hands them to a relay.SendFunc.
+package proxy
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/abuse"
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+	"github.com/VahanMargaryan/smtp-proxy/internal/alert"
+	"github.com/VahanMargaryan/smtp-proxy/internal/arc"
+	"github.com/VahanMargaryan/smtp-proxy/internal/attachment"
+	"github.com/VahanMargaryan/smtp-proxy/internal/clamav"
+	"github.com/VahanMargaryan/smtp-proxy/internal/dkim"
+	"github.com/VahanMargaryan/smtp-proxy/internal/dmarc"
+	"github.com/VahanMargaryan/smtp-proxy/internal/dnsbl"
+	"github.com/VahanMargaryan/smtp-proxy/internal/greylist"
+	"github.com/VahanMargaryan/smtp-proxy/internal/script"
+	"github.com/VahanMargaryan/smtp-proxy/internal/shim"
+	"github.com/VahanMargaryan/smtp-proxy/internal/smime"
+	"github.com/VahanMargaryan/smtp-proxy/internal/spf"
+	"github.com/VahanMargaryan/smtp-proxy/internal/statsd"
+	"github.com/VahanMargaryan/smtp-proxy/internal/suppression"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/processor"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+// errUpstreamUnavailable is returned while the upstream circuit is open.
+var errUpstreamUnavailable = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Upstream unavailable, try again later",
+}
+
+// errMessageTooLarge is returned for messages over MaxMessageSize, whether
+// declared via MAIL SIZE or discovered while reading DATA.
+var errMessageTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message too large",
+}
+
+// errHeaderTooLarge is returned for messages whose header is over the
+// SMTP_MAX_HEADER_* limits.
+var errHeaderTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message header too large",
+}
+
+// errDuplicateHeaders is returned under SMTP_DUPLICATE_HEADERS=reject for
+// messages repeating From, Subject, Date or Content-Type.
+var errDuplicateHeaders = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Duplicate header fields",
+}
+
+// queueIDHeader carries the queue ID to the recipient unless
+// SMTP_QUEUE_ID_HEADER=false.
+const queueIDHeader = "X-Proxy-Queue-ID"
+
+// queuedReply is the reply to an accepted message. It names the message's
+// queue ID, which clients can quote when asking about it. go-smtp sends an
+// *smtp.SMTPError returned from Data as the reply whatever its code.
+func queuedReply(id string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         250,
+		EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+		Message:      "OK: queued as " + id,
+	}
+}
+
+// errEncryptionRequired refuses AUTH on a plaintext connection when
+// SMTP_REQUIRE_TLS_FOR_AUTH is set (RFC 4954 section 6).
+var errEncryptionRequired = &smtp.SMTPError{
+	Code:         538,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 11},
+	Message:      "Encryption required for requested authentication mechanism",
+}
+
+// Backend implements smtp.Backend.
+type Backend struct {
+	mu     sync.Mutex // guards config against UpdateSecrets
+	config *config.Config
+	send   relay.SendFunc
+	limits *limiter
+	order  *sequencer
+	dedup  *dedupWindow
+	policy *sanitizer.Policy
+	users  map[string]*sanitizer.Policy // per-user profiles
+	scorer *abuse.Scorer
+	script *script.Hook
+	procs  processor.Chain
+	signer *smime.Signer
+	sealer *arc.Sealer
+	dkim   *dkim.Verifier
+	dmarc  func(domain string) (*dmarc.Policy, error)
+	dnsbl  *dnsbl.Checker
+	spf    *spf.Checker
+	supp   *suppression.List
+	grey   *greylist.Store
+	ledger *accounting.Ledger
+	alerts *alert.Monitor
+	stats  *statsd.Client
+	certs  []*x509.Certificate // the listener's, for the SNI server name
+}
+
+// Hooks lets programs embedding the proxy control generated headers in
+// code rather than through static configuration.
+type Hooks struct {
+	// MessageID replaces the built-in Message-ID generator when non-nil.
+	MessageID sanitizer.MessageIDGenerator
+	// Decorators append header fields to every relayed message.
+	Decorators []sanitizer.HeaderDecorator
+}
+
+// NewBackend creates a new proxy backend with the given config and send
+// function. It fails if the sanitizer settings in cfg do not compile.
+func NewBackend(cfg *config.Config, send relay.SendFunc) (*Backend, error) {
+	policy, users, err := compilePolicies(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	scorer, err := abuse.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("abuse scoring: %w", err)
+	}
+	var hook *script.Hook
+	if cfg.ScriptFile != "" {
+		if hook, err = script.Load(cfg.ScriptFile); err != nil {
+			return nil, fmt.Errorf("message script: %w", err)
+		}
+	}
+	signer, err := smime.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := arc.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var procs processor.Chain
+	scanner, err := clamav.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if scanner != nil {
+		procs = append(procs, scanner)
+	}
+	if attachments := attachment.New(cfg); attachments != nil {
+		procs = append(procs, attachments)
+	}
+	for _, path := range cfg.Plugins {
+		proc, err := processor.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, proc)
+	}
+	b := &Backend{
+		config: cfg,
+		send:   send,
+		limits: newLimiter(cfg.MaxConcurrentRelays),
+		policy: policy,
+		users:  users,
+		scorer: scorer,
+		script: hook,
+		procs:  procs,
+		signer: signer,
+		sealer: sealer,
+	}
+	if cfg.DKIMVerify {
+		b.dkim = dkim.NewVerifier()
+	}
+	if cfg.DMARCGuard != nil {
+		b.dmarc = dmarc.NewResolver().Lookup
+	}
+	if cfg.SPFAction != "" {
+		b.spf = spf.NewChecker()
+	}
+	if len(cfg.DNSBLLists) > 0 {
+		b.dnsbl = dnsbl.NewChecker(cfg.DNSBLLists)
+	}
+	if cfg.OrderedDelivery {
+		b.order = newSequencer()
+	}
+	if cfg.DedupWindow > 0 {
+		b.dedup = newDedupWindow(cfg.DedupWindow)
+	}
+	return b, nil
+}
+
+// SetSuppressionList makes sessions created afterwards reject suppressed
+// recipients at RCPT.
+func (b *Backend) SetSuppressionList(l *suppression.List) {
+	b.supp = l
+}
+
+// AddProcessor appends p to the processor chain of sessions created
+// afterwards, after any loaded from plugins.
+func (b *Backend) AddProcessor(p processor.Processor) {
+	b.procs = append(b.procs, p)
+}
+
+// SetHooks installs header generation hooks for sessions created
+// afterwards. The sanitizer policy is recompiled with them; on error the
+// previous policy stays in place.
+func (b *Backend) SetHooks(h Hooks) error {
+	policy, users, err := compilePolicies(b.config, &h)
+	if err != nil {
+		return err
+	}
+	b.policy, b.users = policy, users
+	return nil
+}
+
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	cfg := b.currentConfig()
+	ip := remoteIP(c)
+	// go-smtp creates the session on HELO/EHLO, so the hostname is known
+	var shims shim.Set
+	var helo string
+	var tlsState tls.ConnectionState
+	plaintext := false
+	if c != nil {
+		helo = c.Hostname()
+		var isTLS bool
+		tlsState, isTLS = c.TLSConnectionState()
+		plaintext = !isTLS
+		if shims = shim.Match(cfg.ClientShims, helo); shims != nil {
+			slog.Info("client compatibility shims enabled", "ehlo", helo, "remote_ip", ip, "shims", shims)
+		}
+	}
+	s := &Session{
+		config:   cfg,
+		send:     b.send,
+		limits:   b.limits,
+		order:    b.order,
+		dedup:    b.dedup,
+		policy:   b.policy,
+		users:    b.users,
+		scorer:   b.scorer,
+		script:   b.script,
+		procs:    slices.Clip(b.procs),
+		signer:   b.signer,
+		sealer:   b.sealer,
+		dkim:     b.dkim,
+		dmarc:    b.dmarc,
+		dnsbl:    b.dnsbl,
+		spf:      b.spf,
+		shims:    shims,
+		supp:     b.supp,
+		grey:     b.grey,
+		ledger:   b.ledger,
+		alerts:   b.alerts,
+		stats:    b.stats,
+		conn:     c,
+		remoteIP: ip,
+		helo:     helo,
+		domain:   b.serverDomain(cfg, c, tlsState),
+
+		maxMessages: cfg.MaxMessagesPerConn,
+		maxRcpts:    cfg.MaxRcptsPerSession,
+	}
+	// go-smtp starts a new session after STARTTLS
+	s.tlsRequired = cfg.RequireTLSForAuth && plaintext
+	if inNetworks(cfg.TrustedNetworks, ip) {
+		s.auth, s.trusted, s.username = true, true, trustedUser
+		slog.Debug("trusted network client", "remote_ip", ip)
+	}
+	if user, identity := certUser(cfg.TLSClientUsers, tlsState); user != "" {
+		s.auth, s.trusted, s.username = true, false, user
+		slog.Info("client authenticated", "mechanism", "certificate", "identity", identity, "remote_ip", ip)
+	} else if len(tlsState.VerifiedChains) > 0 {
+		slog.Warn("client certificate not mapped to a user", "subject", tlsState.VerifiedChains[0][0].Subject.String(), "remote_ip", ip)
+	}
+	b.stats.Count("sessions", 1)
+	return s, nil
+}
+
+// Session implements smtp.Session and smtp.AuthSession.
+type Session struct {
+	config       *config.Config
+	send         relay.SendFunc
+	limits       *limiter
+	order        *sequencer
+	dedup        *dedupWindow
+	policy       *sanitizer.Policy
+	users        map[string]*sanitizer.Policy
+	scorer       *abuse.Scorer
+	script       *script.Hook
+	procs        processor.Chain
+	signer       *smime.Signer
+	sealer       *arc.Sealer
+	dkim         *dkim.Verifier
+	dmarc        func(domain string) (*dmarc.Policy, error)
+	dnsbl        *dnsbl.Checker
+	spf          *spf.Checker
+	shims        shim.Set
+	supp         *suppression.List
+	grey         *greylist.Store
+	ledger       *accounting.Ledger
+	alerts       *alert.Monitor
+	stats        *statsd.Client
+	conn         *smtp.Conn
+	domain       string // the proxy's name towards this client
+	remoteIP     string
+	helo         string
+	auth         bool
+	tlsRequired  bool // AUTH waits for STARTTLS
+	trusted      bool // submitting from SMTP_TRUSTED_NETWORKS without AUTH
+	authFailures int  // failed AUTH attempts, fed to abuse scoring
+	maxMessages  int  // MAIL commands allowed per connection, 0 = unlimited
+	maxRcpts     int  // RCPT commands allowed per session, 0 = unlimited
+	transactions int  // MAIL commands so far
+	rcpts        int  // RCPT commands so far
+	username     string
+	queueID      string // of the current transaction, from MAIL on
+	from         string
+	mailOpts     smtp.MailOptions
+	mailAt       time.Time
+	recipients   []relay.Recipient
+	rcptTo       []string   // RCPT TO addresses as the client gave them, for LMTP replies
+	rcptOf       []int      // index in rcptTo of each recipient's RCPT TO
+	spfResult    spf.Result // of the current transaction, for trusted sessions
+	spfDomain    string
+	dnsblChecked bool     // blocklists are queried once per connection
+	dnsblListed  []string // zones listing the client
+}
+
+// Ensure Session implements AuthSession at compile time.
+var _ smtp.AuthSession = (*Session)(nil)
+
+// AuthMechanisms lists nothing until STARTTLS when TLS is required, so
+// AUTH is not advertised on plaintext connections.
+func (s *Session) AuthMechanisms() []string {
+	if s.tlsRequired {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login}
+}
+
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.tlsRequired {
+		slog.Warn("auth refused without tls", "mechanism", mech, "remote_ip", s.remoteIP)
+		return nil, errEncryptionRequired
+	}
+	validate := func(username, password string) error {
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.ProxyUsername)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.ProxyPassword)) == 1
+		if !usernameMatch || !passwordMatch {
+			slog.Warn("auth failed", "mechanism", mech)
+			s.stats.Count("auth.failures", 1)
+			s.alerts.AuthFailed()
+			s.authFailures++
+			return smtp.ErrAuthFailed
+		}
+		s.auth = true
+		s.trusted = false
+		s.username = username
+		slog.Info("client authenticated", "mechanism", mech)
+		return nil
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return validate(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{validate: validate}, nil
+	default:
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+}
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if !s.auth {
+		return smtp.ErrAuthRequired
+	}
+	if err := s.checkTransaction(); err != nil {
+		return err
+	}
+	s.queueID = relay.NewID()
+	// A declared SIZE lets us refuse before the client sends the body.
+	// go-smtp also checks it against Server.MaxMessageBytes; this keeps the
+	// reply identical to an overflow found during DATA.
+	if opts != nil && opts.Size > s.config.MaxMessageSize {
+		slog.Warn("message too large", "declared_size", opts.Size, "limit", s.config.MaxMessageSize)
+		return errMessageTooLarge
+	}
+	// Client from is accepted but always overridden by DestFrom for relay.
+	// Clients may send MAIL FROM:<> or any valid address.
+	if s.trusted && s.dnsbl != nil {
+		if err := s.checkDNSBL(); err != nil {
+			return err
+		}
+	}
+	s.spfResult, s.spfDomain = "", ""
+	if s.trusted && s.spf != nil {
+		if err := s.checkSPF(from); err != nil {
+			return err
+		}
+	}
+	s.from = from
+	s.mailOpts = smtp.MailOptions{}
+	if opts != nil {
+		s.mailOpts = *opts
+	}
+	s.mailAt = time.Now()
+	slog.Debug("MAIL FROM", "msg_id", s.queueID, "client_from", from, "relay_from", s.config.DestFrom)
+	return nil
+}
+
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if !s.auth {
+		return smtp.ErrAuthRequired
+	}
+	if err := s.checkSessionRcpt(); err != nil {
+		return err
+	}
+	given := to
+	if to = rewriteRecipient(s.config.RecipientRewrites, to); to != given {
+		slog.Info("recipient rewritten", "msg_id", s.queueID, "to", given, "rewritten_to", to)
+	}
+	members := expandGroup(s.config.RecipientGroups, to)
+	if len(members) != 1 || members[0] != to {
+		slog.Info("recipient group expanded", "msg_id", s.queueID, "to", to, "members", members)
+	}
+	members = slices.DeleteFunc(members, func(m string) bool {
+		if !s.supp.Contains(m) {
+			return false
+		}
+		if m == to {
+			slog.Info("suppressed recipient rejected", "msg_id", s.queueID, "to", m)
+		} else {
+			slog.Info("suppressed group member skipped", "msg_id", s.queueID, "to", to, "member", m)
+		}
+		return true
+	})
+	if len(members) == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Recipient address is suppressed",
+		}
+	}
+	if s.trusted && s.grey != nil {
+		if err := s.checkGreylist(to); err != nil {
+			return err
+		}
+	}
+	for _, m := range members {
+		rcpt := relay.Recipient{Address: m}
+		if opts != nil {
+			rcpt.Options = *opts
+		}
+		s.recipients = append(s.recipients, rcpt)
+		s.rcptOf = append(s.rcptOf, len(s.rcptTo))
+	}
+	s.rcptTo = append(s.rcptTo, given)
+	slog.Debug("RCPT TO", "msg_id", s.queueID, "to", to)
+	return nil
+}
+
+func (s *Session) Data(r io.Reader) error {
+	return s.data(r, nil)
+}
+
+// data relays the message. With a status collector (LMTP), each recipient
+// also gets the upstream's outcome for it; the return value covers any
+// recipient the upstream did not report on, such as rerouted ones.
+func (s *Session) data(r io.Reader, status smtp.StatusCollector) (err error) {
+	defer s.countMessage(&err)
+	defer s.recoverMessage(&err)
+	if !s.auth {
+		return smtp.ErrAuthRequired
+	}
+
+	if len(s.recipients) == 0 {
+		return &smtp.SMTPError{
+			Code:         503,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "No recipients specified",
+		}
+	}
+
+	if !s.limits.acquireRelay() {
+		slog.Warn("relay limit reached", "remote_ip", s.remoteIP)
+		return errTooManyRelays
+	}
+	defer s.limits.releaseRelay()
+
+	// Set at MAIL; sessions driven directly may skip it
+	if s.queueID == "" {
+		s.queueID = relay.NewID()
+	}
+	timer := newTiming(s.queueID, s.stats)
+	defer timer.log()
+
+	// Defense-in-depth: limit read size even though go-smtp enforces MaxMessageBytes
+	raw, err := io.ReadAll(io.LimitReader(r, s.config.MaxMessageSize+1))
+	if errors.Is(err, smtp.ErrDataTooLarge) || (err == nil && int64(len(raw)) > s.config.MaxMessageSize) {
+		// go-smtp stops reading at Server.MaxMessageBytes; the LimitReader
+		// catches anything beyond MaxMessageSize if the two differ.
+		slog.Warn("message too large", "msg_id", s.queueID, "read", len(raw), "limit", s.config.MaxMessageSize)
+		return errMessageTooLarge
+	}
+	if err != nil {
+		slog.Error("failed to read message data", "msg_id", s.queueID, "error", err)
+		return err
+	}
+	limits := sanitizer.HeaderLimits{
+		MaxSize:       s.config.MaxHeaderSize,
+		MaxLineLength: s.config.MaxHeaderLine,
+		MaxFields:     s.config.MaxHeaderFields,
+	}
+	if err := limits.Check(raw); err != nil {
+		slog.Warn("message header too large", "msg_id", s.queueID, "error", err)
+		return errHeaderTooLarge
+	}
+	raw = s.shims.Apply(raw)
+	var dedupKey string
+	if s.dedup != nil {
+		addrs := make([]string, len(s.recipients))
+		for i, rcpt := range s.recipients {
+			addrs[i] = rcpt.Address
+		}
+		dedupKey = dedupMessageKey(s.username, s.from, addrs, raw)
+		if original := s.checkDuplicate(s.queueID, dedupKey); original != "" {
+			return queuedReply(original)
+		}
+		// Unless the message is recorded as relayed below
+		defer s.dedup.release(dedupKey, s.queueID)
+	}
+	timer.mark("read")
+	s.stats.Histogram("message.size", float64(len(raw)))
+	s.stats.Histogram("message.recipients", float64(len(s.recipients)))
+
+	env := &relay.Envelope{
+		ID:          s.queueID,
+		From:        s.from,
+		MailOptions: s.mailOpts,
+		Recipients:  s.recipients,
+		Username:    s.username,
+		RemoteIP:    s.remoteIP,
+		MailAt:      s.mailAt,
+		ReceivedAt:  time.Now(),
+		Timing:      &relay.Timing{},
+	}
+
+	cfg, err := s.routeConfig(raw)
+	if err != nil {
+		return err
+	}
+	if s.config.DebugHeader && debugRequested(raw) {
+		env.Debug = true
+		slog.Info("upstream transcript requested", "msg_id", env.ID, "remote_ip", s.remoteIP)
+	}
+
+	// Use DestFrom as envelope sender (falls back to DestUsername via config)
+	envelopeFrom := cfg.DestFrom
+
+	slog.Info("processing message",
+		"msg_id", env.ID,
+		"client_from", s.from,
+		"envelope_from", envelopeFrom,
+		"recipients", env.Addresses(),
+		"size", len(raw),
+		"upstream", cfg.DestHost,
+	)
+
+	if s.config.BccCheck {
+		if undisclosed := sanitizer.UndisclosedRecipients(raw, env.Addresses()); len(undisclosed) > 0 {
+			slog.Warn("recipients not addressed in To, Cc or Bcc", "msg_id", env.ID, "recipients", undisclosed)
+		}
+	}
+
+	if s.config.DuplicateHeaders != "" {
+		if dups := sanitizer.DuplicateFields(raw); len(dups) > 0 {
+			slog.Warn("duplicate header fields", "msg_id", env.ID, "fields", dups, "action", s.config.DuplicateHeaders)
+			if s.config.DuplicateHeaders == sanitizer.DuplicateReject {
+				return errDuplicateHeaders
+			}
+		}
+	}
+
+	identity, err := s.checkFrom(env.ID, raw)
+	if err != nil {
+		return err
+	}
+
+	score, err := s.screen(env, raw)
+	if err != nil {
+		return err
+	}
+	if err := s.processEnvelope(env); err != nil {
+		return err
+	}
+
+	// DKIM and ARC validation need the message as the client sent it
+	var dkimResults string
+	if s.dkim != nil {
+		if dkimResults, err = s.verifyDKIM(env, raw); err != nil {
+			return err
+		}
+	}
+	var chain string
+	if s.sealer != nil {
+		chain = s.sealer.Validate(raw)
+	}
+	timer.mark("policy")
+
+	var release func()
+	if s.order != nil {
+		release = sync.OnceFunc(s.order.acquire(orderingKey(raw, s.username)))
+		defer release() // after a panic
+		timer.mark("queue_wait")
+	}
+	policy := s.policy
+	if p, ok := s.users[s.username]; ok {
+		policy = p
+	}
+	env.Message = policy.Sanitize(raw, cfg.DestDomain, sanitizer.Vars{
+		User:       s.username,
+		From:       s.from,
+		MsgID:      env.ID,
+		RemoteIP:   s.remoteIP,
+		ReceivedAt: env.ReceivedAt,
+	})
+	if identity != "" {
+		rewriteFrom(env, identity)
+	}
+	if score.Verdict == abuse.Tag {
+		env.Message = append([]byte("X-Abuse-Score: "+score.Header()+"\r\n"), env.Message...)
+	}
+	if h := s.spfHeader(); h != "" {
+		env.Message = append([]byte(h), env.Message...)
+	}
+	if h := s.dnsblHeader(); h != "" {
+		env.Message = append([]byte(h), env.Message...)
+	}
+	if s.config.QueueIDHeader {
+		env.Message = append([]byte(queueIDHeader+": "+env.ID+"\r\n"), env.Message...)
+	}
+	// Trace fields go on top
+	if s.config.ReceivedAdd {
+		env.Message = append([]byte(s.receivedHeader(env.ID, env.ReceivedAt)), env.Message...)
+	}
+	timer.mark("sanitize")
+
+	if err := s.processMessage(env); err != nil {
+		if release != nil {
+			release()
+		}
+		return err
+	}
+	if s.dmarc != nil {
+		if err := s.guardDMARC(cfg, env); err != nil {
+			if release != nil {
+				release()
+			}
+			return err
+		}
+	}
+	// Signing changes the body, so it comes before the ARC seal
+	if s.signer != nil {
+		s.sign(env)
+	}
+	if s.sealer != nil {
+		s.seal(env, chain, s.authResults(dkimResults))
+	}
+	timer.mark("policy")
+
+	err = s.send(cfg, env)
+	timer.markRelay(env.Timing)
+	s.account(env, err)
+	s.alerts.Relay(relayFailed(err))
+	s.reportUpstreamAuth(err)
+	if release != nil {
+		release()
+	}
+	if err != nil && !errors.Is(err, relay.ErrCircuitOpen) {
+		s.stats.Count("relay.errors", 1, "stage:"+cmp.Or(relay.Stage(err), "unknown"))
+	}
+	if err != nil {
+		// A non-LMTP DATA reply covers the whole message. Once some
+		// recipients have it, failing would make the client resend to them
+		// too, so partial deliveries are accepted and the failures logged.
+		var delivery *relay.DeliveryError
+		if errors.As(err, &delivery) {
+			if status != nil {
+				s.reportStatus(env.ID, delivery, status)
+			}
+			if delivery.Partial() {
+				slog.Warn("message partially relayed",
+					"msg_id", env.ID,
+					"from", envelopeFrom,
+					"delivered", delivery.Delivered,
+					"failed", len(delivery.Failed),
+				)
+				s.dedup.record(dedupKey, env.ID)
+				return queuedReply(env.ID)
+			}
+			// Retrying a message the upstream rejected outright cannot
+			// succeed, so pass the 5xx through instead of a 451.
+			if upstream, ok := delivery.Permanent(); ok {
+				slog.Error("relay rejected", "msg_id", env.ID, "stage", relay.Stage(err), "error", err)
+				return permanentRelayError(upstream, err)
+			}
+		}
+		if errors.Is(err, relay.ErrCircuitOpen) {
+			slog.Warn("relay skipped, upstream circuit open", "msg_id", env.ID)
+			return errUpstreamUnavailable
+		}
+		slog.Error("relay failed", "msg_id", env.ID, "stage", relay.Stage(err), "error", err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 0, 0},
+			Message:      fmt.Sprintf("Temporary relay error: %v", err),
+		}
+	}
+
+	slog.Info("message relayed", "msg_id", env.ID, "from", envelopeFrom, "recipients", env.Addresses())
+	s.dedup.record(dedupKey, env.ID)
+	return queuedReply(env.ID)
+}
+
+// reportStatus sets the LMTP status of each recipient the upstream
+// accepted or rejected, once per RCPT TO as the collector requires.
+func (s *Session) reportStatus(id string, delivery *relay.DeliveryError, status smtp.StatusCollector) {
+	outcome := make(map[string]*smtp.SMTPError, len(delivery.Delivered)+len(delivery.Failed))
+	for _, rcpt := range delivery.Delivered {
+		outcome[rcpt] = queuedReply(id)
+	}
+	for _, f := range delivery.Failed {
+		var upstream *smtp.SMTPError
+		if errors.As(f.Err, &upstream) && upstream.Code >= 500 {
+			outcome[f.Recipient] = permanentRelayError(upstream, f)
+		} else {
+			outcome[f.Recipient] = &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 0, 0},
+				Message:      fmt.Sprintf("Temporary relay error: %v", f),
+			}
+		}
+	}
+	// A RCPT TO naming a group succeeds if any member got the message
+	reply := make([]*smtp.SMTPError, len(s.rcptTo))
+	for i, rcpt := range s.recipients {
+		err, ok := outcome[rcpt.Address]
+		if !ok {
+			continue
+		}
+		if prev := reply[s.rcptOf[i]]; prev == nil || prev.Code != 250 {
+			reply[s.rcptOf[i]] = err
+		}
+	}
+	for i, err := range reply {
+		if err != nil {
+			status.SetStatus(s.rcptTo[i], err)
+		}
+	}
+}
+
+// compilePolicies compiles the sanitizer policy and, for each user with
+// their own profile, that user's policy.
+func compilePolicies(cfg *config.Config, hooks *Hooks) (*sanitizer.Policy, map[string]*sanitizer.Policy, error) {
+	policy, err := sanitizer.Compile(sanitizeOptions(cfg, hooks))
+	if err != nil {
+		return nil, nil, fmt.Errorf("sanitizer policy: %w", err)
+	}
+	users := make(map[string]*sanitizer.Policy, len(cfg.SanitizeProfileUsers))
+	for user, profile := range cfg.SanitizeProfileUsers {
+		opts := sanitizeOptions(cfg, hooks)
+		profile.Apply(&opts)
+		if users[user], err = sanitizer.Compile(opts); err != nil {
+			return nil, nil, fmt.Errorf("sanitizer policy for %s: %w", user, err)
+		}
+	}
+	return policy, users, nil
+}
+
+// sanitizeOptions maps configuration and any installed hooks onto
+// sanitizer options.
+func sanitizeOptions(cfg *config.Config, hooks *Hooks) sanitizer.Options {
+	opts := sanitizer.Options{
+		Received:            cfg.ReceivedPolicy,
+		MaxReceivedHops:     cfg.ReceivedMaxHops,
+		SubjectPrefix:       cfg.SubjectPrefix,
+		HeaderRules:         cfg.HeaderRules,
+		Rewrites:            cfg.HeaderRewrites,
+		MessageIDPolicy:     sanitizer.MessageIDPolicy(cfg.MessageIDPolicy),
+		KeepAuthResults:     cfg.ARCKeyFile != "",
+		RewriteReferences:   cfg.RewriteReferences,
+		Duplicates:          cfg.DuplicateHeaders,
+		BackfillDate:        cfg.BackfillDate,
+		BackfillMIMEVersion: cfg.BackfillMIMEVersion,
+	}
+	if cfg.SanitizeProfile != "" {
+		cfg.SanitizeProfile.Apply(&opts)
+	}
+	if cfg.FooterText != "" || cfg.FooterHTML != "" {
+		opts.Footer = &sanitizer.Footer{Text: cfg.FooterText, HTML: cfg.FooterHTML}
+	}
+	if hooks != nil {
+		opts.MessageID = hooks.MessageID
+		opts.Decorators = hooks.Decorators
+	}
+	return opts
+}
+
+// permanentRelayError builds a 5xx reply mirroring the upstream's rejection.
+func permanentRelayError(upstream *smtp.SMTPError, err error) *smtp.SMTPError {
+	code := upstream.EnhancedCode
+	if code == smtp.EnhancedCodeNotSet || code == smtp.NoEnhancedCode {
+		code = smtp.EnhancedCode{5, 0, 0}
+	}
+	return &smtp.SMTPError{
+		Code:         upstream.Code,
+		EnhancedCode: code,
+		Message:      fmt.Sprintf("Permanent relay error: %v", err),
+	}
+}
+
+// Reset clears the mail transaction state.
+// Per RFC 5321, RSET clears the sender and recipients but NOT the auth state.
+func (s *Session) Reset() {
+	s.from = ""
+	s.queueID = ""
+	s.spfResult, s.spfDomain = "", ""
+	s.mailOpts = smtp.MailOptions{}
+	s.mailAt = time.Time{}
+	s.recipients = nil
+	s.rcptTo = nil
+	s.rcptOf = nil
+}
+
+// Logout is called by go-smtp when the connection closes or STARTTLS
+// starts a new session; there is nothing to release.
+func (s *Session) Logout() error {
+	return nil
+}
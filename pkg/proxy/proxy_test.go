@@ -0,0 +1,1981 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+	"github.com/VahanMargaryan/smtp-proxy/internal/dkim"
+	"github.com/VahanMargaryan/smtp-proxy/internal/dmarc"
+	"github.com/VahanMargaryan/smtp-proxy/internal/dnsbl"
+	"github.com/VahanMargaryan/smtp-proxy/internal/greylist"
+	"github.com/VahanMargaryan/smtp-proxy/internal/shim"
+	"github.com/VahanMargaryan/smtp-proxy/internal/spf"
+	"github.com/VahanMargaryan/smtp-proxy/internal/statsd"
+	"github.com/VahanMargaryan/smtp-proxy/internal/suppression"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		ListenAddr:     ":0",
+		ProxyUsername:  "testuser",
+		ProxyPassword:  "testpass",
+		DestHost:       "smtp.example.com",
+		DestPort:       587,
+		DestUsername:   "upstream@example.com",
+		DestPassword:   "upstreampass",
+		DestFrom:       "upstream@example.com",
+		DestDomain:     "example.com",
+		ServerDomain:   "localhost",
+		MaxMessageSize: 25 * 1024 * 1024,
+	}
+}
+
+func noopSend(_ *config.Config, _ *relay.Envelope) error {
+	return nil
+}
+
+func TestSession_AuthRequired(t *testing.T) {
+	cfg := testConfig()
+	session := &Session{config: cfg, send: noopSend}
+
+	err := session.Mail("sender@example.com", nil)
+	if !errors.Is(err, smtp.ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired for Mail, got %v", err)
+	}
+
+	err = session.Rcpt("recipient@example.com", nil)
+	if !errors.Is(err, smtp.ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired for Rcpt, got %v", err)
+	}
+
+	err = accepted(session.Data(strings.NewReader("test")))
+	if !errors.Is(err, smtp.ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired for Data, got %v", err)
+	}
+}
+
+func TestSession_AuthMechanisms(t *testing.T) {
+	cfg := testConfig()
+	session := &Session{config: cfg, send: noopSend}
+
+	mechs := session.AuthMechanisms()
+	if len(mechs) != 2 {
+		t.Fatalf("expected 2 auth mechanisms, got %d", len(mechs))
+	}
+	if mechs[0] != "PLAIN" {
+		t.Errorf("expected PLAIN, got %s", mechs[0])
+	}
+	if mechs[1] != "LOGIN" {
+		t.Errorf("expected LOGIN, got %s", mechs[1])
+	}
+}
+
+func TestSession_Reset(t *testing.T) {
+	cfg := testConfig()
+	session := &Session{
+		config:     cfg,
+		send:       noopSend,
+		auth:       true,
+		from:       "sender@example.com",
+		recipients: []relay.Recipient{{Address: "r1@example.com"}, {Address: "r2@example.com"}},
+	}
+
+	session.Reset()
+
+	if session.from != "" {
+		t.Error("expected from to be cleared")
+	}
+	if session.recipients != nil {
+		t.Error("expected recipients to be cleared")
+	}
+	if !session.auth {
+		t.Error("expected auth to persist through reset (per RFC 5321)")
+	}
+}
+
+func TestSession_RcptSuppressed(t *testing.T) {
+	list, err := suppression.Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Add("gone@example.com", "5.1.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &Session{config: testConfig(), send: noopSend, supp: list, auth: true}
+	_ = session.Mail("sender@test.com", nil)
+
+	err = session.Rcpt("Gone@example.com", nil)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("expected SMTP 550 for suppressed recipient, got %v", err)
+	}
+	if err := session.Rcpt("ok@example.com", nil); err != nil {
+		t.Errorf("unexpected error for other recipient: %v", err)
+	}
+	if len(session.recipients) != 1 {
+		t.Errorf("expected only the unsuppressed recipient, got %v", session.recipients)
+	}
+}
+
+// accepted maps the 250 reply Data returns for an accepted message to nil.
+func accepted(err error) error {
+	if reply, ok := err.(*smtp.SMTPError); ok && reply.Code == 250 {
+		return nil
+	}
+	return err
+}
+
+func TestSession_DataCallsSend(t *testing.T) {
+	cfg := testConfig()
+
+	var sentRecipients []string
+	var sentMessage []byte
+	mockSend := func(c *config.Config, env *relay.Envelope) error {
+		sentRecipients = env.Addresses()
+		sentMessage = env.Message
+		return nil
+	}
+
+	session := &Session{
+		config: cfg,
+		send:   mockSend,
+		auth:   true,
+	}
+
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	_ = session.Rcpt("r2@example.com", nil)
+
+	msg := "From: sender@test.com\r\nSubject: Test\r\n\r\nBody"
+	err := accepted(session.Data(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sentRecipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(sentRecipients))
+	}
+	if sentRecipients[0] != "r1@example.com" {
+		t.Errorf("expected r1@example.com, got %s", sentRecipients[0])
+	}
+	if !strings.Contains(string(sentMessage), "Body") {
+		t.Error("expected message body to be present")
+	}
+}
+
+func TestSession_DataQueueID(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	cfg := testConfig()
+	cfg.QueueIDHeader = true
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := backend.NewSession(nil)
+	session := sess.(*Session)
+	session.auth = true
+	_ = session.Mail("sender@test.com", nil)
+	id := session.queueID
+	_ = session.Rcpt("r1@example.com", nil)
+	err = session.Data(strings.NewReader("X-Proxy-Queue-ID: forged\r\nSubject: Test\r\n\r\nBody"))
+
+	reply, ok := err.(*smtp.SMTPError)
+	if !ok || reply.Code != 250 || reply.Message != "OK: queued as "+id {
+		t.Fatalf("expected the queue ID in the reply, got %v", err)
+	}
+	if env.ID != id {
+		t.Errorf("expected the envelope to carry the queue ID %s, got %s", id, env.ID)
+	}
+	if msg := string(env.Message); !strings.HasPrefix(msg, "X-Proxy-Queue-ID: "+id+"\r\n") || strings.Contains(msg, "forged") {
+		t.Errorf("expected only the proxy's queue ID header, got %q", msg)
+	}
+
+	session.Reset()
+	_ = session.Mail("sender@test.com", nil)
+	if session.queueID == "" || session.queueID == id {
+		t.Errorf("expected a new queue ID for the next transaction, got %q", session.queueID)
+	}
+}
+
+func TestSession_DataSanitizeProfileUsers(t *testing.T) {
+	var sent string
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		sent = string(e.Message)
+		return nil
+	}
+	cfg := testConfig()
+	cfg.SanitizeProfileUsers = map[string]sanitizer.Profile{"app": sanitizer.ProfileTransparent}
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "Received: from app01.internal\r\nX-Mailer: Outlook\r\nSubject: Test\r\n\r\nBody"
+
+	for _, tc := range []struct {
+		username string
+		kept     bool
+	}{
+		{"app", true},
+		{cfg.ProxyUsername, false},
+	} {
+		sess, _ := backend.NewSession(nil)
+		session := sess.(*Session)
+		session.auth, session.username = true, tc.username
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		if err := accepted(session.Data(strings.NewReader(raw))); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.username, err)
+		}
+		kept := strings.Contains(sent, "Received: from app01.internal\r\n") && strings.Contains(sent, "X-Mailer: Outlook\r\n")
+		if kept != tc.kept {
+			t.Errorf("%s: expected client fields kept=%v, got %q", tc.username, tc.kept, sent)
+		}
+	}
+}
+
+func TestSession_DataReceivedHeader(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	cfg := testConfig()
+	cfg.ReceivedAdd = true
+	cfg.ServerDomain = "relay.example.com"
+	session := &Session{config: cfg, send: mockSend, auth: true, username: "app",
+		helo: "app01.internal (evil)\r\nX-Injected: 1", remoteIP: "2001:db8::5"}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Received: from hidden\r\nSubject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg := string(env.Message)
+	want := "Received: from app01.internalevilX-Injected:1 ([IPv6:2001:db8::5])\r\n" +
+		"\t(authenticated as app)\r\n" +
+		"\tby relay.example.com (smtp-proxy) with ESMTPA id " + env.ID + "\r\n" +
+		"\tfor <r1@example.com>; " + env.ReceivedAt.Format(time.RFC1123Z) + "\r\n"
+	if !strings.HasPrefix(msg, want) {
+		t.Errorf("expected the proxy's Received field on top, got %q", msg)
+	}
+	if strings.Contains(msg, "hidden") {
+		t.Error("expected the client's Received field stripped")
+	}
+
+	// Trusted clients are not authenticated; several recipients are not listed
+	session = &Session{config: cfg, send: mockSend, auth: true, trusted: true, remoteIP: "192.0.2.1"}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	_ = session.Rcpt("r2@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = "Received: from unknown ([192.0.2.1])\r\n" +
+		"\tby relay.example.com (smtp-proxy) with ESMTP id " + env.ID + ";\r\n" +
+		"\t" + env.ReceivedAt.Format(time.RFC1123Z) + "\r\n"
+	if msg := string(env.Message); !strings.HasPrefix(msg, want) {
+		t.Errorf("unexpected Received field in %q", msg)
+	}
+}
+
+func TestBackend_ServerDomain(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServerDomain = "relay.example.com"
+	backend, err := NewBackend(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backend.SetServerCerts([]*x509.Certificate{{DNSNames: []string{"mail.example.org", "*.example.net"}}})
+	for _, tc := range []struct {
+		sni, want string
+	}{
+		{"", "relay.example.com"},
+		{"Mail.Example.org", "mail.example.org"},
+		{"mx.example.net", "mx.example.net"},
+		{"other.example.com", "relay.example.com"},
+	} {
+		if got := backend.serverDomain(cfg, nil, tls.ConnectionState{ServerName: tc.sni}); got != tc.want {
+			t.Errorf("SNI %q: got %q, want %q", tc.sni, got, tc.want)
+		}
+	}
+
+	// The Received field names the proxy by the session's domain
+	var env *relay.Envelope
+	cfg.ReceivedAdd = true
+	session := &Session{config: cfg, auth: true, trusted: true, remoteIP: "192.0.2.1", domain: "mail.example.org",
+		send: func(_ *config.Config, e *relay.Envelope) error {
+			env = e
+			return nil
+		}}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(env.Message), "\tby mail.example.org (smtp-proxy) ") {
+		t.Errorf("expected the session's domain in the Received field, got %q", env.Message)
+	}
+}
+
+func TestSession_DataBuildsEnvelope(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+
+	session := &Session{config: testConfig(), send: mockSend, auth: true, username: "testuser", remoteIP: "192.0.2.1"}
+	_ = session.Mail("sender@test.com", &smtp.MailOptions{Body: smtp.Body8BitMIME})
+	_ = session.Rcpt("r1@example.com", &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyFailure}})
+	_ = session.Rcpt("r2@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if env == nil {
+		t.Fatal("expected send to be called")
+	}
+	if env.ID == "" {
+		t.Error("expected a correlation ID")
+	}
+	if env.From != "sender@test.com" || env.Username != "testuser" || env.RemoteIP != "192.0.2.1" {
+		t.Errorf("unexpected envelope identity: %+v", env)
+	}
+	if env.MailOptions.Body != smtp.Body8BitMIME {
+		t.Errorf("expected MAIL parameters to be kept, got %+v", env.MailOptions)
+	}
+	if len(env.Recipients) != 2 || len(env.Recipients[0].Options.Notify) != 1 {
+		t.Errorf("expected recipients with RCPT parameters, got %+v", env.Recipients)
+	}
+	if env.MailAt.IsZero() || env.ReceivedAt.Before(env.MailAt) {
+		t.Errorf("unexpected timestamps: mail %v, received %v", env.MailAt, env.ReceivedAt)
+	}
+}
+
+func TestBackend_Hooks(t *testing.T) {
+	var sent []byte
+	mockSend := func(_ *config.Config, env *relay.Envelope) error {
+		sent = env.Message
+		return nil
+	}
+
+	backend, err := NewBackend(testConfig(), mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.SetHooks(Hooks{
+		MessageID: sanitizer.MessageIDFunc(func(domain string) string { return "<hooked@" + domain + ">" }),
+		Decorators: []sanitizer.HeaderDecorator{sanitizer.HeaderDecoratorFunc(func([]sanitizer.Field) []sanitizer.Field {
+			return []sanitizer.Field{{Name: "X-Tenant", Value: "acme"}}
+		})},
+	})
+	if err != nil {
+		t.Fatalf("unexpected hooks error: %v", err)
+	}
+
+	sess, err := backend.NewSession(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	session := sess.(*Session)
+	session.auth = true
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(sent), "Message-ID: <hooked@example.com>") {
+		t.Error("expected hook Message-ID")
+	}
+	if !strings.Contains(string(sent), "X-Tenant: acme") {
+		t.Error("expected decorator header")
+	}
+}
+
+func TestSession_DataAppendsFooter(t *testing.T) {
+	var sent []byte
+	mockSend := func(_ *config.Config, env *relay.Envelope) error {
+		sent = env.Message
+		return nil
+	}
+
+	cfg := testConfig()
+	cfg.FooterText = "Sent via proxy"
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := backend.NewSession(nil)
+	session := sess.(*Session)
+	session.auth = true
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasSuffix(string(sent), "Body\r\n\r\nSent via proxy\r\n") {
+		t.Errorf("expected footer appended, got %q", sent)
+	}
+}
+
+func TestSession_DataHeaderRules(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+
+	cfg := testConfig()
+	cfg.HeaderRules = []sanitizer.HeaderRule{{Name: "X-Submitted-By", Value: "{user} {from} {msg_id}"}}
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := backend.NewSession(nil)
+	session := sess.(*Session)
+	session.auth = true
+	session.username = "testuser"
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "X-Submitted-By: testuser sender@test.com " + env.ID + "\r\n"
+	if !strings.Contains(string(env.Message), want) {
+		t.Errorf("expected %q in %q", want, env.Message)
+	}
+}
+
+func TestSession_DataAppliesShims(t *testing.T) {
+	var sent []byte
+	mockSend := func(_ *config.Config, env *relay.Envelope) error {
+		sent = env.Message
+		return nil
+	}
+
+	session := &Session{config: testConfig(), send: mockSend, auth: true, shims: shim.Set{"fold-continuations"}}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Wrapped by\r\na printer\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(sent), "Subject: Wrapped by\r\n a printer\r\n") {
+		t.Errorf("expected continuation line re-folded, got %q", sent)
+	}
+}
+
+func TestNewBackend_InvalidPolicy(t *testing.T) {
+	cfg := testConfig()
+	cfg.ReceivedPolicy = "keep"
+	cfg.FooterText = "\xff"
+	_, err := NewBackend(cfg, noopSend)
+	if err == nil {
+		t.Fatal("expected error for invalid sanitizer settings")
+	}
+	for _, want := range []string{"received:", "footer:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in error, got %v", want, err)
+		}
+	}
+
+	backend, err := NewBackend(testConfig(), noopSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SetHooks(Hooks{Decorators: []sanitizer.HeaderDecorator{nil}}); err == nil {
+		t.Error("expected error for nil decorator")
+	}
+}
+
+func TestSession_MessageTooLarge(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 10
+
+	session := &Session{config: cfg, send: noopSend, auth: true}
+	err := session.Mail("sender@test.com", &smtp.MailOptions{Size: 11})
+	assertTooLarge(t, "declared SIZE", err)
+
+	if err := session.Mail("sender@test.com", &smtp.MailOptions{Size: 10}); err != nil {
+		t.Fatalf("unexpected error for SIZE within limit: %v", err)
+	}
+	_ = session.Rcpt("r1@example.com", nil)
+	err = accepted(session.Data(strings.NewReader("Subject: Too long")))
+	assertTooLarge(t, "internal limit", err)
+
+	// go-smtp's own reader limit surfaces the same reply
+	err = accepted(session.Data(io.MultiReader(strings.NewReader("Subject: x"), iotest.ErrReader(smtp.ErrDataTooLarge))))
+	assertTooLarge(t, "go-smtp limit", err)
+}
+
+func TestSession_HeaderTooLarge(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxHeaderSize, cfg.MaxHeaderLine, cfg.MaxHeaderFields = 64, 20, 2
+	sent := false
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		sent = true
+		return nil
+	}
+
+	for name, msg := range map[string]string{
+		"size":   "Subject: a\r\n" + strings.Repeat(" folded line\r\n", 5) + "\r\nBody",
+		"line":   "Subject: " + strings.Repeat("x", 20) + "\r\n\r\nBody",
+		"fields": "From: a@test.com\r\nTo: b@test.com\r\nSubject: x\r\n\r\nBody",
+	} {
+		session := &Session{config: cfg, send: mockSend, auth: true}
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		err := accepted(session.Data(strings.NewReader(msg)))
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr != errHeaderTooLarge {
+			t.Errorf("%s: expected errHeaderTooLarge, got %v", name, err)
+		}
+	}
+	if sent {
+		t.Error("expected no message relayed")
+	}
+
+	// Long body lines are not header lines
+	session := &Session{config: cfg, send: mockSend, auth: true}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: x\r\n\r\n" + strings.Repeat("y", 100)))); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSession_DuplicateHeaders(t *testing.T) {
+	var sent string
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		sent = string(e.Message)
+		return nil
+	}
+	cfg := testConfig()
+	cfg.DuplicateHeaders = sanitizer.DuplicateReject
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "From: boss@test.com\r\nFrom: sender@test.com\r\nSubject: Test\r\n\r\nBody"
+	send := func() error {
+		t.Helper()
+		sess, _ := backend.NewSession(nil)
+		session := sess.(*Session)
+		session.auth = true
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		return accepted(session.Data(strings.NewReader(raw)))
+	}
+
+	if err := send(); err != errDuplicateHeaders {
+		t.Fatalf("expected errDuplicateHeaders, got %v", err)
+	}
+	if sent != "" {
+		t.Error("expected no message relayed")
+	}
+
+	cfg.DuplicateHeaders = sanitizer.DuplicateKeepLast
+	if backend, err = NewBackend(cfg, mockSend); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(sent, "boss@") || !strings.Contains(sent, "From: sender@test.com\r\n") {
+		t.Errorf("expected only the last From kept, got %q", sent)
+	}
+}
+
+func TestSession_FromAllowed(t *testing.T) {
+	var sent string
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		sent = string(e.Message)
+		return nil
+	}
+	cfg := testConfig()
+	cfg.FromAllowed = map[string]config.AllowedFrom{
+		"billing": {Addresses: []string{"billing@tenant-a.example"}, Domains: []string{"tenant-a.example"}},
+	}
+	cfg.FromAction = "reject"
+	send := func(username, from string) error {
+		t.Helper()
+		sent = ""
+		session := &Session{config: cfg, send: mockSend, auth: true, username: username}
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		return accepted(session.Data(strings.NewReader(from + "Subject: Test\r\n\r\nBody")))
+	}
+
+	for _, tc := range []struct {
+		username, from string
+		want           error
+	}{
+		{"billing", "From: Billing <invoices@Tenant-A.example>\r\n", nil},
+		{"billing", "From: ceo@tenant-b.example\r\n", errFromNotAllowed},
+		{"billing", "From: a@tenant-a.example, ceo@tenant-b.example\r\n", errFromNotAllowed},
+		{"billing", "", errFromNotAllowed},
+		{"other", "From: ceo@tenant-b.example\r\n", nil}, // no entry, unrestricted
+	} {
+		if err := send(tc.username, tc.from); err != tc.want {
+			t.Errorf("%s %q: expected %v, got %v", tc.username, tc.from, tc.want, err)
+		}
+	}
+
+	cfg.FromAction = "rewrite"
+	if err := send("billing", "From: \"CEO\" <ceo@tenant-b.example>\r\nX-Original-From: forged\r\n"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(sent, "From: billing@tenant-a.example\r\n") ||
+		!strings.Contains(sent, "X-Original-From: \"CEO\" <ceo@tenant-b.example>\r\n") || strings.Contains(sent, "forged") {
+		t.Errorf("expected From rewritten to the user's identity, got %q", sent)
+	}
+}
+
+func TestSession_RcptRewrite(t *testing.T) {
+	cfg := testConfig()
+	cfg.RecipientRewrites = map[string]string{
+		"*@old.example":       "*@new.example",
+		"ceo@old.example":     "office@new.example",
+		"*@legacy.example":    "archive@new.example",
+		"sales@other.example": "team@new.example",
+	}
+	session := &Session{config: cfg, send: noopSend, auth: true}
+	for _, to := range []string{"Alice@OLD.example", "CEO@old.example", "bob@legacy.example", "sales@other.example", "eve@other.example"} {
+		if err := session.Rcpt(to, nil); err != nil {
+			t.Fatalf("unexpected error for %s: %v", to, err)
+		}
+	}
+	want := []string{"Alice@new.example", "office@new.example", "archive@new.example", "team@new.example", "eve@other.example"}
+	for i, rcpt := range session.recipients {
+		if rcpt.Address != want[i] {
+			t.Errorf("recipient %d: expected %s, got %s", i, want[i], rcpt.Address)
+		}
+	}
+}
+
+func TestSession_RcptGroups(t *testing.T) {
+	list, err := suppression.Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Add("gone@example.com", "5.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.RecipientRewrites = map[string]string{"*@old.example": "*@example.com"}
+	cfg.RecipientGroups = map[string][]string{
+		"team@example.com": {"alice@example.com", "ops@example.com", "gone@example.com"},
+		"ops@example.com":  {"bob@example.com", "alice@example.com", "team@example.com"}, // loop, skipped
+		"left@example.com": {"gone@example.com"},
+	}
+	session := &Session{config: cfg, send: noopSend, supp: list, auth: true}
+	_ = session.Mail("sender@test.com", nil)
+
+	if err := session.Rcpt("Team@old.example", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := session.Rcpt("carol@example.com", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := session.Rcpt("left@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("expected 550 for a group of suppressed members only, got %v", err)
+	}
+
+	var got []string
+	for _, rcpt := range session.recipients {
+		got = append(got, rcpt.Address)
+	}
+	if want := []string{"alice@example.com", "bob@example.com", "carol@example.com"}; !slices.Equal(got, want) {
+		t.Errorf("expected recipients %v, got %v", want, got)
+	}
+	if !slices.Equal(session.rcptTo, []string{"Team@old.example", "carol@example.com"}) || !slices.Equal(session.rcptOf, []int{0, 0, 1}) {
+		t.Errorf("unexpected RCPT bookkeeping: %v %v", session.rcptTo, session.rcptOf)
+	}
+
+	// LMTP: one reply per RCPT TO, a success if any member got the message
+	status := statusRecorder{}
+	session.reportStatus("id", &relay.DeliveryError{
+		Delivered: []string{"bob@example.com"},
+		Failed: []relay.RecipientError{
+			{Recipient: "alice@example.com", Err: &smtp.SMTPError{Code: 550, Message: "No such user"}},
+			{Recipient: "carol@example.com", Err: &smtp.SMTPError{Code: 550, Message: "No such user"}},
+		},
+	}, status)
+	if len(status) != 2 || status["Team@old.example"].(*smtp.SMTPError).Code != 250 || status["carol@example.com"].(*smtp.SMTPError).Code != 550 {
+		t.Errorf("unexpected statuses %v", status)
+	}
+}
+
+// statusRecorder is an smtp.StatusCollector that records the last status
+// per recipient.
+func TestSession_DataDedup(t *testing.T) {
+	sends := 0
+	failing := false
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		if failing {
+			return errors.New("connection reset")
+		}
+		sends++
+		return nil
+	}
+	session := &Session{
+		config:   testConfig(),
+		send:     mockSend,
+		dedup:    newDedupWindow(time.Hour),
+		auth:     true,
+		username: "app",
+	}
+	submit := func(from string, rcpts []string, msg string) error {
+		session.Reset()
+		_ = session.Mail(from, nil)
+		for _, r := range rcpts {
+			_ = session.Rcpt(r, nil)
+		}
+		return session.Data(strings.NewReader(msg))
+	}
+	queuedAs := func(err error) string {
+		t.Helper()
+		reply, ok := err.(*smtp.SMTPError)
+		if !ok || reply.Code != 250 {
+			t.Fatalf("expected the message accepted, got %v", err)
+		}
+		return strings.TrimPrefix(reply.Message, "OK: queued as ")
+	}
+
+	rcpts := []string{"a@example.com", "b@example.com"}
+	first := queuedAs(submit("app@test.com", rcpts, "Date: Mon, 1 Jan 2024 00:00:00 +0000\r\n\r\nYour receipt"))
+	// A retry with a new header and the recipients in another order
+	retry := queuedAs(submit("app@test.com", []string{"b@example.com", "a@example.com"}, "Date: Mon, 1 Jan 2024 00:00:05 +0000\r\n\r\nYour receipt"))
+	if retry != first || sends != 1 {
+		t.Errorf("expected the retry acknowledged as %s without relaying, got %s after %d sends", first, retry, sends)
+	}
+	queuedAs(submit("app@test.com", rcpts, "\r\nAnother receipt"))
+	queuedAs(submit("app@test.com", rcpts[:1], "\r\nYour receipt"))
+	if sends != 3 {
+		t.Errorf("expected a different body or recipient list relayed, got %d sends", sends)
+	}
+
+	keyed := queuedAs(submit("app@test.com", rcpts, "X-Idempotency-Key: order-42\r\n\r\nShipped"))
+	if got := queuedAs(submit("other@test.com", rcpts[:1], "X-Idempotency-Key: order-42\r\n\r\nShipped!")); got != keyed {
+		t.Errorf("expected the idempotency key to identify the message, got %s, want %s", got, keyed)
+	}
+	session.username = "billing"
+	if got := queuedAs(submit("app@test.com", rcpts, "X-Idempotency-Key: order-42\r\n\r\nShipped")); got == keyed {
+		t.Error("expected idempotency keys scoped to the user")
+	}
+
+	// Only relayed messages are remembered
+	failing = true
+	if err := accepted(submit("app@test.com", rcpts, "\r\nFailed")); err == nil {
+		t.Fatal("expected the relay error")
+	}
+	failing = false
+	queuedAs(submit("app@test.com", rcpts, "\r\nFailed"))
+	if sends != 6 {
+		t.Errorf("expected the retry of a failed message relayed, got %d sends", sends)
+	}
+
+	session.dedup.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	queuedAs(submit("app@test.com", rcpts, "\r\nYour receipt"))
+	if sends != 7 {
+		t.Errorf("expected a resubmission after the window relayed, got %d sends", sends)
+	}
+}
+
+func TestSession_DataDedupInFlight(t *testing.T) {
+	window := newDedupWindow(time.Hour)
+	started := make(chan struct{}, 2)
+	finish := make(chan error)
+	var mu sync.Mutex
+	sends := 0
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		mu.Lock()
+		sends++
+		mu.Unlock()
+		started <- struct{}{}
+		return <-finish
+	}
+	submit := func() <-chan error {
+		session := &Session{config: testConfig(), send: mockSend, dedup: window, auth: true, username: "app"}
+		_ = session.Mail("app@test.com", nil)
+		_ = session.Rcpt("a@example.com", nil)
+		done := make(chan error, 1)
+		go func() { done <- session.Data(strings.NewReader("X-Idempotency-Key: order-7\r\n\r\nShipped")) }()
+		return done
+	}
+
+	// A resubmission while the original is relayed waits for its outcome
+	first := submit()
+	<-started
+	second := submit()
+	select {
+	case err := <-second:
+		t.Fatalf("expected the resubmission to wait, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	finish <- nil
+	original, duplicate := <-first, <-second
+	if accepted(original) != nil || duplicate == nil || duplicate.Error() != original.Error() {
+		t.Errorf("expected the resubmission acknowledged as the original, got %v and %v", original, duplicate)
+	}
+
+	// When the original fails, the waiting resubmission is relayed
+	window = newDedupWindow(time.Hour)
+	first = submit()
+	<-started
+	second = submit()
+	finish <- errors.New("connection reset")
+	if err := <-first; accepted(err) == nil {
+		t.Fatal("expected the relay error")
+	}
+	<-started
+	finish <- nil
+	if err := <-second; accepted(err) != nil {
+		t.Errorf("expected the resubmission relayed, got %v", err)
+	}
+	if sends != 3 {
+		t.Errorf("expected 3 relays, got %d", sends)
+	}
+}
+
+type statusRecorder map[string]error
+
+func (r statusRecorder) SetStatus(rcptTo string, err error) { r[rcptTo] = err }
+
+func assertTooLarge(t *testing.T, source string, err error) {
+	t.Helper()
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Errorf("%s: expected 552 5.3.4, got %v", source, err)
+	}
+}
+
+func TestSession_DataRelayError(t *testing.T) {
+	cfg := testConfig()
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		return errors.New("upstream down")
+	}
+
+	session := &Session{
+		config: cfg,
+		send:   mockSend,
+		auth:   true,
+	}
+
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+
+	msg := "From: sender@test.com\r\nSubject: Test\r\n\r\nBody"
+	err := accepted(session.Data(strings.NewReader(msg)))
+	if err == nil {
+		t.Fatal("expected error from relay failure")
+	}
+
+	// Error should be wrapped as SMTP 451
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("expected smtp.SMTPError, got %T: %v", err, err)
+	}
+	if smtpErr.Code != 451 {
+		t.Errorf("expected SMTP code 451, got %d", smtpErr.Code)
+	}
+}
+
+func TestSession_DataPartialDelivery(t *testing.T) {
+	cfg := testConfig()
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		return &relay.DeliveryError{
+			Delivered: []string{"r1@example.com"},
+			Failed:    []relay.RecipientError{{Recipient: "r2@example.com", Err: errors.New("no such user")}},
+		}
+	}
+
+	session := &Session{config: cfg, send: mockSend, auth: true}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	_ = session.Rcpt("r2@example.com", nil)
+
+	// Failing would make the client resend to r1, so the message is accepted
+	err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody")))
+	if err != nil {
+		t.Fatalf("expected partial delivery to be accepted, got %v", err)
+	}
+}
+
+func TestSession_DataAccounting(t *testing.T) {
+	ledger, err := accounting.Load(filepath.Join(t.TempDir(), "accounting"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result error
+	var size int
+	mockSend := func(_ *config.Config, env *relay.Envelope) error {
+		size = len(env.Message)
+		return result
+	}
+	session := &Session{config: testConfig(), send: mockSend, ledger: ledger, auth: true, username: "app"}
+	submit := func(rcpts ...string) {
+		session.Reset()
+		_ = session.Mail("sender@test.com", nil)
+		for _, r := range rcpts {
+			_ = session.Rcpt(r, nil)
+		}
+		_ = session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))
+	}
+
+	submit("a@Gmail.com", "b@example.com")
+	result = &relay.DeliveryError{
+		Delivered: []string{"c@gmail.com"},
+		Failed: []relay.RecipientError{
+			{Recipient: "d@gmail.com", Err: &smtp.SMTPError{Code: 550, Message: "No such user"}},
+			{Recipient: "e@example.com", Err: &smtp.SMTPError{Code: 452, Message: "Mailbox full"}},
+		},
+	}
+	submit("c@gmail.com", "d@gmail.com", "e@example.com")
+	result = relay.ErrCircuitOpen
+	submit("f@example.com")
+
+	got, _ := accounting.Rollup(ledger.Rows(accounting.Filter{}), []string{"user", "domain"})
+	want := []accounting.Row{
+		{User: "app", Domain: "example.com", Counts: accounting.Counts{Sent: 1, Deferred: 2, Bytes: int64(size)}},
+		{User: "app", Domain: "gmail.com", Counts: accounting.Counts{Sent: 2, Failed: 1, Bytes: 2 * int64(size)}},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected accounting rows %+v, want %+v", got, want)
+	}
+}
+
+func TestRelayFailed(t *testing.T) {
+	rejected := relay.RecipientError{Recipient: "a@example.com", Err: &smtp.SMTPError{Code: 550, Message: "No such user"}}
+	deferred := relay.RecipientError{Recipient: "b@example.com", Err: &smtp.SMTPError{Code: 451, Message: "Try again later"}}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"sent", nil, false},
+		{"circuit open", relay.ErrCircuitOpen, true},
+		{"all deferred", &relay.DeliveryError{Failed: []relay.RecipientError{deferred}}, true},
+		{"all rejected", &relay.DeliveryError{Failed: []relay.RecipientError{rejected}}, false},
+		{"partial", &relay.DeliveryError{Delivered: []string{"c@example.com"}, Failed: []relay.RecipientError{deferred}}, false},
+	}
+	for _, tt := range tests {
+		if got := relayFailed(tt.err); got != tt.want {
+			t.Errorf("%s: relayFailed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackend_Submit(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	backend, err := NewBackend(testConfig(), mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := backend.Submit("report", []string{"ops@example.com"}, []byte("Subject: Report\r\n\r\nBody"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if env == nil || env.ID != id || env.Username != "report" || env.From != "upstream@example.com" || !slices.Equal(env.Addresses(), []string{"ops@example.com"}) {
+		t.Errorf("unexpected envelope %+v for queue ID %s", env, id)
+	}
+	if backend.InFlight() != 0 {
+		t.Errorf("expected no relays in flight after Submit, got %d", backend.InFlight())
+	}
+
+	list, err := suppression.Load(filepath.Join(t.TempDir(), "suppressed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = list.Add("ops@example.com", "5.1.1")
+	backend.SetSuppressionList(list)
+	if _, err := backend.Submit("report", []string{"ops@example.com"}, []byte("\r\nBody")); err == nil || !strings.Contains(err.Error(), "RCPT TO ops@example.com") {
+		t.Errorf("expected the suppressed recipient refused, got %v", err)
+	}
+}
+
+func TestSession_DataPermanentRejection(t *testing.T) {
+	rejected := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	deferred := &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Mailbox busy"}
+
+	tests := []struct {
+		name     string
+		failures []error
+		wantCode int
+	}{
+		{"all permanent", []error{rejected, rejected}, 550},
+		{"mixed", []error{rejected, deferred}, 451},
+		{"non-smtp error", []error{errors.New("connection reset")}, 451},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSend := func(_ *config.Config, env *relay.Envelope) error {
+				recipients := env.Addresses()
+				de := &relay.DeliveryError{}
+				for i, err := range tt.failures {
+					de.Failed = append(de.Failed, relay.RecipientError{Recipient: recipients[i%len(recipients)], Err: err})
+				}
+				return de
+			}
+
+			session := &Session{config: testConfig(), send: mockSend, auth: true}
+			_ = session.Mail("sender@test.com", nil)
+			_ = session.Rcpt("r1@example.com", nil)
+			_ = session.Rcpt("r2@example.com", nil)
+
+			err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody")))
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("expected smtp.SMTPError, got %T: %v", err, err)
+			}
+			if smtpErr.Code != tt.wantCode {
+				t.Errorf("expected SMTP code %d, got %d", tt.wantCode, smtpErr.Code)
+			}
+			if tt.wantCode == 550 && smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+				t.Errorf("expected upstream enhanced code 5.1.1, got %v", smtpErr.EnhancedCode)
+			}
+		})
+	}
+}
+
+func TestSession_DataCircuitOpen(t *testing.T) {
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		return relay.ErrCircuitOpen
+	}
+
+	session := &Session{config: testConfig(), send: mockSend, auth: true}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+
+	err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody")))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("expected SMTP 421 while circuit is open, got %v", err)
+	}
+}
+
+func TestSession_DataNoRecipients(t *testing.T) {
+	cfg := testConfig()
+	session := &Session{
+		config: cfg,
+		send:   noopSend,
+		auth:   true,
+	}
+
+	_ = session.Mail("sender@test.com", nil)
+	// No Rcpt call
+
+	msg := "From: sender@test.com\r\nSubject: Test\r\n\r\nBody"
+	err := accepted(session.Data(strings.NewReader(msg)))
+	if err == nil {
+		t.Fatal("expected error when no recipients")
+	}
+
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("expected smtp.SMTPError, got %T: %v", err, err)
+	}
+	if smtpErr.Code != 503 {
+		t.Errorf("expected SMTP code 503, got %d", smtpErr.Code)
+	}
+}
+
+func TestBackend_NewSession(t *testing.T) {
+	cfg := testConfig()
+	backend, err := NewBackend(cfg, noopSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := backend.NewSession(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session == nil {
+		t.Fatal("expected non-nil session")
+	}
+}
+
+func TestSession_DataRelayLimit(t *testing.T) {
+	cfg := testConfig()
+	limits := newLimiter(1)
+	session := &Session{config: cfg, send: noopSend, limits: limits, auth: true}
+
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+
+	// Occupy the only relay slot as if another session were mid-DATA
+	limits.acquireRelay()
+
+	err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody")))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("expected SMTP 451 when relay slots are exhausted, got %v", err)
+	}
+
+	limits.releaseRelay()
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Errorf("unexpected error after slot freed: %v", err)
+	}
+	if limits.relays != 0 {
+		t.Errorf("expected relay slot to be released after DATA, got %d in flight", limits.relays)
+	}
+}
+
+func TestSequencer_FIFO(t *testing.T) {
+	q := newSequencer()
+	first := q.acquire("user")
+
+	// Queue three more acquirers for the same key in a known order
+	var order []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		started := make(chan struct{})
+		go func(i int) {
+			defer wg.Done()
+			close(started)
+			release := q.acquire("user")
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			release()
+		}(i)
+		<-started
+		// Give the goroutine time to enqueue before starting the next
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Another key is independent
+	other := q.acquire("other")
+	other()
+
+	first()
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Errorf("expected FIFO order [1 2 3], got %v", order)
+	}
+	if len(q.tails) != 0 {
+		t.Errorf("expected no queued keys after release, got %d", len(q.tails))
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+	withHeader := []byte("From: a@example.com\r\nX-Ordering-Key: invoices\r\n\r\nBody")
+	if got := orderingKey(withHeader, "testuser"); got != "invoices" {
+		t.Errorf("expected header key, got %q", got)
+	}
+
+	without := []byte("From: a@example.com\r\n\r\nBody")
+	if got := orderingKey(without, "testuser"); got != "testuser" {
+		t.Errorf("expected username fallback, got %q", got)
+	}
+}
+
+func TestSession_DataDKIMRequired(t *testing.T) {
+	cfg := testConfig()
+	cfg.DKIMVerify = true
+	cfg.DKIMRequireDomains = []string{"bank.example"}
+	sent := 0
+	mockSend := func(*config.Config, *relay.Envelope) error {
+		sent++
+		return nil
+	}
+	session := &Session{config: cfg, send: mockSend, auth: true, dkim: dkim.NewVerifier()}
+
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	err := accepted(session.Data(strings.NewReader("From: Bank <alerts@Bank.example>\r\n\r\nBody")))
+	if !errors.Is(err, errDKIMRequired) {
+		t.Fatalf("expected errDKIMRequired for an unsigned message, got %v", err)
+	}
+
+	// Unsigned mail from other domains is only logged
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("From: app@test.com\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent != 1 {
+		t.Errorf("expected one message relayed, got %d", sent)
+	}
+}
+
+func TestSession_DataDMARCGuard(t *testing.T) {
+	cfg := testConfig()
+	cfg.DMARCGuard = map[string]string{"*": "rewrite", "partner.example": "reject"}
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	policies := map[string]*dmarc.Policy{
+		"brand.example":   {Domain: "brand.example", Action: "reject"},
+		"partner.example": {Domain: "partner.example", Action: "quarantine"},
+		// As Lookup returns a parent's policy for a subdomain
+		"mail.partner.example": {Domain: "partner.example", Action: "quarantine"},
+		"example.com":          {Domain: "example.com", Action: "reject"},
+		"none.example":         {Domain: "none.example", Action: "none"},
+	}
+	session := &Session{config: cfg, send: mockSend, auth: true, dmarc: func(domain string) (*dmarc.Policy, error) {
+		return policies[domain], nil
+	}}
+	send := func(msg string) error {
+		env = nil
+		session.Reset()
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		return accepted(session.Data(strings.NewReader(msg)))
+	}
+
+	if err := send("From: Alice <alice@brand.example>\r\nSubject: Hi\r\n\r\nBody"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"From: \"Alice via example.com\" <upstream@example.com>\r\n",
+		"X-Original-From: Alice <alice@brand.example>\r\n",
+		"Reply-To: \"Alice\" <alice@brand.example>\r\n",
+	} {
+		if !strings.Contains(string(env.Message), want) {
+			t.Errorf("expected %q in rewritten message:\n%s", want, env.Message)
+		}
+	}
+
+	if err := send("From: bob@mail.partner.example\r\n\r\nBody"); !errors.Is(err, errDMARCMisaligned) {
+		t.Errorf("expected errDMARCMisaligned, got %v", err)
+	}
+
+	// Aligned senders and unenforced policies pass unchanged
+	for _, from := range []string{"app@news.example.com", "app@none.example", "app@nodmarc.example"} {
+		if err := send("From: " + from + "\r\nReply-To: help@test.com\r\n\r\nBody"); err != nil {
+			t.Fatalf("%s: unexpected error: %v", from, err)
+		}
+		if !strings.Contains(string(env.Message), "From: "+from+"\r\n") || strings.Contains(string(env.Message), "X-Original-From") {
+			t.Errorf("%s: expected From unchanged:\n%s", from, env.Message)
+		}
+	}
+}
+
+func TestSession_SPFHeaderQuoting(t *testing.T) {
+	cfg := testConfig()
+	cfg.SPFAction = "tag"
+	session := &Session{config: cfg, spfResult: spf.Pass, from: "\"a\\\"\r\nBcc: x\"@example.com"}
+	want := `Received-SPF: pass identity=mailfrom; envelope-from="\"a\\\"  Bcc: x\"@example.com"` + "\r\n"
+	if got := session.spfHeader(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestSession_TrustedNetworkSPF(t *testing.T) {
+	cfg := testConfig()
+	cfg.SPFAction = "tag"
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	session := &Session{
+		config:   cfg,
+		send:     mockSend,
+		spf:      spf.NewChecker(),
+		remoteIP: "192.0.2.10",
+		auth:     true,
+		trusted:  true,
+		username: trustedUser,
+	}
+
+	// A single-label domain has no SPF record to look up
+	if err := session.Mail("app@localhost", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("From: app@localhost\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(env.Message), "Received-SPF: none identity=mailfrom; envelope-from=\"app@localhost\"\r\n") {
+		t.Errorf("expected a Received-SPF field, got:\n%s", env.Message)
+	}
+
+	// Authenticated clients are not checked
+	session.trusted = false
+	session.Reset()
+	_ = session.Mail("app@localhost", nil)
+	if session.spfResult != "" {
+		t.Errorf("expected no SPF check after AUTH, got %s", session.spfResult)
+	}
+}
+
+func TestSession_DNSBL(t *testing.T) {
+	cfg := testConfig()
+	cfg.DNSBLAction = "reject"
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	// The lookup already ran and found the client on one list
+	session := &Session{
+		config:       cfg,
+		send:         mockSend,
+		dnsbl:        dnsbl.NewChecker([]string{"zen.example"}),
+		remoteIP:     "192.0.2.10",
+		auth:         true,
+		trusted:      true,
+		username:     trustedUser,
+		dnsblChecked: true,
+		dnsblListed:  []string{"zen.example"},
+	}
+	var smtpErr *smtp.SMTPError
+	if err := session.Mail("app@test.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Fatalf("expected a 554 rejection, got %v", err)
+	}
+
+	cfg.DNSBLAction = "tag"
+	if err := session.Mail("app@test.com", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("From: app@test.com\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(env.Message), "X-DNSBL: zen.example\r\n") {
+		t.Errorf("expected an X-DNSBL field, got:\n%s", env.Message)
+	}
+
+	// Authenticated clients are not checked
+	cfg.DNSBLAction = "reject"
+	session.trusted = false
+	if err := session.Mail("app@test.com", nil); err != nil {
+		t.Errorf("expected no DNSBL check after AUTH, got %v", err)
+	}
+}
+
+func TestSession_Greylist(t *testing.T) {
+	grey, err := greylist.Load(filepath.Join(t.TempDir(), "greylist"), greylist.Options{RetryWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &Session{
+		config:   testConfig(),
+		send:     noopSend,
+		grey:     grey,
+		remoteIP: "192.0.2.10",
+		auth:     true,
+		trusted:  true,
+		username: trustedUser,
+	}
+	_ = session.Mail("app@test.com", nil)
+	var smtpErr *smtp.SMTPError
+	if err := session.Rcpt("r1@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("expected the first attempt greylisted, got %v", err)
+	}
+	// No delay configured: the retry passes
+	if err := session.Rcpt("r1@example.com", nil); err != nil {
+		t.Fatalf("expected the retry accepted, got %v", err)
+	}
+
+	session.trusted = false
+	if err := session.Rcpt("r2@example.com", nil); err != nil {
+		t.Errorf("expected no greylisting after AUTH, got %v", err)
+	}
+}
+
+func TestCertUser(t *testing.T) {
+	users := map[string]string{"billing.internal": "billing", "reports@example.com": "reports"}
+	state := func(cert *x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	for _, tc := range []struct {
+		state    tls.ConnectionState
+		user, id string
+	}{
+		{state(&x509.Certificate{Subject: pkix.Name{CommonName: "Billing.Internal"}}), "billing", "Billing.Internal"},
+		{state(&x509.Certificate{DNSNames: []string{"x.internal", "billing.internal"}}), "billing", "billing.internal"},
+		{state(&x509.Certificate{EmailAddresses: []string{"reports@example.com"}}), "reports", "reports@example.com"},
+		{state(&x509.Certificate{Subject: pkix.Name{CommonName: "other"}}), "", ""},
+		// Presented but not verified
+		{tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "billing.internal"}}}}, "", ""},
+	} {
+		if user, id := certUser(users, tc.state); user != tc.user || id != tc.id {
+			t.Errorf("certUser = %q, %q, want %q, %q", user, id, tc.user, tc.id)
+		}
+	}
+}
+
+func TestInNetworks(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("fd00::/8")
+	networks := []*net.IPNet{lan, v6}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"fd12::1":     true,
+		"192.168.1.1": false,
+		"":            false,
+	} {
+		if got := inNetworks(networks, ip); got != want {
+			t.Errorf("inNetworks(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestSession_DataRoute(t *testing.T) {
+	cfg := testConfig()
+	cfg.Routes = map[string]config.Route{
+		"marketing": {Name: "marketing", Transport: "sendgrid", Host: "api.sendgrid.com", Port: 443,
+			Username: "apikey", Password: "key", From: "news@example.org"},
+	}
+	var sent *config.Config
+	var env *relay.Envelope
+	mockSend := func(c *config.Config, e *relay.Envelope) error {
+		sent, env = c, e
+		return nil
+	}
+	session := &Session{config: cfg, send: mockSend, auth: true}
+
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("From: sender@test.com\r\nX-SMTP-Proxy-Route: Marketing\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent.DestTransport != "sendgrid" || sent.DestHost != "api.sendgrid.com" || sent.DestFrom != "news@example.org" {
+		t.Errorf("expected the marketing route, got %s://%s from %s", sent.DestTransport, sent.DestHost, sent.DestFrom)
+	}
+	if cfg.DestHost == "api.sendgrid.com" {
+		t.Error("expected the session config to be left alone")
+	}
+	if strings.Contains(string(env.Message), "X-SMTP-Proxy-Route") {
+		t.Error("expected the route header to be stripped")
+	}
+
+	// without the header the default upstream is used
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("From: sender@test.com\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent != cfg {
+		t.Errorf("expected the default upstream, got %s", sent.DestHost)
+	}
+
+	sent = nil
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	err := accepted(session.Data(strings.NewReader("From: sender@test.com\r\nX-SMTP-Proxy-Route: bulk\r\n\r\nBody")))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("expected 550 for an unknown route, got %v", err)
+	}
+	if sent != nil {
+		t.Error("expected no relay for an unknown route")
+	}
+
+	// SMTP_ROUTE_ALLOW limits who may pick the route
+	marketing := cfg.Routes["marketing"]
+	marketing.AllowUsers = []string{"newsletter"}
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	marketing.AllowNetworks = []*net.IPNet{network}
+	cfg.Routes["marketing"] = marketing
+	for _, tc := range []struct {
+		user, ip string
+		allowed  bool
+	}{
+		{"newsletter", "192.0.2.1", true},
+		{"", "10.1.2.3", true},
+		{"billing", "192.0.2.1", false},
+	} {
+		sent = nil
+		session.username, session.remoteIP = tc.user, tc.ip
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		err := accepted(session.Data(strings.NewReader("From: sender@test.com\r\nX-SMTP-Proxy-Route: marketing\r\n\r\nBody")))
+		if tc.allowed && (err != nil || sent == nil || sent.DestHost != "api.sendgrid.com") {
+			t.Errorf("%s from %s: expected the route allowed, got %v", tc.user, tc.ip, err)
+		}
+		if !tc.allowed && (!errors.As(err, &smtpErr) || smtpErr.Code != 550 || sent != nil) {
+			t.Errorf("%s from %s: expected 550 for a route not allowed, got %v", tc.user, tc.ip, err)
+		}
+	}
+}
+
+func TestSession_DataDebugHeader(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+	msg := "From: sender@test.com\r\nX-Debug: yes\r\n\r\nBody"
+
+	for _, honoured := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.DebugHeader = honoured
+		session := &Session{config: cfg, send: mockSend, auth: true}
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		if err := accepted(session.Data(strings.NewReader(msg))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if env.Debug != honoured {
+			t.Errorf("DebugHeader=%v: expected Debug=%v", honoured, honoured)
+		}
+		if strings.Contains(string(env.Message), "X-Debug") {
+			t.Error("expected the debug header to be stripped")
+		}
+	}
+
+	if debugRequested([]byte("X-Debug: off\r\n\r\nBody")) {
+		t.Error("expected X-Debug: off to be ignored")
+	}
+}
+
+func TestTiming_LogsStages(t *testing.T) {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
+	before := StageTimings()["connect"].Messages
+	// The transport reports the upstream stages on the envelope
+	send := func(_ *config.Config, env *relay.Envelope) error {
+		env.Timing.Connect += 40 * time.Millisecond
+		env.Timing.Data += 80 * time.Millisecond
+		return nil
+	}
+	session := &Session{config: testConfig(), send: send, auth: true}
+	_ = session.Mail("sender@test.com", nil)
+	_ = session.Rcpt("r1@example.com", nil)
+	if err := accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "msg=\"message timing\"") {
+		t.Fatalf("expected timing log line, got:\n%s", out)
+	}
+	for _, stage := range []string{"read=", "policy=", "sanitize=", "connect=40ms", "auth=0s", "data=80ms", "relay_wait=", "total="} {
+		if !strings.Contains(out, stage) {
+			t.Errorf("expected %s in timing log", stage)
+		}
+	}
+	if strings.Contains(out, "queue_wait=") {
+		t.Error("expected no queue_wait stage without ordered delivery")
+	}
+	if strings.Count(out, "policy=") != 1 {
+		t.Error("expected the policy checks before and after sanitizing summed in one stage")
+	}
+
+	connect := StageTimings()["connect"]
+	if connect.Messages != before+1 || connect.TotalMs < 40 || connect.AvgMs <= 0 {
+		t.Errorf("expected the message in the stage totals, got %+v", connect)
+	}
+}
+
+func TestSession_Metrics(t *testing.T) {
+	agent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	stats, err := statsd.New(agent.LocalAddr().String(), "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stats.Close()
+
+	fail := false
+	mockSend := func(_ *config.Config, _ *relay.Envelope) error {
+		if fail {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	backend, err := NewBackend(testConfig(), mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.SetMetrics(stats)
+	sess, _ := backend.NewSession(nil)
+	session := sess.(*Session)
+	session.auth = true
+	for _, fail = range []bool{false, true} {
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		_ = session.Data(strings.NewReader("Subject: Test\r\n\r\nBody"))
+		session.Reset()
+	}
+
+	want := []string{
+		"sessions:1|c",
+		"message.size:21|h",
+		"message.recipients:1|h",
+		"message.stage:",
+		"message.duration:",
+		"relay.errors:1|c|#stage:unknown",
+		"messages:1|c|#result:relayed",
+		"messages:1|c|#result:deferred",
+	}
+	var got []string
+	buf := make([]byte, 1500)
+	_ = agent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := agent.Read(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+		if strings.HasPrefix(got[len(got)-1], "messages:1|c|#result:deferred") {
+			break
+		}
+	}
+	for _, w := range want {
+		if !slices.ContainsFunc(got, func(m string) bool { return strings.HasPrefix(m, w) }) {
+			t.Errorf("expected a metric starting with %q, got %q", w, got)
+		}
+	}
+}
+
+func TestLoginServer_FullHandshake(t *testing.T) {
+	var authedUser, authedPass string
+	ls := &loginServer{
+		validate: func(username, password string) error {
+			authedUser = username
+			authedPass = password
+			return nil
+		},
+	}
+
+	// Step 0: initial challenge
+	challenge, done, err := ls.Next(nil)
+	if err != nil {
+		t.Fatalf("step 0 error: %v", err)
+	}
+	if done {
+		t.Fatal("step 0 should not be done")
+	}
+	if string(challenge) != "Username:" {
+		t.Errorf("expected 'Username:' challenge, got %q", challenge)
+	}
+
+	// Step 1: send username
+	challenge, done, err = ls.Next([]byte("testuser"))
+	if err != nil {
+		t.Fatalf("step 1 error: %v", err)
+	}
+	if done {
+		t.Fatal("step 1 should not be done")
+	}
+	if string(challenge) != "Password:" {
+		t.Errorf("expected 'Password:' challenge, got %q", challenge)
+	}
+
+	// Step 2: send password
+	_, done, err = ls.Next([]byte("testpass"))
+	if err != nil {
+		t.Fatalf("step 2 error: %v", err)
+	}
+	if !done {
+		t.Fatal("step 2 should be done")
+	}
+	if authedUser != "testuser" {
+		t.Errorf("expected username testuser, got %s", authedUser)
+	}
+	if authedPass != "testpass" {
+		t.Errorf("expected password testpass, got %s", authedPass)
+	}
+}
+
+func TestLoginServer_InvalidCredentials(t *testing.T) {
+	ls := &loginServer{
+		validate: func(username, password string) error {
+			return smtp.ErrAuthFailed
+		},
+	}
+
+	ls.Next(nil)                 // Username challenge
+	ls.Next([]byte("wronguser")) // Password challenge
+	_, _, err := ls.Next([]byte("wrongpass"))
+	if err == nil {
+		t.Fatal("expected auth error")
+	}
+	if !errors.Is(err, smtp.ErrAuthFailed) {
+		t.Errorf("expected ErrAuthFailed, got %v", err)
+	}
+}
+
+func TestLoginServer_ExtraStep(t *testing.T) {
+	ls := &loginServer{
+		validate: func(username, password string) error { return nil },
+	}
+
+	ls.Next(nil)
+	ls.Next([]byte("user"))
+	ls.Next([]byte("pass"))
+
+	// Extra step should error
+	_, _, err := ls.Next([]byte("extra"))
+	if err == nil {
+		t.Fatal("expected error on extra step")
+	}
+}
+
+func TestSession_DataAbuseScoring(t *testing.T) {
+	var sent []byte
+	mockSend := func(_ *config.Config, env *relay.Envelope) error {
+		sent = env.Message
+		return nil
+	}
+
+	cfg := testConfig()
+	cfg.AbuseTagScore = 10
+	cfg.AbuseDeferScore = 20
+	cfg.AbuseBlockScore = 30
+	cfg.AbuseWeights = map[string]int{"content": 0, "recipient_entropy": 0, "sending_spike": 0}
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		failures int
+		code     int
+		tagged   bool
+	}{
+		{0, 0, false},
+		{1, 0, true},
+		{2, 451, false},
+		{3, 550, false},
+	}
+	for _, tt := range tests {
+		sent = nil
+		sess, _ := backend.NewSession(nil)
+		session := sess.(*Session)
+		session.auth = true
+		session.authFailures = tt.failures
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		err := accepted(session.Data(strings.NewReader("Subject: Test\r\nX-Abuse-Score: 0\r\n\r\nBody")))
+
+		if tt.code == 0 {
+			if err != nil {
+				t.Fatalf("%d failures: unexpected error: %v", tt.failures, err)
+			}
+			tagged := strings.HasPrefix(string(sent), "X-Abuse-Score: 10 (auth_failures=10)\r\n")
+			if tagged != tt.tagged || strings.Count(string(sent), "X-Abuse-Score") > 1 {
+				t.Errorf("%d failures: unexpected headers in %q", tt.failures, sent)
+			}
+			continue
+		}
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.code {
+			t.Errorf("%d failures: expected %d, got %v", tt.failures, tt.code, err)
+		}
+		if sent != nil {
+			t.Errorf("%d failures: message should not be relayed", tt.failures)
+		}
+	}
+}
+
+func TestSession_DataScript(t *testing.T) {
+	var env *relay.Envelope
+	mockSend := func(_ *config.Config, e *relay.Envelope) error {
+		env = e
+		return nil
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.star")
+	src := `
+def on_message(msg):
+    subject = msg.headers.get("subject", "")
+    if subject == "reject":
+        reject(550, "Not today", enhanced="5.7.1")
+    elif subject == "crash":
+        fail("boom")
+    elif subject == "reroute":
+        reroute(["archive@example.com"])
+        set_header("X-Rerouted", msg.id)
+`
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.ScriptFile = path
+	backend, err := NewBackend(cfg, mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := func(subject string) error {
+		env = nil
+		sess, _ := backend.NewSession(nil)
+		session := sess.(*Session)
+		session.auth = true
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt("r1@example.com", nil)
+		return accepted(session.Data(strings.NewReader("Subject: " + subject + "\r\n\r\nBody")))
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := data("reject"); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Message != "Not today" {
+		t.Errorf("expected script rejection, got %v", err)
+	}
+	if err := data("crash"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("expected 451 for a failing script, got %v", err)
+	}
+	if env != nil {
+		t.Error("rejected messages should not be relayed")
+	}
+
+	if err := data("reroute"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := env.Addresses(); len(got) != 1 || got[0] != "archive@example.com" {
+		t.Errorf("expected rerouted recipients, got %v", got)
+	}
+	if !strings.Contains(string(env.Message), "X-Rerouted: "+env.ID+"\r\n") {
+		t.Errorf("expected header set by script in %q", env.Message)
+	}
+
+	cfg.ScriptFile = filepath.Join(t.TempDir(), "missing.star")
+	if _, err := NewBackend(cfg, noopSend); err == nil {
+		t.Error("expected error for missing script")
+	}
+}
+
+// testProcessor rejects envelopes for blocked@example.com, panics on
+// messages for panic@example.com and appends a marker to the message body.
+type testProcessor struct{}
+
+func (testProcessor) ProcessEnvelope(env *relay.Envelope) error {
+	for _, addr := range env.Addresses() {
+		switch addr {
+		case "blocked@example.com":
+			return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Blocked by scanner"}
+		case "broken@example.com":
+			return errors.New("scanner unavailable")
+		}
+	}
+	return nil
+}
+
+func (testProcessor) ProcessMessage(env *relay.Envelope) ([]byte, error) {
+	if slices.Contains(env.Addresses(), "panic@example.com") {
+		panic("processor bug")
+	}
+	return append(env.Message, "[scanned]"...), nil
+}
+
+func TestSession_DataProcessors(t *testing.T) {
+	var sent []byte
+	mockSend := func(_ *config.Config, env *relay.Envelope) error {
+		sent = env.Message
+		return nil
+	}
+	backend, err := NewBackend(testConfig(), mockSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.AddProcessor(testProcessor{})
+
+	data := func(rcpt string) error {
+		sent = nil
+		sess, _ := backend.NewSession(nil)
+		session := sess.(*Session)
+		session.auth = true
+		_ = session.Mail("sender@test.com", nil)
+		_ = session.Rcpt(rcpt, nil)
+		return accepted(session.Data(strings.NewReader("Subject: Test\r\n\r\nBody")))
+	}
+
+	if err := data("ok@example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(string(sent), "Body[scanned]") {
+		t.Errorf("expected processed message, got %q", sent)
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := data("blocked@example.com"); !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Errorf("expected processor's own reply, got %v", err)
+	}
+	if err := data("broken@example.com"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("expected 451 for a failing processor, got %v", err)
+	}
+	if sent != nil {
+		t.Error("rejected messages should not be relayed")
+	}
+
+	if err := data("panic@example.com"); err != errInternal {
+		t.Errorf("expected 451 for a panicking processor, got %v", err)
+	}
+	if Panics() == 0 {
+		t.Error("expected the panic counted")
+	}
+
+	cfg := testConfig()
+	cfg.Plugins = []string{filepath.Join(t.TempDir(), "missing.so")}
+	if _, err := NewBackend(cfg, noopSend); err == nil {
+		t.Error("expected error for missing plugin")
+	}
+
+	// A panic must not leave the ordering lock held
+	cfg = testConfig()
+	cfg.OrderedDelivery = true
+	if backend, err = NewBackend(cfg, mockSend); err != nil {
+		t.Fatal(err)
+	}
+	backend.AddProcessor(testProcessor{})
+	done := make(chan error, 1)
+	go func() {
+		_ = data("panic@example.com")
+		done <- data("ok@example.com")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error after a panic: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message after a panic blocked on the ordering lock")
+	}
+
+	cfg = testConfig()
+	cfg.ClamAVAddr = "clamd"
+	if _, err := NewBackend(cfg, noopSend); err == nil {
+		t.Error("expected error for invalid clamd address")
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// SetServerCerts gives the certificates the listener offers, so a session
+// after STARTTLS names the proxy after the client's SNI server name when
+// one of them covers it.
+func (b *Backend) SetServerCerts(certs []*x509.Certificate) {
+	b.certs = certs
+}
+
+// serverDomain returns the proxy's name for the session on c: the SNI
+// server name one of its certificates covers, the domain of the local
+// address in cfg.ServerDomains, or cfg.ServerDomain.
+func (b *Backend) serverDomain(cfg *config.Config, c *smtp.Conn, state tls.ConnectionState) string {
+	if name := state.ServerName; name != "" {
+		for _, cert := range b.certs {
+			if cert.VerifyHostname(name) == nil {
+				return strings.ToLower(name)
+			}
+		}
+	}
+	if c != nil && c.Conn() != nil {
+		if addr, ok := c.Conn().LocalAddr().(*net.TCPAddr); ok {
+			if domain, ok := cfg.ServerDomains[addr.IP.String()]; ok {
+				return domain
+			}
+		}
+	}
+	return cfg.ServerDomain
+}
+
+// receivedHeader returns the proxy's own Received field for a message
+// taken in at at (RFC 5321 section 4.4): the client's HELO name and IP,
+// the TLS version and cipher, the authenticated user, the protocol with
+// its RFC 3848 S and A suffixes, the queue ID and, for a single
+// recipient, the recipient. It ends in CRLF.
+func (s *Session) receivedHeader(id string, at time.Time) string {
+	from := traceToken(s.helo)
+	if from == "" {
+		from = "unknown"
+	}
+	lines := []string{"Received: from " + from}
+	if ip := net.ParseIP(s.remoteIP); ip != nil {
+		literal := ip.String()
+		if ip.To4() == nil {
+			literal = "IPv6:" + literal
+		}
+		lines[0] += " ([" + literal + "])"
+	}
+
+	protocol := "ESMTP"
+	if s.username == lmtpUser {
+		protocol = "LMTP"
+	}
+	var suffix string
+	if s.conn != nil {
+		if state, ok := s.conn.TLSConnectionState(); ok {
+			lines = append(lines, "(using "+tls.VersionName(state.Version)+" with cipher "+tls.CipherSuiteName(state.CipherSuite)+")")
+			suffix = "S"
+		}
+	}
+	if s.auth && !s.trusted && s.username != lmtpUser {
+		lines = append(lines, "(authenticated as "+traceToken(s.username)+")")
+		suffix += "A"
+	}
+
+	lines = append(lines, "by "+cmp.Or(s.domain, s.config.ServerDomain)+" (smtp-proxy) with "+protocol+suffix+" id "+id)
+	date := at.Format(time.RFC1123Z)
+	if len(s.recipients) == 1 {
+		lines = append(lines, "for <"+traceToken(s.recipients[0].Address)+">; "+date)
+	} else {
+		lines[len(lines)-1] += ";"
+		lines = append(lines, date)
+	}
+	return strings.Join(lines, "\r\n\t") + "\r\n"
+}
+
+// traceToken drops from client-supplied s the characters that could end
+// a comment or the field: controls, whitespace, parentheses and angle
+// brackets.
+func traceToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f || strings.ContainsRune("()<>", r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errInternal answers a message whose processing panicked. It is
+// temporary: the client retries, and the fault may be gone after a
+// restart or plugin fix.
+var errInternal = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Internal error while processing message, try again later",
+}
+
+// panics counts messages failed by a recovered panic.
+var panics atomic.Int64
+
+// Panics returns the number of messages that failed because processing
+// them panicked, since the program started.
+func Panics() int64 {
+	return panics.Load()
+}
+
+// recoverMessage turns a panic while handling one message, e.g. in the
+// sanitizer or a processor plugin, into errInternal for that message. The
+// session and the other connections carry on. Use it deferred, with a
+// pointer to the named error result.
+func (s *Session) recoverMessage(err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	panics.Add(1)
+	s.stats.Count("panics", 1)
+	slog.Error("panic while processing message",
+		"msg_id", s.queueID,
+		"remote_ip", s.remoteIP,
+		"client_from", s.from,
+		"panic", fmt.Sprint(v),
+		"stack", string(debug.Stack()),
+		"panics_total", panics.Load(),
+	)
+	*err = errInternal
+}
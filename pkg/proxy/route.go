@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// routeHeader lets a client pick one of the configured SMTP_ROUTES for a
+// message. It is stripped by the sanitizer before relay.
+const routeHeader = "X-SMTP-Proxy-Route"
+
+// errUnknownRoute rejects a message naming a route that is not configured,
+// rather than relaying it through an upstream the client did not ask for.
+var errUnknownRoute = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Unknown route",
+}
+
+// errRouteNotAllowed rejects a message naming a route SMTP_ROUTE_ALLOW
+// does not grant the session.
+var errRouteNotAllowed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Route not allowed",
+}
+
+// routeConfig returns the config to relay raw with: s.config, or a copy
+// pointing at the route named by the X-SMTP-Proxy-Route header if the
+// route allows the session's user or address.
+func (s *Session) routeConfig(raw []byte) (*config.Config, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return s.config, nil
+	}
+	name := strings.ToLower(strings.TrimSpace(msg.Header.Get(routeHeader)))
+	if name == "" {
+		return s.config, nil
+	}
+	route, ok := s.config.Routes[name]
+	if !ok {
+		slog.Warn("unknown route requested", "route", name, "remote_ip", s.remoteIP)
+		return nil, errUnknownRoute
+	}
+	if !route.Allows(s.username, net.ParseIP(s.remoteIP)) {
+		slog.Warn("route not allowed", "route", name, "user", s.username, "remote_ip", s.remoteIP)
+		return nil, errRouteNotAllowed
+	}
+	return s.config.ForRoute(route), nil
+}
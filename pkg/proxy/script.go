@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"log/slog"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/script"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// errScriptFailed is returned when the message hook errors. The failure is
+// temporary so a fixed script can still accept the message on retry.
+var errScriptFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Message policy check failed, try again later",
+}
+
+// runScript passes the sanitized message to the message hook and applies
+// its decision to env.
+func (s *Session) runScript(env *relay.Envelope) error {
+	if s.script == nil {
+		return nil
+	}
+	d, err := s.script.Run(&script.Message{
+		ID:         env.ID,
+		Sender:     env.From,
+		Recipients: env.Addresses(),
+		Username:   env.Username,
+		RemoteIP:   env.RemoteIP,
+		Size:       len(env.Message),
+		Headers:    script.Headers(env.Message),
+	})
+	if err != nil {
+		slog.Error("message script failed", "msg_id", env.ID, "error", err)
+		return errScriptFailed
+	}
+	if r := d.Reject; r != nil {
+		slog.Info("message rejected by script", "msg_id", env.ID, "code", r.Code, "reason", r.Message)
+		return &smtp.SMTPError{
+			Code:         r.Code,
+			EnhancedCode: smtp.EnhancedCode(r.EnhancedCode),
+			Message:      r.Message,
+		}
+	}
+	if d.Recipients != nil {
+		slog.Info("message rerouted by script", "msg_id", env.ID, "recipients", env.Addresses(), "rerouted_to", d.Recipients)
+		env.Recipients = make([]relay.Recipient, len(d.Recipients))
+		for i, addr := range d.Recipients {
+			env.Recipients[i] = relay.Recipient{Address: addr}
+		}
+	}
+	env.Message = d.Apply(env.Message)
+	return nil
+}
@@ -0,0 +1,19 @@
+package proxy
+
+import "github.com/VahanMargaryan/smtp-proxy/pkg/config"
+
+// UpdateSecrets makes sessions created afterwards use the credentials of
+// fresh, a configuration loaded again after a secret file changed, as
+// config.WithSecrets picks them. Sessions already open keep the
+// credentials they started with.
+func (b *Backend) UpdateSecrets(fresh *config.Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.config = b.config.WithSecrets(fresh)
+}
+
+func (b *Backend) currentConfig() *config.Config {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.config
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/smime"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// sign replaces the final message with its S/MIME signed form. Messages
+// from senders without a certificate, or that fail to sign, are relayed
+// unsigned.
+func (s *Session) sign(env *relay.Envelope) {
+	signed, err := s.signer.Sign(env.Message)
+	if errors.Is(err, smime.ErrNoIdentity) {
+		slog.Debug("smime signing skipped", "msg_id", env.ID, "reason", err)
+		return
+	}
+	if err != nil {
+		slog.Warn("smime signing failed", "msg_id", env.ID, "error", err)
+		return
+	}
+	env.Message = signed
+}
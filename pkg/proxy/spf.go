@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/spf"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+// trustedUser is the client identity of sessions from SMTP_TRUSTED_NETWORKS
+// that did not authenticate, e.g. in {user} header rule variables.
+const trustedUser = "trusted"
+
+// errSPFFail refuses a sender whose domain does not permit the client
+// (RFC 7372 section 3.2).
+var errSPFFail = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+	Message:      "SPF validation failed",
+}
+
+// errSPFTempFail defers a sender whose SPF policy could not be fetched.
+var errSPFTempFail = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 24},
+	Message:      "SPF validation error, try again later",
+}
+
+// inNetworks reports whether ip is within one of networks.
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && slices.ContainsFunc(networks, func(n *net.IPNet) bool { return n.Contains(parsed) })
+}
+
+// checkSPF evaluates the SPF policy of the MAIL FROM domain for an
+// unauthenticated session's client and logs the result. With
+// SMTP_SPF_ACTION=reject it refuses a fail and defers a temperror.
+func (s *Session) checkSPF(from string) error {
+	ip := net.ParseIP(s.remoteIP)
+	if ip == nil {
+		return nil
+	}
+	domain := spf.Domain(from, s.helo)
+	result, err := s.spf.Check(ip, from, s.helo)
+	s.spfResult = result
+	s.spfDomain = domain
+
+	attrs := []slog.Attr{
+		slog.String("msg_id", s.queueID),
+		slog.String("remote_ip", s.remoteIP),
+		slog.String("client_from", from),
+		slog.String("domain", domain),
+		slog.String("result", string(result)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "spf check", attrs...)
+
+	if s.config.SPFAction != "reject" {
+		return nil
+	}
+	switch result {
+	case spf.Fail:
+		return errSPFFail
+	case spf.TempError:
+		return errSPFTempFail
+	}
+	return nil
+}
+
+// spfHeader returns the Received-SPF field recording the session's last
+// SPF result, or "" if there is none or tagging is off. The client's IP
+// and HELO name are left out, like the Received fields the sanitizer
+// strips.
+func (s *Session) spfHeader() string {
+	if s.spfResult == "" || s.config.SPFAction == "log" {
+		return ""
+	}
+	from := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(sanitizer.HeaderValue(s.from))
+	return "Received-SPF: " + string(s.spfResult) + " identity=mailfrom; envelope-from=\"" + from + "\"\r\n"
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Submit runs message from SMTP_DEST_FROM to recipients through a session
+// of its own, as user, with the same screening, sanitizing and relaying as
+// client mail. It is how the proxy sends mail it generates itself, such as
+// reports. It returns the queue ID the message was accepted under.
+func (b *Backend) Submit(user string, recipients []string, message []byte) (string, error) {
+	sess, err := b.NewSession(nil)
+	if err != nil {
+		return "", err
+	}
+	s := sess.(*Session)
+	defer s.Logout()
+	s.auth, s.trusted, s.username = true, false, user
+
+	if err := s.Mail(s.config.DestFrom, &smtp.MailOptions{}); err != nil {
+		return "", fmt.Errorf("MAIL FROM: %w", err)
+	}
+	for _, to := range recipients {
+		if err := s.Rcpt(to, &smtp.RcptOptions{}); err != nil {
+			return "", fmt.Errorf("RCPT TO %s: %w", to, err)
+		}
+	}
+	// Accepted messages get a 250 reply naming the queue ID
+	var reply *smtp.SMTPError
+	if err := s.Data(bytes.NewReader(message)); !errors.As(err, &reply) || reply.Code != 250 {
+		return "", fmt.Errorf("DATA: %w", err)
+	}
+	return strings.TrimPrefix(reply.Message, "OK: queued as "), nil
+}
+
+// InFlight returns the number of messages being relayed right now. The
+// proxy relays while the client waits, so this is its queue depth.
+func (b *Backend) InFlight() int {
+	return b.limits.inFlight()
+}
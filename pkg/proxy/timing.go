@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/statsd"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// timing records how long each pipeline stage of a message took, for
+// pinpointing latency under load.
+type timing struct {
+	id      string
+	start   time.Time
+	last    time.Time
+	stages  []stage
+	metrics *statsd.Client
+}
+
+// stage is the time a message spent in one pipeline stage.
+type stage struct {
+	name string
+	d    time.Duration
+}
+
+func newTiming(id string, metrics *statsd.Client) *timing {
+	now := time.Now()
+	return &timing{id: id, start: now, last: now, metrics: metrics}
+}
+
+// mark closes the current stage under the given name. A stage marked
+// again, like policy, which has checks before and after sanitizing, adds
+// to its earlier time.
+func (t *timing) mark(name string) {
+	now := time.Now()
+	t.add(name, now.Sub(t.last))
+	t.last = now
+}
+
+// markRelay closes the relay stage, split into the upstream stages rt
+// recorded. The rest, throttling and the backoff between attempts, is
+// relay_wait.
+func (t *timing) markRelay(rt *relay.Timing) {
+	now := time.Now()
+	wait := now.Sub(t.last) - rt.Connect - rt.Auth - rt.Data
+	t.add("connect", rt.Connect)
+	t.add("auth", rt.Auth)
+	t.add("data", rt.Data)
+	t.add("relay_wait", max(wait, 0))
+	t.last = now
+}
+
+func (t *timing) add(name string, d time.Duration) {
+	for i := range t.stages {
+		if t.stages[i].name == name {
+			t.stages[i].d += d
+			return
+		}
+	}
+	t.stages = append(t.stages, stage{name, d})
+}
+
+// log emits the breakdown at debug level together with the total, and
+// adds it to the metrics and the totals served by StageTimings.
+func (t *timing) log() {
+	total := time.Since(t.start)
+	t.metrics.Timing("message.duration", total)
+	attrs := make([]slog.Attr, 0, len(t.stages)+2)
+	attrs = append(attrs, slog.String("msg_id", t.id))
+	for _, s := range t.stages {
+		t.metrics.Timing("message.stage", s.d, "stage:"+s.name)
+		attrs = append(attrs, slog.Duration(s.name, s.d))
+	}
+	attrs = append(attrs, slog.Duration("total", total))
+	slog.Default().LogAttrs(context.Background(), slog.LevelDebug, "message timing", attrs...)
+	stageTotals.add(t.stages)
+}
+
+// StageTiming is the time messages spent in one pipeline stage since the
+// program started.
+type StageTiming struct {
+	Messages int64   `json:"messages"`
+	TotalMs  float64 `json:"total_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+}
+
+// stageTotals sums the stages of every message.
+var stageTotals = &stageSums{sums: make(map[string]*stageSum)}
+
+type stageSums struct {
+	mu   sync.Mutex
+	sums map[string]*stageSum
+}
+
+type stageSum struct {
+	messages int64
+	total    time.Duration
+}
+
+func (s *stageSums) add(stages []stage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range stages {
+		sum, ok := s.sums[st.name]
+		if !ok {
+			sum = &stageSum{}
+			s.sums[st.name] = sum
+		}
+		sum.messages++
+		sum.total += st.d
+	}
+}
+
+// StageTimings returns the time messages spent in each pipeline stage
+// since the program started, by stage name.
+func StageTimings() map[string]StageTiming {
+	stageTotals.mu.Lock()
+	defer stageTotals.mu.Unlock()
+	timings := make(map[string]StageTiming, len(stageTotals.sums))
+	for name, sum := range stageTotals.sums {
+		ms := float64(sum.total) / float64(time.Millisecond)
+		timings[name] = StageTiming{Messages: sum.messages, TotalMs: ms, AvgMs: ms / float64(sum.messages)}
+	}
+	return timings
+}
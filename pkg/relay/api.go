@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// apiTimeout bounds one HTTP API request, including the upload.
+const apiTimeout = 5 * time.Minute
+
+// apiRootCAs is swapped out in tests; nil uses the system roots.
+var apiRootCAs *x509.CertPool
+
+// apiClient returns an HTTP client whose connections are opened like SMTP
+// ones, honouring the address family policy, source IP and egress proxy.
+func apiClient(cfg *config.Config) *http.Client {
+	connect := directDialer(cfg)
+	if cfg.DestProxy != nil {
+		connect = (&tunnelDialer{proxy: cfg.DestProxy, dial: connect}).Dial
+	}
+	return &http.Client{
+		Timeout: apiTimeout,
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+				return connect(addr)
+			},
+			TLSClientConfig:     &tls.Config{RootCAs: apiRootCAs},
+			TLSHandshakeTimeout: dialTimeout,
+		},
+	}
+}
+
+// apiURL returns the HTTPS URL of path on the configured API host.
+func apiURL(cfg *config.Config, path string) string {
+	if cfg.DestPort == 443 {
+		return "https://" + cfg.DestHost + path
+	}
+	return "https://" + net.JoinHostPort(cfg.DestHost, strconv.Itoa(cfg.DestPort)) + path
+}
+
+// postAPI sends req and maps the provider's answer to the errors the SMTP
+// transport produces. Providers accept or reject a message as a whole, so
+// a rejection fails every recipient:
+//
+//	2xx                 delivered
+//	401, 403            ErrAuth, temporary like an upstream auth failure
+//	429, 5xx            ErrConnect, temporary like a connection failure
+//	other 4xx           DeliveryError with an ErrDataRejected 554 for every recipient, permanent
+func postAPI(cfg *config.Config, env *Envelope, provider string, req *http.Request) error {
+	// The request does not separate connecting and authenticating from
+	// sending, so it all counts as data
+	start := time.Now()
+	defer env.Timing.add(start, start, start)
+	resp, err := apiClient(cfg).Do(req)
+	if err != nil {
+		return staged(ErrConnect, fmt.Errorf("relay: %s: %w", provider, err))
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg := apiErrorMessage(body)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return staged(ErrAuth, fmt.Errorf("relay: %s: %s: %s", provider, resp.Status, msg))
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return staged(ErrConnect, fmt.Errorf("relay: %s: %s: %s", provider, resp.Status, msg))
+	}
+	reply := &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      fmt.Sprintf("%s rejected the message: %s: %s", provider, resp.Status, msg),
+	}
+	failed := make([]RecipientError, 0, len(env.Recipients))
+	for _, rcpt := range env.Addresses() {
+		failed = append(failed, RecipientError{Recipient: rcpt, Err: staged(ErrDataRejected, reply)})
+	}
+	return &DeliveryError{Failed: failed}
+}
+
+// apiErrorMessage extracts a readable message from a provider's error
+// body. SendGrid uses {"errors":[{"message"}]}, Mailgun and SES use
+// {"message"}; anything else is returned trimmed.
+func apiErrorMessage(body []byte) string {
+	var parsed struct {
+		Message string `json:"message"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		if parsed.Message != "" {
+			return parsed.Message
+		}
+		var msgs []string
+		for _, e := range parsed.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		if len(msgs) > 0 {
+			return strings.Join(msgs, "; ")
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
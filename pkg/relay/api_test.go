@@ -0,0 +1,236 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// startAPI runs an HTTPS provider API and returns a config relaying to it
+// with transport. Requests are handed to handler after being recorded.
+func startAPI(t *testing.T, transport string, handler http.HandlerFunc) (*config.Config, <-chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec := r.Clone(r.Context())
+		rec.Body = io.NopCloser(strings.NewReader(string(body)))
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		requests <- rec
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	orig := apiRootCAs
+	apiRootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	t.Cleanup(func() { apiRootCAs = orig })
+
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return &config.Config{
+		DestTransport: transport,
+		DestHost:      host,
+		DestPort:      port,
+		DestUsername:  "api",
+		DestPassword:  "secret-key",
+		DestFrom:      "bounce@example.com",
+		DestDomain:    "example.com",
+		DestRegion:    "eu-west-1",
+	}, requests
+}
+
+func ok(w http.ResponseWriter, _ *http.Request) {
+	_, _ = io.WriteString(w, `{"id":"<1@example.com>","message":"Queued"}`)
+}
+
+const apiMessage = "From: App <app@example.com>\r\n" +
+	"To: a@dest.org\r\n" +
+	"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+	"Message-ID: <abc@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Gr=C3=BC=C3=9Fe\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf; name=report.pdf\r\n" +
+	"Content-Disposition: attachment; filename=report.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--b--\r\n"
+
+func TestSend_Mailgun(t *testing.T) {
+	cfg, requests := startAPI(t, "mailgun", ok)
+
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org", "b@dest.org"}, []byte(apiMessage))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := <-requests
+	if r.URL.Path != "/v3/example.com/messages.mime" {
+		t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if user, pass, _ := r.BasicAuth(); user != "api" || pass != "secret-key" {
+		t.Errorf("unexpected credentials %s:%s", user, pass)
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if to := r.MultipartForm.Value["to"]; strings.Join(to, ",") != "a@dest.org,b@dest.org" {
+		t.Errorf("unexpected recipients %v", to)
+	}
+	f, _ := r.MultipartForm.File["message"][0].Open()
+	if got, _ := io.ReadAll(f); string(got) != apiMessage {
+		t.Errorf("expected the message unchanged, got %q", got)
+	}
+}
+
+func TestSend_SES(t *testing.T) {
+	cfg, requests := startAPI(t, "ses", ok)
+
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte(apiMessage))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := <-requests
+	if r.URL.Path != sesPath {
+		t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=api/") || !strings.Contains(auth, "/eu-west-1/ses/aws4_request") {
+		t.Errorf("unexpected Authorization %q", auth)
+	}
+	var input struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct{ Raw struct{ Data []byte } }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+	if input.FromEmailAddress != "bounce@example.com" || len(input.Destination.ToAddresses) != 1 || string(input.Content.Raw.Data) != apiMessage {
+		t.Errorf("unexpected request %+v", input)
+	}
+}
+
+func TestSESRegion(t *testing.T) {
+	for host, want := range map[string]string{
+		"email.eu-west-1.amazonaws.com":      "eu-west-1",
+		"email-smtp.eu-west-1.amazonaws.com": "",
+		"api.mailgun.net":                    "",
+	} {
+		if got := sesRegion(host); got != want {
+			t.Errorf("%s: got %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestSend_SendGrid(t *testing.T) {
+	cfg, requests := startAPI(t, "sendgrid", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	// b@dest.org is not in To, so it must stay hidden
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org", "b@dest.org"}, []byte(apiMessage))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := <-requests
+	if r.URL.Path != "/v3/mail/send" || r.Header.Get("Authorization") != "Bearer secret-key" {
+		t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Authorization"))
+	}
+	var m sendgridMail
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Personalizations) != 1 {
+		t.Fatalf("expected one personalization, got %+v", m.Personalizations)
+	}
+	p := m.Personalizations[0]
+	if len(p.To) != 1 || p.To[0].Email != "a@dest.org" || len(p.Bcc) != 1 || p.Bcc[0].Email != "b@dest.org" {
+		t.Errorf("unexpected personalization %+v", p)
+	}
+	if m.From.Email != "app@example.com" || m.From.Name != "App" || m.Subject != "Grüße" {
+		t.Errorf("unexpected from/subject %+v %q", m.From, m.Subject)
+	}
+	if m.Headers["Message-Id"] != "<abc@example.com>" || m.Headers["Content-Type"] != "" {
+		t.Errorf("unexpected headers %v", m.Headers)
+	}
+	if len(m.Content) != 1 || m.Content[0].Type != "text/plain" || m.Content[0].Value != "Grüße" {
+		t.Errorf("unexpected content %+v", m.Content)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Filename != "report.pdf" || m.Attachments[0].Content != base64.StdEncoding.EncodeToString([]byte("%PDF-1.4")) {
+		t.Errorf("unexpected attachments %+v", m.Attachments)
+	}
+}
+
+func TestSend_SendGridUnconvertible(t *testing.T) {
+	cfg, requests := startAPI(t, "sendgrid", ok)
+
+	msg := "From: app@example.com\r\nTo: a@dest.org\r\nContent-Type: text/plain; charset=iso-8859-1\r\n\r\nGr\xfc\xdfe\r\n"
+	err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte(msg)))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("expected DeliveryError, got %v", err)
+	}
+	if _, permanent := delivery.Permanent(); !permanent {
+		t.Errorf("expected a permanent failure, got %v", err)
+	}
+	select {
+	case <-requests:
+		t.Error("expected no API request")
+	default:
+	}
+}
+
+func TestSend_APIErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		cfg, _ := startAPI(t, "mailgun", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(tc.status)
+			_, _ = io.WriteString(w, `{"message":"nope"}`)
+		})
+
+		err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte(apiMessage)))
+		if err == nil || !strings.Contains(err.Error(), "nope") {
+			t.Fatalf("%d: expected the provider's message, got %v", tc.status, err)
+		}
+		permanent := false
+		var delivery *DeliveryError
+		if errors.As(err, &delivery) {
+			_, permanent = delivery.Permanent()
+		}
+		if permanent != tc.permanent {
+			t.Errorf("%d: permanent = %v, want %v (%v)", tc.status, permanent, tc.permanent, err)
+		}
+	}
+}
+
+func TestProbe_API(t *testing.T) {
+	cfg, requests := startAPI(t, "mailgun", ok)
+
+	if err := Probe(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-requests:
+		t.Error("expected no API request")
+	default:
+	}
+}
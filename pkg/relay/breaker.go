@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// ErrCircuitOpen is returned without contacting the upstream while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("relay: upstream circuit open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Breaker stops sending to an upstream that is clearly down. After
+// threshold consecutive upstream failures it opens and fails fast for the
+// cooldown period, then lets a single probe through (half-open): success
+// closes the circuit, failure reopens it.
+type Breaker struct {
+	upstream  string // for the logs
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewBreaker creates a breaker from cfg. It returns nil when
+// cfg.BreakerThreshold is 0; a nil *Breaker passes sends straight through.
+func NewBreaker(cfg *config.Config) *Breaker {
+	if cfg.BreakerThreshold == 0 {
+		return nil
+	}
+	return &Breaker{
+		upstream:  cfg.DestHost,
+		threshold: cfg.BreakerThreshold,
+		cooldown:  cfg.BreakerCooldown,
+		now:       time.Now,
+	}
+}
+
+// Wrap returns a SendFunc that consults the breaker around send.
+func (b *Breaker) Wrap(send SendFunc) SendFunc {
+	if b == nil {
+		return send
+	}
+	return func(cfg *config.Config, env *Envelope) error {
+		if !b.allow() {
+			return ErrCircuitOpen
+		}
+		err := send(cfg, env)
+		b.record(upstreamDown(err))
+		return err
+	}
+}
+
+// allow reports whether a send may proceed, moving an open circuit to
+// half-open once the cooldown has elapsed.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		slog.Info("relay: circuit half-open, probing upstream", "upstream", b.upstream)
+		return true
+	case breakerHalfOpen:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state != breakerClosed {
+			slog.Info("relay: circuit closed, upstream recovered", "upstream", b.upstream)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			slog.Error("relay: circuit open, upstream unavailable",
+				"upstream", b.upstream,
+				"consecutive_failures", b.failures,
+				"cooldown", b.cooldown,
+			)
+		}
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// upstreamDown reports whether err means the upstream itself is failing
+// (unreachable, timing out, refusing service) as opposed to rejecting
+// particular recipients or messages.
+func upstreamDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) {
+		if delivery.Partial() {
+			return false
+		}
+		for _, f := range delivery.Failed {
+			if !upstreamDown(f.Err) {
+				return false
+			}
+		}
+		return true
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code == 421
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestBreaker_DisabledByDefault(t *testing.T) {
+	if b := NewBreaker(&config.Config{}); b != nil {
+		t.Fatal("expected nil breaker when threshold is 0")
+	}
+	var b *Breaker
+	if err := b.Wrap(func(*config.Config, *Envelope) error { return nil })(nil, &Envelope{}); err != nil {
+		t.Errorf("expected nil breaker to pass through, got %v", err)
+	}
+}
+
+func TestBreaker_OpensAndRecovers(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(&config.Config{BreakerThreshold: 2, BreakerCooldown: 30 * time.Second})
+	b.now = func() time.Time { return now }
+
+	calls := 0
+	upstreamErr := errors.New("connection refused")
+	sendErr := upstreamErr
+	send := b.Wrap(func(*config.Config, *Envelope) error {
+		calls++
+		return sendErr
+	})
+
+	// Two consecutive failures open the circuit
+	_ = send(nil, &Envelope{})
+	_ = send(nil, &Envelope{})
+	if err := send(nil, &Envelope{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected upstream not to be called while open, got %d calls", calls)
+	}
+
+	// After cooldown a failed probe reopens immediately
+	now = now.Add(31 * time.Second)
+	if err := send(nil, &Envelope{}); !errors.Is(err, upstreamErr) {
+		t.Fatalf("expected probe to reach upstream, got %v", err)
+	}
+	if err := send(nil, &Envelope{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected circuit to reopen after failed probe, got %v", err)
+	}
+
+	// A successful probe closes it
+	now = now.Add(31 * time.Second)
+	sendErr = nil
+	if err := send(nil, &Envelope{}); err != nil {
+		t.Fatalf("expected successful probe, got %v", err)
+	}
+	if err := send(nil, &Envelope{}); err != nil {
+		t.Errorf("expected closed circuit, got %v", err)
+	}
+}
+
+func TestBreaker_IgnoresRecipientRejections(t *testing.T) {
+	b := NewBreaker(&config.Config{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	rejection := &DeliveryError{Failed: []RecipientError{{
+		Recipient: "bad@example.com",
+		Err:       &smtp.SMTPError{Code: 550, Message: "No such user"},
+	}}}
+	send := b.Wrap(func(*config.Config, *Envelope) error { return rejection })
+
+	_ = send(nil, &Envelope{})
+	if err := send(nil, &Envelope{}); errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected recipient rejections not to open the circuit")
+	}
+}
+
+func TestUpstreamDown(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"network", errors.New("dial tcp: timeout"), true},
+		{"421", &smtp.SMTPError{Code: 421}, true},
+		{"451", &smtp.SMTPError{Code: 451}, false},
+		{"partial", &DeliveryError{Delivered: []string{"a"}, Failed: []RecipientError{{Err: errors.New("eof")}}}, false},
+		{"all network", &DeliveryError{Failed: []RecipientError{{Err: errors.New("eof")}}}, true},
+	}
+	for _, tt := range tests {
+		if got := upstreamDown(tt.err); got != tt.want {
+			t.Errorf("%s: upstreamDown = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
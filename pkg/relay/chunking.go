@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// chunkSize is the largest BDAT chunk sent upstream.
+const chunkSize = 1 << 20
+
+// chunkTimeout bounds writing one chunk and reading its reply.
+const chunkTimeout = 5 * time.Minute
+
+// sendChunked transmits message with BDAT (RFC 3030) after MAIL and RCPT
+// have succeeded on the client. Chunks carry the message as is, without
+// dot-stuffing. conn is the connection the client talks over; replies are
+// read from it directly since go-smtp's client has no BDAT support. The
+// commands and replies, never the content, are copied to debug if set.
+func sendChunked(conn net.Conn, message []byte, debug io.Writer) error {
+	defer conn.SetDeadline(time.Time{})
+	replies := textproto.NewReader(bufio.NewReader(conn))
+	for first := true; first || len(message) > 0; first = false {
+		n := min(len(message), chunkSize)
+		cmd := "BDAT " + strconv.Itoa(n)
+		if n == len(message) {
+			cmd += " LAST"
+		}
+		if debug != nil {
+			fmt.Fprintf(debug, "%s\r\n", cmd)
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(chunkTimeout))
+		if _, err := conn.Write(append([]byte(cmd+"\r\n"), message[:n]...)); err != nil {
+			return err
+		}
+		code, msg, err := replies.ReadResponse(250)
+		if debug != nil && code != 0 {
+			for _, line := range strings.Split(msg, "\n") {
+				fmt.Fprintf(debug, "%d %s\r\n", code, line)
+			}
+		}
+		if err != nil {
+			var protoErr *textproto.Error
+			if errors.As(err, &protoErr) {
+				return replyError(protoErr.Code, protoErr.Msg)
+			}
+			return err
+		}
+		message = message[n:]
+	}
+	return nil
+}
+
+// replyError converts an upstream reply into an SMTPError, splitting off
+// the enhanced status code if the reply starts with one.
+func replyError(code int, msg string) *smtp.SMTPError {
+	e := &smtp.SMTPError{Code: code, EnhancedCode: smtp.NoEnhancedCode, Message: msg}
+	head, rest, _ := strings.Cut(msg, " ")
+	parts := strings.Split(head, ".")
+	if len(parts) != 3 || parts[0] != strconv.Itoa(code/100) {
+		return e
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return e
+		}
+		e.EnhancedCode[i] = n
+	}
+	e.Message = rest
+	return e
+}
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestSend_Chunking(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	cfg.DestChunking = true
+
+	// Dot-prefixed lines pass through unstuffed, across several chunks
+	body := strings.Repeat(".line\r\n", 2*chunkSize/7)
+	msg := []byte("Subject: Test\r\n\r\n" + body + ".\r\n")
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, msg)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.messages) != 1 || !bytes.Equal(mock.messages[0], msg) {
+		t.Errorf("upstream received a different message (%d transactions)", len(mock.messages))
+	}
+}
+
+func TestSend_ChunkingRejected(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	cfg.DestChunking = true
+	mock.rejectData = true
+
+	err := Send(cfg, testEnvelope([]string{"a@dest.org", "b@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || len(delivery.Failed) != 2 {
+		t.Fatalf("expected both recipients failed, got %v", err)
+	}
+	upstream, ok := delivery.Permanent()
+	if !ok || upstream.Code != 554 || upstream.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Errorf("expected permanent 554 5.7.1, got %v", err)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	e := replyError(552, "5.3.4 Message too big")
+	if e.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) || e.Message != "Message too big" {
+		t.Errorf("unexpected error %+v", e)
+	}
+	e = replyError(451, "Try again")
+	if e.EnhancedCode != smtp.NoEnhancedCode || e.Message != "Try again" {
+		t.Errorf("unexpected error %+v", e)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"upstream.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock, cfg := startMockUpstream(t, 0, func(s *smtp.Server) {
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	})
+	cfg.DestChunking = true
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(cfg.DestHost, strconv.Itoa(cfg.DestPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	cert, _ := x509.ParseCertificate(der)
+	pool.AddCert(cert)
+	conn, err = startTLS(conn, "relay.example.com", &tls.Config{ServerName: "upstream.local", RootCAs: pool})
+	if err != nil {
+		t.Fatalf("startTLS: %v", err)
+	}
+	client := smtp.NewClient(conn)
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		t.Error("expected STARTTLS no longer offered over TLS")
+	}
+	if err := client.Mail("upstream@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("a@dest.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendChunked(conn, []byte("Subject: TLS\r\n\r\nBody\r\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.messages) != 1 {
+		t.Errorf("expected one message delivered over TLS, got %d", len(mock.messages))
+	}
+}
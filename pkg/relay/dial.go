@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// dialTimeout bounds connecting and, for STARTTLS, the handshake.
+const dialTimeout = 30 * time.Second
+
+// dial connects to the upstream at addr, choosing the TLS mode by port, and
+// returns a client along with the connection it talks over. The
+// connection is the TLS one when TLS is used, so BDAT chunks written to it
+// directly are encrypted like the client's own commands. Connections go
+// through cfg.DestProxy when set, and are opened by directDialer.
+// cfg.DestHeloName is only used for the EHLO preceding STARTTLS; the caller
+// still has to call Hello on the client.
+func dial(cfg *config.Config, addr string, tlsConfig *tls.Config) (*smtp.Client, net.Conn, error) {
+	connect := directDialer(cfg)
+	if cfg.DestProxy != nil {
+		connect = (&tunnelDialer{proxy: cfg.DestProxy, dial: connect}).Dial
+	}
+
+	conn, err := connect(addr)
+	if err != nil {
+		return nil, nil, staged(ErrConnect, err)
+	}
+	switch cfg.DestPort {
+	case 465:
+		conn, err = handshake(conn, tlsConfig)
+	case 587:
+		conn, err = startTLS(conn, cfg.DestHeloName, tlsConfig)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return smtp.NewClient(conn), conn, nil
+}
+
+// handshake starts implicit TLS on conn.
+func handshake(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, staged(ErrTLS, fmt.Errorf("TLS handshake: %w", err))
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// startTLS upgrades a fresh plaintext connection with STARTTLS. go-smtp's
+// client expects a greeting on a new connection, so the returned
+// connection replays the server's original greeting before the TLS data.
+func startTLS(conn net.Conn, heloName string, tlsConfig *tls.Config) (net.Conn, error) {
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	text := textproto.NewConn(conn)
+	_, greeting, err := text.ReadResponse(220)
+	if err != nil {
+		return fail(staged(ErrConnect, fmt.Errorf("greeting: %w", err)))
+	}
+	if err := text.PrintfLine("EHLO %s", heloName); err != nil {
+		return fail(staged(ErrConnect, err))
+	}
+	_, ext, err := text.ReadResponse(250)
+	if err != nil {
+		return fail(staged(ErrConnect, fmt.Errorf("EHLO: %w", err)))
+	}
+	if !hasExtension(ext, "STARTTLS") {
+		return fail(staged(ErrTLS, fmt.Errorf("upstream does not support STARTTLS")))
+	}
+	if err := text.PrintfLine("STARTTLS"); err != nil {
+		return fail(staged(ErrConnect, err))
+	}
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fail(staged(ErrTLS, fmt.Errorf("STARTTLS: %w", err)))
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fail(staged(ErrTLS, fmt.Errorf("TLS handshake: %w", err)))
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	lines := strings.Split(greeting, "\n")
+	var replay strings.Builder
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		replay.WriteString("220" + sep + line + "\r\n")
+	}
+	return &greetingConn{Conn: tlsConn, greeting: []byte(replay.String())}, nil
+}
+
+// hasExtension reports whether an EHLO reply lists ext. The first line is
+// the server's hostname.
+func hasExtension(reply, ext string) bool {
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		if name, _, _ := strings.Cut(line, " "); strings.EqualFold(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// greetingConn returns greeting from its first reads, then reads from the
+// underlying connection.
+type greetingConn struct {
+	net.Conn
+	greeting []byte
+}
+
+func (c *greetingConn) Read(p []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(p, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
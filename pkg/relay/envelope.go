@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Envelope is one message on its way through the proxy: who submitted it,
+// the envelope the client gave, and the sanitized content to relay. The
+// upstream envelope sender is always cfg.DestFrom, never From.
+type Envelope struct {
+	// ID correlates log lines for this message across the pipeline.
+	ID string
+
+	// From is the client's MAIL FROM, possibly empty (null sender).
+	From string
+	// MailOptions are the client's MAIL FROM parameters.
+	MailOptions smtp.MailOptions
+	// Recipients are the accepted RCPT TO addresses in submission order.
+	Recipients []Recipient
+
+	// Username is the authenticated client identity.
+	Username string
+	// RemoteIP is the client's address, empty if unknown.
+	RemoteIP string
+
+	// MailAt is when MAIL FROM was accepted; ReceivedAt when DATA completed.
+	MailAt     time.Time
+	ReceivedAt time.Time
+
+	// Message is the sanitized message to relay.
+	Message []byte
+
+	// Debug logs the upstream dialogue of every attempt for this message.
+	Debug bool
+
+	// Timing, when set, sums how long the upstream stages of the delivery
+	// attempts took. Copies made for redirected recipients share it.
+	Timing *Timing
+}
+
+// Timing is the time delivery attempts spent in each upstream stage.
+type Timing struct {
+	Connect time.Duration // dial, TLS and EHLO
+	Auth    time.Duration
+	Data    time.Duration // MAIL, RCPT, the message and QUIT
+}
+
+// add records an attempt that started at start and got connected and
+// authenticated at the given times, zero for stages it did not reach. The
+// attempt ends now. A nil *Timing records nothing.
+func (t *Timing) add(start, connected, authenticated time.Time) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	switch {
+	case connected.IsZero():
+		t.Connect += now.Sub(start)
+	case authenticated.IsZero():
+		t.Connect += connected.Sub(start)
+		t.Auth += now.Sub(connected)
+	default:
+		t.Connect += connected.Sub(start)
+		t.Auth += authenticated.Sub(connected)
+		t.Data += now.Sub(authenticated)
+	}
+}
+
+// Recipient is an envelope recipient with its RCPT TO parameters.
+type Recipient struct {
+	Address string
+	Options smtp.RcptOptions
+}
+
+// NewID returns a random correlation ID for an Envelope.
+func NewID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Addresses returns the recipient addresses in order.
+func (e *Envelope) Addresses() []string {
+	addrs := make([]string, len(e.Recipients))
+	for i, r := range e.Recipients {
+		addrs[i] = r.Address
+	}
+	return addrs
+}
+
+// withRecipients returns a shallow copy of e limited to the given
+// addresses, keeping each recipient's options.
+func (e *Envelope) withRecipients(addrs []string) *Envelope {
+	keep := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		keep[a] = true
+	}
+	c := *e
+	c.Recipients = nil
+	for _, r := range e.Recipients {
+		if keep[r.Address] {
+			c.Recipients = append(c.Recipients, r)
+		}
+	}
+	return &c
+}
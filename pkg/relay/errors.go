@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// The stages a relay attempt can fail at. Errors returned by Send match
+// one of them with errors.Is, so callers can decide on retries and
+// reporting without inspecting error text. The rejection stages mean the
+// upstream replied with an error; a connection lost during MAIL, RCPT or
+// the message transfer counts as ErrConnect.
+var (
+	ErrConnect      = errors.New("relay: upstream connection failed")
+	ErrTLS          = errors.New("relay: upstream TLS failed")
+	ErrAuth         = errors.New("relay: upstream authentication failed")
+	ErrMailRejected = errors.New("relay: sender rejected")
+	ErrRcptRejected = errors.New("relay: recipient rejected")
+	ErrDataRejected = errors.New("relay: message rejected")
+)
+
+// stageNames are the short stage names used in logs.
+var stageNames = map[error]string{
+	ErrConnect:      "connect",
+	ErrTLS:          "tls",
+	ErrAuth:         "auth",
+	ErrMailRejected: "mail",
+	ErrRcptRejected: "rcpt",
+	ErrDataRejected: "data",
+}
+
+// StageError tags a relay failure with the stage it happened at. Err is
+// the underlying error, an *smtp.SMTPError when the upstream replied.
+type StageError struct {
+	Stage error // one of ErrConnect, ErrTLS, ErrAuth or the Err*Rejected stages
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() []error {
+	return []error{e.Stage, e.Err}
+}
+
+// Reply returns the upstream's reply when the failure was one, with its
+// code, enhanced code and message.
+func (e *StageError) Reply() (*smtp.SMTPError, bool) {
+	var reply *smtp.SMTPError
+	ok := errors.As(e.Err, &reply)
+	return reply, ok
+}
+
+// Stage returns the short name of the stage err failed at ("connect",
+// "tls", "auth", "mail", "rcpt" or "data"), or "" if it carries none. For
+// a DeliveryError it is the stage of the first failed recipient.
+func Stage(err error) string {
+	var se *StageError
+	if !errors.As(err, &se) {
+		return ""
+	}
+	return stageNames[se.Stage]
+}
+
+// staged tags err with stage.
+func staged(stage, err error) error {
+	return &StageError{Stage: stage, Err: err}
+}
+
+// refused tags an error of a transaction command with stage if the
+// upstream replied, and with ErrConnect if the connection failed.
+func refused(stage, err error) error {
+	var reply *smtp.SMTPError
+	if !errors.As(err, &reply) {
+		stage = ErrConnect
+	}
+	return staged(stage, err)
+}
+
+// RecipientError records why the upstream did not accept a single recipient.
+type RecipientError struct {
+	Recipient string
+	Err       error
+}
+
+func (e RecipientError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Recipient, e.Err)
+}
+
+func (e RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// DeliveryError is returned by Send when at least one recipient was not
+// accepted upstream. Delivered lists the recipients that did receive the
+// message, so callers can tell a partial delivery from a total failure.
+type DeliveryError struct {
+	Delivered []string
+	Failed    []RecipientError
+}
+
+func (e *DeliveryError) Error() string {
+	parts := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		parts[i] = f.Error()
+	}
+	total := len(e.Delivered) + len(e.Failed)
+	return fmt.Sprintf("relay: %d of %d recipients failed: %s", len(e.Failed), total, strings.Join(parts, "; "))
+}
+
+func (e *DeliveryError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
+
+// Partial reports whether the message reached some but not all recipients.
+func (e *DeliveryError) Partial() bool {
+	return len(e.Delivered) > 0
+}
+
+// Permanent reports whether every failed recipient was rejected by the
+// upstream with a 5xx reply, returning the first such reply. Connection and
+// authentication problems never produce a DeliveryError, so they are always
+// treated as temporary.
+func (e *DeliveryError) Permanent() (*smtp.SMTPError, bool) {
+	var first *smtp.SMTPError
+	for _, f := range e.Failed {
+		var smtpErr *smtp.SMTPError
+		if !errors.As(f.Err, &smtpErr) || smtpErr.Code/100 != 5 {
+			return nil, false
+		}
+		if first == nil {
+			first = smtpErr
+		}
+	}
+	return first, first != nil
+}
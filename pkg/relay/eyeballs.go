@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// lookupIPAddr is swapped out in tests.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// directDialer returns the function that opens TCP connections for relay
+// traffic, to the upstream or to the egress proxy. It applies the address
+// family policy of cfg.DestIPFamily:
+//
+//	any          resolver order, racing the other family after the fallback delay (RFC 8305)
+//	ipv4, ipv6   only that family
+//	prefer-ipv4  IPv4 first, racing IPv6 after the fallback delay
+//	prefer-ipv6  IPv6 first, racing IPv4 after the fallback delay
+func directDialer(cfg *config.Config) func(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout, FallbackDelay: cfg.DestFallbackDelay}
+	if cfg.DestSourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: cfg.DestSourceIP}
+	}
+	switch cfg.DestIPFamily {
+	case "ipv4":
+		return func(addr string) (net.Conn, error) { return dialer.Dial("tcp4", addr) }
+	case "ipv6":
+		return func(addr string) (net.Conn, error) { return dialer.Dial("tcp6", addr) }
+	case "prefer-ipv4", "prefer-ipv6":
+		preferV4 := cfg.DestIPFamily == "prefer-ipv4"
+		return func(addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			defer cancel()
+			return dialPreferred(ctx, dialer, addr, preferV4)
+		}
+	}
+	return func(addr string) (net.Conn, error) { return dialer.Dial("tcp", addr) }
+}
+
+// dialPreferred connects to addr trying the addresses of the preferred
+// family first. The other family is started after the dialer's fallback
+// delay, or as soon as the preferred family has failed, and the first
+// connection to succeed wins. net.Dialer alone cannot do this, since it
+// always leads with the family of the first resolved address.
+func dialPreferred(ctx context.Context, dialer *net.Dialer, addr string, preferV4 bool) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	ips, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var primaries, fallbacks []string
+	for _, ip := range ips {
+		target := net.JoinHostPort(ip.IP.String(), port)
+		if (ip.IP.To4() != nil) == preferV4 {
+			primaries = append(primaries, target)
+		} else {
+			fallbacks = append(fallbacks, target)
+		}
+	}
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result)
+	race := func(targets []string, primary bool) {
+		var err error
+		for _, target := range targets {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, "tcp", target); err == nil {
+				select {
+				case results <- result{conn: conn, primary: primary}:
+				case <-ctx.Done():
+					conn.Close()
+				}
+				return
+			}
+		}
+		select {
+		case results <- result{err: err, primary: primary}:
+		case <-ctx.Done():
+		}
+	}
+
+	go race(primaries, true)
+	pending := 1
+	var fallbackTimer <-chan time.Time
+	if len(fallbacks) > 0 {
+		delay := dialer.FallbackDelay
+		if delay <= 0 {
+			delay = 300 * time.Millisecond
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+	startFallback := func() {
+		if fallbackTimer != nil {
+			fallbackTimer = nil
+			pending++
+			go race(fallbacks, false)
+		}
+	}
+
+	var dialErr error
+	for {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			pending--
+			if dialErr == nil || res.primary {
+				dialErr = res.err
+			}
+			startFallback()
+			if pending == 0 {
+				return nil, fmt.Errorf("dial %s: %w", addr, dialErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// resolveTo makes every lookup return ips.
+func resolveTo(t *testing.T, ips ...string) {
+	t.Helper()
+	orig := lookupIPAddr
+	t.Cleanup(func() { lookupIPAddr = orig })
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+}
+
+func listenLoopback(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestDirectDialer_FallsBackFromBrokenFamily(t *testing.T) {
+	port := listenLoopback(t)
+	// 100::/64 is the discard prefix: it either fails or hangs
+	resolveTo(t, "100::1", "127.0.0.1")
+
+	cfg := &config.Config{DestIPFamily: "prefer-ipv6", DestFallbackDelay: 50 * time.Millisecond}
+	start := time.Now()
+	conn, err := directDialer(cfg)(net.JoinHostPort("upstream.example", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("expected IPv4 fallback, got %s", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fallback took %v", elapsed)
+	}
+}
+
+func TestDirectDialer_PrefersFamily(t *testing.T) {
+	port := listenLoopback(t)
+	resolveTo(t, "100::1", "127.0.0.1")
+
+	cfg := &config.Config{DestIPFamily: "prefer-ipv4", DestFallbackDelay: time.Minute}
+	conn, err := directDialer(cfg)(net.JoinHostPort("upstream.example", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("expected IPv4, got %s", got)
+	}
+}
+
+func TestDirectDialer_AllFail(t *testing.T) {
+	// A closed port on both loopback addresses
+	ln, _ := net.Listen("tcp4", "127.0.0.1:0")
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+	resolveTo(t, "127.0.0.1", "::1")
+
+	cfg := &config.Config{DestIPFamily: "prefer-ipv4", DestFallbackDelay: time.Minute}
+	if _, err := directDialer(cfg)(net.JoinHostPort("upstream.example", port)); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDirectDialer_SingleFamily(t *testing.T) {
+	port := listenLoopback(t)
+	cfg := &config.Config{DestIPFamily: "ipv6"}
+	if _, err := directDialer(cfg)(net.JoinHostPort("127.0.0.1", port)); err == nil {
+		t.Error("expected an IPv4 address to be refused with ipv6 only")
+	}
+	cfg.DestIPFamily = "ipv4"
+	conn, err := directDialer(cfg)(net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+}
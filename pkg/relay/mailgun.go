@@ -0,0 +1,41 @@
+package relay
+
+import (
+	"bytes"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// sendMailgun delivers env through Mailgun's MIME sending API, which takes
+// the message as is. The sending domain is cfg.DestDomain, and
+// cfg.DestUsername and cfg.DestPassword are the basic auth credentials
+// ("api" and the API key).
+func sendMailgun(cfg *config.Config, env *Envelope) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, rcpt := range env.Addresses() {
+		_ = form.WriteField("to", rcpt)
+	}
+	part, err := form.CreateFormFile("message", "message.eml")
+	if err != nil {
+		return err
+	}
+	_, _ = part.Write(env.Message)
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, apiURL(cfg, "/v3/"+url.PathEscape(cfg.DestDomain)+"/messages.mime"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth(cfg.DestUsername, cfg.DestPassword)
+
+	slog.Debug("relaying through mailgun", "msg_id", env.ID, "domain", cfg.DestDomain)
+	return postAPI(cfg, env, "mailgun", req)
+}
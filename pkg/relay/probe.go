@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/emersion/go-sasl"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// Probe checks that the upstream in cfg is reachable the way a delivery
+// would reach it, without sending anything. For the smtp transport it
+// connects, says EHLO, authenticates and quits. HTTP API transports have no
+// side-effect-free way to check credentials, so only the TLS connection to
+// the API host is made.
+func Probe(cfg *config.Config) error {
+	addr := net.JoinHostPort(cfg.DestHost, strconv.Itoa(cfg.DestPort))
+
+	if cfg.DestTransport != "" && cfg.DestTransport != "smtp" {
+		connect := directDialer(cfg)
+		if cfg.DestProxy != nil {
+			connect = (&tunnelDialer{proxy: cfg.DestProxy, dial: connect}).Dial
+		}
+		conn, err := connect(addr)
+		if err != nil {
+			return staged(ErrConnect, fmt.Errorf("connect to %s: %w", addr, err))
+		}
+		if conn, err = handshake(conn, &tls.Config{ServerName: cfg.DestHost, RootCAs: apiRootCAs}); err != nil {
+			return fmt.Errorf("connect to %s: %w", addr, err)
+		}
+		return conn.Close()
+	}
+
+	client, _, err := dial(cfg, addr, &tls.Config{ServerName: cfg.DestHost})
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	defer client.Close()
+	if err := client.Hello(cfg.DestHeloName); err != nil {
+		return staged(ErrConnect, fmt.Errorf("EHLO: %w", err))
+	}
+	if err := client.Auth(sasl.NewPlainClient("", cfg.DestUsername, cfg.DestPassword)); err != nil {
+		return staged(ErrAuth, fmt.Errorf("auth: %w", err))
+	}
+	return client.Quit()
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// Redirect sends every message to a single test inbox instead of its
+// recipients, so a staging environment exercises the real upstream without
+// mailing customers. Recipients on the allow list are still delivered to
+// directly.
+type Redirect struct {
+	to    string
+	allow []string
+}
+
+// NewRedirect creates a redirect from cfg. It returns nil when
+// SMTP_REDIRECT_TO is not set; a nil *Redirect passes sends straight
+// through.
+func NewRedirect(cfg *config.Config) *Redirect {
+	if cfg.RedirectTo == "" {
+		return nil
+	}
+	return &Redirect{to: cfg.RedirectTo, allow: cfg.RedirectAllow}
+}
+
+// Wrap returns a SendFunc that delivers allowed recipients unchanged and
+// one copy of the message to the redirect address in place of all the
+// others, recording each replaced recipient in an X-Original-To field.
+// Failures of the redirected copy are reported against the original
+// recipients.
+func (r *Redirect) Wrap(send SendFunc) SendFunc {
+	if r == nil {
+		return send
+	}
+	return func(cfg *config.Config, env *Envelope) error {
+		var allowed, redirected []string
+		for _, rcpt := range env.Recipients {
+			if r.allowed(rcpt.Address) {
+				allowed = append(allowed, rcpt.Address)
+			} else {
+				redirected = append(redirected, rcpt.Address)
+			}
+		}
+		if len(redirected) == 0 {
+			return send(cfg, env)
+		}
+
+		slog.Info("redirecting message",
+			"msg_id", env.ID,
+			"redirect_to", r.to,
+			"original_recipients", redirected,
+		)
+		var header strings.Builder
+		for _, addr := range redirected {
+			header.WriteString("X-Original-To: " + addr + "\r\n")
+		}
+		c := *env
+		c.Recipients = []Recipient{{Address: r.to}}
+		c.Message = append([]byte(header.String()), env.Message...)
+		err := asRecipients(send(cfg, &c), redirected)
+		if len(allowed) == 0 {
+			return err
+		}
+
+		result := &DeliveryError{}
+		for _, part := range []struct {
+			addrs []string
+			err   error
+		}{
+			{allowed, send(cfg, env.withRecipients(allowed))},
+			{redirected, err},
+		} {
+			var delivery *DeliveryError
+			switch {
+			case part.err == nil:
+				result.Delivered = append(result.Delivered, part.addrs...)
+			case errors.As(part.err, &delivery):
+				result.Delivered = append(result.Delivered, delivery.Delivered...)
+				result.Failed = append(result.Failed, delivery.Failed...)
+			default:
+				for _, addr := range part.addrs {
+					result.Failed = append(result.Failed, RecipientError{Recipient: addr, Err: part.err})
+				}
+			}
+		}
+		if len(result.Failed) == 0 {
+			return nil
+		}
+		return result
+	}
+}
+
+// allowed reports whether addr matches an allow list entry, either the
+// whole address or its domain.
+func (r *Redirect) allowed(addr string) bool {
+	addr = strings.ToLower(addr)
+	_, domain, _ := strings.Cut(addr, "@")
+	for _, a := range r.allow {
+		if a == addr || a == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// asRecipients rewrites the upstream's rejection of the redirect address
+// as a rejection of each original recipient, so replies and logs name the
+// addresses the client submitted.
+func asRecipients(err error, addrs []string) error {
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || len(delivery.Failed) == 0 {
+		return err
+	}
+	rewritten := &DeliveryError{}
+	for _, addr := range addrs {
+		rewritten.Failed = append(rewritten.Failed, RecipientError{Recipient: addr, Err: delivery.Failed[0].Err})
+	}
+	return rewritten
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestRedirect_DisabledByDefault(t *testing.T) {
+	if r := NewRedirect(&config.Config{}); r != nil {
+		t.Fatal("expected nil redirect without SMTP_REDIRECT_TO")
+	}
+}
+
+func TestRedirect_ReplacesRecipients(t *testing.T) {
+	r := NewRedirect(&config.Config{RedirectTo: "inbox@test.example", RedirectAllow: []string{"team.example", "qa@partner.example"}})
+
+	var sent []*Envelope
+	send := r.Wrap(func(_ *config.Config, env *Envelope) error {
+		sent = append(sent, env)
+		return nil
+	})
+
+	env := testEnvelope([]string{"a@customer.example", "Dev@Team.example", "qa@partner.example", "b@partner.example"}, []byte("Subject: hi\r\n\r\nbody\r\n"))
+	if err := send(nil, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 sends, got %d", len(sent))
+	}
+
+	redirected := sent[0]
+	if got := redirected.Addresses(); !slices.Equal(got, []string{"inbox@test.example"}) {
+		t.Errorf("expected the redirect address, got %v", got)
+	}
+	want := "X-Original-To: a@customer.example\r\nX-Original-To: b@partner.example\r\nSubject: hi\r\n"
+	if !strings.HasPrefix(string(redirected.Message), want) {
+		t.Errorf("unexpected redirected message:\n%s", redirected.Message)
+	}
+
+	direct := sent[1]
+	if got := direct.Addresses(); !slices.Equal(got, []string{"Dev@Team.example", "qa@partner.example"}) {
+		t.Errorf("expected the allowed recipients, got %v", got)
+	}
+	if string(direct.Message) != string(env.Message) {
+		t.Errorf("expected the allowed copy unchanged:\n%s", direct.Message)
+	}
+}
+
+func TestRedirect_AllAllowed(t *testing.T) {
+	r := NewRedirect(&config.Config{RedirectTo: "inbox@test.example", RedirectAllow: []string{"team.example"}})
+	env := testEnvelope([]string{"a@team.example"}, []byte("Subject: hi\r\n\r\n"))
+	send := r.Wrap(func(_ *config.Config, got *Envelope) error {
+		if got != env {
+			t.Error("expected the envelope passed through")
+		}
+		return nil
+	})
+	if err := send(nil, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRedirect_FailureNamesOriginalRecipients(t *testing.T) {
+	r := NewRedirect(&config.Config{RedirectTo: "inbox@test.example"})
+	rejected := &smtp.SMTPError{Code: 550, Message: "No such user"}
+	send := r.Wrap(func(_ *config.Config, env *Envelope) error {
+		return &DeliveryError{Failed: []RecipientError{{Recipient: env.Recipients[0].Address, Err: rejected}}}
+	})
+
+	err := send(nil, testEnvelope([]string{"a@customer.example", "b@customer.example"}, nil))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("expected a DeliveryError, got %v", err)
+	}
+	if len(delivery.Failed) != 2 || delivery.Failed[0].Recipient != "a@customer.example" || delivery.Failed[1].Recipient != "b@customer.example" {
+		t.Errorf("unexpected failures %v", delivery.Failed)
+	}
+	if _, ok := delivery.Permanent(); !ok {
+		t.Error("expected the upstream 5xx to stay permanent")
+	}
+
+	send = r.Wrap(func(*config.Config, *Envelope) error { return ErrCircuitOpen })
+	if err := send(nil, testEnvelope([]string{"a@customer.example"}, nil)); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen passed through, got %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+// Package relay delivers envelopes to the configured upstream over SMTP or
+// a provider HTTP API, with retries, and the SendFunc wrappers (circuit
+// breaker, throttle, warm-up) placed around it.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/verp"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+// errNoSMTPUTF8 fails a message that needs SMTPUTF8 when the upstream does
+// not offer it. Downgrading UTF-8 addresses is not possible (RFC 6531).
+var errNoSMTPUTF8 = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "Upstream does not support SMTPUTF8",
+}
+
+// errNo8BitMIME fails 8-bit content the upstream cannot take when
+// conversion is disabled or impossible.
+var errNo8BitMIME = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 3},
+	Message:      "Upstream does not support 8BITMIME and the message cannot be converted",
+}
+
+// SendFunc is the function signature for sending messages upstream.
+// Extracted as a type to allow injection in tests.
+type SendFunc func(cfg *config.Config, env *Envelope) error
+
+// transports maps cfg.DestTransport to the function making one delivery
+// attempt with it.
+var transports = map[string]func(*config.Config, *Envelope) error{
+	"smtp":     sendSMTP,
+	"sendgrid": sendSendGrid,
+	"mailgun":  sendMailgun,
+	"ses":      sendSES,
+}
+
+// sendOnce makes a single delivery attempt with the configured transport.
+func sendOnce(cfg *config.Config, env *Envelope) error {
+	if send, ok := transports[cfg.DestTransport]; ok {
+		return send(cfg, env)
+	}
+	return sendSMTP(cfg, env)
+}
+
+// sendSMTP makes a single delivery attempt with deliverSMTP. The upstream
+// dialogue is logged for a failed attempt with cfg.RelayTranscript, and for
+// every attempt at debug level or when env.Debug is set.
+func sendSMTP(cfg *config.Config, env *Envelope) error {
+	debug := slog.Default().Enabled(context.Background(), slog.LevelDebug)
+	if !cfg.RelayTranscript && !debug && !env.Debug {
+		return deliverSMTP(cfg, env, nil)
+	}
+	tr := &transcript{}
+	err := deliverSMTP(cfg, env, tr)
+	dialogue := tr.String()
+	if dialogue == "" {
+		return err
+	}
+	var level slog.Level
+	switch {
+	case err != nil && cfg.RelayTranscript:
+		level = slog.LevelWarn
+	case env.Debug:
+		level = slog.LevelInfo
+	case debug:
+		level = slog.LevelDebug
+	default:
+		return err
+	}
+	slog.LogAttrs(context.Background(), level, "relay: upstream transcript",
+		slog.String("msg_id", env.ID),
+		slog.String("addr", fmt.Sprintf("%s:%d", cfg.DestHost, cfg.DestPort)),
+		slog.String("transcript", dialogue),
+	)
+	return err
+}
+
+// Trace makes a single delivery attempt, without Send's retries, and
+// writes the redacted upstream dialogue to w. HTTP API transports have no
+// dialogue, so nothing is written for them.
+func Trace(cfg *config.Config, env *Envelope, w io.Writer) error {
+	if cfg.DestTransport != "" && cfg.DestTransport != "smtp" {
+		return sendOnce(cfg, env)
+	}
+	tr := &transcript{}
+	err := deliverSMTP(cfg, env, tr)
+	if dialogue := tr.String(); dialogue != "" {
+		fmt.Fprintln(w, dialogue)
+	}
+	return err
+}
+
+// deliverSMTP connects to the upstream SMTP server and forwards env.Message
+// to env's recipients. The envelope sender is always replaced with
+// cfg.DestFrom, VERP-encoded per recipient when cfg.VERP is set. The
+// message is sent with BDAT when cfg.DestChunking is set and the upstream
+// advertises CHUNKING. The dialogue is recorded in tr when it is non-nil.
+func deliverSMTP(cfg *config.Config, env *Envelope, tr *transcript) error {
+	addr := fmt.Sprintf("%s:%d", cfg.DestHost, cfg.DestPort)
+	tlsConfig := &tls.Config{ServerName: cfg.DestHost}
+
+	slog.Debug("connecting to upstream", "msg_id", env.ID, "addr", addr)
+	start := time.Now()
+	var connected, authenticated time.Time
+	defer func() { env.Timing.add(start, connected, authenticated) }()
+
+	client, conn, err := dial(cfg, addr, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("relay: connect to %s: %w", addr, err)
+	}
+	defer client.Close()
+	if tr != nil {
+		// Port 587 has already completed EHLO and STARTTLS by now, so its
+		// transcript starts after the TLS handshake.
+		client.DebugWriter = tr
+	}
+	if err := client.Hello(cfg.DestHeloName); err != nil {
+		return staged(ErrConnect, fmt.Errorf("relay: EHLO: %w", err))
+	}
+	connected = time.Now()
+
+	auth := sasl.NewPlainClient("", cfg.DestUsername, cfg.DestPassword)
+	if err := client.Auth(auth); err != nil {
+		return staged(ErrAuth, fmt.Errorf("relay: auth: %w", err))
+	}
+
+	slog.Debug("relay authenticated", "msg_id", env.ID)
+	authenticated = time.Now()
+
+	var delivered []string
+	var failed []RecipientError
+	size := batchSize(cfg, client)
+	if cfg.VERP {
+		// Each recipient needs its own MAIL FROM
+		size = 1
+	}
+	message, err := prepareBody(cfg, client, env)
+	if err != nil {
+		// Nothing was sent, but the outcome is the same for every recipient
+		failed := make([]RecipientError, 0, len(env.Recipients))
+		for _, rcpt := range env.Addresses() {
+			failed = append(failed, RecipientError{Recipient: rcpt, Err: err})
+		}
+		return &DeliveryError{Failed: failed}
+	}
+
+	opts := mailOptions(env)
+	var chunks net.Conn
+	if ok, _ := client.Extension("CHUNKING"); ok && cfg.DestChunking {
+		chunks = conn
+	}
+	for _, batch := range splitRecipients(env.Addresses(), size) {
+		from := cfg.DestFrom
+		if cfg.VERP {
+			from = verp.Encode(cfg.VERPSecret, from, batch[0])
+		}
+		accepted, rejected := sendBatch(client, chunks, from, batch, message, opts)
+		delivered = append(delivered, accepted...)
+		failed = append(failed, rejected...)
+	}
+
+	slog.Debug("relay timing",
+		"msg_id", env.ID,
+		"connect", connected.Sub(start),
+		"auth", authenticated.Sub(connected),
+		"data", time.Since(authenticated),
+	)
+
+	if len(failed) > 0 {
+		return &DeliveryError{Delivered: delivered, Failed: failed}
+	}
+
+	slog.Debug("relay sent", "msg_id", env.ID, "recipients", delivered)
+
+	// Message was accepted by upstream for every recipient. Quit error is
+	// non-fatal since the message is already delivered.
+	if err := client.Quit(); err != nil {
+		slog.Warn("relay: quit error (message already accepted)", "msg_id", env.ID, "error", err)
+	}
+
+	return nil
+}
+
+// sendBatch runs one upstream transaction. Recipients rejected at RCPT are
+// reported individually and the message is still sent to the rest; a failure
+// of MAIL or DATA fails every recipient in the batch. The message goes out
+// in BDAT chunks over chunks when it is non-nil, with DATA otherwise.
+func sendBatch(client *smtp.Client, chunks net.Conn, from string, batch []string, message []byte, opts *smtp.MailOptions) (accepted []string, failed []RecipientError) {
+	failAll := func(err error) []RecipientError {
+		errs := make([]RecipientError, 0, len(batch))
+		for _, rcpt := range batch {
+			errs = append(errs, RecipientError{Recipient: rcpt, Err: err})
+		}
+		return errs
+	}
+
+	if opts.UTF8 {
+		if ok, _ := client.Extension("SMTPUTF8"); !ok {
+			return nil, failAll(errNoSMTPUTF8)
+		}
+	}
+	if err := client.Mail(from, opts); err != nil {
+		return nil, failAll(refused(ErrMailRejected, err))
+	}
+	for _, rcpt := range batch {
+		if err := client.Rcpt(rcpt, nil); err != nil {
+			failed = append(failed, RecipientError{Recipient: rcpt, Err: refused(ErrRcptRejected, err)})
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		// Abort the transaction so the connection is usable for the next batch
+		if err := client.Reset(); err != nil {
+			slog.Debug("relay: reset after rejected batch failed", "error", err)
+		}
+		return nil, failed
+	}
+
+	if chunks != nil {
+		if err := sendChunked(chunks, message, client.DebugWriter); err != nil {
+			// A rejected chunk leaves the transaction open upstream
+			if rerr := client.Reset(); rerr != nil {
+				slog.Debug("relay: reset after failed BDAT failed", "error", rerr)
+			}
+			return nil, failAll(refused(ErrDataRejected, err))
+		}
+		return accepted, failed
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return nil, failAll(refused(ErrDataRejected, err))
+	}
+	if _, err := w.Write(message); err != nil {
+		w.Close()
+		return nil, failAll(refused(ErrDataRejected, err))
+	}
+	if err := w.Close(); err != nil {
+		return nil, failAll(refused(ErrDataRejected, err))
+	}
+	return accepted, failed
+}
+
+// prepareBody returns the message to send to an upstream. 8-bit content
+// for an upstream without 8BITMIME is re-encoded as quoted-printable, or
+// refused when cfg.EightBitDowngrade is "reject" or conversion fails.
+func prepareBody(cfg *config.Config, client *smtp.Client, env *Envelope) ([]byte, error) {
+	if ok, _ := client.Extension("8BITMIME"); ok || !sanitizer.Has8Bit(env.Message) {
+		return env.Message, nil
+	}
+	if cfg.EightBitDowngrade == "reject" {
+		slog.Warn("relay: 8-bit message refused, upstream lacks 8BITMIME", "msg_id", env.ID)
+		return nil, errNo8BitMIME
+	}
+	message, err := sanitizer.Downgrade8Bit(env.Message)
+	if err != nil {
+		slog.Warn("relay: 8-bit message not converted", "msg_id", env.ID, "error", err)
+		return nil, errNo8BitMIME
+	}
+	slog.Debug("relay: 8-bit message converted to quoted-printable", "msg_id", env.ID)
+	return message, nil
+}
+
+// mailOptions returns the upstream MAIL FROM parameters for env. SMTPUTF8
+// is passed on only when the client asked for it and the recipients or
+// header actually contain UTF-8, so ASCII mail still reaches upstreams
+// without the extension. BODY=8BITMIME is added by the client library
+// whenever the upstream supports it.
+func mailOptions(env *Envelope) *smtp.MailOptions {
+	opts := &smtp.MailOptions{}
+	if env.MailOptions.UTF8 && needsUTF8(env) {
+		opts.UTF8 = true
+	}
+	return opts
+}
+
+// needsUTF8 reports whether a recipient address or the message header
+// contains non-ASCII characters. The envelope sender is always
+// cfg.DestFrom and is not checked.
+func needsUTF8(env *Envelope) bool {
+	for _, r := range env.Recipients {
+		if !isASCII(r.Address) {
+			return true
+		}
+	}
+	header := env.Message
+	if i := bytes.Index(header, []byte("\r\n\r\n")); i >= 0 {
+		header = header[:i]
+	}
+	return !isASCII(string(header))
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// batchSize returns the maximum number of recipients per upstream
+// transaction, or 0 for no limit. An explicit cfg.DestMaxRecipients is
+// lowered further if the upstream advertises a smaller LIMITS RCPTMAX
+// (RFC 9422).
+func batchSize(cfg *config.Config, client *smtp.Client) int {
+	limit := cfg.DestMaxRecipients
+	if ok, params := client.Extension("LIMITS"); ok {
+		if n := parseRcptMax(params); n > 0 && (limit == 0 || n < limit) {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// parseRcptMax extracts RCPTMAX from a LIMITS extension parameter string
+// such as "MAILMAX=10 RCPTMAX=50". It returns 0 if absent or malformed.
+func parseRcptMax(params string) int {
+	for _, field := range strings.Fields(params) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || !strings.EqualFold(name, "RCPTMAX") {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// splitRecipients partitions recipients into batches of at most size.
+// A size of 0 returns a single batch.
+func splitRecipients(recipients []string, size int) [][]string {
+	if size <= 0 || len(recipients) <= size {
+		return [][]string{recipients}
+	}
+	var batches [][]string
+	for len(recipients) > size {
+		batches = append(batches, recipients[:size:size])
+		recipients = recipients[size:]
+	}
+	return append(batches, recipients)
+}
@@ -0,0 +1,702 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/verp"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestTLSModeSelection(t *testing.T) {
+	tests := []struct {
+		port     int
+		wantMode string
+	}{
+		{465, "implicit TLS"},
+		{587, "STARTTLS"},
+		{25, "plain"},
+		{2525, "plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantMode, func(t *testing.T) {
+			cfg := &config.Config{
+				DestHost: "unreachable.invalid",
+				DestPort: tt.port,
+			}
+
+			// We can't actually connect, but we verify the function
+			// attempts the connection (will fail with DNS error).
+			err := Send(cfg, testEnvelope([]string{"test@example.com"}, []byte("test")))
+			if err == nil {
+				t.Fatal("expected connection error to unreachable host")
+			}
+			// The error should be a connection error, not a logic error
+			if tt.port == 465 || tt.port == 587 || tt.port == 25 || tt.port == 2525 {
+				// All should fail at the connect stage
+				t.Logf("port %d: got expected error: %v", tt.port, err)
+			}
+		})
+	}
+}
+
+// mockUpstream records each transaction's sender and recipients, rejects any
+// recipient listed in reject, and defers a recipient with 451 as many times
+// as its tempfail count.
+type mockUpstream struct {
+	mu           sync.Mutex
+	transactions [][]string
+	senders      []string
+	utf8         []bool // SMTPUTF8 parameter of each MAIL FROM
+	helo         []string
+	remotes      []string // client IP of each MAIL FROM
+	messages     [][]byte
+	rejectData   bool
+	reject       map[string]bool
+	tempfail     map[string]int
+	password     string // when set, AUTH fails with any other password
+}
+
+func (m *mockUpstream) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &mockSession{mock: m, conn: c}, nil
+}
+
+type mockSession struct {
+	mock       *mockUpstream
+	conn       *smtp.Conn
+	recipients []string
+}
+
+func (s *mockSession) AuthMechanisms() []string { return []string{sasl.Plain} }
+
+func (s *mockSession) Auth(_ string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(_, _, password string) error {
+		if s.mock.password != "" && password != s.mock.password {
+			return errors.New("invalid credentials")
+		}
+		return nil
+	}), nil
+}
+
+func (s *mockSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.mock.mu.Lock()
+	defer s.mock.mu.Unlock()
+	s.mock.senders = append(s.mock.senders, from)
+	s.mock.utf8 = append(s.mock.utf8, opts != nil && opts.UTF8)
+	s.mock.helo = append(s.mock.helo, s.conn.Hostname())
+	host, _, _ := net.SplitHostPort(s.conn.Conn().RemoteAddr().String())
+	s.mock.remotes = append(s.mock.remotes, host)
+	return nil
+}
+
+func (s *mockSession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	if s.mock.reject[to] {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	s.mock.mu.Lock()
+	defer s.mock.mu.Unlock()
+	if s.mock.tempfail[to] > 0 {
+		s.mock.tempfail[to]--
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"}
+	}
+	s.recipients = append(s.recipients, to)
+	return nil
+}
+
+func (s *mockSession) Data(r io.Reader) error {
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mock.mu.Lock()
+	defer s.mock.mu.Unlock()
+	if s.mock.rejectData {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Message refused"}
+	}
+	s.mock.transactions = append(s.mock.transactions, s.recipients)
+	s.mock.messages = append(s.mock.messages, msg)
+	return nil
+}
+
+func (s *mockSession) Reset() { s.recipients = nil }
+
+func (s *mockSession) Logout() error { return nil }
+
+// startMockUpstream runs a plaintext upstream that advertises
+// LIMITS RCPTMAX=maxRecipients and SMTPUTF8 and returns a config pointing
+// at it. configure, if given, adjusts the server before it starts.
+func startMockUpstream(t *testing.T, maxRecipients int, configure ...func(*smtp.Server)) (*mockUpstream, *config.Config) {
+	t.Helper()
+
+	mock := &mockUpstream{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := smtp.NewServer(mock)
+	s.Domain = "upstream.local"
+	s.AllowInsecureAuth = true
+	s.MaxRecipients = maxRecipients
+	s.EnableSMTPUTF8 = true
+	s.ReadTimeout = 10 * time.Second
+	s.WriteTimeout = 10 * time.Second
+	for _, f := range configure {
+		f(s)
+	}
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return mock, &config.Config{
+		DestHost:     host,
+		DestPort:     port,
+		DestUsername: "upstream@example.com",
+		DestPassword: "upstreampass",
+		DestFrom:     "upstream@example.com",
+		DestHeloName: "relay.example.com",
+	}
+}
+
+func TestSend_HeloName(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	cfg.DestHeloName = "mail.example.net"
+
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.helo) != 1 || mock.helo[0] != "mail.example.net" {
+		t.Errorf("expected EHLO mail.example.net, got %v", mock.helo)
+	}
+}
+
+func TestSend_SourceIP(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	cfg.DestSourceIP = net.IPv4(127, 0, 0, 1)
+
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.remotes) != 1 || mock.remotes[0] != "127.0.0.1" {
+		t.Errorf("expected connection from 127.0.0.1, got %v", mock.remotes)
+	}
+
+	// An address not assigned to this host cannot be bound
+	cfg.DestSourceIP = net.ParseIP("192.0.2.1")
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err == nil || !strings.Contains(err.Error(), "connect") {
+		t.Errorf("expected connect error, got %v", err)
+	}
+}
+
+func TestSend_Timing(t *testing.T) {
+	_, cfg := startMockUpstream(t, 0)
+
+	env := testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	env.Timing = &Timing{}
+	if err := Send(cfg, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if env.Timing.Connect <= 0 || env.Timing.Auth <= 0 || env.Timing.Data <= 0 {
+		t.Errorf("expected every upstream stage timed, got %+v", *env.Timing)
+	}
+
+	// A failed connection only spends time connecting
+	cfg.DestSourceIP = net.ParseIP("192.0.2.1")
+	env.Timing = &Timing{}
+	if err := Send(cfg, env); err == nil {
+		t.Fatal("expected connect error")
+	}
+	if env.Timing.Auth != 0 || env.Timing.Data != 0 {
+		t.Errorf("expected only the connect stage timed, got %+v", *env.Timing)
+	}
+}
+
+func TestSend_SplitsByUpstreamLimit(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 2)
+
+	recipients := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+	if err := Send(cfg, testEnvelope(recipients, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mock.transactions) != 3 {
+		t.Fatalf("expected 3 upstream transactions, got %d: %v", len(mock.transactions), mock.transactions)
+	}
+	if len(mock.transactions[2]) != 1 || mock.transactions[2][0] != "e@example.com" {
+		t.Errorf("unexpected last batch: %v", mock.transactions[2])
+	}
+}
+
+func TestSend_ConfiguredLimitBelowUpstream(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 10)
+	cfg.DestMaxRecipients = 3
+
+	recipients := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}
+	if err := Send(cfg, testEnvelope(recipients, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mock.transactions) != 2 {
+		t.Fatalf("expected 2 upstream transactions, got %d: %v", len(mock.transactions), mock.transactions)
+	}
+}
+
+func TestParseRcptMax(t *testing.T) {
+	tests := map[string]int{
+		"RCPTMAX=50":            50,
+		"MAILMAX=10 RCPTMAX=20": 20,
+		"rcptmax=5":             5,
+		"MAILMAX=10":            0,
+		"RCPTMAX=abc":           0,
+		"RCPTMAX=0":             0,
+		"":                      0,
+	}
+
+	for params, want := range tests {
+		if got := parseRcptMax(params); got != want {
+			t.Errorf("parseRcptMax(%q) = %d, want %d", params, got, want)
+		}
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	recipients := []string{"a", "b", "c", "d", "e"}
+
+	if got := splitRecipients(recipients, 0); len(got) != 1 || len(got[0]) != 5 {
+		t.Errorf("expected single batch with no limit, got %v", got)
+	}
+	got := splitRecipients(recipients, 2)
+	if len(got) != 3 || len(got[0]) != 2 || len(got[1]) != 2 || len(got[2]) != 1 {
+		t.Errorf("expected batches of 2,2,1, got %v", got)
+	}
+}
+
+func TestSend_PartialRecipientFailure(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	mock.reject = map[string]bool{"bad@example.com": true}
+
+	err := Send(cfg, testEnvelope([]string{"good@example.com", "bad@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("expected *DeliveryError, got %T: %v", err, err)
+	}
+	if !delivery.Partial() {
+		t.Error("expected partial delivery")
+	}
+	if len(delivery.Delivered) != 1 || delivery.Delivered[0] != "good@example.com" {
+		t.Errorf("unexpected delivered recipients: %v", delivery.Delivered)
+	}
+	if len(delivery.Failed) != 1 || delivery.Failed[0].Recipient != "bad@example.com" {
+		t.Fatalf("unexpected failed recipients: %v", delivery.Failed)
+	}
+
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("expected upstream 550 to be reachable via errors.As, got %v", err)
+	}
+
+	if len(mock.transactions) != 1 || len(mock.transactions[0]) != 1 {
+		t.Errorf("expected message relayed to accepted recipient only, got %v", mock.transactions)
+	}
+}
+
+func TestSend_AllRecipientsRejected(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 1)
+	mock.reject = map[string]bool{"a@example.com": true, "b@example.com": true}
+
+	err := Send(cfg, testEnvelope([]string{"a@example.com", "b@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("expected *DeliveryError, got %T: %v", err, err)
+	}
+	if delivery.Partial() {
+		t.Error("expected total failure, not partial")
+	}
+	if len(delivery.Failed) != 2 {
+		t.Errorf("expected 2 failed recipients, got %v", delivery.Failed)
+	}
+	if len(mock.transactions) != 0 {
+		t.Errorf("expected no DATA upstream, got %v", mock.transactions)
+	}
+	if upstream, ok := delivery.Permanent(); !ok || upstream.Code != 550 {
+		t.Errorf("expected permanent 550 rejection, got %v, %v", upstream, ok)
+	}
+}
+
+// noSleep records backoff delays instead of waiting, advancing the
+// clock by each.
+func noSleep(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var delays []time.Duration
+	origSleep, origNow := sleep, now
+	clock := time.Unix(1700000000, 0)
+	sleep = func(d time.Duration) {
+		delays = append(delays, d)
+		clock = clock.Add(d)
+	}
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { sleep, now = origSleep, origNow })
+	return &delays
+}
+
+func TestSend_RetryTimeLimit(t *testing.T) {
+	delays := noSleep(t)
+	mock, cfg := startMockUpstream(t, 0)
+	mock.tempfail = map[string]int{"slow@example.com": 10}
+	cfg.RelayAttempts = 10
+	cfg.RelayRetryDelay = 20 * time.Second
+	cfg.RelayRetryMaxTime = time.Minute
+
+	err := Send(cfg, testEnvelope([]string{"slow@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || len(delivery.Failed) != 1 {
+		t.Fatalf("expected the recipient to fail, got %v", err)
+	}
+	// 20s, then 40s capped to 30s; a third retry would start after 80s
+	if len(*delays) != 2 || (*delays)[0] != 20*time.Second || (*delays)[1] != maxRetryDelay {
+		t.Errorf("expected delays [20s 30s], got %v", *delays)
+	}
+	if left := mock.tempfail["slow@example.com"]; left != 7 {
+		t.Errorf("expected 3 attempts, got %d", 10-left)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := &config.Config{RelayRetryDelay: time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 6: maxRetryDelay, 200: maxRetryDelay} {
+		if got := backoff(cfg, attempt); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestSend_RetriesTransientRecipients(t *testing.T) {
+	delays := noSleep(t)
+	mock, cfg := startMockUpstream(t, 0)
+	mock.tempfail = map[string]int{"slow@example.com": 2}
+	cfg.RelayAttempts = 3
+	cfg.RelayRetryDelay = 100 * time.Millisecond
+
+	err := Send(cfg, testEnvelope([]string{"fast@example.com", "slow@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+	if err != nil {
+		t.Fatalf("expected delivery after retries, got %v", err)
+	}
+
+	// Only the deferred recipient is retried, so fast@ gets a single copy
+	if len(mock.transactions) != 2 {
+		t.Fatalf("expected 2 upstream transactions, got %v", mock.transactions)
+	}
+	if got := mock.transactions[1]; len(got) != 1 || got[0] != "slow@example.com" {
+		t.Errorf("expected retry for slow@example.com only, got %v", got)
+	}
+
+	// Exponential backoff without jitter
+	if len(*delays) != 2 || (*delays)[0] != 100*time.Millisecond || (*delays)[1] != 200*time.Millisecond {
+		t.Errorf("expected delays [100ms 200ms], got %v", *delays)
+	}
+}
+
+func TestSend_GivesUpAfterAttempts(t *testing.T) {
+	delays := noSleep(t)
+	mock, cfg := startMockUpstream(t, 0)
+	mock.tempfail = map[string]int{"slow@example.com": 5}
+	cfg.RelayAttempts = 2
+
+	err := Send(cfg, testEnvelope([]string{"slow@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || len(delivery.Failed) != 1 {
+		t.Fatalf("expected one failed recipient, got %v", err)
+	}
+	if _, ok := delivery.Permanent(); ok {
+		t.Error("expected exhausted retries to remain temporary")
+	}
+	if len(*delays) != 1 {
+		t.Errorf("expected 1 backoff, got %d", len(*delays))
+	}
+}
+
+func TestSend_NoRetryOnPermanentRejection(t *testing.T) {
+	delays := noSleep(t)
+	mock, cfg := startMockUpstream(t, 0)
+	mock.reject = map[string]bool{"bad@example.com": true}
+	cfg.RelayAttempts = 3
+
+	err := Send(cfg, testEnvelope([]string{"bad@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+	if err == nil {
+		t.Fatal("expected rejection error")
+	}
+	if len(*delays) != 0 {
+		t.Errorf("expected no retries for 5xx, got %d", len(*delays))
+	}
+}
+
+func TestSend_RetriesConnectionFailure(t *testing.T) {
+	delays := noSleep(t)
+	cfg := &config.Config{
+		DestHost:      "unreachable.invalid",
+		DestPort:      2525,
+		RelayAttempts: 3,
+	}
+
+	err := Send(cfg, testEnvelope([]string{"test@example.com"}, []byte("test")))
+	if err == nil {
+		t.Fatal("expected connection error")
+	}
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) {
+		t.Errorf("expected raw connection error when nothing was delivered, got %v", err)
+	}
+	if len(*delays) != 2 {
+		t.Errorf("expected 2 backoffs for 3 attempts, got %d", len(*delays))
+	}
+}
+
+// testEnvelope builds an envelope for recipients carrying message.
+func testEnvelope(recipients []string, message []byte) *Envelope {
+	env := &Envelope{ID: NewID(), Message: message}
+	for _, rcpt := range recipients {
+		env.Recipients = append(env.Recipients, Recipient{Address: rcpt})
+	}
+	return env
+}
+
+func TestEnvelope_WithRecipients(t *testing.T) {
+	env := &Envelope{
+		ID: "abc",
+		Recipients: []Recipient{
+			{Address: "a@example.com"},
+			{Address: "b@example.com", Options: smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}}},
+		},
+	}
+	sub := env.withRecipients([]string{"b@example.com"})
+	if sub.ID != "abc" || len(sub.Recipients) != 1 || sub.Recipients[0].Address != "b@example.com" {
+		t.Fatalf("unexpected subset: %+v", sub)
+	}
+	if len(sub.Recipients[0].Options.Notify) != 1 {
+		t.Error("expected recipient options to be kept")
+	}
+	if len(env.Recipients) != 2 {
+		t.Error("expected original envelope to be unchanged")
+	}
+}
+
+func TestSend_VERP(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	cfg.VERP = true
+	cfg.VERPSecret = "verp-key"
+
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org", "b@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{verp.Encode("verp-key", cfg.DestFrom, "a@dest.org"), verp.Encode("verp-key", cfg.DestFrom, "b@dest.org")}
+	if len(mock.senders) != 2 || mock.senders[0] != want[0] || mock.senders[1] != want[1] {
+		t.Errorf("expected one VERP transaction per recipient %v, got %v", want, mock.senders)
+	}
+	if len(mock.transactions) != 2 {
+		t.Errorf("expected 2 transactions, got %v", mock.transactions)
+	}
+}
+
+func TestSend_SMTPUTF8(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+
+	ascii := testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	ascii.MailOptions.UTF8 = true
+	intl := testEnvelope([]string{"用户@例子.广告"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	intl.MailOptions.UTF8 = true
+	header := testEnvelope([]string{"a@dest.org"}, []byte("Subject: Grüße\r\n\r\nBody\r\n"))
+	header.MailOptions.UTF8 = true
+	for _, env := range []*Envelope{ascii, intl, header} {
+		if err := Send(cfg, env); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := []bool{false, true, true}
+	for i := range want {
+		if mock.utf8[i] != want[i] {
+			t.Errorf("transaction %d: expected SMTPUTF8=%v, got %v", i, want[i], mock.utf8[i])
+		}
+	}
+	if mock.transactions[1][0] != "用户@例子.广告" {
+		t.Errorf("unexpected recipient %q", mock.transactions[1][0])
+	}
+}
+
+func TestSend_SMTPUTF8Unsupported(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0, func(s *smtp.Server) { s.EnableSMTPUTF8 = false })
+
+	env := testEnvelope([]string{"用户@例子.广告"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	env.MailOptions.UTF8 = true
+	err := Send(cfg, env)
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("expected DeliveryError, got %v", err)
+	}
+	if upstream, ok := delivery.Permanent(); !ok || upstream.EnhancedCode != (smtp.EnhancedCode{5, 6, 7}) {
+		t.Errorf("expected permanent 5.6.7 failure, got %v", err)
+	}
+	if len(mock.senders) != 0 {
+		t.Errorf("expected no upstream transaction, got %v", mock.senders)
+	}
+}
+
+// startLegacyUpstream runs a minimal upstream that does not offer 8BITMIME
+// (go-smtp's server always does) and returns a config pointing at it and a
+// channel receiving each message it accepts.
+func startLegacyUpstream(t *testing.T) (*config.Config, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		_ = text.PrintfLine("220 legacy.local ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb, _, _ := strings.Cut(strings.ToUpper(line), " "); verb {
+			case "EHLO":
+				_ = text.PrintfLine("250-legacy.local\r\n250 AUTH PLAIN")
+			case "AUTH":
+				_ = text.PrintfLine("235 2.7.0 Authenticated")
+			case "DATA":
+				_ = text.PrintfLine("354 Go ahead")
+				data, _ := text.ReadDotBytes()
+				messages <- string(data)
+				_ = text.PrintfLine("250 2.0.0 Queued")
+			case "QUIT":
+				_ = text.PrintfLine("221 Bye")
+				return
+			default:
+				_ = text.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return &config.Config{
+		DestHost:          host,
+		DestPort:          port,
+		DestUsername:      "upstream@example.com",
+		DestPassword:      "upstreampass",
+		DestFrom:          "upstream@example.com",
+		DestHeloName:      "relay.example.com",
+		EightBitDowngrade: "encode",
+	}, messages
+}
+
+func TestSend_8BitDowngrade(t *testing.T) {
+	cfg, messages := startLegacyUpstream(t)
+
+	msg := "Subject: Hi\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nGrüße\r\n"
+	if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte(msg))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := <-messages
+	if !strings.Contains(got, "Content-Transfer-Encoding: quoted-printable\n\nGr=C3=BC=C3=9Fe") {
+		t.Errorf("expected quoted-printable body, got %q", got)
+	}
+}
+
+func TestSend_8BitReject(t *testing.T) {
+	cfg, messages := startLegacyUpstream(t)
+	cfg.EightBitDowngrade = "reject"
+
+	err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte("Subject: Hi\r\n\r\nGrüße\r\n")))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("expected DeliveryError, got %v", err)
+	}
+	if upstream, ok := delivery.Permanent(); !ok || upstream.EnhancedCode != (smtp.EnhancedCode{5, 6, 3}) {
+		t.Errorf("expected permanent 5.6.3 failure, got %v", err)
+	}
+	select {
+	case got := <-messages:
+		t.Errorf("expected nothing sent, got %q", got)
+	default:
+	}
+}
+
+func TestProbe(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	mock.password = "upstreampass"
+	if err := Probe(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.senders) != 0 {
+		t.Errorf("expected no transaction, got senders %v", mock.senders)
+	}
+
+	cfg.DestPassword = "wrong"
+	if err := Probe(cfg); err == nil || !strings.Contains(err.Error(), "auth") {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+}
+
+func TestSend_ErrorStages(t *testing.T) {
+	noSleep(t)
+	message := []byte("Subject: Test\r\n\r\nBody\r\n")
+
+	mock, cfg := startMockUpstream(t, 0)
+	mock.password = "other"
+	err := Send(cfg, testEnvelope([]string{"a@example.com"}, message))
+	if !errors.Is(err, ErrAuth) || Stage(err) != "auth" {
+		t.Errorf("expected ErrAuth, got %v", err)
+	}
+
+	mock, cfg = startMockUpstream(t, 0)
+	mock.reject = map[string]bool{"bad@example.com": true}
+	err = Send(cfg, testEnvelope([]string{"bad@example.com"}, message))
+	var stage *StageError
+	if !errors.Is(err, ErrRcptRejected) || !errors.As(err, &stage) {
+		t.Fatalf("expected ErrRcptRejected, got %v", err)
+	}
+	if reply, ok := stage.Reply(); !ok || reply.Code != 550 || reply.Message != "No such user" {
+		t.Errorf("expected the upstream's 550 reply, got %v", reply)
+	}
+
+	mock, cfg = startMockUpstream(t, 0)
+	mock.rejectData = true
+	if err := Send(cfg, testEnvelope([]string{"a@example.com"}, message)); !errors.Is(err, ErrDataRejected) || Stage(err) != "data" {
+		t.Errorf("expected ErrDataRejected, got %v", err)
+	}
+
+	cfg = &config.Config{DestHost: "unreachable.invalid", DestPort: 2525}
+	err = Send(cfg, testEnvelope([]string{"a@example.com"}, message))
+	if !errors.Is(err, ErrConnect) || errors.Is(err, ErrAuth) {
+		t.Errorf("expected ErrConnect, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// maxRetryDelay caps the backoff before any one retry.
+const maxRetryDelay = 30 * time.Second
+
+// defaultRetryMaxTime bounds the retries of a Config without
+// RelayRetryMaxTime, such as one built by an embedder.
+const defaultRetryMaxTime = time.Minute
+
+// sleep and now are swapped out in tests.
+var (
+	sleep = time.Sleep
+	now   = time.Now
+)
+
+// Send forwards a sanitized message upstream, retrying transient failures
+// up to cfg.RelayAttempts times with exponential backoff. Only recipients
+// that have not been delivered or permanently rejected are retried, so a
+// partial delivery never duplicates the message. The client waits in
+// DATA meanwhile, so no retry starts more than cfg.RelayRetryMaxTime
+// after the first attempt.
+func Send(cfg *config.Config, env *Envelope) error {
+	deadline := now().Add(cmp.Or(cfg.RelayRetryMaxTime, defaultRetryMaxTime))
+	var delivered []string
+	var rejected []RecipientError
+	pending := env.Addresses()
+
+	var lastErr error
+	var lastFailed []RecipientError
+	for attempt := 1; ; attempt++ {
+		attemptEnv := env
+		if attempt > 1 {
+			attemptEnv = env.withRecipients(pending)
+		}
+		err := sendOnce(cfg, attemptEnv)
+		lastErr, lastFailed = nil, nil
+		retryable := true
+
+		var delivery *DeliveryError
+		switch {
+		case err == nil:
+			delivered = append(delivered, pending...)
+			pending = nil
+		case errors.As(err, &delivery):
+			delivered = append(delivered, delivery.Delivered...)
+			pending = nil
+			for _, f := range delivery.Failed {
+				if isTransient(f.Err) {
+					pending = append(pending, f.Recipient)
+					lastFailed = append(lastFailed, f)
+				} else {
+					rejected = append(rejected, f)
+				}
+			}
+		default:
+			// Connection or auth failure: nothing was sent this attempt
+			lastErr = err
+			retryable = isTransient(err)
+		}
+
+		if len(pending) == 0 || !retryable || attempt >= cfg.RelayAttempts {
+			break
+		}
+
+		delay := backoff(cfg, attempt)
+		if now().Add(delay).After(deadline) {
+			slog.Warn("relay: retry time exhausted",
+				"msg_id", env.ID,
+				"attempt", attempt,
+				"max_time", cmp.Or(cfg.RelayRetryMaxTime, defaultRetryMaxTime),
+				"pending", len(pending),
+			)
+			break
+		}
+		slog.Warn("relay: transient failure, retrying",
+			"msg_id", env.ID,
+			"attempt", attempt,
+			"max_attempts", cfg.RelayAttempts,
+			"pending", len(pending),
+			"delay", delay,
+			"error", firstNonNil(lastErr, lastFailed),
+		)
+		sleep(delay)
+	}
+
+	// A connection or auth failure with nothing delivered keeps its
+	// original error so callers see why the upstream was unreachable.
+	if lastErr != nil && len(delivered) == 0 && len(rejected) == 0 {
+		return lastErr
+	}
+
+	failed := append(rejected, lastFailed...)
+	if lastErr != nil {
+		for _, rcpt := range pending {
+			failed = append(failed, RecipientError{Recipient: rcpt, Err: lastErr})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	for _, f := range failed {
+		slog.Warn("relay: recipient failed", "msg_id", env.ID, "recipient", f.Recipient, "error", f.Err)
+	}
+	return &DeliveryError{Delivered: delivered, Failed: failed}
+}
+
+// isTransient reports whether err is worth retrying. Upstream replies are
+// transient only if 4xx; anything else (network errors, timeouts) is
+// assumed to be a blip.
+func isTransient(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Temporary()
+	}
+	return true
+}
+
+// backoff returns the delay before the attempt after the given one:
+// RelayRetryDelay doubled per attempt, up to maxRetryDelay, plus up to
+// RelayRetryJitter.
+func backoff(cfg *config.Config, attempt int) time.Duration {
+	delay := cfg.RelayRetryDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryDelay)
+	if cfg.RelayRetryJitter > 0 {
+		delay += rand.N(cfg.RelayRetryJitter)
+	}
+	return delay
+}
+
+func firstNonNil(err error, failed []RecipientError) error {
+	if err != nil || len(failed) == 0 {
+		return err
+	}
+	return failed[0]
+}
@@ -0,0 +1,253 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// sendgridReserved lists header fields SendGrid builds itself or refuses
+// in the headers object.
+var sendgridReserved = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true,
+	"Subject": true, "Date": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true,
+	"Received": true, "Dkim-Signature": true, "X-Sg-Id": true, "X-Sg-Eid": true,
+}
+
+type sendgridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendgridPersonalization struct {
+	To  []sendgridAddress `json:"to"`
+	Cc  []sendgridAddress `json:"cc,omitempty"`
+	Bcc []sendgridAddress `json:"bcc,omitempty"`
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendgridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendgridMail struct {
+	Personalizations []sendgridPersonalization `json:"personalizations"`
+	From             sendgridAddress           `json:"from"`
+	ReplyTo          *sendgridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Content          []sendgridContent         `json:"content,omitempty"`
+	Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+}
+
+// sendSendGrid delivers env through SendGrid's v3 mail send API, with
+// cfg.DestPassword as the API key. The API has no raw MIME input, so the
+// message is converted into its JSON form; a message that cannot be is
+// rejected permanently.
+func sendSendGrid(cfg *config.Config, env *Envelope) error {
+	m, err := sendgridMessage(env)
+	if err != nil {
+		rejected := &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message cannot be converted for SendGrid: " + err.Error(),
+		}
+		failed := make([]RecipientError, 0, len(env.Recipients))
+		for _, rcpt := range env.Addresses() {
+			failed = append(failed, RecipientError{Recipient: rcpt, Err: rejected})
+		}
+		return &DeliveryError{Failed: failed}
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, apiURL(cfg, "/v3/mail/send"), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.DestPassword)
+
+	slog.Debug("relaying through sendgrid", "msg_id", env.ID)
+	return postAPI(cfg, env, "sendgrid", req)
+}
+
+// sendgridMessage converts env into a SendGrid mail object. Envelope
+// recipients named in To or Cc keep that role; the others become Bcc so
+// they stay hidden. Without a To recipient, which SendGrid requires, each
+// recipient gets a personalization of its own.
+func sendgridMessage(env *Envelope) (*sendgridMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(env.Message))
+	if err != nil {
+		return nil, err
+	}
+	dec := new(mime.WordDecoder)
+	m := &sendgridMail{Headers: map[string]string{}}
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("From: %w", err)
+	}
+	m.From = sendgridAddress{Email: from.Address, Name: from.Name}
+	if v := msg.Header.Get("Reply-To"); v != "" {
+		if replyTo, err := mail.ParseAddress(v); err == nil {
+			m.ReplyTo = &sendgridAddress{Email: replyTo.Address, Name: replyTo.Name}
+		}
+	}
+	if m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	for name, values := range msg.Header {
+		if !sendgridReserved[name] {
+			m.Headers[name] = values[0]
+		}
+	}
+
+	roles := map[string]string{}
+	for _, field := range []string{"To", "Cc"} {
+		list, _ := msg.Header.AddressList(field)
+		for _, a := range list {
+			if _, ok := roles[strings.ToLower(a.Address)]; !ok {
+				roles[strings.ToLower(a.Address)] = field
+			}
+		}
+	}
+	var p sendgridPersonalization
+	for _, rcpt := range env.Addresses() {
+		addr := sendgridAddress{Email: rcpt}
+		switch roles[strings.ToLower(rcpt)] {
+		case "To":
+			p.To = append(p.To, addr)
+		case "Cc":
+			p.Cc = append(p.Cc, addr)
+		default:
+			p.Bcc = append(p.Bcc, addr)
+		}
+	}
+	if len(p.To) > 0 {
+		m.Personalizations = []sendgridPersonalization{p}
+	} else {
+		for _, addr := range append(p.Cc, p.Bcc...) {
+			m.Personalizations = append(m.Personalizations, sendgridPersonalization{To: []sendgridAddress{addr}})
+		}
+	}
+
+	header := textproto.MIMEHeader(msg.Header)
+	if err := m.addEntity(header, msg.Body, 0); err != nil {
+		return nil, err
+	}
+	if len(m.Content) == 0 {
+		// SendGrid requires content; attachments alone are not enough
+		m.Content = []sendgridContent{{Type: "text/plain", Value: " "}}
+	}
+	// text/plain must come first
+	if len(m.Content) == 2 && m.Content[0].Type == "text/html" {
+		m.Content[0], m.Content[1] = m.Content[1], m.Content[0]
+	}
+	return m, nil
+}
+
+// addEntity adds a MIME entity to m: the first text/plain and text/html
+// parts outside attachments become content, everything else an attachment.
+func (m *sendgridMail) addEntity(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > 10 {
+		return fmt.Errorf("MIME nested too deeply")
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.addEntity(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	var data []byte
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		data, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, body))
+	case "quoted-printable":
+		data, err = io.ReadAll(quotedprintable.NewReader(body))
+	default:
+		data, err = io.ReadAll(body)
+	}
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if (mediaType == "text/plain" || mediaType == "text/html") && disposition != "attachment" && !m.hasContent(mediaType) {
+		switch charset := strings.ToLower(params["charset"]); charset {
+		case "", "utf-8", "us-ascii":
+		default:
+			return fmt.Errorf("unsupported charset %s", charset)
+		}
+		m.Content = append(m.Content, sendgridContent{Type: mediaType, Value: string(data)})
+		return nil
+	}
+
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename == "" {
+		filename = "attachment"
+	}
+	if disposition != "inline" {
+		disposition = "attachment"
+	}
+	m.Attachments = append(m.Attachments, sendgridAttachment{
+		Content:     base64.StdEncoding.EncodeToString(data),
+		Type:        mediaType,
+		Filename:    filename,
+		Disposition: disposition,
+		ContentID:   strings.Trim(header.Get("Content-ID"), "<>"),
+	})
+	return nil
+}
+
+func (m *sendgridMail) hasContent(mediaType string) bool {
+	for _, c := range m.Content {
+		if c.Type == mediaType {
+			return true
+		}
+	}
+	return false
+}
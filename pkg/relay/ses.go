@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/sigv4"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// sesPath is the SES v2 SendEmail endpoint.
+const sesPath = "/v2/email/outbound-emails"
+
+// sendSES delivers env as a raw message through Amazon SES v2. Requests are
+// signed with Signature Version 4 using cfg.DestUsername and
+// cfg.DestPassword as the access key ID and secret key.
+func sendSES(cfg *config.Config, env *Envelope) error {
+	region := cfg.DestRegion
+	if region == "" {
+		region = sesRegion(cfg.DestHost)
+	}
+	if region == "" {
+		return fmt.Errorf("relay: ses: cannot tell the region from %s, set SMTP_DEST_REGION", cfg.DestHost)
+	}
+
+	var input struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct {
+			Raw struct{ Data []byte }
+		}
+	}
+	input.FromEmailAddress = cfg.DestFrom
+	input.Destination.ToAddresses = env.Addresses()
+	input.Content.Raw.Data = env.Message
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, apiURL(cfg, sesPath), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sigv4.Sign(req, payload, cfg.DestUsername, cfg.DestPassword, region, "ses", time.Now())
+
+	slog.Debug("relaying through ses", "msg_id", env.ID, "region", region)
+	return postAPI(cfg, env, "ses", req)
+}
+
+// sesRegion returns the region of an SES API endpoint such as
+// email.eu-west-1.amazonaws.com, or "" for any other host.
+func sesRegion(host string) string {
+	labels := strings.Split(host, ".")
+	if len(labels) != 4 || labels[0] != "email" || labels[2] != "amazonaws" || labels[3] != "com" {
+		return ""
+	}
+	return labels[1]
+}
@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// Sink replaces Send under SMTP_SINK_MODE: every message is accepted
+// without contacting the upstream, so staging environments cannot mail
+// real recipients. Messages are logged and, with a directory, archived.
+type Sink struct {
+	dir string
+}
+
+// NewSink returns the sink for cfg. cfg.SinkDir, when set, must be an
+// existing directory.
+func NewSink(cfg *config.Config) (*Sink, error) {
+	if cfg.SinkDir != "" {
+		info, err := os.Stat(cfg.SinkDir)
+		if err != nil {
+			return nil, fmt.Errorf("sink directory: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("sink directory: %s is not a directory", cfg.SinkDir)
+		}
+	}
+	return &Sink{dir: cfg.SinkDir}, nil
+}
+
+// Send is a SendFunc that records env instead of relaying it. The archived
+// file is <msg_id>.eml, the message as it would have been relayed with
+// X-Envelope-From and X-Envelope-To fields recording the envelope.
+func (s *Sink) Send(cfg *config.Config, env *Envelope) error {
+	slog.Info("sink: message not relayed",
+		"msg_id", env.ID,
+		"envelope_from", cfg.DestFrom,
+		"recipients", env.Addresses(),
+		"upstream", cfg.DestHost,
+		"size", len(env.Message),
+	)
+	if s.dir == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "X-Envelope-From: <%s>\r\n", cfg.DestFrom)
+	fmt.Fprintf(&buf, "X-Envelope-To: %s\r\n", strings.Join(env.Addresses(), ", "))
+	buf.Write(env.Message)
+
+	// Write then rename, so a reader of the directory never sees a partial file
+	path := filepath.Join(s.dir, env.ID+".eml")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("sink: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sink: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestSink_Archives(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{DestHost: "smtp.example.com", DestFrom: "bounce@example.com", SinkMode: true, SinkDir: dir}
+	sink, err := NewSink(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	env := testEnvelope([]string{"a@dest.org", "b@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	if err := sink.Send(cfg, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, env.ID+".eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "X-Envelope-From: <bounce@example.com>\r\nX-Envelope-To: a@dest.org, b@dest.org\r\nSubject: Test\r\n\r\nBody\r\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the archived message, got %d entries", len(entries))
+	}
+}
+
+func TestNewSink_InvalidDir(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	_ = os.WriteFile(file, nil, 0o600)
+	for _, dir := range []string{file, filepath.Join(t.TempDir(), "missing")} {
+		if _, err := NewSink(&config.Config{SinkDir: dir}); err == nil || !strings.Contains(err.Error(), "sink directory") {
+			t.Errorf("%s: expected an error, got %v", dir, err)
+		}
+	}
+}
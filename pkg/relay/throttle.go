@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// Throttle smooths outbound bursts per recipient domain so the upstream
+// account is not rate-limited by providers that throttle bursts. Messages
+// to a throttled domain are spaced evenly at the configured rate and capped
+// in concurrency; a message that would wait longer than the configured
+// maximum fails with a temporary error instead.
+type Throttle struct {
+	maxWait  time.Duration
+	now      func() time.Time
+	sleep    func(time.Duration)
+	limits   map[string]*domainThrottle
+	fallback *domainThrottle // "*" entry, shared by all unlisted domains
+}
+
+type domainThrottle struct {
+	interval time.Duration // 0 = no rate limit
+	slots    chan struct{} // nil = no concurrency limit
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewThrottle creates a throttle from cfg.DomainLimits. It returns nil when
+// no limits are configured; a nil *Throttle passes sends straight through.
+func NewThrottle(cfg *config.Config) *Throttle {
+	if len(cfg.DomainLimits) == 0 {
+		return nil
+	}
+	t := &Throttle{
+		maxWait: cfg.DomainThrottleWait,
+		now:     time.Now,
+		sleep:   time.Sleep,
+		limits:  make(map[string]*domainThrottle),
+	}
+	for _, l := range cfg.DomainLimits {
+		d := &domainThrottle{}
+		if l.PerMinute > 0 {
+			d.interval = time.Minute / time.Duration(l.PerMinute)
+		}
+		if l.Concurrent > 0 {
+			d.slots = make(chan struct{}, l.Concurrent)
+		}
+		if l.Domain == "*" {
+			t.fallback = d
+		} else {
+			t.limits[l.Domain] = d
+		}
+	}
+	return t
+}
+
+// Wrap returns a SendFunc that waits for every recipient domain's limits
+// before calling send.
+func (t *Throttle) Wrap(send SendFunc) SendFunc {
+	if t == nil {
+		return send
+	}
+	return func(cfg *config.Config, env *Envelope) error {
+		release, err := t.acquire(env.Addresses())
+		if err != nil {
+			return err
+		}
+		defer release()
+		return send(cfg, env)
+	}
+}
+
+// acquire takes a concurrency slot and a rate slot for each distinct
+// recipient domain, in sorted order so concurrent messages cannot deadlock.
+func (t *Throttle) acquire(recipients []string) (release func(), err error) {
+	var held []*domainThrottle
+	release = func() {
+		for _, d := range held {
+			<-d.slots
+		}
+	}
+
+	deadline := t.now().Add(t.maxWait)
+	for _, domain := range recipientDomains(recipients) {
+		d := t.limits[domain]
+		if d == nil {
+			d = t.fallback
+		}
+		if d == nil {
+			continue
+		}
+
+		if d.slots != nil {
+			if !d.takeSlot(deadline.Sub(t.now())) {
+				release()
+				return nil, fmt.Errorf("relay: throttled: too many concurrent messages to %s", domain)
+			}
+			held = append(held, d)
+		}
+
+		wait, ok := d.reserve(t.now(), deadline)
+		if !ok {
+			release()
+			return nil, fmt.Errorf("relay: throttled: rate limit for %s exceeded", domain)
+		}
+		if wait > 0 {
+			slog.Debug("relay: throttling", "domain", domain, "wait", wait)
+			t.sleep(wait)
+		}
+	}
+	return release, nil
+}
+
+// takeSlot acquires a concurrency slot, waiting at most wait.
+func (d *domainThrottle) takeSlot(wait time.Duration) bool {
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// reserve books the next send slot for the domain and returns how long to
+// wait for it. It books nothing and reports false if the slot is past the
+// deadline.
+func (d *domainThrottle) reserve(now, deadline time.Time) (time.Duration, bool) {
+	if d.interval == 0 {
+		return 0, true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	slot := d.next
+	if slot.Before(now) {
+		slot = now
+	}
+	if slot.After(deadline) {
+		return 0, false
+	}
+	d.next = slot.Add(d.interval)
+	return slot.Sub(now), true
+}
+
+// recipientDomains returns the sorted, distinct lowercase domains of the
+// recipients.
+func recipientDomains(recipients []string) []string {
+	var domains []string
+	for _, rcpt := range recipients {
+		at := strings.LastIndex(rcpt, "@")
+		if at < 0 {
+			continue
+		}
+		domains = append(domains, strings.ToLower(rcpt[at+1:]))
+	}
+	slices.Sort(domains)
+	return slices.Compact(domains)
+}
@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// fakeClock is a manual clock whose sleep advances time.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+}
+
+func newTestThrottle(limits []config.DomainLimit, maxWait time.Duration) (*Throttle, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	th := NewThrottle(&config.Config{DomainLimits: limits, DomainThrottleWait: maxWait})
+	th.now = clock.Now
+	th.sleep = clock.Sleep
+	return th, clock
+}
+
+func TestThrottle_DisabledByDefault(t *testing.T) {
+	if th := NewThrottle(&config.Config{}); th != nil {
+		t.Fatal("expected nil throttle without limits")
+	}
+}
+
+func TestThrottle_SpacesMessagesPerDomain(t *testing.T) {
+	th, clock := newTestThrottle([]config.DomainLimit{{Domain: "gmail.com", PerMinute: 30}}, time.Minute)
+	send := th.Wrap(func(*config.Config, *Envelope) error { return nil })
+
+	for i := 0; i < 3; i++ {
+		if err := send(nil, testEnvelope([]string{"user@Gmail.com"}, nil)); err != nil {
+			t.Fatalf("send %d: unexpected error: %v", i, err)
+		}
+	}
+	// 30/min = one every 2s; the first goes immediately
+	if len(clock.slept) != 2 || clock.slept[0] != 2*time.Second || clock.slept[1] != 2*time.Second {
+		t.Errorf("expected two 2s waits, got %v", clock.slept)
+	}
+
+	// Unthrottled domains are not delayed
+	clock.slept = nil
+	if err := send(nil, testEnvelope([]string{"user@example.com"}, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(clock.slept) != 0 {
+		t.Errorf("expected no wait for unlisted domain, got %v", clock.slept)
+	}
+}
+
+func TestThrottle_FailsPastMaxWait(t *testing.T) {
+	th, _ := newTestThrottle([]config.DomainLimit{{Domain: "*", PerMinute: 1}}, 10*time.Second)
+	th.sleep = func(time.Duration) {} // time does not advance
+
+	send := th.Wrap(func(*config.Config, *Envelope) error { return nil })
+	if err := send(nil, testEnvelope([]string{"a@yahoo.com"}, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := send(nil, testEnvelope([]string{"b@yahoo.com"}, nil))
+	if err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected throttled error, got %v", err)
+	}
+}
+
+func TestThrottle_ConcurrencyCap(t *testing.T) {
+	th, _ := newTestThrottle([]config.DomainLimit{{Domain: "gmail.com", Concurrent: 1}}, 0)
+
+	release, err := th.acquire([]string{"a@gmail.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := th.acquire([]string{"b@gmail.com"}); err == nil {
+		t.Fatal("expected second concurrent message to be refused")
+	}
+	release()
+	release2, err := th.acquire([]string{"b@gmail.com"})
+	if err != nil {
+		t.Fatalf("expected slot after release, got %v", err)
+	}
+	release2()
+}
+
+func TestRecipientDomains(t *testing.T) {
+	got := recipientDomains([]string{"a@B.com", "c@a.com", "d@b.com", "invalid"})
+	if strings.Join(got, ",") != "a.com,b.com" {
+		t.Errorf("expected [a.com b.com], got %v", got)
+	}
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// maxTranscript bounds the captured dialogue so a pathological session
+// cannot grow it without limit.
+const maxTranscript = 64 * 1024
+
+// transcript captures the upstream SMTP dialogue from the client's debug
+// stream, one line at a time. Credentials are redacted and the message
+// content between DATA and the terminating dot is replaced by its size, so
+// the result is safe to log.
+type transcript struct {
+	mu        sync.Mutex
+	partial   []byte
+	lines     []string
+	size      int
+	truncated bool
+
+	inAuth   bool // a 334 challenge is outstanding
+	inData   bool // between 354 and the final "."
+	dataSize int
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(t.partial[:i]), "\r")
+		t.partial = t.partial[i+1:]
+		t.addLine(line)
+	}
+	return len(p), nil
+}
+
+func (t *transcript) addLine(line string) {
+	if t.inData {
+		if line == "." {
+			t.inData = false
+			t.append(fmt.Sprintf("[message content, %d bytes]", t.dataSize))
+			t.append(".")
+			t.dataSize = 0
+			return
+		}
+		t.dataSize += len(line) + 2
+		return
+	}
+
+	upper := strings.ToUpper(line)
+	switch {
+	case strings.HasPrefix(upper, "AUTH "):
+		// "AUTH PLAIN <initial-response>": keep the mechanism only
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			line = fields[0] + " " + fields[1] + " [redacted]"
+		}
+	case strings.HasPrefix(line, "334"):
+		t.inAuth = true
+		t.append(line)
+		return
+	case t.inAuth && !isReply(line):
+		line = "[redacted]"
+	case strings.HasPrefix(line, "354"):
+		t.inData = true
+	}
+	if isReply(line) {
+		t.inAuth = false
+	}
+	t.append(line)
+}
+
+func (t *transcript) append(line string) {
+	if t.truncated {
+		return
+	}
+	if t.size+len(line) > maxTranscript {
+		t.lines = append(t.lines, "[transcript truncated]")
+		t.truncated = true
+		return
+	}
+	t.size += len(line)
+	t.lines = append(t.lines, line)
+}
+
+// String returns the captured dialogue, one line per SMTP line.
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// isReply reports whether line looks like a server reply ("250 ...", "250-...").
+func isReply(line string) bool {
+	if len(line) < 3 {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if line[i] < '0' || line[i] > '9' {
+			return false
+		}
+	}
+	return len(line) == 3 || line[3] == ' ' || line[3] == '-'
+}
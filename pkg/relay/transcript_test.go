@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestTranscript_Redacts(t *testing.T) {
+	tr := &transcript{}
+	dialogue := "220 upstream.local ESMTP\r\n" +
+		"EHLO localhost\r\n" +
+		"250-upstream.local\r\n250 AUTH PLAIN LOGIN\r\n" +
+		"AUTH PLAIN AHVzZXIAc2VjcmV0\r\n" +
+		"235 2.7.0 Authenticated\r\n" +
+		"AUTH LOGIN\r\n334 VXNlcm5hbWU6\r\ndXNlcg==\r\n334 UGFzc3dvcmQ6\r\nc2VjcmV0\r\n235 ok\r\n" +
+		"MAIL FROM:<a@example.com>\r\n250 ok\r\n" +
+		"DATA\r\n354 go ahead\r\n" +
+		"Subject: secret stuff\r\n\r\nBody\r\n.\r\n" +
+		"250 queued\r\n"
+	// Split mid-line to exercise partial writes
+	_, _ = tr.Write([]byte(dialogue[:30]))
+	_, _ = tr.Write([]byte(dialogue[30:]))
+
+	got := tr.String()
+	for _, leaked := range []string{"AHVzZXIAc2VjcmV0", "dXNlcg==", "c2VjcmV0", "secret stuff", "Body"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("transcript leaks %q:\n%s", leaked, got)
+		}
+	}
+	for _, want := range []string{"220 upstream.local ESMTP", "AUTH PLAIN [redacted]", "334 UGFzc3dvcmQ6", "MAIL FROM:<a@example.com>", "[message content, 31 bytes]", "250 queued"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("transcript missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestTranscript_Truncates(t *testing.T) {
+	tr := &transcript{}
+	line := strings.Repeat("x", 1000) + "\r\n"
+	for i := 0; i < 100; i++ {
+		_, _ = tr.Write([]byte(line))
+	}
+	got := tr.String()
+	if len(got) > maxTranscript+1000 {
+		t.Errorf("transcript not bounded: %d bytes", len(got))
+	}
+	if !strings.HasSuffix(got, "[transcript truncated]") {
+		t.Error("expected truncation marker")
+	}
+}
+
+func TestSend_LogsTranscriptOnFailure(t *testing.T) {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
+	mock, cfg := startMockUpstream(t, 0)
+	mock.reject = map[string]bool{"bad@example.com": true}
+	cfg.RelayTranscript = true
+
+	if err := Send(cfg, testEnvelope([]string{"bad@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err == nil {
+		t.Fatal("expected delivery error")
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "relay: upstream transcript") {
+		t.Fatalf("expected transcript log, got: %s", out)
+	}
+	if !strings.Contains(out, "RCPT TO:<bad@example.com>") || !strings.Contains(out, "550 5.1.1") {
+		t.Errorf("expected rejected RCPT in transcript, got: %s", out)
+	}
+	secret := base64.StdEncoding.EncodeToString([]byte("\x00" + cfg.DestUsername + "\x00" + cfg.DestPassword))
+	if strings.Contains(out, secret) || strings.Contains(out, cfg.DestPassword) {
+		t.Errorf("transcript leaks credentials: %s", out)
+	}
+}
+
+func TestSend_NoTranscriptOnSuccess(t *testing.T) {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
+	_, cfg := startMockUpstream(t, 0)
+	cfg.RelayTranscript = true
+
+	if err := Send(cfg, testEnvelope([]string{"good@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "upstream transcript") {
+		t.Errorf("transcript logged for successful delivery: %s", buf.String())
+	}
+}
+
+func TestSend_TranscriptOnSuccessWhenDebugging(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		level slog.Level
+		debug bool
+		want  string
+	}{
+		{"debug level", slog.LevelDebug, false, "level=DEBUG"},
+		{"debug header", slog.LevelInfo, true, "level=INFO"},
+	} {
+		var buf bytes.Buffer
+		orig := slog.Default()
+		slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: tc.level})))
+
+		_, cfg := startMockUpstream(t, 0)
+		env := testEnvelope([]string{"good@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+		env.Debug = tc.debug
+		err := Send(cfg, env)
+		slog.SetDefault(orig)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+
+		var line string
+		for _, l := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(l, "upstream transcript") {
+				line = l
+			}
+		}
+		if !strings.Contains(line, tc.want) || !strings.Contains(line, "RCPT TO:<good@example.com>") {
+			t.Errorf("%s: expected the transcript at %s, got: %s", tc.name, tc.want, buf.String())
+		}
+		if strings.Contains(line, cfg.DestPassword) {
+			t.Errorf("%s: transcript leaks credentials: %s", tc.name, line)
+		}
+	}
+}
+
+func TestTrace_WritesDialogue(t *testing.T) {
+	mock, cfg := startMockUpstream(t, 0)
+	cfg.RelayAttempts = 3
+
+	var buf bytes.Buffer
+	if err := Trace(cfg, testEnvelope([]string{"a@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")), &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "EHLO relay.example.com") || !strings.Contains(out, "RCPT TO:<a@example.com>") || !strings.Contains(out, "[message content, ") {
+		t.Errorf("expected the dialogue, got: %s", out)
+	}
+	if strings.Contains(out, cfg.DestPassword) {
+		t.Errorf("transcript leaks credentials: %s", out)
+	}
+
+	// a single attempt, even when a retry would follow a failure
+	mock.tempfail = map[string]int{"b@example.com": 1}
+	if err := Trace(cfg, testEnvelope([]string{"b@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")), io.Discard); err == nil {
+		t.Error("expected the temporary failure without a retry")
+	}
+}
@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// tunnelDialer connects to the upstream through a SOCKS5 (RFC 1928) or
+// HTTP CONNECT egress proxy. Credentials in the proxy URL are sent with
+// username/password authentication (RFC 1929) or Proxy-Authorization Basic.
+type tunnelDialer struct {
+	proxy *url.URL
+	dial  func(addr string) (net.Conn, error) // connects to the proxy
+}
+
+// Dial opens a tunnel to addr. The exchange with the proxy is bounded by
+// dialTimeout.
+func (d *tunnelDialer) Dial(addr string) (net.Conn, error) {
+	conn, err := d.dial(d.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	switch d.proxy.Scheme {
+	case "socks5":
+		err = d.socks5(conn, addr)
+	default:
+		conn, err = d.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// SOCKS5 constants
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksPasswordAuth = 2
+	socksConnect      = 1
+	socksDomain       = 3
+	socksIPv4         = 1
+	socksIPv6         = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (d *tunnelDialer) socks5(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socksNoAuth)
+	if d.proxy.User != nil {
+		method = socksPasswordAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		return fmt.Errorf("SOCKS5 proxy refused authentication method %d", method)
+	}
+
+	if method == socksPasswordAuth {
+		user := d.proxy.User.Username()
+		pass, _ := d.proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("SOCKS5 host name too long: %s", host)
+		}
+		req = append(append(req, socksDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socksIPv4), ip4...)
+	} else {
+		req = append(append(req, socksIPv6), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, which is not needed
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		msg, ok := socksReplies[head[1]]
+		if !ok {
+			msg = "reply " + strconv.Itoa(int(head[1]))
+		}
+		return fmt.Errorf("SOCKS5 connect to %s: %s", addr, msg)
+	}
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply with address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// connect issues an HTTP CONNECT for addr. The returned connection keeps
+// any bytes the proxy sent after its response, such as an eager greeting.
+func (d *tunnelDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		pass, _ := d.proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+	buffered, _ := br.Peek(br.Buffered())
+	return &greetingConn{Conn: conn, greeting: buffered}, nil
+}
@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startEgressProxy runs a single-connection proxy for scheme that checks
+// the credentials user:pass, then splices the client to the requested
+// address. It returns the proxy URL and a channel with the requested
+// target.
+func startEgressProxy(t *testing.T, scheme string) (*url.URL, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	targets := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		var target string
+		if scheme == "socks5" {
+			target = socksHandshake(br, conn)
+		} else {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization")); !ok || user != "user" || pass != "pass" {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+			target = req.Host
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		}
+		if target == "" {
+			return
+		}
+		targets <- target
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		go io.Copy(upstream, br)
+		io.Copy(conn, upstream)
+	}()
+
+	return &url.URL{Scheme: scheme, User: url.UserPassword("user", "pass"), Host: ln.Addr().String()}, targets
+}
+
+// socksHandshake serves the SOCKS5 greeting, password authentication and
+// CONNECT request, returning the target or "" on failure.
+func socksHandshake(br *bufio.Reader, conn net.Conn) string {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return ""
+	}
+	methods := make([]byte, head[1])
+	io.ReadFull(br, methods)
+	if !strings.ContainsRune(string(methods), socksPasswordAuth) {
+		conn.Write([]byte{socksVersion, 0xff})
+		return ""
+	}
+	conn.Write([]byte{socksVersion, socksPasswordAuth})
+
+	readString := func() string {
+		n, _ := br.ReadByte()
+		b := make([]byte, n)
+		io.ReadFull(br, b)
+		return string(b)
+	}
+	br.ReadByte()
+	if readString() != "user" || readString() != "pass" {
+		conn.Write([]byte{1, 1})
+		return ""
+	}
+	conn.Write([]byte{1, 0})
+
+	req := make([]byte, 4)
+	io.ReadFull(br, req)
+	var host string
+	switch req[3] {
+	case socksDomain:
+		host = readString()
+	case socksIPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	}
+	port := make([]byte, 2)
+	io.ReadFull(br, port)
+	conn.Write([]byte{socksVersion, 0, 0, socksIPv4, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+func parseProxyAuth(header string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
+
+func TestSend_EgressProxy(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			mock, cfg := startMockUpstream(t, 0)
+			proxy, targets := startEgressProxy(t, scheme)
+			cfg.DestProxy = proxy
+
+			if err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n"))); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := <-targets; got != net.JoinHostPort(cfg.DestHost, strconv.Itoa(cfg.DestPort)) {
+				t.Errorf("expected tunnel to the upstream, got %s", got)
+			}
+			if len(mock.messages) != 1 {
+				t.Errorf("expected one message through the proxy, got %d", len(mock.messages))
+			}
+		})
+	}
+}
+
+func TestSend_EgressProxyAuthFailure(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			_, cfg := startMockUpstream(t, 0)
+			proxy, _ := startEgressProxy(t, scheme)
+			proxy.User = url.UserPassword("user", "wrong")
+			cfg.DestProxy = proxy
+
+			err := Send(cfg, testEnvelope([]string{"a@dest.org"}, []byte("Subject: Test\r\n\r\nBody\r\n")))
+			if err == nil || !strings.Contains(err.Error(), "egress proxy") {
+				t.Errorf("expected egress proxy error, got %v", err)
+			}
+		})
+	}
+}
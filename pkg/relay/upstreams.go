@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// PerUpstream returns a SendFunc that relays each message through a chain
+// of its own per upstream (transport, host and port), built by wrap from
+// the config of the upstream's first message. Stateful wrappers such as
+// the Breaker and Throttle then track each route separately: one upstream
+// failing or filling up does not hold up mail for the others. Credentials
+// are not part of the key, so a chain keeps its state when they are
+// rotated.
+func PerUpstream(wrap func(cfg *config.Config) SendFunc) SendFunc {
+	var mu sync.Mutex
+	chains := make(map[string]SendFunc)
+	return func(cfg *config.Config, env *Envelope) error {
+		key := cfg.DestTransport + "://" + net.JoinHostPort(cfg.DestHost, strconv.Itoa(cfg.DestPort))
+		mu.Lock()
+		send, ok := chains[key]
+		if !ok {
+			send = wrap(cfg)
+			chains[key] = send
+		}
+		mu.Unlock()
+		return send(cfg, env)
+	}
+}
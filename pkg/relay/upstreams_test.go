@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestPerUpstream(t *testing.T) {
+	down := errors.New("connection refused")
+	built := 0
+	send := PerUpstream(func(cfg *config.Config) SendFunc {
+		built++
+		return NewBreaker(cfg).Wrap(func(cfg *config.Config, _ *Envelope) error {
+			if cfg.DestHost == "down.example.com" {
+				return down
+			}
+			return nil
+		})
+	})
+
+	base := &config.Config{DestTransport: "smtp", DestHost: "down.example.com", DestPort: 587, BreakerThreshold: 1, BreakerCooldown: time.Minute}
+	route := base.ForRoute(config.Route{Transport: "smtp", Host: "up.example.com", Port: 587})
+	_ = send(base, &Envelope{})
+	if err := send(base, &Envelope{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the failing upstream's circuit open, got %v", err)
+	}
+	if err := send(route, &Envelope{}); err != nil {
+		t.Errorf("expected the route unaffected by the other upstream's breaker, got %v", err)
+	}
+	if err := send(route, &Envelope{}); err != nil || built != 2 {
+		t.Errorf("expected one chain per upstream, built %d, got %v", built, err)
+	}
+
+	// Rotated credentials keep the upstream's chain and its breaker state
+	rotated := *base
+	rotated.DestUsername, rotated.DestPassword = "rotated@example.com", "new-pass"
+	if err := send(&rotated, &Envelope{}); !errors.Is(err, ErrCircuitOpen) || built != 2 {
+		t.Errorf("expected the same chain after a credential change, built %d, got %v", built, err)
+	}
+}
@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// ErrWarmupLimit is returned when a message would exceed the current
+// warm-up day's volume cap.
+var ErrWarmupLimit = errors.New("relay: daily warm-up volume reached")
+
+// Warmup caps daily sending volume for a new upstream account or IP,
+// ramping up over the configured schedule so the sending identity builds
+// reputation gradually. Volume is counted in recipients, since each one is
+// a separate delivery to the receiving providers. Counts are kept in
+// memory and reset at UTC midnight and on restart.
+type Warmup struct {
+	start    time.Time
+	schedule []int
+	now      func() time.Time
+
+	mu   sync.Mutex
+	day  int
+	sent int
+}
+
+// NewWarmup creates a warm-up limiter from cfg. It returns nil when no
+// schedule is configured; a nil *Warmup passes sends straight through.
+func NewWarmup(cfg *config.Config) *Warmup {
+	if len(cfg.WarmupSchedule) == 0 {
+		return nil
+	}
+	return &Warmup{
+		start:    cfg.WarmupStart,
+		schedule: cfg.WarmupSchedule,
+		now:      time.Now,
+		day:      -1,
+	}
+}
+
+// Wrap returns a SendFunc that enforces the day's cap before calling send.
+// Only recipients the upstream accepted count against the cap.
+func (w *Warmup) Wrap(send SendFunc) SendFunc {
+	if w == nil {
+		return send
+	}
+	return func(cfg *config.Config, env *Envelope) error {
+		n := len(env.Recipients)
+		if !w.reserve(n) {
+			return ErrWarmupLimit
+		}
+		err := send(cfg, env)
+		if err != nil {
+			var delivery *DeliveryError
+			delivered := 0
+			if errors.As(err, &delivery) {
+				delivered = len(delivery.Delivered)
+			}
+			w.refund(n - delivered)
+		}
+		return err
+	}
+}
+
+// reserve counts n recipients against today's cap, reporting false if they
+// do not fit.
+func (w *Warmup) reserve(n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	elapsed := w.now().Sub(w.start)
+	day := int(elapsed / (24 * time.Hour))
+	if elapsed < 0 {
+		day = -1
+	}
+	if day != w.day {
+		w.day = day
+		w.sent = 0
+	}
+	if day < 0 {
+		// Schedule has not begun: hold at the first day's cap
+		day = 0
+	}
+	if day >= len(w.schedule) {
+		return true // warm-up complete
+	}
+
+	limit := w.schedule[day]
+	if w.sent+n > limit {
+		slog.Warn("relay: warm-up cap reached, deferring message",
+			"day", day+1,
+			"limit", limit,
+			"sent", w.sent,
+			"recipients", n,
+		)
+		return false
+	}
+	w.sent += n
+	return true
+}
+
+func (w *Warmup) refund(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sent -= n
+	if w.sent < 0 {
+		w.sent = 0
+	}
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+func TestWarmup_DisabledByDefault(t *testing.T) {
+	if w := NewWarmup(&config.Config{}); w != nil {
+		t.Fatal("expected nil warm-up without a schedule")
+	}
+}
+
+func TestWarmup_RampsDailyCap(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	w := NewWarmup(&config.Config{WarmupSchedule: []int{3, 5}, WarmupStart: start})
+	w.now = func() time.Time { return now }
+	send := w.Wrap(func(*config.Config, *Envelope) error { return nil })
+
+	two := []string{"a@example.com", "b@example.com"}
+
+	// Day 1: cap 3
+	if err := send(nil, testEnvelope(two, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := send(nil, testEnvelope(two, nil)); !errors.Is(err, ErrWarmupLimit) {
+		t.Fatalf("expected ErrWarmupLimit over day 1 cap, got %v", err)
+	}
+
+	// Day 2: counter resets, cap 5
+	now = start.Add(25 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := send(nil, testEnvelope(two, nil)); err != nil {
+			t.Fatalf("day 2 send %d: unexpected error: %v", i, err)
+		}
+	}
+	if err := send(nil, testEnvelope(two, nil)); !errors.Is(err, ErrWarmupLimit) {
+		t.Fatalf("expected ErrWarmupLimit over day 2 cap, got %v", err)
+	}
+
+	// After the schedule: unlimited
+	now = start.Add(72 * time.Hour)
+	for i := 0; i < 10; i++ {
+		if err := send(nil, testEnvelope(two, nil)); err != nil {
+			t.Fatalf("post-warm-up send %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestWarmup_RefundsUndelivered(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := NewWarmup(&config.Config{WarmupSchedule: []int{2}, WarmupStart: start})
+	w.now = func() time.Time { return start }
+
+	fail := w.Wrap(func(*config.Config, *Envelope) error {
+		return &DeliveryError{Delivered: []string{"a@example.com"}, Failed: []RecipientError{{Recipient: "b@example.com"}}}
+	})
+	_ = fail(nil, testEnvelope([]string{"a@example.com", "b@example.com"}, nil))
+
+	// Only the delivered recipient counted, so one more fits
+	ok := w.Wrap(func(*config.Config, *Envelope) error { return nil })
+	if err := ok(nil, testEnvelope([]string{"c@example.com"}, nil)); err != nil {
+		t.Errorf("expected refunded capacity, got %v", err)
+	}
+	if err := ok(nil, testEnvelope([]string{"d@example.com"}, nil)); !errors.Is(err, ErrWarmupLimit) {
+		t.Errorf("expected cap reached, got %v", err)
+	}
+}
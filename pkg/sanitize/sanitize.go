@@ -0,0 +1,78 @@
+// Package sanitize removes the header fields that reveal where a message
+// came from, the same way the proxy does before relaying, for programs
+// that want the sanitizer without the proxy:
+//
+//	err := sanitize.Sanitize(r, w, sanitize.Policy{Domain: "example.com"})
+//
+// The zero Policy apart from Domain gives the proxy's defaults. For the
+// full set of options (Received chain, footers, header rules) use package
+// sanitizer directly.
+package sanitize
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/sanitizer"
+)
+
+// MessageIDMode selects what happens to the message's Message-ID.
+type MessageIDMode = sanitizer.MessageIDPolicy
+
+const (
+	// MessageIDReplace always generates a new Message-ID (the default).
+	MessageIDReplace = sanitizer.MessageIDReplace
+	// MessageIDPreserve keeps the Message-ID, adding one only when missing.
+	MessageIDPreserve = sanitizer.MessageIDPreserve
+	// MessageIDReplaceKeepOriginal generates a new Message-ID and keeps the
+	// old one in X-Original-Message-ID.
+	MessageIDReplaceKeepOriginal = sanitizer.MessageIDReplaceKeepOriginal
+)
+
+// Policy controls what Sanitize removes.
+type Policy struct {
+	// Domain is the right-hand side of generated Message-IDs. Required.
+	Domain string
+	// Strip lists header fields to remove in addition to DefaultStrip.
+	Strip []string
+	// Keep lists fields from DefaultStrip to pass through unchanged.
+	Keep []string
+	// MessageID selects the Message-ID handling; empty means
+	// MessageIDReplace.
+	MessageID MessageIDMode
+}
+
+// DefaultStrip returns the header fields removed by default, lowercase and
+// sorted. Received is among them and cannot be kept.
+func DefaultStrip() []string {
+	return slices.Sorted(maps.Keys(sanitizer.StrippedHeaders()))
+}
+
+// Sanitize reads a message from r and writes it to w with the fields the
+// policy strips removed and the Message-ID handled per p.MessageID. The
+// body is copied unchanged apart from line endings, which become CRLF.
+// An invalid policy is reported before anything is read or written.
+func Sanitize(r io.Reader, w io.Writer, p Policy) error {
+	if p.Domain == "" {
+		return errors.New("sanitize: policy domain is required")
+	}
+	policy, err := sanitizer.Compile(sanitizer.Options{
+		MessageIDPolicy: p.MessageID,
+		Strip:           p.Strip,
+		Keep:            p.Keep,
+	})
+	if err != nil {
+		return fmt.Errorf("sanitize: %w", err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("sanitize: read: %w", err)
+	}
+	if _, err := w.Write(policy.Sanitize(raw, p.Domain, sanitizer.Vars{})); err != nil {
+		return fmt.Errorf("sanitize: write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package sanitize
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testMessage = "Received: from laptop.internal\r\n" +
+	"X-Mailer: Outlook\r\n" +
+	"X-Originating-IP: 10.0.0.7\r\n" +
+	"X-Internal-Ticket: 4711\r\n" +
+	"Message-ID: <client@laptop.internal>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Body\r\n"
+
+func TestSanitize_Defaults(t *testing.T) {
+	var out bytes.Buffer
+	if err := Sanitize(strings.NewReader(testMessage), &out, Policy{Domain: "example.com"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := out.String()
+	for _, h := range []string{"Received", "X-Mailer", "X-Originating-IP", "client@laptop.internal"} {
+		if strings.Contains(got, h) {
+			t.Errorf("expected %s to be removed:\n%s", h, got)
+		}
+	}
+	if !strings.Contains(got, "X-Internal-Ticket: 4711") || !strings.Contains(got, "@example.com>") || !strings.HasSuffix(got, "\r\n\r\nBody\r\n") {
+		t.Errorf("unexpected output:\n%s", got)
+	}
+}
+
+func TestSanitize_StripKeepPreserve(t *testing.T) {
+	var out bytes.Buffer
+	p := Policy{
+		Domain:    "example.com",
+		Strip:     []string{"x-internal-ticket"},
+		Keep:      []string{"X-Mailer"},
+		MessageID: MessageIDPreserve,
+	}
+	if err := Sanitize(strings.NewReader(testMessage), &out, p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := out.String()
+	if strings.Contains(got, "X-Internal-Ticket") || strings.Contains(got, "X-Originating-IP") {
+		t.Errorf("expected stripped fields to be removed:\n%s", got)
+	}
+	if !strings.Contains(got, "X-Mailer: Outlook") || !strings.Contains(got, "Message-ID: <client@laptop.internal>") {
+		t.Errorf("expected kept fields:\n%s", got)
+	}
+}
+
+func TestSanitize_InvalidPolicy(t *testing.T) {
+	for name, p := range map[string]Policy{
+		"no domain":    {},
+		"bad name":     {Domain: "example.com", Strip: []string{"X Bad"}},
+		"keep receive": {Domain: "example.com", Keep: []string{"Received"}},
+		"bad mode":     {Domain: "example.com", MessageID: "drop"},
+	} {
+		var out bytes.Buffer
+		if err := Sanitize(strings.NewReader(testMessage), &out, p); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%s: expected no output", name)
+		}
+	}
+}
+
+func TestDefaultStrip(t *testing.T) {
+	names := DefaultStrip()
+	if !slices.IsSorted(names) || !slices.Contains(names, "received") || !slices.Contains(names, "x-mailer") {
+		t.Errorf("unexpected default strip list %v", names)
+	}
+}
@@ -0,0 +1,51 @@
+package sanitizer
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// UndisclosedRecipients returns the envelope recipients that raw does not
+// address in To, Cc or Bcc. A client that lists its blind copies in Bcc
+// (which the sanitizer then strips) yields none; anything returned was
+// added to the envelope without a trace in the headers.
+func UndisclosedRecipients(raw []byte, recipients []string) []string {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	headerPart := raw
+	if end := bytes.Index(raw, []byte("\n\n")); end != -1 {
+		headerPart = raw[:end]
+	}
+	headerPart = bytes.ReplaceAll(headerPart, []byte("\n"), []byte("\r\n"))
+
+	addressed := make(map[string]bool)
+	for _, h := range parseHeaders(headerPart) {
+		switch h.name {
+		case "to", "cc", "bcc":
+		default:
+			continue
+		}
+		value := toField(h).Value
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			// Fall back to anything address-shaped in a malformed field
+			for _, word := range strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(" ,;<>\"", r) }) {
+				if strings.Contains(word, "@") {
+					addressed[strings.ToLower(word)] = true
+				}
+			}
+			continue
+		}
+		for _, a := range list {
+			addressed[strings.ToLower(a.Address)] = true
+		}
+	}
+
+	var undisclosed []string
+	for _, r := range recipients {
+		if !addressed[strings.ToLower(r)] {
+			undisclosed = append(undisclosed, r)
+		}
+	}
+	return undisclosed
+}
@@ -0,0 +1,83 @@
+package sanitizer
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DuplicatePolicy selects what happens to a message that repeats a field
+// allowed only once.
+type DuplicatePolicy string
+
+const (
+	// DuplicateKeepFirst keeps the first occurrence of each such field.
+	DuplicateKeepFirst DuplicatePolicy = "keep-first"
+	// DuplicateKeepLast keeps the last occurrence of each such field.
+	DuplicateKeepLast DuplicatePolicy = "keep-last"
+	// DuplicateReject leaves the header alone; the caller rejects the
+	// message on what DuplicateFields reports.
+	DuplicateReject DuplicatePolicy = "reject"
+)
+
+// singleFields are the fields a message may carry at most once (RFC 5322
+// section 3.6, RFC 2045 section 5) that mail clients act on. A second one
+// is a common spam and header injection signature: recipients' clients
+// disagree on which of them to show.
+var singleFields = map[string]bool{
+	"from":         true,
+	"subject":      true,
+	"date":         true,
+	"content-type": true,
+}
+
+// ParseDuplicatePolicy validates a policy name.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(s); p {
+	case DuplicateKeepFirst, DuplicateKeepLast, DuplicateReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown duplicate header policy %q (must be keep-first, keep-last, or reject)", s)
+	}
+}
+
+// DuplicateFields returns the From, Subject, Date and Content-Type fields
+// that raw's header repeats, lowercase, in the order of their second
+// occurrence.
+func DuplicateFields(raw []byte) []string {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	headerPart := raw
+	if end := bytes.Index(raw, []byte("\n\n")); end != -1 {
+		headerPart = raw[:end]
+	}
+	headerPart = bytes.ReplaceAll(headerPart, []byte("\n"), []byte("\r\n"))
+
+	seen := make(map[string]int)
+	var dups []string
+	for _, h := range parseHeaders(headerPart) {
+		if !singleFields[h.name] {
+			continue
+		}
+		if seen[h.name]++; seen[h.name] == 2 {
+			dups = append(dups, h.name)
+		}
+	}
+	return dups
+}
+
+// dropDuplicates removes all but the first, or with keepLast the last,
+// occurrence of each of the singleFields.
+func dropDuplicates(headers []header, keepLast bool) []header {
+	keep := make(map[string]int) // field name to index of the kept one
+	for i, h := range headers {
+		if _, ok := keep[h.name]; singleFields[h.name] && (keepLast || !ok) {
+			keep[h.name] = i
+		}
+	}
+	out := make([]header, 0, len(headers))
+	for i, h := range headers {
+		if j, ok := keep[h.name]; !ok || i == j {
+			out = append(out, h)
+		}
+	}
+	return out
+}
@@ -0,0 +1,145 @@
+package sanitizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/mimepart"
+)
+
+// maxDowngradeDepth bounds how deeply nested entities are re-encoded.
+const maxDowngradeDepth = 10
+
+// ErrCannotDowngrade is returned by Downgrade8Bit for 8-bit content that
+// cannot be re-encoded.
+var ErrCannotDowngrade = errors.New("8-bit content cannot be converted to 7-bit")
+
+// Has8Bit reports whether b contains bytes outside US-ASCII.
+func Has8Bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// Downgrade8Bit re-encodes the 8-bit body parts of a CRLF message as
+// quoted-printable, so it can be relayed to a server without 8BITMIME
+// (RFC 6152). Multiparts and attached messages are converted part by part.
+// It fails with ErrCannotDowngrade when 8-bit data is in a header field,
+// under a signature or encryption, or in a part already declared base64 or
+// quoted-printable. A 7-bit message is returned unchanged.
+func Downgrade8Bit(msg []byte) ([]byte, error) {
+	if !Has8Bit(msg) {
+		return msg, nil
+	}
+	return downgradeEntity(msg, 0)
+}
+
+func downgradeEntity(entity []byte, depth int) ([]byte, error) {
+	if depth >= maxDowngradeDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrCannotDowngrade)
+	}
+	var headerPart, body []byte
+	if bytes.HasPrefix(entity, []byte("\r\n")) {
+		body = entity[2:]
+	} else if i := bytes.Index(entity, []byte("\r\n\r\n")); i >= 0 {
+		headerPart, body = entity[:i+2], entity[i+4:]
+	} else {
+		headerPart = entity
+	}
+	if Has8Bit(headerPart) {
+		return nil, fmt.Errorf("%w: 8-bit header field", ErrCannotDowngrade)
+	}
+	if !Has8Bit(body) {
+		return entity, nil
+	}
+
+	headers := parseHeaders(headerPart)
+	var contentType, encoding string
+	for _, h := range headers {
+		switch h.name {
+		case "content-type":
+			contentType = toField(h).Value
+		case "content-transfer-encoding":
+			encoding = strings.ToLower(toField(h).Value)
+		}
+	}
+	mediaType, params := "text/plain", map[string]string{}
+	if contentType != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("%w: invalid Content-Type: %v", ErrCannotDowngrade, err)
+		}
+	}
+
+	switch {
+	case mediaType == "multipart/signed" || mediaType == "multipart/encrypted":
+		return nil, fmt.Errorf("%w: 8-bit data in %s", ErrCannotDowngrade, mediaType)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		converted, err := downgradeMultipart(body, params["boundary"], depth)
+		if err != nil {
+			return nil, err
+		}
+		return withEncoding(headers, "7bit", converted, encoding != ""), nil
+	case mediaType == "message/rfc822":
+		converted, err := downgradeEntity(body, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return withEncoding(headers, "7bit", converted, encoding != ""), nil
+	}
+
+	switch encoding {
+	case "", "7bit", "8bit", "binary":
+	default:
+		return nil, fmt.Errorf("%w: 8-bit data in a %s part", ErrCannotDowngrade, encoding)
+	}
+	encoded := encodeBody(body, "quoted-printable")
+	// Inside a multipart the final CRLF belongs to the next delimiter
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		encoded = bytes.TrimSuffix(encoded, []byte("\r\n"))
+	}
+	return withEncoding(headers, "quoted-printable", encoded, true), nil
+}
+
+// downgradeMultipart converts each part of a multipart body.
+func downgradeMultipart(body []byte, boundary string, depth int) ([]byte, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: multipart without boundary", ErrCannotDowngrade)
+	}
+	body, err := mimepart.Replace(body, mimepart.Split(body, boundary), func(p mimepart.Part) ([]byte, error) {
+		return downgradeEntity(body[p.Start:p.End], depth+1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if Has8Bit(body) {
+		// 8-bit preamble, epilogue or unterminated part
+		return nil, fmt.Errorf("%w: 8-bit data outside the body parts", ErrCannotDowngrade)
+	}
+	return body, nil
+}
+
+// withEncoding rebuilds an entity from its header fields, with any
+// Content-Transfer-Encoding replaced by encoding when set is true.
+func withEncoding(headers []header, encoding string, body []byte, set bool) []byte {
+	var buf bytes.Buffer
+	for _, h := range headers {
+		if set && h.name == "content-transfer-encoding" {
+			continue
+		}
+		buf.Write(bytes.Join(h.lines, []byte("\r\n")))
+		buf.WriteString("\r\n")
+	}
+	if set {
+		buf.WriteString("Content-Transfer-Encoding: " + encoding + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
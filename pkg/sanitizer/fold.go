@@ -0,0 +1,46 @@
+package sanitizer
+
+import "bytes"
+
+// maxLineLength is the RFC 5322 section 2.1.1 limit on a line, without
+// its CRLF.
+const maxLineLength = 998
+
+// writeLine writes a header line and its CRLF to buf, folding it before
+// whitespace (RFC 5322 section 2.2.3) into lines of at most maxLineLength
+// bytes. A run without whitespace cannot be folded and is written as is,
+// broken at the first whitespace after it.
+func writeLine(buf *bytes.Buffer, line []byte) {
+	for len(line) > maxLineLength {
+		i := foldPoint(line)
+		if i < 0 {
+			break
+		}
+		buf.Write(line[:i])
+		buf.WriteString("\r\n")
+		line = line[i:]
+	}
+	buf.Write(line)
+	buf.WriteString("\r\n")
+}
+
+// foldPoint returns the index of the whitespace to fold line before: the
+// last one keeping the line within maxLineLength, else the first one. A
+// fold must leave something other than whitespace on the line before it.
+// It returns -1 if line cannot be folded.
+func foldPoint(line []byte) int {
+	start := bytes.IndexFunc(line, func(r rune) bool { return r != ' ' && r != '\t' })
+	if start < 0 {
+		return -1
+	}
+	if start < maxLineLength {
+		if i := bytes.LastIndexAny(line[start:maxLineLength+1], " \t"); i > 0 {
+			return start + i
+		}
+	}
+	from := max(start, maxLineLength)
+	if i := bytes.IndexAny(line[from:], " \t"); i >= 0 {
+		return from + i
+	}
+	return -1
+}
@@ -0,0 +1,255 @@
+package sanitizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/mimepart"
+)
+
+// maxFooterDepth bounds how deeply nested multiparts are searched for the
+// body to decorate.
+const maxFooterDepth = 5
+
+// Footer is a disclaimer appended to the message body. Text goes at the
+// end of text/plain parts; HTML goes before </body> in text/html parts and
+// defaults to Text, escaped, when empty.
+//
+// In multipart/alternative every alternative gets the footer; in
+// multipart/mixed and multipart/related only the first part (the body the
+// reader sees) does. Signed or encrypted content is never touched, since
+// changing it would invalidate the signature.
+type Footer struct {
+	Text string
+	HTML string
+}
+
+// apply returns content with the footer added, given the top-level
+// Content-Type and Content-Transfer-Encoding. The original is returned if
+// no part could be decorated.
+func (f *Footer) apply(contentType, encoding string, content []byte) []byte {
+	out, _ := f.transform(contentType, encoding, content, 0)
+	return out
+}
+
+func (f *Footer) transform(contentType, encoding string, content []byte, depth int) ([]byte, bool) {
+	mediaType := "text/plain"
+	params := map[string]string{}
+	if contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return content, false
+		}
+	}
+
+	switch mediaType {
+	case "text/plain":
+		if f.Text == "" {
+			return content, false
+		}
+		return f.transformText(content, encoding, params["charset"], f.Text, appendFooter)
+	case "text/html":
+		footer := f.HTML
+		if footer == "" {
+			footer = textToHTML(f.Text)
+		}
+		if footer == "" {
+			return content, false
+		}
+		return f.transformText(content, encoding, params["charset"], footer, insertHTMLFooter)
+	case "multipart/alternative":
+		return f.transformMultipart(content, params["boundary"], true, depth)
+	case "multipart/mixed", "multipart/related":
+		return f.transformMultipart(content, params["boundary"], false, depth)
+	}
+	return content, false
+}
+
+// transformText decodes a text part, adds footer with insert and re-encodes
+// it with the same transfer encoding. Parts in a charset the footer cannot
+// be written in are left alone.
+func (f *Footer) transformText(content []byte, encoding, charset, footer string, insert func(text []byte, footer string) []byte) ([]byte, bool) {
+	if !utf8Compatible(charset, footer) {
+		return content, false
+	}
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	text, ok := decodeBody(content, encoding)
+	if !ok {
+		return content, false
+	}
+	out := encodeBody(insert(text, footer), encoding)
+	// Keep the part's own trailing line break: inside a multipart the final
+	// CRLF belongs to the next delimiter.
+	out = bytes.TrimSuffix(out, []byte("\r\n"))
+	if bytes.HasSuffix(content, []byte("\r\n")) {
+		out = append(out, "\r\n"...)
+	}
+	return out, true
+}
+
+// transformMultipart decorates every subpart when all is set, otherwise only
+// the first one.
+func (f *Footer) transformMultipart(content []byte, boundary string, all bool, depth int) ([]byte, bool) {
+	if boundary == "" || depth >= maxFooterDepth {
+		return content, false
+	}
+	parts := mimepart.Split(content, boundary)
+	if len(parts) == 0 {
+		return content, false
+	}
+	if !all {
+		parts = parts[:1]
+	}
+
+	changed := false
+	out, _ := mimepart.Replace(content, parts, func(p mimepart.Part) ([]byte, error) {
+		raw := content[p.Start:p.End]
+		headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+		if bytes.HasPrefix(raw, []byte("\r\n")) {
+			headerEnd = -2 // no header fields: body follows the first CRLF
+		} else if headerEnd == -1 {
+			return raw, nil
+		}
+		var contentType, encoding string
+		if headerEnd > 0 {
+			for _, h := range parseHeaders(raw[:headerEnd]) {
+				switch h.name {
+				case "content-type":
+					contentType = toField(h).Value
+				case "content-transfer-encoding":
+					encoding = toField(h).Value
+				}
+			}
+		}
+		bodyStart := headerEnd + 4
+		body, ok := f.transform(contentType, encoding, raw[bodyStart:], depth+1)
+		if !ok {
+			return raw, nil
+		}
+		changed = true
+		return append(raw[:bodyStart:bodyStart], body...), nil
+	})
+	if !changed {
+		return content, false
+	}
+	return out, true
+}
+
+// decodeBody undoes a Content-Transfer-Encoding. Unknown encodings report
+// false.
+func decodeBody(content []byte, encoding string) ([]byte, bool) {
+	switch encoding {
+	case "", "7bit", "8bit", "binary":
+		return content, true
+	case "quoted-printable":
+		text, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+		return text, err == nil
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, content)
+		text, err := base64.StdEncoding.DecodeString(string(clean))
+		return text, err == nil
+	}
+	return nil, false
+}
+
+// encodeBody applies a Content-Transfer-Encoding decodeBody accepted.
+func encodeBody(text []byte, encoding string) []byte {
+	var buf bytes.Buffer
+	switch encoding {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&buf)
+		_, _ = w.Write(text)
+		_ = w.Close()
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(text)
+		for len(encoded) > 76 {
+			buf.WriteString(encoded[:76])
+			buf.WriteString("\r\n")
+			encoded = encoded[76:]
+		}
+		buf.WriteString(encoded)
+		buf.WriteString("\r\n")
+	default:
+		return text
+	}
+	return buf.Bytes()
+}
+
+// appendFooter adds footer after a blank line, keeping CRLF line endings.
+func appendFooter(text []byte, footer string) []byte {
+	var buf bytes.Buffer
+	buf.Write(text)
+	if len(text) > 0 && !bytes.HasSuffix(text, []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(crlf(footer))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// insertHTMLFooter places footer before the last </body>, or at the end of
+// documents without one.
+func insertHTMLFooter(text []byte, footer string) []byte {
+	i := bytes.LastIndex(bytes.ToLower(text), []byte("</body>"))
+	if i == -1 {
+		return appendFooter(text, footer)
+	}
+	var buf bytes.Buffer
+	buf.Write(text[:i])
+	buf.WriteString(crlf(footer))
+	buf.WriteString("\r\n")
+	buf.Write(text[i:])
+	return buf.Bytes()
+}
+
+// textToHTML renders a plaintext footer as an HTML paragraph.
+func textToHTML(text string) string {
+	if text == "" {
+		return ""
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = html.EscapeString(l)
+	}
+	return "<p>" + strings.Join(lines, "<br>\n") + "</p>"
+}
+
+// utf8Compatible reports whether footer can be added to a part in charset.
+// ASCII footers fit any ASCII-compatible charset; anything else needs a
+// part declared as UTF-8.
+func utf8Compatible(charset, footer string) bool {
+	if isASCII(footer) {
+		return true
+	}
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8":
+		return utf8.ValidString(footer)
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
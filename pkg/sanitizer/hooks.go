@@ -0,0 +1,111 @@
+package sanitizer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// MessageIDGenerator produces the Message-ID for a sanitized message.
+// MessageID returns the msg-id including angle brackets, e.g.
+// "<0f8fad5b-d9cb-469f-a165-70867728950e@example.com>".
+type MessageIDGenerator interface {
+	MessageID(domain string) string
+}
+
+// MessageIDFunc adapts a function to MessageIDGenerator.
+type MessageIDFunc func(domain string) string
+
+func (f MessageIDFunc) MessageID(domain string) string { return f(domain) }
+
+// Field is a single unfolded header field.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// HeaderDecorator adds header fields to a sanitized message. Decorate
+// receives the fields that survived sanitization, in order, and returns
+// fields to append after them.
+type HeaderDecorator interface {
+	Decorate(existing []Field) []Field
+}
+
+// HeaderDecoratorFunc adapts a function to HeaderDecorator.
+type HeaderDecoratorFunc func(existing []Field) []Field
+
+func (f HeaderDecoratorFunc) Decorate(existing []Field) []Field { return f(existing) }
+
+// DefaultMessageID is the built-in generator: <uuid@domain>, with a random
+// (version 4) UUID from crypto/rand, so IDs can neither collide nor be
+// predicted. Generators that only want to change the domain can wrap it.
+var DefaultMessageID MessageIDGenerator = MessageIDFunc(func(domain string) string {
+	return "<" + newUUID() + "@" + domain + ">"
+})
+
+// newUUID returns a random RFC 9562 version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// toField unfolds a parsed header into a Field.
+func toField(h header) Field {
+	value := bytes.Join(h.lines, []byte(" "))
+	name, rest, _ := bytes.Cut(value, []byte(":"))
+	return Field{
+		Name:  string(bytes.TrimSpace(name)),
+		Value: strings.Join(strings.Fields(string(rest)), " "),
+	}
+}
+
+// writeField writes a generated field, guarding against header injection:
+// fields with an invalid name are dropped and the value is passed through
+// HeaderValue.
+func writeField(buf *bytes.Buffer, f Field) {
+	if !validFieldName(f.Name) {
+		return
+	}
+	writeLine(buf, []byte(f.Name+": "+HeaderValue(f.Value)))
+}
+
+// HeaderValue makes s safe to write as a header field value: CR and LF
+// become spaces, so s cannot end the field and start another, and the
+// other control characters but tab are dropped.
+func HeaderValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r' || r == '\n':
+			return ' '
+		case r == '\t':
+			return r
+		case r < ' ' || r == 0x7f:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// hasControl reports whether s contains a control character other than
+// tab.
+func hasControl(s string) bool {
+	return strings.ContainsFunc(s, func(r rune) bool { return (r < ' ' && r != '\t') || r == 0x7f })
+}
+
+// validFieldName reports whether name is a non-empty RFC 5322 field-name:
+// printable US-ASCII excluding colon.
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
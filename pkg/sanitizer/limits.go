@@ -0,0 +1,52 @@
+package sanitizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrHeaderTooLarge is returned by HeaderLimits.Check for a header over a
+// limit.
+var ErrHeaderTooLarge = errors.New("header exceeds limits")
+
+// HeaderLimits bounds the header section of a message. A zero field means
+// no limit.
+type HeaderLimits struct {
+	// MaxSize is the total size of the header in bytes, line endings
+	// included.
+	MaxSize int
+	// MaxLineLength is the length of each physical line, continuation
+	// lines included, without its line ending.
+	MaxLineLength int
+	// MaxFields is the number of header fields.
+	MaxFields int
+}
+
+// Check reports whether the header of raw is within l, wrapping
+// ErrHeaderTooLarge if not. It scans the header in place, stopping at the
+// first limit exceeded, so an oversized header costs no allocations; run
+// it before anything splits the header into lines.
+func (l HeaderLimits) Check(raw []byte) error {
+	size, fields := 0, 0
+	for len(raw) > 0 {
+		line, rest, _ := bytes.Cut(raw, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+		if l.MaxLineLength > 0 && len(line) > l.MaxLineLength {
+			return fmt.Errorf("%w: line of %d bytes, limit %d", ErrHeaderTooLarge, len(line), l.MaxLineLength)
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			if fields++; l.MaxFields > 0 && fields > l.MaxFields {
+				return fmt.Errorf("%w: more than %d fields", ErrHeaderTooLarge, l.MaxFields)
+			}
+		}
+		if size += len(raw) - len(rest); l.MaxSize > 0 && size > l.MaxSize {
+			return fmt.Errorf("%w: more than %d bytes", ErrHeaderTooLarge, l.MaxSize)
+		}
+		raw = rest
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package sanitizer
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+)
+
+// MessageIDPolicy selects what happens to the client's Message-ID.
+type MessageIDPolicy string
+
+const (
+	// MessageIDReplace always generates a new Message-ID (the default).
+	MessageIDReplace MessageIDPolicy = "replace"
+	// MessageIDPreserve keeps the client's Message-ID, generating one only
+	// when it is missing.
+	MessageIDPreserve MessageIDPolicy = "preserve"
+	// MessageIDReplaceKeepOriginal generates a new Message-ID and records
+	// the client's in X-Original-Message-ID.
+	MessageIDReplaceKeepOriginal MessageIDPolicy = "replace-keep-original"
+)
+
+// maxThreadIDs bounds how many replaced Message-IDs a policy remembers
+// for rewriting References and In-Reply-To.
+const maxThreadIDs = 10000
+
+var msgIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// threadIDs remembers the Message-IDs a policy replaced, oldest first, so
+// later messages in the same thread can refer to the new IDs.
+type threadIDs struct {
+	mu    sync.Mutex
+	size  int
+	ids   map[string]string
+	order []string
+}
+
+func newThreadIDs(size int) *threadIDs {
+	return &threadIDs{size: size, ids: make(map[string]string)}
+}
+
+func (t *threadIDs) add(original, replacement string) {
+	if original == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.ids[original]; !ok {
+		t.order = append(t.order, original)
+	}
+	t.ids[original] = replacement
+	for len(t.order) > t.size {
+		delete(t.ids, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// rewrite replaces every remembered msg-id in lines, keeping the folding.
+func (t *threadIDs) rewrite(lines [][]byte) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([][]byte, len(lines))
+	for i, l := range lines {
+		out[i] = msgIDPattern.ReplaceAllFunc(l, func(id []byte) []byte {
+			if repl, ok := t.ids[string(id)]; ok {
+				return []byte(repl)
+			}
+			return id
+		})
+	}
+	return out
+}
+
+// originalMessageID returns the msg-id of a Message-ID field, or its whole
+// value when it has no angle brackets.
+func originalMessageID(h header) string {
+	value := toField(h).Value
+	if id := msgIDPattern.FindString(value); id != "" {
+		return id
+	}
+	return string(bytes.TrimSpace([]byte(value)))
+}
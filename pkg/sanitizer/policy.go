@@ -0,0 +1,132 @@
+package sanitizer
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Policy is a validated, immutable set of sanitizer options. It is compiled
+// once at startup so a bad setting fails there, with the offending rule
+// named, rather than on the first message that reaches it. A nil *Policy
+// sanitizes with the defaults.
+type Policy struct {
+	opts Options
+}
+
+// Compile validates opts and returns the policy built from them. Every
+// problem found is reported, each prefixed with the rule it belongs to.
+func Compile(opts Options) (*Policy, error) {
+	var errs []error
+
+	switch opts.Received {
+	case "", ReceivedStrip, ReceivedSummarize:
+	case ReceivedCap:
+		if opts.MaxReceivedHops < 1 {
+			errs = append(errs, fmt.Errorf("received: max hops must be at least 1 with policy %q", opts.Received))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("received: unknown policy %q", opts.Received))
+	}
+
+	switch opts.MessageIDPolicy {
+	case "", MessageIDReplace, MessageIDReplaceKeepOriginal:
+		if opts.RewriteReferences {
+			opts.threads = newThreadIDs(maxThreadIDs)
+		}
+	case MessageIDPreserve:
+		// IDs are never replaced, so references stay valid
+	default:
+		errs = append(errs, fmt.Errorf("message_id: unknown policy %q", opts.MessageIDPolicy))
+	}
+
+	switch opts.Duplicates {
+	case "", DuplicateKeepFirst, DuplicateKeepLast, DuplicateReject:
+	default:
+		errs = append(errs, fmt.Errorf("duplicates: unknown policy %q", opts.Duplicates))
+	}
+
+	for i, d := range opts.Decorators {
+		if d == nil {
+			errs = append(errs, fmt.Errorf("decorators[%d]: nil decorator", i))
+		}
+	}
+
+	if f := opts.Footer; f != nil {
+		if !utf8.ValidString(f.Text) {
+			errs = append(errs, errors.New("footer: text is not valid UTF-8"))
+		}
+		if !utf8.ValidString(f.HTML) {
+			errs = append(errs, errors.New("footer: html is not valid UTF-8"))
+		}
+		// Render the HTML fallback now rather than per message
+		compiled := *f
+		if compiled.HTML == "" {
+			compiled.HTML = textToHTML(compiled.Text)
+		}
+		opts.Footer = &compiled
+	}
+
+	switch p := opts.SubjectPrefix; {
+	case strings.ContainsAny(p, "\r\n"):
+		errs = append(errs, errors.New("subject_prefix: must be a single line"))
+	case hasControl(p):
+		errs = append(errs, errors.New("subject_prefix: must not contain control characters"))
+	case !utf8.ValidString(p):
+		errs = append(errs, errors.New("subject_prefix: not valid UTF-8"))
+	case !isASCII(p):
+		// Non-ASCII header text must be an RFC 2047 encoded-word
+		opts.SubjectPrefix = mime.QEncoding.Encode("utf-8", p)
+	}
+
+	for _, list := range []struct {
+		field string
+		names []string
+	}{{"strip", opts.Strip}, {"keep", opts.Keep}} {
+		for i, name := range list.names {
+			switch {
+			case !validFieldName(name):
+				errs = append(errs, fmt.Errorf("%s[%d]: invalid header name %q", list.field, i, name))
+			case strings.EqualFold(name, "Received"):
+				errs = append(errs, fmt.Errorf("%s[%d]: Received is governed by the received policy", list.field, i))
+			}
+		}
+	}
+
+	for i, r := range opts.HeaderRules {
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("headers[%d] %s: %w", i, r.Name, err))
+		}
+	}
+
+	opts.Rewrites = slices.Clone(opts.Rewrites)
+	for i := range opts.Rewrites {
+		r := &opts.Rewrites[i]
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("rewrite[line %d] %s %s: %w", r.Line, r.Action, r.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	opts.Decorators = slices.Clone(opts.Decorators)
+	opts.HeaderRules = slices.Clone(opts.HeaderRules)
+	opts.Strip = slices.Clone(opts.Strip)
+	opts.Keep = slices.Clone(opts.Keep)
+	return &Policy{opts: opts}, nil
+}
+
+// Sanitize applies the policy to raw, expanding header rules with vars.
+// See SanitizeMessage.
+func (p *Policy) Sanitize(raw []byte, domain string, vars Vars) []byte {
+	if p == nil {
+		return Sanitize(raw, domain, Options{})
+	}
+	opts := p.opts
+	opts.Vars = vars
+	return Sanitize(raw, domain, opts)
+}
@@ -0,0 +1,77 @@
+package sanitizer
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Profile is a named bundle of the choices that decide how much of the
+// client's identity a message keeps: the Received handling, the
+// Message-ID policy and the default-stripped fields passed through.
+type Profile string
+
+const (
+	// ProfileAnonymize hides the source: the defaults, with the Received
+	// chain stripped and the Message-ID replaced.
+	ProfileAnonymize Profile = "anonymize"
+	// ProfileTransparent relays the client's header as sent: the whole
+	// Received chain, the Message-ID and the identifying fields are kept.
+	// Bcc, delivery fields and proxy control fields are still stripped.
+	ProfileTransparent Profile = "transparent"
+	// ProfileCompliance hides the source but keeps an audit trail: the
+	// Received chain is summarized and the original Message-ID is kept
+	// in X-Original-Message-ID.
+	ProfileCompliance Profile = "compliance"
+)
+
+// alwaysStripped are the default-stripped fields that even
+// ProfileTransparent removes: blind copies, fields set at final delivery,
+// and the proxy's own control and result fields.
+var alwaysStripped = map[string]bool{
+	"received":           true, // governed by the Received policy
+	"bcc":                true,
+	"resent-bcc":         true,
+	"return-path":        true,
+	"delivered-to":       true,
+	"x-ordering-key":     true,
+	"x-idempotency-key":  true,
+	"x-smtp-proxy-route": true,
+	"x-debug":            true,
+	"x-abuse-score":      true,
+	"x-proxy-queue-id":   true,
+}
+
+// ParseProfile validates a profile name.
+func ParseProfile(s string) (Profile, error) {
+	switch p := Profile(s); p {
+	case ProfileAnonymize, ProfileTransparent, ProfileCompliance:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown profile %q (must be anonymize, transparent or compliance)", s)
+	}
+}
+
+// Apply sets the options p governs, replacing Received,
+// MessageIDPolicy and Keep. Only ProfileTransparent passes the Received
+// chain through; there is no policy name for that. Strip lists are left alone, so fields an
+// operator strips explicitly stay stripped under every profile.
+func (p Profile) Apply(opts *Options) {
+	opts.Keep, opts.keepReceived = nil, false
+	switch p {
+	case ProfileAnonymize:
+		opts.Received = ReceivedStrip
+		opts.MessageIDPolicy = MessageIDReplace
+	case ProfileTransparent:
+		opts.Received, opts.keepReceived = "", true
+		opts.MessageIDPolicy = MessageIDPreserve
+		for _, name := range slices.Sorted(maps.Keys(stripHeaders)) {
+			if !alwaysStripped[name] {
+				opts.Keep = append(opts.Keep, name)
+			}
+		}
+	case ProfileCompliance:
+		opts.Received = ReceivedSummarize
+		opts.MessageIDPolicy = MessageIDReplaceKeepOriginal
+	}
+}
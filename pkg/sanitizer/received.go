@@ -0,0 +1,98 @@
+package sanitizer
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ReceivedPolicy selects how the Received trace chain is handled.
+type ReceivedPolicy string
+
+const (
+	// ReceivedStrip removes every Received header (default).
+	ReceivedStrip ReceivedPolicy = "strip"
+	// ReceivedCap keeps only the MaxReceivedHops most recent hops.
+	ReceivedCap ReceivedPolicy = "cap"
+	// ReceivedSummarize replaces the chain with one X-Received-Summary
+	// header carrying the hop count and first/last timestamps, but no hosts.
+	ReceivedSummarize ReceivedPolicy = "summarize"
+)
+
+// ParseReceivedPolicy validates a policy name.
+func ParseReceivedPolicy(s string) (ReceivedPolicy, error) {
+	switch p := ReceivedPolicy(s); p {
+	case ReceivedStrip, ReceivedCap, ReceivedSummarize:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown Received policy %q (must be strip, cap, or summarize)", s)
+	}
+}
+
+// receivedFilter decides, header by header, what replaces each Received
+// header in the output. Received headers are prepended by each hop, so the
+// first one seen is the most recent.
+type receivedFilter struct {
+	opts    Options
+	seen    int
+	summary []byte
+}
+
+func newReceivedFilter(opts Options, headers []header) *receivedFilter {
+	f := &receivedFilter{opts: opts}
+	if opts.Received == ReceivedSummarize {
+		f.summary = summarizeReceived(headers)
+	}
+	return f
+}
+
+// next returns the lines to emit in place of one Received header.
+func (f *receivedFilter) next(lines [][]byte) [][]byte {
+	f.seen++
+	if f.opts.keepReceived {
+		return lines
+	}
+	switch f.opts.Received {
+	case ReceivedCap:
+		if f.seen <= f.opts.MaxReceivedHops {
+			return lines
+		}
+	case ReceivedSummarize:
+		if f.seen == 1 {
+			return [][]byte{f.summary}
+		}
+	}
+	return nil
+}
+
+// summarizeReceived builds the X-Received-Summary line for the chain.
+func summarizeReceived(headers []header) []byte {
+	var dates [][]byte
+	hops := 0
+	for _, h := range headers {
+		if h.name != "received" {
+			continue
+		}
+		hops++
+		if d := receivedDate(h.lines); len(d) > 0 {
+			dates = append(dates, d)
+		}
+	}
+
+	line := fmt.Appendf(nil, "X-Received-Summary: hops=%d", hops)
+	if len(dates) > 0 {
+		// Oldest hop is last in header order
+		line = fmt.Appendf(line, "; first=%s; last=%s", dates[len(dates)-1], dates[0])
+	}
+	return line
+}
+
+// receivedDate returns the timestamp after the final ';' of a Received
+// header (RFC 5322 section 3.6.7), or nil if there is none.
+func receivedDate(lines [][]byte) []byte {
+	value := bytes.Join(lines, []byte(" "))
+	semi := bytes.LastIndexByte(value, ';')
+	if semi < 0 {
+		return nil
+	}
+	return bytes.Join(bytes.Fields(value[semi+1:]), []byte(" "))
+}
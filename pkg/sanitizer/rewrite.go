@@ -0,0 +1,140 @@
+package sanitizer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteAction is what a RewriteRule does to a matching header field.
+type RewriteAction string
+
+const (
+	// RewriteDrop removes the field.
+	RewriteDrop RewriteAction = "drop"
+	// RewriteReplace replaces the matched part of the value with Arg,
+	// which may refer to submatches as $1 or ${name}.
+	RewriteReplace RewriteAction = "replace"
+	// RewriteRename renames the field to Arg, keeping its value.
+	RewriteRename RewriteAction = "rename"
+)
+
+// RewriteRule matches header fields whose name matches Name
+// (case-insensitive) and whose unfolded value matches Value, and applies
+// Action. Rules run in order on every field the client sent; each sees the
+// result of the ones before it. Rules take effect only in a compiled Policy.
+type RewriteRule struct {
+	Line   int // position in the rules file, used in errors
+	Action RewriteAction
+	Name   string
+	Value  string
+	Arg    string
+
+	name, value *regexp.Regexp
+}
+
+// ParseRewriteRules parses a rules file: one rule per line, blank lines and
+// "#" comments ignored.
+//
+//	drop    <name-regex> [<value-regex>]
+//	rename  <name-regex> <value-regex> <new-name>
+//	replace <name-regex> <value-regex> <replacement...>
+//
+// Regexes are checked by Compile.
+func ParseRewriteRules(text string) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		r := RewriteRule{Line: i + 1, Action: RewriteAction(fields[0]), Value: ".*"}
+		switch r.Action {
+		case RewriteDrop:
+			if len(fields) < 2 || len(fields) > 3 {
+				return nil, fmt.Errorf("line %d: expected drop <name-regex> [<value-regex>]", r.Line)
+			}
+			r.Name = fields[1]
+			if len(fields) == 3 {
+				r.Value = fields[2]
+			}
+		case RewriteRename:
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: expected rename <name-regex> <value-regex> <new-name>", r.Line)
+			}
+			r.Name, r.Value, r.Arg = fields[1], fields[2], fields[3]
+		case RewriteReplace:
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: expected replace <name-regex> <value-regex> <replacement>", r.Line)
+			}
+			r.Name, r.Value = fields[1], fields[2]
+			// The replacement is the rest of the line and may contain spaces
+			rest := strings.TrimSpace(line[len(fields[0]):])
+			rest = strings.TrimSpace(rest[len(fields[1]):])
+			r.Arg = strings.TrimSpace(rest[len(fields[2]):])
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q (must be drop, rename, or replace)", r.Line, fields[0])
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// compile fills in the rule's regexes.
+func (r *RewriteRule) compile() error {
+	var err error
+	if r.name, err = regexp.Compile("(?i)" + r.Name); err != nil {
+		return fmt.Errorf("name: %w", err)
+	}
+	if r.value, err = regexp.Compile(r.Value); err != nil {
+		return fmt.Errorf("value: %w", err)
+	}
+	switch r.Action {
+	case RewriteDrop, RewriteReplace:
+	case RewriteRename:
+		if !validFieldName(r.Arg) {
+			return errors.New("rename: invalid field name")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if strings.ContainsAny(r.Arg, "\r\n") {
+		return errors.New("argument must be a single line")
+	}
+	if hasControl(r.Arg) {
+		return errors.New("argument must not contain control characters")
+	}
+	return nil
+}
+
+// rewriteHeader runs the rules over h. It returns false if the field is
+// dropped.
+func rewriteHeader(rules []RewriteRule, h header) (header, bool) {
+	for _, r := range rules {
+		if r.name == nil {
+			continue // not compiled
+		}
+		f := toField(h)
+		if !r.name.MatchString(f.Name) || !r.value.MatchString(f.Value) {
+			continue
+		}
+		switch r.Action {
+		case RewriteDrop:
+			return h, false
+		case RewriteReplace:
+			f.Value = r.value.ReplaceAllString(f.Value, r.Arg)
+		case RewriteRename:
+			f.Name = r.Arg
+		}
+		h = fieldHeader(f)
+	}
+	return h, true
+}
+
+// fieldHeader turns a rewritten field back into a single-line header.
+func fieldHeader(f Field) header {
+	line := f.Name + ": " + strings.NewReplacer("\r", " ", "\n", " ").Replace(f.Value)
+	return header{name: strings.ToLower(f.Name), lines: [][]byte{[]byte(line)}}
+}
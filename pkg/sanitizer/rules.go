@@ -0,0 +1,95 @@
+package sanitizer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HeaderRule adds a header field to every message. Value may reference
+// per-message variables as {name}; see Vars.
+type HeaderRule struct {
+	Name  string
+	Value string
+}
+
+// Vars carries the per-message values HeaderRule templates can use, and
+// the time used to backfill a missing Date.
+type Vars struct {
+	User       string    // {user}: authenticated client username
+	From       string    // {from}: client's original MAIL FROM
+	MsgID      string    // {msg_id}: correlation ID logged for the message
+	RemoteIP   string    // {remote_ip}: client address
+	ReceivedAt time.Time // when the proxy accepted the message; zero means now
+}
+
+func (v Vars) lookup(name string) (string, bool) {
+	switch name {
+	case "user":
+		return v.User, true
+	case "from":
+		return v.From, true
+	case "msg_id":
+		return v.MsgID, true
+	case "remote_ip":
+		return v.RemoteIP, true
+	}
+	return "", false
+}
+
+// expand renders a rule value. Unknown variables and unmatched braces are
+// kept verbatim; Compile reports them.
+func (r HeaderRule) expand(vars Vars) string {
+	var b strings.Builder
+	rest := r.Value
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open == -1 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			break
+		}
+		b.WriteString(rest[:open])
+		name := rest[open+1 : open+end]
+		if value, ok := vars.lookup(name); ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(rest[open : open+end+1])
+		}
+		rest = rest[open+end+1:]
+	}
+	b.WriteString(rest)
+	return b.String()
+}
+
+// validate checks the rule's field name and template variables.
+func (r HeaderRule) validate() error {
+	if !validFieldName(r.Name) {
+		return errors.New("invalid field name")
+	}
+	if strings.ContainsAny(r.Value, "\r\n") {
+		return errors.New("value must be a single line")
+	}
+	if hasControl(r.Value) {
+		return errors.New("value must not contain control characters")
+	}
+	rest := r.Value
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open == -1 {
+			return nil
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			return fmt.Errorf("unterminated variable in %q", r.Value)
+		}
+		name := rest[open+1 : open+end]
+		if _, ok := (Vars{}).lookup(name); !ok {
+			return fmt.Errorf("unknown variable {%s} (must be user, from, msg_id, or remote_ip)", name)
+		}
+		rest = rest[open+end+1:]
+	}
+}
@@ -0,0 +1,339 @@
+// Package sanitizer strips and rewrites message headers so relayed mail
+// does not reveal the client that submitted it.
+package sanitizer
+
+import (
+	"bytes"
+	"maps"
+	"strings"
+	"time"
+)
+
+// stripHeaders lists headers that reveal source/relay information.
+var stripHeaders = map[string]bool{
+	"received":                          true,
+	"x-mailer":                          true,
+	"x-originating-ip":                  true,
+	"x-sender":                          true,
+	"user-agent":                        true,
+	"x-google-dkim-signature":           true,
+	"x-gm-message-state":                true,
+	"x-google-smtp-source":              true,
+	"x-received":                        true,
+	"x-forwarded-to":                    true,
+	"x-forwarded-for":                   true,
+	"x-original-to":                     true,
+	"x-ms-exchange-organization-authas": true,
+	"x-ms-exchange-organization-authmechanism": true,
+	"x-ms-exchange-organization-authsource":    true,
+	"dkim-signature":                           true,
+	"arc-seal":                                 true,
+	"arc-message-signature":                    true,
+	"arc-authentication-results":               true,
+	"authentication-results":                   true,
+	"received-spf":                             true,
+	"return-path":                              true,
+	"delivered-to":                             true,
+	"x-spam-status":                            true,
+	"x-spam-score":                             true,
+	"x-spam-flag":                              true,
+	"x-ordering-key":                           true, // proxy control header
+	"x-idempotency-key":                        true, // proxy control header
+	"x-smtp-proxy-route":                       true, // proxy control header
+	"x-debug":                                  true, // proxy control header
+	"x-abuse-score":                            true, // set only by the proxy
+	"x-proxy-queue-id":                         true, // set only by the proxy
+	"bcc":                                      true, // blind copies must not reach recipients
+	"resent-bcc":                               true,
+}
+
+// StrippedHeaders returns a copy of the header fields stripped by default,
+// lowercase.
+func StrippedHeaders() map[string]bool {
+	return maps.Clone(stripHeaders)
+}
+
+// authHeaders are kept under Options.KeepAuthResults.
+var authHeaders = map[string]bool{
+	"authentication-results":     true,
+	"arc-seal":                   true,
+	"arc-message-signature":      true,
+	"arc-authentication-results": true,
+	"received-spf":               true,
+}
+
+// Options controls optional sanitizer behaviour. The zero value reproduces
+// the default: every Received header is stripped.
+type Options struct {
+	// Received selects how the Received chain is handled.
+	Received ReceivedPolicy
+	// MaxReceivedHops is the number of most recent hops kept under ReceivedCap.
+	MaxReceivedHops int
+	// MessageID generates the replacement Message-ID; nil uses
+	// DefaultMessageID.
+	MessageID MessageIDGenerator
+	// MessageIDPolicy selects whether the client's Message-ID is replaced;
+	// empty means MessageIDReplace.
+	MessageIDPolicy MessageIDPolicy
+	// RewriteReferences points References and In-Reply-To at the IDs that
+	// replaced earlier messages' Message-IDs, so threads survive
+	// replacement. It needs a compiled Policy, which remembers the IDs.
+	RewriteReferences bool
+	// Decorators append header fields after sanitization, in order.
+	Decorators []HeaderDecorator
+	// Footer, when non-nil, is appended to the message body.
+	Footer *Footer
+	// SubjectPrefix is inserted at the start of the Subject, e.g. "[staging]".
+	// It must already be a valid header value (see Compile).
+	SubjectPrefix string
+	// HeaderRules add header fields, expanded with Vars, before Decorators run.
+	HeaderRules []HeaderRule
+	// Vars are the per-message values for HeaderRules.
+	Vars Vars
+	// Rewrites drop, rename or edit client header fields, in order.
+	Rewrites []RewriteRule
+	// KeepAuthResults keeps Authentication-Results, Received-SPF and ARC
+	// header fields instead of stripping them, so an ARC seal can extend the
+	// chain.
+	KeepAuthResults bool
+	// Strip lists header fields to remove in addition to the defaults, and
+	// Keep default-stripped ones to pass through. Names are matched
+	// case-insensitively; Received is governed by Received instead.
+	Strip []string
+	Keep  []string
+	// Duplicates drops repeated From, Subject, Date and Content-Type
+	// fields under DuplicateKeepFirst or DuplicateKeepLast; the others
+	// leave them.
+	Duplicates DuplicatePolicy
+	// BackfillDate adds a Date header, set to Vars.ReceivedAt, to messages
+	// without one.
+	BackfillDate bool
+	// BackfillMIMEVersion adds "MIME-Version: 1.0" to messages without one.
+	BackfillMIMEVersion bool
+
+	threads      *threadIDs // set by Compile when RewriteReferences is on
+	keepReceived bool       // set by ProfileTransparent
+}
+
+// stripped reports whether the header field name (lowercase) is removed.
+func (o *Options) stripped(name string) bool {
+	for _, k := range o.Keep {
+		if strings.EqualFold(k, name) {
+			return false
+		}
+	}
+	if stripHeaders[name] && !(o.KeepAuthResults && authHeaders[name]) {
+		return true
+	}
+	for _, k := range o.Strip {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// header is a parsed header field with its folded continuation lines.
+type header struct {
+	name  string // lowercase
+	lines [][]byte
+}
+
+// SanitizeMessage strips source-identifying headers from an email message
+// and generates a new Message-ID. The message body passes through unmodified.
+// The domain parameter is used for generating the new Message-ID.
+func SanitizeMessage(raw []byte, domain string) []byte {
+	return Sanitize(raw, domain, Options{})
+}
+
+// Sanitize is SanitizeMessage with explicit options.
+func Sanitize(raw []byte, domain string, opts Options) []byte {
+	// Normalize line endings to \r\n
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+
+	// Split headers from body at the first blank line BEFORE normalizing body
+	headerEnd := bytes.Index(raw, []byte("\n\n"))
+	var headerPart, body []byte
+	if headerEnd == -1 {
+		headerPart = raw
+		body = nil
+	} else {
+		headerPart = raw[:headerEnd]
+		body = raw[headerEnd:] // includes the \n\n separator
+	}
+
+	// Only normalize headers to \r\n; leave body as-is then normalize it separately
+	headerPart = bytes.ReplaceAll(headerPart, []byte("\n"), []byte("\r\n"))
+	if body != nil {
+		body = bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))
+	}
+
+	headers := parseHeaders(headerPart)
+	if opts.Duplicates == DuplicateKeepFirst || opts.Duplicates == DuplicateKeepLast {
+		headers = dropDuplicates(headers, opts.Duplicates == DuplicateKeepLast)
+	}
+
+	// Rebuild headers, stripping blocked ones and replacing Message-ID
+	var result bytes.Buffer
+	messageIDFound := false
+	subjectFound := false
+	dateFound := false
+	mimeVersionFound := false
+	gen := opts.MessageID
+	if gen == nil {
+		gen = DefaultMessageID
+	}
+	newMessageID := Field{Name: "Message-ID", Value: gen.MessageID(domain)}
+	var kept []Field
+	var contentType, encoding string
+
+	received := newReceivedFilter(opts, headers)
+	for _, h := range headers {
+		if h.name == "received" {
+			out := received.next(h.lines)
+			for _, l := range out {
+				writeLine(&result, l)
+			}
+			if len(out) > 0 && len(opts.Decorators) > 0 {
+				kept = append(kept, toField(header{lines: out}))
+			}
+			continue
+		}
+		if len(opts.Rewrites) > 0 && h.name != "" {
+			var keep bool
+			if h, keep = rewriteHeader(opts.Rewrites, h); !keep {
+				continue
+			}
+		}
+		if opts.stripped(h.name) {
+			continue
+		}
+		switch h.name {
+		case "content-type":
+			contentType = toField(h).Value
+		case "content-transfer-encoding":
+			encoding = toField(h).Value
+		case "date":
+			dateFound = true
+		case "mime-version":
+			mimeVersionFound = true
+		}
+		if h.name == "subject" && opts.SubjectPrefix != "" {
+			h = prefixSubject(h, opts.SubjectPrefix)
+			subjectFound = true
+		}
+		if h.name == "message-id" && !messageIDFound {
+			messageIDFound = true
+			if opts.MessageIDPolicy == MessageIDPreserve {
+				for _, l := range h.lines {
+					writeLine(&result, l)
+				}
+				kept = append(kept, toField(h))
+				continue
+			}
+			original := originalMessageID(h)
+			if opts.threads != nil {
+				opts.threads.add(original, newMessageID.Value)
+			}
+			writeField(&result, newMessageID)
+			kept = append(kept, newMessageID)
+			if opts.MessageIDPolicy == MessageIDReplaceKeepOriginal {
+				f := Field{Name: "X-Original-Message-ID", Value: original}
+				writeField(&result, f)
+				kept = append(kept, f)
+			}
+			continue
+		}
+		if h.name == "message-id" {
+			continue // a second Message-ID is invalid; keep only the first
+		}
+		if h.name == "x-original-message-id" && opts.MessageIDPolicy == MessageIDReplaceKeepOriginal {
+			continue // only the proxy sets it in this mode
+		}
+		if (h.name == "references" || h.name == "in-reply-to") && opts.threads != nil {
+			h.lines = opts.threads.rewrite(h.lines)
+		}
+		for _, l := range h.lines {
+			writeLine(&result, l)
+		}
+		if len(opts.Decorators) > 0 {
+			kept = append(kept, toField(h))
+		}
+	}
+
+	if !messageIDFound {
+		writeField(&result, newMessageID)
+		kept = append(kept, newMessageID)
+	}
+	if !dateFound && opts.BackfillDate {
+		date := opts.Vars.ReceivedAt
+		if date.IsZero() {
+			date = time.Now()
+		}
+		f := Field{Name: "Date", Value: date.Format(time.RFC1123Z)}
+		writeField(&result, f)
+		kept = append(kept, f)
+	}
+	if !mimeVersionFound && opts.BackfillMIMEVersion {
+		f := Field{Name: "MIME-Version", Value: "1.0"}
+		writeField(&result, f)
+		kept = append(kept, f)
+	}
+	if !subjectFound && opts.SubjectPrefix != "" {
+		subject := Field{Name: "Subject", Value: opts.SubjectPrefix}
+		writeField(&result, subject)
+		kept = append(kept, subject)
+	}
+	for _, r := range opts.HeaderRules {
+		f := Field{Name: r.Name, Value: r.expand(opts.Vars)}
+		writeField(&result, f)
+		kept = append(kept, f)
+	}
+
+	for _, d := range opts.Decorators {
+		for _, f := range d.Decorate(kept) {
+			writeField(&result, f)
+		}
+	}
+
+	// Append body (includes the blank line separator)
+	if body != nil {
+		if opts.Footer != nil {
+			body = append([]byte("\r\n\r\n"), opts.Footer.apply(contentType, encoding, body[4:])...)
+		}
+		result.Write(body)
+	} else {
+		result.WriteString("\r\n")
+	}
+
+	return result.Bytes()
+}
+
+// parseHeaders splits a CRLF header block into fields, handling folded
+// continuation lines.
+func parseHeaders(headerPart []byte) []header {
+	lines := bytes.Split(headerPart, []byte("\r\n"))
+	var headers []header
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		// Continuation line (starts with space or tab)
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) > 0 {
+				headers[len(headers)-1].lines = append(headers[len(headers)-1].lines, line)
+			}
+			continue
+		}
+		// New header
+		colonIdx := bytes.IndexByte(line, ':')
+		if colonIdx <= 0 {
+			// Malformed header line (no colon or colon at position 0), keep it
+			headers = append(headers, header{name: "", lines: [][]byte{line}})
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(string(line[:colonIdx])))
+		headers = append(headers, header{name: name, lines: [][]byte{line}})
+	}
+	return headers
+}
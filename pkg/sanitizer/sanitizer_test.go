@@ -0,0 +1,1165 @@
+package sanitizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeMessage_StripsReceivedHeaders(t *testing.T) {
+	raw := "Received: from mail.example.com\r\n" +
+		"Received: from smtp.local\r\n" +
+		"From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Hello, World!"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if strings.Contains(result, "Received:") {
+		t.Error("expected Received headers to be stripped")
+	}
+	if !strings.Contains(result, "From: sender@example.com") {
+		t.Error("expected From header to be preserved")
+	}
+	if !strings.Contains(result, "To: recipient@example.com") {
+		t.Error("expected To header to be preserved")
+	}
+	if !strings.Contains(result, "Subject: Test") {
+		t.Error("expected Subject header to be preserved")
+	}
+	if !strings.Contains(result, "Hello, World!") {
+		t.Error("expected body to be preserved")
+	}
+}
+
+func TestSanitizeMessage_StripsSourceHeaders(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"X-Mailer: ThunderBird 91.0\r\n" +
+		"X-Originating-IP: 192.168.1.100\r\n" +
+		"User-Agent: Mozilla/5.0\r\n" +
+		"X-Google-DKIM-Signature: v=1\r\n" +
+		"DKIM-Signature: v=1; d=example.com\r\n" +
+		"Authentication-Results: spf=pass\r\n" +
+		"Received-SPF: pass (mx.source.com: 192.168.1.100 is permitted)\r\n" +
+		"Return-Path: <bounce@source.com>\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	stripExpected := []string{
+		"X-Mailer:",
+		"X-Originating-IP:",
+		"User-Agent:",
+		"X-Google-DKIM-Signature:",
+		"DKIM-Signature:",
+		"Authentication-Results:",
+		"Received-SPF:",
+		"Return-Path:",
+	}
+	for _, h := range stripExpected {
+		if strings.Contains(result, h) {
+			t.Errorf("expected %s to be stripped", h)
+		}
+	}
+}
+
+func TestSanitize_KeepAuthResults(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass\r\n" +
+		"Received-SPF: pass (mx.example.com: 192.0.2.1 is permitted)\r\n" +
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none\r\n" +
+		"DKIM-Signature: v=1; d=example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{KeepAuthResults: true}))
+
+	for _, h := range []string{"Authentication-Results:", "Received-SPF:", "ARC-Seal:"} {
+		if !strings.Contains(result, h) {
+			t.Errorf("expected %s to be kept", h)
+		}
+	}
+	if strings.Contains(result, "DKIM-Signature:") {
+		t.Error("expected DKIM-Signature to be stripped")
+	}
+}
+
+func TestSanitizeMessage_PreservesContentHeaders(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Cc: cc@example.com\r\n" +
+		"Subject: Important\r\n" +
+		"Date: Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"Reply-To: reply@example.com\r\n" +
+		"\r\n" +
+		"Content here"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	preserveExpected := []string{
+		"From: sender@example.com",
+		"To: recipient@example.com",
+		"Cc: cc@example.com",
+		"Subject: Important",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain",
+		"Content-Transfer-Encoding: 7bit",
+		"Reply-To: reply@example.com",
+	}
+	for _, h := range preserveExpected {
+		if !strings.Contains(result, h) {
+			t.Errorf("expected %s to be preserved", h)
+		}
+	}
+}
+
+func TestSanitizeMessage_GeneratesMessageID(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if !strings.Contains(result, "Message-ID: <") {
+		t.Error("expected Message-ID to be generated")
+	}
+	if !strings.Contains(result, "@proxy.local>") {
+		t.Error("expected Message-ID to use proxy domain")
+	}
+}
+
+func TestSanitizeMessage_ReplacesExistingMessageID(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Message-ID: <original@source.local>\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if strings.Contains(result, "original@source.local") {
+		t.Error("expected original Message-ID to be replaced")
+	}
+	if !strings.Contains(result, "@proxy.local>") {
+		t.Error("expected new Message-ID with proxy domain")
+	}
+	count := strings.Count(result, "Message-ID:")
+	if count != 1 {
+		t.Errorf("expected exactly 1 Message-ID, got %d", count)
+	}
+}
+
+func TestSanitizeMessage_HandlesFoldedHeaders(t *testing.T) {
+	raw := "Received: from mail.example.com\r\n" +
+		" by smtp.relay.com with ESMTP\r\n" +
+		" id abc123\r\n" +
+		"From: sender@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if strings.Contains(result, "mail.example.com") {
+		t.Error("expected folded Received header to be stripped")
+	}
+	if strings.Contains(result, "smtp.relay.com") {
+		t.Error("expected folded continuation lines to be stripped")
+	}
+	if !strings.Contains(result, "From: sender@example.com") {
+		t.Error("expected From header to be preserved")
+	}
+}
+
+func TestSanitizeMessage_FoldedHeaderWithColon(t *testing.T) {
+	raw := "Received: from mail.example.com\r\n" +
+		"\tby relay.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if strings.Contains(result, "relay.example.com") {
+		t.Error("expected folded continuation with colon to be stripped with parent header")
+	}
+	if !strings.Contains(result, "Subject: Test") {
+		t.Error("expected Subject to be preserved")
+	}
+}
+
+func TestSanitizeMessage_PreservesBody(t *testing.T) {
+	body := "This is a multiline\r\nbody with special chars: <>&\"\r\nand more lines."
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		body
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if !strings.Contains(result, body) {
+		t.Error("expected body to be preserved exactly")
+	}
+}
+
+func TestSanitizeMessage_BodyResemblingHeaders(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Received: this is body text, not a header\r\n" +
+		"X-Mailer: also body text"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if !strings.Contains(result, "Received: this is body text") {
+		t.Error("expected body text resembling headers to be preserved")
+	}
+	if !strings.Contains(result, "X-Mailer: also body text") {
+		t.Error("expected body text with X-Mailer to be preserved")
+	}
+}
+
+func TestSanitizeMessage_EmptyBody(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if !strings.Contains(result, "From: sender@example.com") {
+		t.Error("expected headers to be preserved")
+	}
+	if !strings.HasSuffix(result, "\r\n\r\n") {
+		t.Error("expected message to end with blank line separator")
+	}
+}
+
+func TestSanitizeMessage_HeadersOnly(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Test"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if !strings.Contains(result, "From: sender@example.com") {
+		t.Error("expected From header to be preserved")
+	}
+	if !strings.Contains(result, "Subject: Test") {
+		t.Error("expected Subject header to be preserved")
+	}
+}
+
+func TestSanitizeMessage_LFLineEndings(t *testing.T) {
+	raw := "Received: from mail.example.com\n" +
+		"From: sender@example.com\n" +
+		"Subject: Test\n" +
+		"\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if strings.Contains(result, "Received:") {
+		t.Error("expected Received header to be stripped with LF endings")
+	}
+	if !strings.Contains(result, "From: sender@example.com") {
+		t.Error("expected From header to be preserved")
+	}
+}
+
+func TestSanitizeMessage_CaseInsensitiveHeaders(t *testing.T) {
+	raw := "RECEIVED: from mail.example.com\r\n" +
+		"x-mailer: ThunderBird\r\n" +
+		"X-ORIGINATING-IP: 1.2.3.4\r\n" +
+		"From: sender@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"Body"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	if strings.Contains(result, "RECEIVED:") {
+		t.Error("expected uppercase RECEIVED to be stripped")
+	}
+	if strings.Contains(result, "x-mailer:") {
+		t.Error("expected lowercase x-mailer to be stripped")
+	}
+	if strings.Contains(result, "X-ORIGINATING-IP:") {
+		t.Error("expected X-ORIGINATING-IP to be stripped")
+	}
+}
+
+func TestSanitizeMessage_UniqueMessageIDs(t *testing.T) {
+	raw := "From: sender@example.com\r\nSubject: Test\r\n\r\nBody"
+
+	result1 := string(SanitizeMessage([]byte(raw), "proxy.local"))
+	result2 := string(SanitizeMessage([]byte(raw), "proxy.local"))
+
+	// Extract Message-IDs
+	extractMsgID := func(s string) string {
+		start := strings.Index(s, "Message-ID: <")
+		if start == -1 {
+			return ""
+		}
+		end := strings.Index(s[start:], ">")
+		if end == -1 {
+			return ""
+		}
+		return s[start : start+end+1]
+	}
+
+	id1 := extractMsgID(result1)
+	id2 := extractMsgID(result2)
+
+	if id1 == "" || id2 == "" {
+		t.Fatal("expected both messages to have Message-IDs")
+	}
+	if id1 == id2 {
+		t.Error("expected different Message-IDs for different calls")
+	}
+}
+
+const receivedChain = "Received: from relay2.internal (10.0.0.2)\r\n" +
+	"\tby edge.example.com; Tue, 2 Jan 2024 10:00:05 +0000\r\n" +
+	"Received: from relay1.internal (10.0.0.1); Tue, 2 Jan 2024 10:00:03 +0000\r\n" +
+	"Received: from app.internal (10.0.0.9); Tue, 2 Jan 2024 10:00:00 +0000\r\n" +
+	"From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Body"
+
+func TestSanitize_ReceivedCap(t *testing.T) {
+	result := string(Sanitize([]byte(receivedChain), "proxy.local", Options{Received: ReceivedCap, MaxReceivedHops: 2}))
+
+	if strings.Count(result, "Received:") != 2 {
+		t.Fatalf("expected 2 Received headers, got:\n%s", result)
+	}
+	// The most recent hops are kept, including folded lines
+	if !strings.Contains(result, "relay2.internal") || !strings.Contains(result, "\tby edge.example.com") {
+		t.Error("expected most recent hop to be kept intact")
+	}
+	if !strings.Contains(result, "relay1.internal") {
+		t.Error("expected second most recent hop to be kept")
+	}
+	if strings.Contains(result, "app.internal") {
+		t.Error("expected oldest hop to be dropped")
+	}
+}
+
+func TestSanitize_ReceivedSummarize(t *testing.T) {
+	result := string(Sanitize([]byte(receivedChain), "proxy.local", Options{Received: ReceivedSummarize}))
+
+	if strings.Contains(result, "Received:") {
+		t.Error("expected Received headers to be replaced")
+	}
+	if strings.Contains(result, "internal") || strings.Contains(result, "10.0.0.") {
+		t.Error("expected summary to hide hosts and addresses")
+	}
+	want := "X-Received-Summary: hops=3; first=Tue, 2 Jan 2024 10:00:00 +0000; last=Tue, 2 Jan 2024 10:00:05 +0000\r\n"
+	if !strings.Contains(result, want) {
+		t.Errorf("expected summary %q, got:\n%s", want, result)
+	}
+	if !strings.HasPrefix(result, "X-Received-Summary:") {
+		t.Error("expected summary in place of the chain")
+	}
+}
+
+func TestSanitize_ReceivedSummarizeNoChain(t *testing.T) {
+	raw := "From: sender@example.com\r\nSubject: Test\r\n\r\nBody"
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Received: ReceivedSummarize}))
+	if strings.Contains(result, "X-Received-Summary") {
+		t.Error("expected no summary when there is no Received chain")
+	}
+}
+
+func TestParseReceivedPolicy(t *testing.T) {
+	for _, name := range []string{"strip", "cap", "summarize"} {
+		if _, err := ParseReceivedPolicy(name); err != nil {
+			t.Errorf("unexpected error for %q: %v", name, err)
+		}
+	}
+	if _, err := ParseReceivedPolicy("keep"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestSanitizeMessage_StripsOrderingKey(t *testing.T) {
+	raw := "From: sender@example.com\r\nX-Ordering-Key: invoices\r\nSubject: Test\r\n\r\nBody"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+	if strings.Contains(result, "X-Ordering-Key") {
+		t.Error("expected X-Ordering-Key control header to be stripped")
+	}
+}
+
+func TestDefaultMessageID_Format(t *testing.T) {
+	pattern := regexp.MustCompile(`^<[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}@proxy\.local>$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := DefaultMessageID.MessageID("proxy.local")
+		if !pattern.MatchString(id) {
+			t.Fatalf("expected <uuidv4@domain>, got %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate Message-ID %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSanitize_CustomMessageID(t *testing.T) {
+	raw := "From: sender@example.com\r\nMessage-ID: <orig@source.com>\r\n\r\nBody"
+	gen := MessageIDFunc(func(domain string) string { return "<fixed@" + domain + ">" })
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{MessageID: gen}))
+	if !strings.Contains(result, "Message-ID: <fixed@proxy.local>\r\n") {
+		t.Errorf("expected custom Message-ID, got:\n%s", result)
+	}
+	if strings.Contains(result, "orig@source.com") {
+		t.Error("expected original Message-ID to be replaced")
+	}
+}
+
+func TestSanitize_HeaderDecorators(t *testing.T) {
+	raw := "From: sender@example.com\r\nSubject: Hello\r\n\tWorld\r\n\r\nBody"
+
+	var seen []Field
+	decorator := HeaderDecoratorFunc(func(existing []Field) []Field {
+		seen = existing
+		return []Field{
+			{Name: "X-Tenant", Value: "acme"},
+			{Name: "X-Injected", Value: "a\r\nBcc: victim@example.com"},
+			{Name: "Bad Name", Value: "dropped"},
+		}
+	})
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Decorators: []HeaderDecorator{decorator}}))
+
+	if !strings.Contains(result, "X-Tenant: acme\r\n") {
+		t.Error("expected decorator header to be added")
+	}
+	if strings.Contains(result, "\r\nBcc:") {
+		t.Error("expected CRLF in decorator value to be neutralized")
+	}
+	if strings.Contains(result, "Bad Name") {
+		t.Error("expected invalid field name to be dropped")
+	}
+	// Decorators run before the body separator
+	if strings.Index(result, "X-Tenant") > strings.Index(result, "\r\n\r\n") {
+		t.Error("expected decorator headers in the header block")
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("expected decorator to see From, Subject and Message-ID, got %v", seen)
+	}
+	if seen[1] != (Field{Name: "Subject", Value: "Hello World"}) {
+		t.Errorf("expected unfolded Subject, got %+v", seen[1])
+	}
+	if seen[2].Name != "Message-ID" {
+		t.Errorf("expected generated Message-ID to be visible, got %+v", seen[2])
+	}
+}
+
+func TestSanitize_FooterPlainText(t *testing.T) {
+	raw := "From: sender@example.com\r\nSubject: Hi\r\n\r\nHello there"
+	footer := &Footer{Text: "Confidential.\nDo not forward."}
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Footer: footer}))
+
+	if !strings.HasSuffix(result, "\r\n\r\nHello there\r\n\r\nConfidential.\r\nDo not forward.") {
+		t.Errorf("expected footer appended to body, got %q", result)
+	}
+}
+
+func TestSanitize_FooterMultipartAlternative(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=C3=A9 menu\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PGh0bWw+PGJvZHk+PHA+SGk8L3A+PC9ib2R5PjwvaHRtbD4=\r\n" +
+		"--b1--\r\n"
+	footer := &Footer{Text: "Legal <notice>"}
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Footer: footer}))
+
+	if !strings.Contains(result, "Caf=C3=A9 menu\r\n\r\nLegal <notice>\r\n--b1\r\n") {
+		t.Errorf("expected footer in quoted-printable text part, got %q", result)
+	}
+	// The HTML part stays base64 and gains the escaped footer before </body>
+	start := strings.Index(result, "base64\r\n\r\n") + len("base64\r\n\r\n")
+	end := strings.Index(result, "--b1--")
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(result[start:end], "\r\n", ""))
+	if err != nil {
+		t.Fatalf("expected valid base64 HTML part: %v", err)
+	}
+	if string(decoded) != "<html><body><p>Hi</p><p>Legal &lt;notice&gt;</p>\r\n</body></html>" {
+		t.Errorf("unexpected HTML part: %q", decoded)
+	}
+}
+
+func TestSanitize_FooterMixedFirstPartOnly(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Body\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; name=notes.txt\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"\r\n" +
+		"Attachment\r\n" +
+		"--outer--\r\n"
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Footer: &Footer{Text: "Footer"}}))
+
+	if strings.Count(result, "Footer") != 1 || !strings.Contains(result, "Body\r\n\r\nFooter\r\n--outer\r\n") {
+		t.Errorf("expected footer on the first part only, got %q", result)
+	}
+}
+
+func TestSanitize_FooterSkipsSignedAndIncompatible(t *testing.T) {
+	signed := "Content-Type: multipart/signed; boundary=s; protocol=\"application/pkcs7-signature\"\r\n" +
+		"\r\n--s\r\nContent-Type: text/plain\r\n\r\nSigned\r\n--s--\r\n"
+	result := string(Sanitize([]byte(signed), "proxy.local", Options{Footer: &Footer{Text: "Footer"}}))
+	if strings.Contains(result, "Footer") {
+		t.Error("expected signed message to be left alone")
+	}
+
+	latin1 := "Content-Type: text/plain; charset=iso-8859-1\r\n\r\nBody"
+	result = string(Sanitize([]byte(latin1), "proxy.local", Options{Footer: &Footer{Text: "Vertraulich – nicht weiterleiten"}}))
+	if strings.Contains(result, "Vertraulich") {
+		t.Error("expected non-ASCII footer to skip a non-UTF-8 part")
+	}
+}
+
+func TestCompile(t *testing.T) {
+	_, err := Compile(Options{Received: ReceivedCap, Footer: &Footer{HTML: "\xff"}})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"received: max hops", "footer: html"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in error, got %v", want, err)
+		}
+	}
+
+	footer := &Footer{Text: "Notice"}
+	p, err := Compile(Options{Footer: footer})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Later changes to the options do not leak into the compiled policy
+	footer.Text = "Changed"
+	result := string(p.Sanitize([]byte("Content-Type: text/html\r\n\r\n<body>Hi</body>"), "proxy.local", Vars{}))
+	if !strings.Contains(result, "<p>Notice</p>") {
+		t.Errorf("expected compiled HTML footer, got %q", result)
+	}
+
+	var nilPolicy *Policy
+	if !strings.Contains(string(nilPolicy.Sanitize([]byte("Subject: x\r\n\r\nBody"), "proxy.local", Vars{})), "Message-ID:") {
+		t.Error("expected nil policy to sanitize with defaults")
+	}
+}
+
+func TestSanitize_SubjectPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"plain", "Subject: Hello\r\n\r\nBody", "Subject: [staging] Hello\r\n"},
+		{"folded", "Subject: Hello\r\n World\r\n\r\nBody", "Subject: [staging] Hello\r\n World\r\n"},
+		{"already tagged", "Subject: [staging] Re: Hello\r\n\r\nBody", "Subject: [staging] Re: Hello\r\n"},
+		{"missing", "From: a@example.com\r\n\r\nBody", "Subject: [staging]\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := string(Sanitize([]byte(tt.raw), "proxy.local", Options{SubjectPrefix: "[staging]"}))
+			if !strings.Contains(result, tt.want) {
+				t.Errorf("expected %q in %q", tt.want, result)
+			}
+		})
+	}
+}
+
+func TestSanitize_Backfill(t *testing.T) {
+	received := time.Date(2026, 3, 14, 9, 26, 53, 0, time.FixedZone("", 2*60*60))
+	opts := Options{BackfillDate: true, BackfillMIMEVersion: true, Vars: Vars{ReceivedAt: received}}
+
+	result := string(Sanitize([]byte("Subject: Reading\r\n\r\n21.5C"), "proxy.local", opts))
+	if !strings.Contains(result, "Date: Sat, 14 Mar 2026 09:26:53 +0200\r\n") {
+		t.Errorf("expected Date from ReceivedAt, got %q", result)
+	}
+	if !strings.Contains(result, "MIME-Version: 1.0\r\n") {
+		t.Errorf("expected MIME-Version, got %q", result)
+	}
+
+	// Client headers are kept as sent
+	raw := "Date: Fri, 13 Mar 2026 08:00:00 +0000\r\nMime-Version: 1.0 (Generated)\r\nSubject: Hi\r\n\r\nBody"
+	result = string(Sanitize([]byte(raw), "proxy.local", opts))
+	if strings.Count(result, "Date:") != 1 || !strings.Contains(result, "Date: Fri, 13 Mar 2026") {
+		t.Errorf("expected client Date kept, got %q", result)
+	}
+	if strings.Count(strings.ToLower(result), "mime-version:") != 1 {
+		t.Errorf("expected client MIME-Version kept, got %q", result)
+	}
+
+	// Each backfill is independent, and both are off by default
+	result = string(Sanitize([]byte("Subject: Hi\r\n\r\nBody"), "proxy.local", Options{BackfillMIMEVersion: true}))
+	if strings.Contains(result, "Date:") || !strings.Contains(result, "MIME-Version: 1.0") {
+		t.Errorf("expected only MIME-Version, got %q", result)
+	}
+	result = string(SanitizeMessage([]byte("Subject: Hi\r\n\r\nBody"), "proxy.local"))
+	if strings.Contains(result, "Date:") || strings.Contains(result, "MIME-Version:") {
+		t.Errorf("expected no backfill by default, got %q", result)
+	}
+
+	// Without ReceivedAt the current time is used
+	before := time.Now().Add(-time.Second)
+	result = string(Sanitize([]byte("Subject: Hi\r\n\r\nBody"), "proxy.local", Options{BackfillDate: true}))
+	_, rest, _ := strings.Cut(result, "Date: ")
+	value, _, _ := strings.Cut(rest, "\r\n")
+	if date, err := time.Parse(time.RFC1123Z, value); err != nil || date.Before(before) {
+		t.Errorf("expected current Date, got %q (%v)", value, err)
+	}
+}
+
+func TestSanitize_MessageIDPolicy(t *testing.T) {
+	gen := MessageIDFunc(func(string) string { return "<new@proxy.local>" })
+	raw := "Message-ID: <orig@client.local>\r\nSubject: Hi\r\n\r\nBody"
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{MessageID: gen}))
+	if !strings.Contains(result, "Message-ID: <new@proxy.local>\r\n") || strings.Contains(result, "orig@") {
+		t.Errorf("replace: unexpected result %q", result)
+	}
+
+	result = string(Sanitize([]byte(raw), "proxy.local", Options{MessageID: gen, MessageIDPolicy: MessageIDPreserve}))
+	if !strings.Contains(result, "Message-ID: <orig@client.local>\r\n") || strings.Contains(result, "new@") {
+		t.Errorf("preserve: unexpected result %q", result)
+	}
+	result = string(Sanitize([]byte("Subject: Hi\r\n\r\nBody"), "proxy.local", Options{MessageID: gen, MessageIDPolicy: MessageIDPreserve}))
+	if !strings.Contains(result, "Message-ID: <new@proxy.local>\r\n") {
+		t.Errorf("preserve: expected generated ID when missing, got %q", result)
+	}
+
+	spoofed := "X-Original-Message-ID: <forged@client.local>\r\n" + raw
+	result = string(Sanitize([]byte(spoofed), "proxy.local", Options{MessageID: gen, MessageIDPolicy: MessageIDReplaceKeepOriginal}))
+	if !strings.Contains(result, "Message-ID: <new@proxy.local>\r\nX-Original-Message-ID: <orig@client.local>\r\n") || strings.Contains(result, "forged") {
+		t.Errorf("replace-keep-original: unexpected result %q", result)
+	}
+
+	if _, err := Compile(Options{MessageIDPolicy: "keep"}); err == nil || !strings.Contains(err.Error(), "message_id") {
+		t.Errorf("expected message_id error, got %v", err)
+	}
+}
+
+func TestProfile_Apply(t *testing.T) {
+	gen := MessageIDFunc(func(string) string { return "<new@proxy.local>" })
+	raw := "Received: from a by b; Tue, 2 Jan 2024 10:00:05 +0000\r\n" +
+		"Received: from c by a; Tue, 2 Jan 2024 10:00:00 +0000\r\n" +
+		"Message-ID: <orig@client.local>\r\n" +
+		"X-Mailer: Outlook\r\n" +
+		"Bcc: hidden@example.com\r\n" +
+		"X-Debug: 1\r\n" +
+		"Subject: Hi\r\n\r\nBody"
+	sanitize := func(p Profile) string {
+		t.Helper()
+		opts := Options{MessageID: gen, Received: ReceivedCap, MaxReceivedHops: 1, Keep: []string{"x-debug"}}
+		p.Apply(&opts)
+		policy, err := Compile(opts)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		return string(policy.Sanitize([]byte(raw), "proxy.local", Vars{}))
+	}
+
+	result := sanitize(ProfileAnonymize)
+	for _, gone := range []string{"Received:", "orig@", "X-Mailer", "Bcc", "X-Debug"} {
+		if strings.Contains(result, gone) {
+			t.Errorf("anonymize: expected %q stripped, got %q", gone, result)
+		}
+	}
+
+	result = sanitize(ProfileTransparent)
+	for _, kept := range []string{"Received: from a by b", "Received: from c by a", "Message-ID: <orig@client.local>\r\n", "X-Mailer: Outlook\r\n"} {
+		if !strings.Contains(result, kept) {
+			t.Errorf("transparent: expected %q kept, got %q", kept, result)
+		}
+	}
+	for _, gone := range []string{"Bcc", "X-Debug"} {
+		if strings.Contains(result, gone) {
+			t.Errorf("transparent: expected %q stripped, got %q", gone, result)
+		}
+	}
+
+	result = sanitize(ProfileCompliance)
+	if !strings.HasPrefix(result, "X-Received-Summary: hops=2;") || strings.Contains(result, "Received: from") {
+		t.Errorf("compliance: expected a summarized chain, got %q", result)
+	}
+	if !strings.Contains(result, "Message-ID: <new@proxy.local>\r\nX-Original-Message-ID: <orig@client.local>\r\n") {
+		t.Errorf("compliance: expected the original Message-ID kept, got %q", result)
+	}
+}
+
+func TestParseProfile(t *testing.T) {
+	for _, name := range []string{"anonymize", "transparent", "compliance"} {
+		if p, err := ParseProfile(name); err != nil || string(p) != name {
+			t.Errorf("ParseProfile(%q) = %q, %v", name, p, err)
+		}
+	}
+	if _, err := ParseProfile("keep"); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestPolicy_RewriteReferences(t *testing.T) {
+	n := 0
+	gen := MessageIDFunc(func(string) string {
+		n++
+		return fmt.Sprintf("<new%d@proxy.local>", n)
+	})
+	p, err := Compile(Options{MessageID: gen, RewriteReferences: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = p.Sanitize([]byte("Message-ID: <a@client.local>\r\nSubject: Ticket\r\n\r\nBody"), "proxy.local", Vars{})
+	reply := "Message-ID: <b@client.local>\r\n" +
+		"In-Reply-To: <a@client.local>\r\n" +
+		"References: <root@elsewhere>\r\n <a@client.local>\r\n" +
+		"Subject: Re: Ticket\r\n\r\nBody"
+	result := string(p.Sanitize([]byte(reply), "proxy.local", Vars{}))
+
+	if !strings.Contains(result, "In-Reply-To: <new1@proxy.local>\r\n") {
+		t.Errorf("expected In-Reply-To rewritten, got %q", result)
+	}
+	if !strings.Contains(result, "References: <root@elsewhere>\r\n <new1@proxy.local>\r\n") {
+		t.Errorf("expected References rewritten with folding kept, got %q", result)
+	}
+
+	// Without the option references are left alone
+	p, _ = Compile(Options{MessageID: gen})
+	_ = p.Sanitize([]byte("Message-ID: <c@client.local>\r\n\r\nBody"), "proxy.local", Vars{})
+	result = string(p.Sanitize([]byte("In-Reply-To: <c@client.local>\r\n\r\nBody"), "proxy.local", Vars{}))
+	if !strings.Contains(result, "In-Reply-To: <c@client.local>") {
+		t.Errorf("expected In-Reply-To unchanged, got %q", result)
+	}
+}
+
+func TestThreadIDs_Bounded(t *testing.T) {
+	ids := newThreadIDs(2)
+	ids.add("<1@x>", "<n1@y>")
+	ids.add("<2@x>", "<n2@y>")
+	ids.add("<3@x>", "<n3@y>")
+	got := ids.rewrite([][]byte{[]byte("References: <1@x> <2@x> <3@x>")})
+	if string(got[0]) != "References: <1@x> <n2@y> <n3@y>" {
+		t.Errorf("expected oldest ID forgotten, got %q", got[0])
+	}
+}
+
+func TestCompile_SubjectPrefix(t *testing.T) {
+	if _, err := Compile(Options{SubjectPrefix: "[a]\r\nBcc: x@example.com"}); err == nil || !strings.Contains(err.Error(), "subject_prefix") {
+		t.Errorf("expected subject_prefix error, got %v", err)
+	}
+	if _, err := Compile(Options{SubjectPrefix: "[a]\x00"}); err == nil || !strings.Contains(err.Error(), "subject_prefix: must not contain control characters") {
+		t.Errorf("expected subject_prefix control character error, got %v", err)
+	}
+
+	p, err := Compile(Options{SubjectPrefix: "[тест]"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := string(p.Sanitize([]byte("Subject: Hi\r\n\r\nBody"), "proxy.local", Vars{}))
+	if !strings.Contains(result, "Subject: =?utf-8?q?") || !strings.Contains(result, "?= Hi\r\n") {
+		t.Errorf("expected encoded-word prefix, got %q", result)
+	}
+}
+
+func TestSanitize_HeaderRules(t *testing.T) {
+	p, err := Compile(Options{HeaderRules: []HeaderRule{
+		{Name: "X-Environment", Value: "staging"},
+		{Name: "X-Submitted-By", Value: "{user} <{from}> id={msg_id} ip={remote_ip}"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vars := Vars{User: "app", From: "evil@example.com\r\nBcc: victim@example.com", MsgID: "abc123", RemoteIP: "192.0.2.1"}
+	result := string(p.Sanitize([]byte("Subject: Hi\r\n\r\nBody"), "proxy.local", vars))
+
+	if !strings.Contains(result, "X-Environment: staging\r\n") {
+		t.Error("expected static header")
+	}
+	if !strings.Contains(result, "X-Submitted-By: app <evil@example.com  Bcc: victim@example.com> id=abc123 ip=192.0.2.1\r\n") {
+		t.Errorf("expected expanded header with CRLF neutralized, got %q", result)
+	}
+}
+
+func TestCompile_HeaderRules(t *testing.T) {
+	_, err := Compile(Options{HeaderRules: []HeaderRule{
+		{Name: "X-Ok", Value: "{user}"},
+		{Name: "Bad Name", Value: "x"},
+		{Name: "X-Campaign", Value: "{campaign}"},
+		{Name: "X-Open", Value: "{user"},
+		{Name: "X-Bell", Value: "ring\a"},
+	}})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"headers[1] Bad Name: invalid field name", "headers[2] X-Campaign: unknown variable {campaign}", "headers[3] X-Open: unterminated", "headers[4] X-Bell: value must not contain control characters"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in error, got %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "headers[0]") {
+		t.Errorf("expected valid rule to pass, got %v", err)
+	}
+}
+
+func TestParseRewriteRules(t *testing.T) {
+	rules, err := ParseRewriteRules(`
+# comment
+drop    ^X-Internal-
+rename  ^X-Campaign-Id$  .*  X-Campaign
+replace ^Subject$  ^\[EXT\]\s*  [external] $0 kept
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %+v", rules)
+	}
+	if rules[0].Line != 3 || rules[0].Action != RewriteDrop || rules[0].Value != ".*" {
+		t.Errorf("unexpected drop rule: %+v", rules[0])
+	}
+	if rules[2].Arg != "[external] $0 kept" {
+		t.Errorf("expected replacement to keep spaces, got %q", rules[2].Arg)
+	}
+
+	for _, bad := range []string{"strip ^X-", "rename ^X-A$ .*", "drop"} {
+		if _, err := ParseRewriteRules(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSanitize_Rewrites(t *testing.T) {
+	rules, err := ParseRewriteRules(`
+drop    ^X-Internal-
+drop    ^X-Priority$  ^5
+rename  ^X-Campaign-Id$  .*  X-Campaign
+replace ^Subject$  ^\[EXT\]\s*
+replace ^X-Ticket$  ^(\w+)-(\d+)$  ${2}@${1}
+rename  ^X-Leak$  .*  X-Mailer
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Compile(Options{Rewrites: rules})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	raw := "X-Internal-Host: db01\r\n" +
+		"X-Priority: 5 (Lowest)\r\n" +
+		"X-Campaign-Id: spring\r\n" +
+		"Subject: [EXT] Hello\r\n" +
+		"\tthere\r\n" +
+		"X-Ticket: ops-42\r\n" +
+		"X-Leak: secret\r\n" +
+		"\r\nBody"
+	result := string(p.Sanitize([]byte(raw), "proxy.local", Vars{}))
+
+	for _, gone := range []string{"X-Internal-Host", "X-Priority", "X-Campaign-Id", "[EXT]", "secret"} {
+		if strings.Contains(result, gone) {
+			t.Errorf("expected %q to be rewritten away, got %q", gone, result)
+		}
+	}
+	for _, want := range []string{"X-Campaign: spring\r\n", "Subject: Hello there\r\n", "X-Ticket: 42@ops\r\n"} {
+		if !strings.Contains(result, want) {
+			t.Errorf("expected %q in %q", want, result)
+		}
+	}
+}
+
+func TestCompile_RewriteErrors(t *testing.T) {
+	rules := []RewriteRule{
+		{Line: 4, Action: RewriteDrop, Name: "^X-(", Value: ".*"},
+		{Line: 7, Action: RewriteRename, Name: "^X-A$", Value: ".*", Arg: "Bad Name"},
+		{Line: 9, Action: RewriteReplace, Name: "^X-B$", Value: ".*", Arg: "x\x1b[2J"},
+	}
+	_, err := Compile(Options{Rewrites: rules})
+	if err == nil {
+		t.Fatal("expected compile errors")
+	}
+	for _, want := range []string{"rewrite[line 4] drop ^X-(: name:", "rewrite[line 7] rename ^X-A$: rename: invalid field name", "rewrite[line 9] replace ^X-B$: argument must not contain control characters"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestSanitize_GeneratedValuesCannotInject(t *testing.T) {
+	gen := MessageIDFunc(func(string) string { return "<id@proxy.local>\r\nBcc: victim@example.com" })
+	p, err := Compile(Options{
+		MessageID:       gen,
+		MessageIDPolicy: MessageIDReplaceKeepOriginal,
+		HeaderRules:     []HeaderRule{{Name: "X-Sender", Value: "{from}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "Message-ID: <orig\x00@client.local>\r\nSubject: Hi\r\n\r\nBody"
+	result := string(p.Sanitize([]byte(raw), "proxy.local", Vars{From: "a@example.com\nBcc: victim@example.com\x00\x7f\tx"}))
+
+	header, _, _ := strings.Cut(result, "\r\n\r\n")
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("expected no injected field, got %q", header)
+		}
+	}
+	for _, want := range []string{
+		"Message-ID: <id@proxy.local>  Bcc: victim@example.com\r\n",
+		"X-Original-Message-ID: <orig@client.local>\r\n",
+		"X-Sender: a@example.com Bcc: victim@example.com\tx\r\n",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("expected %q, got %q", want, result)
+		}
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain value":           "plain value",
+		"a\r\nBcc: x":           "a  Bcc: x",
+		"tab\tkept":             "tab\tkept",
+		"nul\x00esc\x1bdel\x7f": "nulescdel",
+		"ünïcode":               "ünïcode",
+	} {
+		if got := HeaderValue(in); got != want {
+			t.Errorf("HeaderValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSanitize_FoldsLongLines(t *testing.T) {
+	words := strings.TrimSpace(strings.Repeat("lorem ipsum ", 250))
+	token := strings.Repeat("x", 1200)
+	raw := "Subject: " + words + "\r\nX-Token: a " + token + " b\r\nTo: a@b\r\n\r\nBody"
+	decorate := HeaderDecoratorFunc(func([]Field) []Field { return []Field{{Name: "X-Tags", Value: words}} })
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Decorators: []HeaderDecorator{decorate}}))
+	header, _, _ := strings.Cut(result, "\r\n\r\n")
+	lines := strings.Split(header, "\r\n")
+	for _, line := range lines {
+		if len(line) > 998 && line != " "+token {
+			t.Errorf("expected lines of at most 998 bytes, got %d: %.40q", len(line), line)
+		}
+		if strings.TrimSpace(line) == "" {
+			t.Error("expected no whitespace-only lines")
+		}
+	}
+	if !slices.Contains(lines, "X-Token: a") || !slices.Contains(lines, " "+token) || !slices.Contains(lines, " b") {
+		t.Error("expected the unbreakable token on a line of its own")
+	}
+	unfolded := strings.ReplaceAll(header, "\r\n ", " ")
+	for _, want := range []string{"Subject: " + words + "\r\n", "X-Token: a " + token + " b\r\nTo: a@b\r\n", "X-Tags: " + words} {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("expected %.40q after unfolding", want)
+		}
+	}
+}
+
+func TestSanitize_Duplicates(t *testing.T) {
+	raw := "From: a@example.com\r\nSubject: first\r\nTo: x@example.com\r\nTo: y@example.com\r\n" +
+		"subject: second\r\n  folded\r\nFrom: b@example.com\r\n\r\nSubject: in the body"
+
+	if got := DuplicateFields([]byte(raw)); !slices.Equal(got, []string{"subject", "from"}) {
+		t.Errorf("expected subject and from repeated, got %v", got)
+	}
+	if got := DuplicateFields([]byte("From: a@example.com\nSubject: x\n\nSubject: y")); got != nil {
+		t.Errorf("expected no duplicates, got %v", got)
+	}
+
+	result := string(Sanitize([]byte(raw), "proxy.local", Options{Duplicates: DuplicateKeepFirst}))
+	if !strings.Contains(result, "From: a@example.com\r\nSubject: first\r\nTo: x@example.com\r\nTo: y@example.com\r\n") ||
+		strings.Contains(result, "second") || strings.Contains(result, "b@example.com") {
+		t.Errorf("keep-first: unexpected result %q", result)
+	}
+	result = string(Sanitize([]byte(raw), "proxy.local", Options{Duplicates: DuplicateKeepLast}))
+	if !strings.Contains(result, "To: x@example.com\r\nTo: y@example.com\r\nsubject: second\r\n  folded\r\nFrom: b@example.com\r\n") ||
+		strings.Contains(result, "first") || strings.Contains(result, "a@example.com") {
+		t.Errorf("keep-last: unexpected result %q", result)
+	}
+	if result = string(Sanitize([]byte(raw), "proxy.local", Options{Duplicates: DuplicateReject})); strings.Count(result, "From:") != 2 {
+		t.Errorf("reject: expected the header left alone, got %q", result)
+	}
+
+	if _, err := ParseDuplicatePolicy("keep-all"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+	if _, err := Compile(Options{Duplicates: "keep-all"}); err == nil || !strings.Contains(err.Error(), "duplicates:") {
+		t.Errorf("expected duplicates error, got %v", err)
+	}
+}
+
+func TestHeaderLimits_Check(t *testing.T) {
+	limits := HeaderLimits{MaxSize: 40, MaxLineLength: 16, MaxFields: 2}
+	for _, tc := range []struct {
+		raw  string
+		want string // "" for within limits
+	}{
+		{"Subject: hi\r\nTo: a@b\r\n\r\n" + strings.Repeat("x", 100), ""},
+		{"Subject: hi\nTo: a@b\n\nbody", ""},
+		{"Subject: no body", ""},
+		{"Subject: " + strings.Repeat("x", 11) + "\r\n\r\n", "line of 20 bytes"},
+		{"Subject: hi\r\nTo: a@b\r\nCc: c@d\r\n\r\n", "more than 2 fields"},
+		{"Subject: hi\r\n" + strings.Repeat(" more\r\n", 5) + "\r\n", "more than 40 bytes"},
+	} {
+		err := limits.Check([]byte(tc.raw))
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.raw, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrHeaderTooLarge) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: expected %q, got %v", tc.raw, tc.want, err)
+		}
+	}
+	if err := (HeaderLimits{}).Check([]byte(strings.Repeat("x", 10000))); err != nil {
+		t.Errorf("expected no limits by default, got %v", err)
+	}
+}
+
+func TestSanitizeMessage_StripsBcc(t *testing.T) {
+	raw := "To: a@example.com\r\nBcc: secret@example.com,\r\n other@example.com\r\nResent-Bcc: x@example.com\r\nSubject: Hi\r\n\r\nBody"
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+	if strings.Contains(strings.ToLower(result), "bcc") || strings.Contains(result, "other@example.com") {
+		t.Errorf("expected Bcc fields and their continuations removed, got %q", result)
+	}
+}
+
+func TestUndisclosedRecipients(t *testing.T) {
+	raw := "To: Alice <Alice@Example.com>, bob@example.com\r\n" +
+		"Cc: \"Carol, Ops\" <carol@example.com>\r\n" +
+		"Bcc: dave@example.com\r\n" +
+		"Subject: Hi\r\n\r\nTo: eve@example.com\r\n"
+	got := UndisclosedRecipients([]byte(raw), []string{"alice@example.com", "carol@example.com", "dave@example.com", "eve@example.com", "mallory@example.com"})
+	if strings.Join(got, " ") != "eve@example.com mallory@example.com" {
+		t.Errorf("unexpected undisclosed recipients %v", got)
+	}
+
+	// Malformed address lists still count the addresses they contain
+	got = UndisclosedRecipients([]byte("To: frank@example.com;; <grace@example.com\r\n\r\n"), []string{"frank@example.com", "grace@example.com"})
+	if len(got) != 0 {
+		t.Errorf("expected addresses found in malformed To, got %v", got)
+	}
+}
+
+func TestDowngrade8Bit(t *testing.T) {
+	ascii := []byte("Subject: Hi\r\n\r\nplain\r\n")
+	if got, err := Downgrade8Bit(ascii); err != nil || !bytes.Equal(got, ascii) {
+		t.Errorf("expected 7-bit message unchanged, got %q, %v", got, err)
+	}
+
+	single := "Subject: Hi\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nGrüße\r\n"
+	got, err := Downgrade8Bit([]byte(single))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Subject: Hi\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nGr=C3=BC=C3=9Fe\r\n"
+	if string(got) != want {
+		t.Errorf("unexpected single-part result:\n%q\nwant\n%q", got, want)
+	}
+
+	multi := "Content-Type: multipart/mixed; boundary=b\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nçava\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n" +
+		"--b--\r\n"
+	got, err = Downgrade8Bit([]byte(multi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Content-Type: multipart/mixed; boundary=b\r\nContent-Transfer-Encoding: 7bit\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n=C3=A7ava\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n" +
+		"--b--\r\n"
+	if string(got) != want {
+		t.Errorf("unexpected multipart result:\n%q\nwant\n%q", got, want)
+	}
+
+	for name, msg := range map[string]string{
+		"header":    "Subject: Grüße\r\n\r\nbody\r\n",
+		"signed":    "Content-Type: multipart/signed; boundary=b\r\n\r\n--b\r\n\r\nçava\r\n--b--\r\n",
+		"base64":    "Content-Transfer-Encoding: base64\r\n\r\nçava\r\n",
+		"preamble":  "Content-Type: multipart/mixed; boundary=b\r\n\r\nçava\r\n--b\r\n\r\nok\r\n--b--\r\n",
+		"boundless": "Content-Type: multipart/mixed\r\n\r\nçava\r\n",
+	} {
+		if _, err := Downgrade8Bit([]byte(msg)); !errors.Is(err, ErrCannotDowngrade) {
+			t.Errorf("%s: expected ErrCannotDowngrade, got %v", name, err)
+		}
+	}
+}
+
+func TestSanitizeMessage_StripsControlHeaders(t *testing.T) {
+	raw := "From: sender@example.com\r\nX-SMTP-Proxy-Route: marketing\r\nX-Debug: 1\r\nSubject: Test\r\n\r\nBody"
+
+	result := string(SanitizeMessage([]byte(raw), "proxy.local"))
+	if strings.Contains(result, "X-SMTP-Proxy-Route") || strings.Contains(result, "X-Debug") {
+		t.Error("expected X-SMTP-Proxy-Route and X-Debug control headers to be stripped")
+	}
+}
+
+func TestSetFields(t *testing.T) {
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"X-Original-From: forged\r\n" +
+		" continued\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"From: body line\r\n"
+
+	got := string(SetFields([]byte(raw),
+		Field{Name: "From", Value: "ops@example.org"},
+		Field{Name: "X-Original-From", Value: "Alice <alice@example.com>\r\nBcc: x@example.com"},
+	))
+	want := "Subject: Test\r\n" +
+		"From: ops@example.org\r\n" +
+		"X-Original-From: Alice <alice@example.com>  Bcc: x@example.com\r\n" +
+		"\r\n" +
+		"From: body line\r\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := string(SetFields([]byte("Subject: Test"), Field{Name: "From", Value: "ops@example.org"})); got != "Subject: Test\r\nFrom: ops@example.org\r\n\r\n" {
+		t.Errorf("headers-only message: got %q", got)
+	}
+	if got := SetFields([]byte(raw)); string(got) != raw {
+		t.Errorf("expected the message unchanged without fields, got %q", got)
+	}
+}
@@ -0,0 +1,41 @@
+package sanitizer
+
+import (
+	"bytes"
+	"strings"
+)
+
+// SetFields replaces header fields of a CRLF message: every existing field
+// named by one of fields is dropped and fields are appended to the header,
+// in order. Values go through HeaderValue, and a field with an invalid
+// name is not written. The body passes through unmodified.
+func SetFields(msg []byte, fields ...Field) []byte {
+	if len(fields) == 0 {
+		return msg
+	}
+	drop := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		drop[strings.ToLower(f.Name)] = true
+	}
+
+	headerPart, body := msg, []byte("\r\n")
+	if end := bytes.Index(msg, []byte("\r\n\r\n")); end != -1 {
+		headerPart, body = msg[:end], msg[end+2:]
+	}
+
+	var out bytes.Buffer
+	for _, h := range parseHeaders(headerPart) {
+		if drop[h.name] {
+			continue
+		}
+		for _, line := range h.lines {
+			out.Write(line)
+			out.WriteString("\r\n")
+		}
+	}
+	for _, f := range fields {
+		writeField(&out, f)
+	}
+	out.Write(body)
+	return out.Bytes()
+}
@@ -0,0 +1,30 @@
+package sanitizer
+
+import (
+	"bytes"
+	"strings"
+)
+
+// prefixSubject inserts prefix at the start of a Subject header, keeping
+// any folded continuation lines. Subjects already carrying the prefix (a
+// reply to tagged mail, say) are left alone.
+func prefixSubject(h header, prefix string) header {
+	if strings.HasPrefix(toField(h).Value, prefix) {
+		return h
+	}
+	first := h.lines[0]
+	colon := bytes.IndexByte(first, ':')
+	value := bytes.TrimLeft(first[colon+1:], " \t")
+
+	line := make([]byte, 0, len(first)+len(prefix)+2)
+	line = append(line, first[:colon+1]...)
+	line = append(line, ' ')
+	line = append(line, prefix...)
+	if len(value) > 0 {
+		line = append(line, ' ')
+		line = append(line, value...)
+	}
+
+	lines := append([][]byte{line}, h.lines[1:]...)
+	return header{name: h.name, lines: lines}
+}
@@ -0,0 +1,117 @@
+package smtpproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+)
+
+// certCheckInterval is how often the listener certificates' expiry is
+// checked.
+const certCheckInterval = time.Hour
+
+// listenerCert is a certificate offered by the submission listener and
+// the file it was loaded from.
+type listenerCert struct {
+	file string
+	leaf *x509.Certificate
+}
+
+// name returns the certificate's first DNS name, or its CN.
+func (c listenerCert) name() string {
+	if len(c.leaf.DNSNames) > 0 {
+		return c.leaf.DNSNames[0]
+	}
+	return c.leaf.Subject.CommonName
+}
+
+// daysLeft returns the whole days until c expires, negative once it has.
+func (c listenerCert) daysLeft(now time.Time) int {
+	return int(math.Floor(c.leaf.NotAfter.Sub(now).Hours() / 24))
+}
+
+// certStatus is a listener certificate as listed on /debug/vars.
+type certStatus struct {
+	File     string    `json:"file"`
+	Name     string    `json:"name"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+}
+
+// certExpiry describes the listener certificates for /debug/vars,
+// soonest expiry first.
+func (s *Server) certExpiry() []certStatus {
+	now := time.Now()
+	certs := make([]certStatus, len(s.certs))
+	for i, c := range s.certs {
+		certs[i] = certStatus{c.file, c.name(), c.leaf.NotAfter.UTC(), c.daysLeft(now)}
+	}
+	slices.SortFunc(certs, func(a, b certStatus) int { return a.NotAfter.Compare(b.NotAfter) })
+	return certs
+}
+
+// certsVar serves certExpiry as the tls_certs variable.
+type certsVar func() []certStatus
+
+// String returns the list as JSON, for expvar.
+func (f certsVar) String() string {
+	b, err := json.Marshal(f())
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// checkCerts sends the days left on the listener certificate that expires
+// first as the tls.cert_expiry_days gauge, and logs each certificate
+// within SMTP_TLS_CERT_WARN_DAYS of its expiry: a warning before, an error
+// after. warned holds the days left each was last logged with, so the log
+// repeats once a day rather than at every check.
+func (s *Server) checkCerts(now time.Time, warned map[string]int) {
+	var soonest float64
+	for i, c := range s.certs {
+		left := c.leaf.NotAfter.Sub(now).Hours() / 24
+		if i == 0 || left < soonest {
+			soonest = left
+		}
+		days := c.daysLeft(now)
+		if days >= s.cfg.TLSCertWarnDays {
+			delete(warned, c.file)
+			continue
+		}
+		if last, ok := warned[c.file]; ok && last == days {
+			continue
+		}
+		warned[c.file] = days
+		notAfter := c.leaf.NotAfter.UTC()
+		if days < 0 {
+			slog.Error("tls certificate expired", "file", c.file, "name", c.name(), "not_after", notAfter, "days_ago", -days)
+		} else {
+			slog.Warn("tls certificate expires soon", "file", c.file, "name", c.name(), "not_after", notAfter, "days_left", days)
+		}
+	}
+	if len(s.certs) > 0 {
+		s.stats.Gauge("tls.cert_expiry_days", math.Round(soonest*10)/10)
+	}
+}
+
+// watchCerts checks the listener certificates now and every hour until
+// ctx is done.
+func (s *Server) watchCerts(ctx context.Context) {
+	warned := make(map[string]int)
+	s.checkCerts(time.Now(), warned)
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkCerts(time.Now(), warned)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package smtpproxy
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/redact"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+)
+
+// watchSecrets reloads the configuration every SMTP_SECRET_FILES_RELOAD
+// until ctx is done, so credentials rotated in their secret files, Vault
+// or AWS take effect without a restart.
+func (s *Server) watchSecrets(ctx context.Context) {
+	current := s.cfg
+	ticker := time.NewTicker(s.cfg.SecretFilesReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current = s.reloadSecrets(current)
+		}
+	}
+}
+
+// reloadSecrets loads the configuration again and, when its credentials
+// differ from current, masks the new ones in the logs and hands them to
+// sessions created afterwards, the admin and capture UI logins and the
+// alert sinks. It returns the configuration now in use; one that fails to
+// load is logged and changes nothing.
+func (s *Server) reloadSecrets(current *config.Config) *config.Config {
+	fresh, err := config.Load()
+	if err != nil {
+		slog.Error("secret reload failed", "error", err)
+		return current
+	}
+	updated := current.WithSecrets(fresh)
+	if slices.Equal(updated.Secrets(), current.Secrets()) {
+		return current
+	}
+	if h, ok := slog.Default().Handler().(*redact.Handler); ok {
+		h.AddSecrets(updated.Secrets())
+	}
+	s.backend.UpdateSecrets(fresh)
+	s.current.Store(updated)
+	s.alerts.SetSinks(s.alertSinks(updated))
+	slog.Info("secrets reloaded", "files", s.cfg.SecretFiles, "vault", s.cfg.VaultSecrets, "aws", s.cfg.AWSSecrets)
+	return updated
+}
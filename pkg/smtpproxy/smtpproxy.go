@@ -0,0 +1,526 @@
+// Package smtpproxy runs the complete proxy — the submission listener and
+// the optional bounce and LMTP listeners — so other Go programs can embed
+// the relay instead of running the smtp-proxy binary:
+//
+//	cfg, err := config.Load()
+//	...
+//	srv, err := smtpproxy.New(cfg)
+//	...
+//	err = srv.Run(ctx)
+//
+// Logging goes to the slog default logger.
+package smtpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+	"github.com/VahanMargaryan/smtp-proxy/internal/admin"
+	"github.com/VahanMargaryan/smtp-proxy/internal/alert"
+	"github.com/VahanMargaryan/smtp-proxy/internal/bounce"
+	"github.com/VahanMargaryan/smtp-proxy/internal/capture"
+	"github.com/VahanMargaryan/smtp-proxy/internal/greylist"
+	"github.com/VahanMargaryan/smtp-proxy/internal/listener"
+	"github.com/VahanMargaryan/smtp-proxy/internal/report"
+	"github.com/VahanMargaryan/smtp-proxy/internal/statsd"
+	"github.com/VahanMargaryan/smtp-proxy/internal/suppression"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/proxy"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// errorLog sends go-smtp's own error output to the slog default logger.
+// This includes the stack of a panic outside message processing, which
+// go-smtp answers with 421, closing only that connection.
+type errorLog struct{}
+
+func (errorLog) Printf(format string, v ...any) {
+	slog.Error("smtp server error", "error", strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (errorLog) Println(v ...any) {
+	slog.Error("smtp server error", "error", strings.TrimSpace(fmt.Sprintln(v...)))
+}
+
+// stagesVar serves proxy.StageTimings as the message_stages variable.
+type stagesVar func() map[string]proxy.StageTiming
+
+// String returns the timings as JSON, for expvar.
+func (f stagesVar) String() string {
+	b, err := json.Marshal(f())
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// ioTimeout is the read and write timeout of the listeners, except reads
+// on the submission listener, which follow SMTP_IDLE_TIMEOUT.
+const ioTimeout = 60 * time.Second
+
+// captureLimit is the number of sink mode messages the capture UI keeps.
+const captureLimit = 1000
+
+// captureMaxBytes caps the total size of the messages the capture UI keeps.
+const captureMaxBytes = 256 << 20
+
+// Server is a configured proxy. Create it with New, then call Run.
+type Server struct {
+	cfg     *config.Config
+	backend *proxy.Backend
+
+	submission *smtp.Server
+	bounce     *smtp.Server   // nil without SMTP_BOUNCE_LISTEN_ADDR
+	lmtp       *smtp.Server   // nil without SMTP_LMTP_LISTEN_ADDR
+	ui         *http.Server   // nil without SMTP_SINK_UI_ADDR
+	admin      *http.Server   // nil without SMTP_ADMIN_ADDR
+	stats      *statsd.Client // nil without SMTP_STATSD_ADDR
+	ledger     *accounting.Ledger
+	alerts     *alert.Monitor // nil without an SMTP_ALERT_* destination
+	certs      []listenerCert
+
+	// The configuration in use, replaced when secrets are reloaded
+	current *atomic.Pointer[config.Config]
+}
+
+// New builds a server from cfg, wrapping relay.Send in the record of
+// relayed recipients the bounce listener checks, each upstream's circuit
+// breaker and throttle, and the warm-up cap, or replacing it with a
+// relay.Sink in sink mode, then in the recipient redirect, and loading the
+// suppression list. Nothing listens until Run.
+func New(cfg *config.Config) (*Server, error) {
+	// Wrapped innermost first: warm-up rejects before throttling waits,
+	// and the breaker only sees real upstream attempts.
+	current := new(atomic.Pointer[config.Config])
+	current.Store(cfg)
+	login := func() (string, string) {
+		c := current.Load()
+		return c.ProxyUsername, c.ProxyPassword
+	}
+	send := relay.Send
+	var relayed *bounce.Relayed
+	if cfg.BounceListenAddr != "" {
+		relayed = bounce.NewRelayed()
+		send = relayed.Wrap(send)
+	}
+	upstream := send
+	send = relay.PerUpstream(func(cfg *config.Config) relay.SendFunc {
+		return relay.NewThrottle(cfg).Wrap(relay.NewBreaker(cfg).Wrap(upstream))
+	})
+	send = relay.NewWarmup(cfg).Wrap(send)
+	var ui *http.Server
+	if cfg.SinkMode {
+		sink, err := relay.NewSink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		release := send
+		send = sink.Send
+		if cfg.SinkUIAddr != "" {
+			store := capture.NewStore(captureLimit, captureMaxBytes)
+			send = store.Wrap(send)
+			ui = &http.Server{
+				Addr:              cfg.SinkUIAddr,
+				Handler:           capture.Handler(store, release, login),
+				ReadHeaderTimeout: ioTimeout,
+			}
+		}
+	}
+	// Outermost, so captured and archived messages show the redirect
+	send = relay.NewRedirect(cfg).Wrap(send)
+	backend, err := proxy.NewBackend(cfg, send)
+	if err != nil {
+		return nil, err
+	}
+
+	var suppressed *suppression.List
+	if cfg.SuppressionFile != "" {
+		suppressed, err = suppression.Load(cfg.SuppressionFile)
+		if err != nil {
+			return nil, fmt.Errorf("suppression list: %w", err)
+		}
+		backend.SetSuppressionList(suppressed)
+		slog.Info("suppression list loaded", "path", cfg.SuppressionFile, "entries", suppressed.Len())
+	}
+
+	if cfg.GreylistFile != "" {
+		grey, err := greylist.Load(cfg.GreylistFile, greylist.Options{
+			Delay:       cfg.GreylistDelay,
+			RetryWindow: cfg.GreylistRetryWindow,
+			Expiry:      cfg.GreylistExpiry,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backend.SetGreylist(grey)
+		slog.Info("greylist loaded", "path", cfg.GreylistFile, "entries", grey.Len(), "delay", cfg.GreylistDelay)
+	}
+
+	var ledger *accounting.Ledger
+	if cfg.AccountingFile != "" {
+		ledger, err = accounting.Load(cfg.AccountingFile, cfg.AccountingRetention)
+		if err != nil {
+			return nil, err
+		}
+		backend.SetAccounting(ledger)
+		slog.Info("accounting ledger loaded", "path", cfg.AccountingFile, "retention_days", cfg.AccountingRetention)
+	}
+
+	var stats *statsd.Client
+	if cfg.StatsdAddr != "" {
+		stats, err = statsd.New(cfg.StatsdAddr, cfg.StatsdPrefix, cfg.StatsdTags, cfg.StatsdFormat == "dogstatsd")
+		if err != nil {
+			return nil, fmt.Errorf("statsd: %w", err)
+		}
+		backend.SetMetrics(stats)
+	}
+
+	s := &Server{cfg: cfg, backend: backend, ui: ui, stats: stats, ledger: ledger, current: current}
+	if cfg.Alerting() {
+		s.alerts = alert.New(alert.Thresholds{
+			RelayErrorRate: cfg.AlertRelayErrorRate,
+			AuthFailures:   cfg.AlertAuthFailures,
+			QueueDepth:     cfg.AlertQueueDepth,
+			Window:         cfg.AlertWindow,
+		}, s.alertSinks(cfg), backend.InFlight, cfg.ServerDomain)
+		backend.SetAlerts(s.alerts)
+	}
+	if cfg.AdminAddr != "" {
+		admin.Publish("panics", admin.IntFunc(proxy.Panics))
+		admin.Publish("tls_certs", certsVar(s.certExpiry))
+		admin.Publish("message_stages", stagesVar(proxy.StageTimings))
+		s.admin = &http.Server{
+			Addr:              cfg.AdminAddr,
+			Handler:           admin.Handler(login, ledger),
+			ReadHeaderTimeout: ioTimeout,
+		}
+	}
+
+	s.submission = smtp.NewServer(backend)
+	s.submission.Addr = cfg.ListenAddr
+	s.submission.Domain = cfg.ServerDomain
+	s.submission.AllowInsecureAuth = true
+	s.submission.MaxMessageBytes = cfg.MaxMessageSize
+	s.submission.MaxRecipients = cfg.MaxRecipients
+	s.submission.EnableSMTPUTF8 = true
+	s.submission.ReadTimeout = cfg.IdleTimeout
+	if cfg.MaxCommandsPerSession > 0 && cfg.IdleTimeout <= 0 {
+		// listener.WithCommandLimit counts the deadline set per command
+		return nil, errors.New("SMTP_MAX_COMMANDS_PER_SESSION needs SMTP_IDLE_TIMEOUT")
+	}
+	s.submission.WriteTimeout = ioTimeout
+	s.submission.ErrorLog = errorLog{}
+	if cfg.TLSCertFile != "" {
+		// crypto/tls picks the certificate matching the client's SNI name,
+		// falling back to the first
+		pairs := append([]config.TLSCertPair{{CertFile: cfg.TLSCertFile, KeyFile: cfg.TLSKeyFile}}, cfg.TLSExtraCerts...)
+		certs := make([]tls.Certificate, 0, len(pairs))
+		for _, p := range pairs {
+			cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("tls certificate %s: %w", p.CertFile, err)
+			}
+			certs = append(certs, cert)
+			if cert.Leaf == nil {
+				continue
+			}
+			if cfg.TLSRefuseExpired && time.Now().After(cert.Leaf.NotAfter) {
+				return nil, fmt.Errorf("tls certificate %s expired on %s (SMTP_TLS_REFUSE_EXPIRED)", p.CertFile, cert.Leaf.NotAfter.UTC().Format(time.DateOnly))
+			}
+			s.certs = append(s.certs, listenerCert{file: p.CertFile, leaf: cert.Leaf})
+			s.alerts.WatchCert(p.CertFile, cert.Leaf, cfg.TLSCertWarnDays)
+		}
+		s.submission.TLSConfig = &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12}
+		leaves := make([]*x509.Certificate, len(s.certs))
+		for i, c := range s.certs {
+			leaves[i] = c.leaf
+		}
+		backend.SetServerCerts(leaves)
+		if cfg.TLSClientCAFile != "" {
+			pem, err := os.ReadFile(cfg.TLSClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("tls client ca: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("tls client ca: no certificates in %s", cfg.TLSClientCAFile)
+			}
+			// Clients without a certificate can still use AUTH
+			s.submission.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			s.submission.TLSConfig.ClientCAs = pool
+		}
+	}
+
+	if cfg.BounceListenAddr != "" {
+		s.bounce = smtp.NewServer(bounce.NewBackend(cfg.DestFrom, cfg.VERPSecret, cfg.MaxMessageSize, suppressed, relayed))
+		s.bounce.Addr = cfg.BounceListenAddr
+		s.bounce.Domain = cfg.ServerDomain
+		s.bounce.MaxMessageBytes = cfg.MaxMessageSize
+		s.bounce.ReadTimeout = ioTimeout
+		s.bounce.WriteTimeout = ioTimeout
+		s.bounce.ErrorLog = errorLog{}
+	}
+
+	if cfg.LMTPListenAddr != "" {
+		s.lmtp = smtp.NewServer(backend.LMTP())
+		s.lmtp.LMTP = true
+		s.lmtp.Network = "tcp"
+		s.lmtp.Addr = cfg.LMTPListenAddr
+		if path, ok := strings.CutPrefix(cfg.LMTPListenAddr, "unix:"); ok {
+			s.lmtp.Network = "unix"
+			s.lmtp.Addr = path
+		}
+		s.lmtp.Domain = cfg.ServerDomain
+		s.lmtp.MaxMessageBytes = cfg.MaxMessageSize
+		s.lmtp.MaxRecipients = cfg.MaxRecipients
+		s.lmtp.EnableSMTPUTF8 = true
+		s.lmtp.ReadTimeout = ioTimeout
+		s.lmtp.WriteTimeout = ioTimeout
+		s.lmtp.ErrorLog = errorLog{}
+	}
+	return s, nil
+}
+
+// Backend returns the proxy backend, so processors and hooks can be added
+// before Run.
+func (s *Server) Backend() *proxy.Backend {
+	return s.backend
+}
+
+// Run listens on the configured addresses and serves until ctx is done,
+// then shuts down gracefully within cfg.ShutdownTimeout. It returns early
+// with the error of a listener that fails, and nil once Shutdown is called.
+func (s *Server) Run(ctx context.Context) error {
+	// Stops the watchers and loops started below when a listener fails
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	slog.Info("starting smtp proxy",
+		"listen", s.cfg.ListenAddr,
+		"upstream", s.cfg.DestHost,
+		"upstream_port", s.cfg.DestPort,
+		"transport", s.cfg.DestTransport,
+		"from", s.cfg.DestFrom,
+		"reuse_port", s.cfg.ReusePort,
+	)
+	if s.cfg.DestProxy != nil {
+		slog.Info("relaying through egress proxy", "proxy", s.cfg.DestProxy.Redacted())
+	}
+	for _, r := range s.cfg.Routes {
+		slog.Info("route configured", "route", r.Name, "upstream", r.Host, "transport", r.Transport)
+	}
+	if len(s.cfg.TrustedNetworks) > 0 {
+		networks := make([]string, len(s.cfg.TrustedNetworks))
+		for i, n := range s.cfg.TrustedNetworks {
+			networks[i] = n.String()
+		}
+		slog.Info("accepting mail without auth from trusted networks", "networks", networks, "spf", s.cfg.SPFAction, "dnsbl", s.cfg.DNSBLLists)
+	}
+	if s.cfg.SinkMode {
+		slog.Warn("sink mode: messages are accepted but not relayed", "archive", s.cfg.SinkDir)
+	}
+	if s.cfg.RedirectTo != "" {
+		slog.Warn("redirecting all mail", "redirect_to", s.cfg.RedirectTo, "allow", s.cfg.RedirectAllow)
+	}
+	if s.stats != nil {
+		slog.Info("sending metrics", "statsd", s.cfg.StatsdAddr, "format", s.cfg.StatsdFormat, "tags", s.cfg.StatsdTags)
+	}
+
+	ln, err := listener.Listen(s.cfg.ListenAddr, s.cfg.ReusePort)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	if s.cfg.MaxConnections > 0 || s.cfg.MaxConnectionsPerIP > 0 {
+		ln = listener.WithConnLimit(ln, s.cfg.MaxConnections, s.cfg.MaxConnectionsPerIP, func(string) {
+			s.stats.Count("sessions.refused", 1, "reason:connection_limit")
+		})
+	}
+	if len(s.cfg.ServerDomains) > 0 {
+		slog.Info("greeting by local address", "domains", s.cfg.ServerDomains)
+		ln = listener.WithBannerDomains(ln, s.cfg.ServerDomain, s.cfg.ServerDomains)
+	}
+	if s.submission.TLSConfig != nil {
+		var names []string
+		for _, cert := range s.submission.TLSConfig.Certificates {
+			if cert.Leaf != nil {
+				names = append(names, cert.Leaf.DNSNames...)
+			}
+		}
+		slog.Info("offering starttls", "names", names, "require_tls_for_auth", s.cfg.RequireTLSForAuth, "client_certs", s.cfg.TLSClientCAFile != "")
+		go s.watchCerts(ctx)
+	}
+	if s.cfg.BannerDelay > 0 {
+		slog.Info("delaying greeting, rejecting early talkers", "delay", s.cfg.BannerDelay)
+		ln = listener.WithBannerDelay(ln, s.cfg.BannerDelay)
+	}
+	if s.cfg.MaxCommandsPerSession > 0 {
+		ln = listener.WithCommandLimit(ln, s.cfg.MaxCommandsPerSession)
+	}
+
+	errCh := make(chan error, 5)
+	go func() {
+		errCh <- s.submission.Serve(ln)
+	}()
+	if s.bounce != nil {
+		slog.Info("starting bounce listener", "listen", s.cfg.BounceListenAddr, "bounce_addr", s.cfg.DestFrom)
+		go func() {
+			errCh <- s.bounce.ListenAndServe()
+		}()
+	}
+	if s.lmtp != nil {
+		if s.lmtp.Network == "unix" {
+			// A socket left behind by an unclean exit blocks the bind
+			_ = os.Remove(s.lmtp.Addr)
+		}
+		slog.Info("starting lmtp listener", "listen", s.cfg.LMTPListenAddr)
+		go func() {
+			errCh <- s.lmtp.ListenAndServe()
+		}()
+	}
+
+	if s.ui != nil {
+		slog.Info("starting capture ui", "listen", s.cfg.SinkUIAddr)
+		go func() {
+			errCh <- s.ui.ListenAndServe()
+		}()
+	}
+	if s.admin != nil {
+		slog.Info("starting admin listener", "listen", s.cfg.AdminAddr)
+		go func() {
+			errCh <- s.admin.ListenAndServe()
+		}()
+	}
+
+	if s.cfg.SecretFilesReload > 0 {
+		slog.Info("watching secret files", "files", s.cfg.SecretFiles, "vault", s.cfg.VaultSecrets, "aws", s.cfg.AWSSecrets, "interval", s.cfg.SecretFilesReload)
+		go s.watchSecrets(ctx)
+	}
+	if s.alerts != nil {
+		slog.Info("alerting enabled",
+			"relay_error_rate", s.cfg.AlertRelayErrorRate,
+			"auth_failures", s.cfg.AlertAuthFailures,
+			"queue_depth", s.cfg.AlertQueueDepth,
+			"window", s.cfg.AlertWindow,
+		)
+		go s.alerts.Run(ctx)
+	}
+	if len(s.cfg.ReportTo) > 0 {
+		slog.Info("scheduling daily report", "to", s.cfg.ReportTo, "next", report.Next(time.Now(), s.cfg.ReportAt))
+		go report.Run(ctx, s.cfg.ReportAt, s.sendReport)
+	}
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, smtp.ErrServerClosed) || errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+		defer cancel()
+		_ = s.Shutdown(shutdownCtx)
+		return err
+	case <-ctx.Done():
+		slog.Info("shutting down...")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
+
+// reportUser is the client identity of the daily report, e.g. in the
+// accounting counters.
+const reportUser = "report"
+
+// sendReport emails the daily summary of day to SMTP_REPORT_TO through the
+// proxy's own pipeline. A failure is logged; the next report is still
+// scheduled.
+func (s *Server) sendReport(day string) {
+	summary := report.Summary{
+		Day:      day,
+		Rows:     s.ledger.Rows(accounting.Filter{From: day, To: day}),
+		InFlight: s.backend.InFlight(),
+	}
+	message := summary.Message(s.cfg.DestFrom, s.cfg.ReportTo, s.cfg.ServerDomain, time.Now())
+	id, err := s.backend.Submit(reportUser, s.cfg.ReportTo, message)
+	if err != nil {
+		slog.Error("daily report failed", "day", day, "error", err)
+		return
+	}
+	slog.Info("daily report sent", "msg_id", id, "day", day, "to", s.cfg.ReportTo)
+}
+
+// alertUser is the client identity of alert emails.
+const alertUser = "alert"
+
+// alertSinks returns the alert destinations configured in cfg. Alert
+// emails go through the proxy's own pipeline.
+func (s *Server) alertSinks(cfg *config.Config) []alert.Sink {
+	var sinks []alert.Sink
+	if cfg.AlertWebhookURL != "" {
+		sinks = append(sinks, &alert.Webhook{URL: cfg.AlertWebhookURL})
+	}
+	if cfg.AlertSlackURL != "" {
+		sinks = append(sinks, &alert.Slack{URL: cfg.AlertSlackURL})
+	}
+	if cfg.AlertTeamsURL != "" {
+		sinks = append(sinks, &alert.Teams{URL: cfg.AlertTeamsURL})
+	}
+	if len(cfg.AlertEmail) > 0 {
+		sinks = append(sinks, &alert.Email{
+			From: cfg.DestFrom,
+			To:   cfg.AlertEmail,
+			Submit: func(recipients []string, message []byte) error {
+				_, err := s.backend.Submit(alertUser, recipients, message)
+				return err
+			},
+		})
+	}
+	return sinks
+}
+
+// Shutdown stops accepting connections and waits for in-flight sessions
+// until ctx is done. The submission listener is closed first, so with
+// SMTP_REUSE_PORT a replacement process already bound to the same address
+// receives all new connections while sessions drain here.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	if err := s.submission.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if s.bounce != nil {
+		if err := s.bounce.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("bounce listener: %w", err))
+		}
+	}
+	if s.lmtp != nil {
+		if err := s.lmtp.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("lmtp listener: %w", err))
+		}
+	}
+	if s.ui != nil {
+		if err := s.ui.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("capture ui: %w", err))
+		}
+	}
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("admin listener: %w", err))
+		}
+	}
+	// After the sessions, so their last metrics go out
+	_ = s.stats.Close()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,526 @@
+package smtpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/proxy"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	// Reserve a free port; Run binds it again
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return &config.Config{
+		ListenAddr:      addr,
+		ProxyUsername:   "testuser",
+		ProxyPassword:   "testpass",
+		DestHost:        "smtp.example.com",
+		DestPort:        587,
+		DestUsername:    "upstream@example.com",
+		DestPassword:    "upstreampass",
+		DestFrom:        "upstream@example.com",
+		DestDomain:      "example.com",
+		ServerDomain:    "localhost",
+		MaxMessageSize:  1 << 20,
+		ShutdownTimeout: time.Second,
+	}
+}
+
+func TestServer_RunUntilCancelled(t *testing.T) {
+	cfg := testConfig(t)
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", cfg.ListenAddr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("proxy not listening: %v", err)
+	}
+	greeting, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if !strings.HasPrefix(greeting, "220 localhost") {
+		t.Errorf("unexpected greeting %q", greeting)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestServer_RunListenError(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cfg := testConfig(t)
+	cfg.ListenAddr = taken.Addr().String()
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := srv.Run(context.Background()); err == nil {
+		t.Error("expected an error for an address in use")
+	}
+
+	// A listener failing after startup stops the secret watcher too
+	cfg = testConfig(t)
+	cfg.AdminAddr = taken.Addr().String()
+	cfg.SecretFilesReload = time.Hour
+	if srv, err = New(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := srv.Run(context.Background()); err == nil {
+		t.Error("expected an error for an admin address in use")
+	}
+	stack := make([]byte, 1<<20)
+	for range 100 {
+		if !bytes.Contains(stack[:runtime.Stack(stack, true)], []byte(".watchSecrets(")) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected the secret watcher stopped after Run returned")
+}
+
+// issue creates a certificate from tmpl signed by parent (self-signed if
+// nil) and returns it with its key.
+func issue(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+	issuer, signer := tmpl, crypto.Signer(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey.(crypto.Signer)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCert writes cert and its key as PEM files to dir, returning their
+// paths.
+func writeCert(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// serverCert is a self-signed certificate for localhost.
+func serverCert(t *testing.T) tls.Certificate {
+	return hostCert(t, "localhost")
+}
+
+func hostCert(t *testing.T, name string) tls.Certificate {
+	return issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+	}, nil)
+}
+
+// dialProxy connects to a proxy started by Run, waiting for it to listen.
+func dialProxy(t *testing.T, addr string, tlsConfig *tls.Config) *smtp.Client {
+	t.Helper()
+	var client *smtp.Client
+	var err error
+	for range 50 {
+		if tlsConfig != nil {
+			client, err = smtp.DialStartTLS(addr, tlsConfig)
+		} else {
+			client, err = smtp.Dial(addr)
+		}
+		if err == nil {
+			t.Cleanup(func() { client.Close() })
+			return client
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("proxy not reachable: %v", err)
+	return nil
+}
+
+func TestServer_RequireTLSForAuth(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeCert(t, t.TempDir(), serverCert(t))
+	cfg.RequireTLSForAuth = true
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = srv.Run(ctx) }()
+
+	client := dialProxy(t, cfg.ListenAddr, nil)
+	if err := client.Hello("client.example"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("AUTH"); ok {
+		t.Error("expected AUTH not to be advertised before STARTTLS")
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		t.Fatal("expected STARTTLS to be advertised")
+	}
+	var smtpErr *smtp.SMTPError
+	err = client.Auth(sasl.NewPlainClient("", "testuser", "testpass"))
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 538 {
+		t.Fatalf("expected 538 for AUTH before STARTTLS, got %v", err)
+	}
+
+	client = dialProxy(t, cfg.ListenAddr, &tls.Config{InsecureSkipVerify: true})
+	if ok, _ := client.Extension("AUTH"); !ok {
+		t.Error("expected AUTH to be advertised after STARTTLS")
+	}
+	if err := client.Auth(sasl.NewPlainClient("", "testuser", "testpass")); err != nil {
+		t.Errorf("expected AUTH to succeed over TLS, got %v", err)
+	}
+}
+
+func TestServer_CommandLimitTLS(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeCert(t, t.TempDir(), serverCert(t))
+	cfg.MaxCommandsPerSession = 8
+	// The limit counts the idle timeout set before each command
+	if _, err := New(cfg); err == nil {
+		t.Fatal("expected an error for a command limit without an idle timeout")
+	}
+	cfg.IdleTimeout = time.Minute
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = srv.Run(ctx) }()
+
+	// EHLO, STARTTLS, EHLO, AUTH, MAIL, RCPT and DATA; the message lines
+	// are content, not commands
+	client := dialProxy(t, cfg.ListenAddr, &tls.Config{InsecureSkipVerify: true})
+	if err := client.Auth(sasl.NewPlainClient("", "testuser", "testpass")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.Mail("app@example.com", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.Rcpt("user@example.com", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	io.WriteString(w, "Subject: test\r\n\r\n"+strings.Repeat("NOOP\r\n", 20))
+	w.Close()
+
+	// go-smtp answers NOOP itself; it is still counted over TLS
+	if err := client.Noop(); err != nil {
+		t.Fatalf("expected the eighth command allowed, got %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := client.Noop(); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("expected 421 over the command limit after STARTTLS, got %v", err)
+	}
+	if err := client.Noop(); err == nil {
+		t.Error("expected the connection closed")
+	}
+}
+
+func TestServer_ClientCertAuth(t *testing.T) {
+	ca := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	clientCert := func(cn string, parent *tls.Certificate) tls.Certificate {
+		return issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: cn},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, parent)
+	}
+
+	cfg := testConfig(t)
+	dir := t.TempDir()
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeCert(t, dir, serverCert(t))
+	cfg.TLSClientCAFile, _ = writeCert(t, t.TempDir(), ca)
+	cfg.TLSClientUsers = map[string]string{"billing.internal": "billing"}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = srv.Run(ctx) }()
+
+	for _, tc := range []struct {
+		name string
+		cert []tls.Certificate
+		want bool
+	}{
+		{"mapped", []tls.Certificate{clientCert("billing.internal", &ca)}, true},
+		{"unmapped", []tls.Certificate{clientCert("other.internal", &ca)}, false},
+		{"none", nil, false},
+	} {
+		client := dialProxy(t, cfg.ListenAddr, &tls.Config{InsecureSkipVerify: true, Certificates: tc.cert})
+		err := client.Mail("app@example.com", nil)
+		if got := err == nil; got != tc.want {
+			t.Errorf("%s: MAIL without AUTH accepted = %v (%v), want %v", tc.name, got, err, tc.want)
+		}
+	}
+
+	// A certificate from another CA fails the handshake. With TLS 1.3 the
+	// client only notices on its next command.
+	client, err := smtp.DialStartTLS(cfg.ListenAddr, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert("billing.internal", nil)}})
+	if err == nil {
+		defer client.Close()
+		err = client.Mail("app@example.com", nil)
+	}
+	if err == nil {
+		t.Error("expected a certificate from an unknown CA to be refused")
+	}
+}
+
+func TestServer_SNICertificates(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeCert(t, t.TempDir(), hostCert(t, "mail.a.example"))
+	cert, key := writeCert(t, t.TempDir(), hostCert(t, "mail.b.example"))
+	cfg.TLSExtraCerts = []config.TLSCertPair{{CertFile: cert, KeyFile: key}}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = srv.Run(ctx) }()
+
+	for sni, want := range map[string]string{
+		"mail.b.example": "mail.b.example",
+		"mail.a.example": "mail.a.example",
+		"other.example":  "mail.a.example", // the default
+	} {
+		client := dialProxy(t, cfg.ListenAddr, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		// The handshake completes with the first command after STARTTLS
+		if err := client.Noop(); err != nil {
+			t.Fatalf("SNI %s: unexpected error: %v", sni, err)
+		}
+		state, ok := client.TLSConnectionState()
+		if !ok || len(state.PeerCertificates) == 0 {
+			t.Fatalf("SNI %s: expected a TLS connection", sni)
+		}
+		if got := state.PeerCertificates[0].Subject.CommonName; got != want {
+			t.Errorf("SNI %s: got certificate for %s, want %s", sni, got, want)
+		}
+	}
+}
+
+func TestServer_CertExpiry(t *testing.T) {
+	now := time.Now()
+	expired := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "old.example"},
+		NotBefore:    now.Add(-90 * 24 * time.Hour),
+		NotAfter:     now.Add(-36 * time.Hour),
+	}, nil)
+	cfg := testConfig(t)
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeCert(t, t.TempDir(), hostCert(t, "mail.a.example"))
+	cert, key := writeCert(t, t.TempDir(), expired)
+	cfg.TLSExtraCerts = []config.TLSCertPair{{CertFile: cert, KeyFile: key}}
+	cfg.TLSCertWarnDays = 30
+
+	cfg.TLSRefuseExpired = true
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), cert) {
+		t.Fatalf("expected the expired certificate to stop startup, got %v", err)
+	}
+	cfg.TLSRefuseExpired = false
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+	warned := make(map[string]int)
+	srv.checkCerts(now, warned)
+	logs := buf.String()
+	if !strings.Contains(logs, "level=WARN msg=\"tls certificate expires soon\" file="+cfg.TLSCertFile+" name=mail.a.example") || !strings.Contains(logs, "days_left=0") {
+		t.Errorf("expected a warning for the certificate expiring within the hour, got %q", logs)
+	}
+	if !strings.Contains(logs, "level=ERROR msg=\"tls certificate expired\" file="+cert+" name=old.example") || !strings.Contains(logs, "days_ago=2") {
+		t.Errorf("expected an error for the expired certificate, got %q", logs)
+	}
+	buf.Reset()
+	srv.checkCerts(now.Add(time.Minute), warned)
+	if buf.Len() != 0 {
+		t.Errorf("expected no repeat within the day, got %q", buf.String())
+	}
+
+	var certs []struct {
+		Name     string `json:"name"`
+		DaysLeft int    `json:"days_left"`
+	}
+	if err := json.Unmarshal([]byte(certsVar(srv.certExpiry).String()), &certs); err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].DaysLeft != -2 || certs[0].Name != "old.example" || certs[1].Name != "mail.a.example" {
+		t.Errorf("expected the certificates soonest expiry first, got %+v", certs)
+	}
+}
+
+func TestStagesVar(t *testing.T) {
+	v := stagesVar(func() map[string]proxy.StageTiming {
+		return map[string]proxy.StageTiming{"connect": {Messages: 2, TotalMs: 80, AvgMs: 40}}
+	})
+	var stages map[string]struct {
+		Messages int64   `json:"messages"`
+		AvgMs    float64 `json:"avg_ms"`
+	}
+	if err := json.Unmarshal([]byte(v.String()), &stages); err != nil {
+		t.Fatal(err)
+	}
+	if stages["connect"].Messages != 2 || stages["connect"].AvgMs != 40 {
+		t.Errorf("unexpected message_stages %s", v.String())
+	}
+}
+
+func TestServer_ReloadSecrets(t *testing.T) {
+	password := filepath.Join(t.TempDir(), "proxy-password")
+	if err := os.WriteFile(password, []byte("first-pass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMTP_PROXY_USERNAME", "testuser")
+	t.Setenv("SMTP_PROXY_PASSWORD_FILE", password)
+	t.Setenv("SMTP_DEST_HOST", "smtp.example.com")
+	t.Setenv("SMTP_DEST_USERNAME", "upstream@example.com")
+	t.Setenv("SMTP_DEST_PASSWORD", "upstreampass")
+	t.Setenv("SMTP_ADMIN_ADDR", "127.0.0.1:0")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	login := func(pass string) error {
+		sess, err := srv.Backend().NewSession(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Logout()
+		server, err := sess.(smtp.AuthSession).Auth(sasl.Plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = server.Next([]byte("\x00testuser\x00" + pass))
+		return err
+	}
+
+	if got := srv.reloadSecrets(cfg); got != cfg {
+		t.Error("expected no change while the file is unchanged")
+	}
+	if err := os.WriteFile(password, []byte("second-pass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	current := srv.reloadSecrets(cfg)
+	if current.ProxyPassword != "second-pass" {
+		t.Fatalf("expected the rotated password, got %q", current.ProxyPassword)
+	}
+	if err := login("second-pass"); err != nil {
+		t.Errorf("expected the rotated password accepted, got %v", err)
+	}
+	if err := login("first-pass"); err == nil {
+		t.Error("expected the old password refused")
+	}
+	// The admin endpoints take the rotated password too
+	for pass, want := range map[string]int{"second-pass": http.StatusOK, "first-pass": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		req.SetBasicAuth("testuser", pass)
+		rec := httptest.NewRecorder()
+		srv.admin.Handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("admin login with %s: got %d, want %d", pass, rec.Code, want)
+		}
+	}
+
+	if err := os.Remove(password); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.reloadSecrets(current); got != current {
+		t.Error("expected a failed reload to keep the credentials")
+	}
+}
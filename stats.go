@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/accounting"
+)
+
+// runStats implements "smtp-proxy stats": it prints the accounting
+// counters recorded in SMTP_ACCOUNTING_FILE, optionally filtered and
+// summed, as a table or JSON. It only reads the file, so it can run next
+// to the proxy. It returns the exit code.
+func runStats(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(out)
+	file := fs.String("file", os.Getenv("SMTP_ACCOUNTING_FILE"), "accounting file (default: SMTP_ACCOUNTING_FILE)")
+	from := fs.String("from", "", "first day to include, YYYY-MM-DD (UTC)")
+	to := fs.String("to", "", "last day to include, YYYY-MM-DD (UTC)")
+	user := fs.String("user", "", "only this user")
+	domain := fs.String("domain", "", "only this recipient domain")
+	by := fs.String("by", "day,user,domain", "fields to group by, summing over the others")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(out, "stats: -file or SMTP_ACCOUNTING_FILE is required")
+		return 2
+	}
+	f := accounting.Filter{User: *user, Domain: *domain}
+	for _, day := range []struct {
+		flag     string
+		src, dst *string
+	}{{"from", from, &f.From}, {"to", to, &f.To}} {
+		if *day.src == "" {
+			continue
+		}
+		var err error
+		if *day.dst, err = accounting.ParseDay(*day.src); err != nil {
+			fmt.Fprintf(out, "stats: -%s: %v\n", day.flag, err)
+			return 2
+		}
+	}
+	fields := strings.Split(*by, ",")
+
+	rows, err := accounting.Read(*file)
+	if err != nil {
+		fmt.Fprintf(out, "stats: %v\n", err)
+		return 1
+	}
+	rows, err = accounting.Rollup(accounting.Select(rows, f), fields)
+	if err != nil {
+		fmt.Fprintf(out, "stats: -by: %v\n", err)
+		return 2
+	}
+
+	if *asJSON {
+		if rows == nil {
+			rows = []accounting.Row{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(rows)
+		return 0
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := strings.ToUpper(strings.Join(fields, "\t"))
+	fmt.Fprintf(w, "%s\tSENT\tDEFERRED\tFAILED\tBYTES\t\n", header)
+	var total accounting.Counts
+	for _, r := range rows {
+		var cols []string
+		for _, field := range fields {
+			switch field {
+			case "day":
+				cols = append(cols, r.Day)
+			case "user":
+				cols = append(cols, r.User)
+			case "domain":
+				cols = append(cols, r.Domain)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\n", strings.Join(cols, "\t"), r.Sent, r.Deferred, r.Failed, r.Bytes)
+		total.Sent += r.Sent
+		total.Deferred += r.Deferred
+		total.Failed += r.Failed
+		total.Bytes += r.Bytes
+	}
+	fmt.Fprintf(w, "total%s\t%d\t%d\t%d\t%d\t\n", strings.Repeat("\t", len(fields)-1), total.Sent, total.Deferred, total.Failed, total.Bytes)
+	w.Flush()
+	return 0
+}
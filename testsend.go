@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/VahanMargaryan/smtp-proxy/internal/redact"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/config"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/proxy"
+	"github.com/VahanMargaryan/smtp-proxy/pkg/relay"
+)
+
+// runTestSend implements "smtp-proxy test-send": it submits a canned
+// message to an in-process proxy session, so it passes through the same
+// screening, sanitizing and signing as client mail, relays it with a
+// single attempt and prints each stage to out. It returns the exit code.
+func runTestSend(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("test-send", flag.ContinueOnError)
+	fs.SetOutput(out)
+	to := fs.String("to", "", "recipient of the test message (required)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *to == "" {
+		fmt.Fprintln(out, "test-send: -to is required")
+		fs.Usage()
+		return 2
+	}
+
+	// Keep startup logging out of the report
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  configuration: %v\n", err)
+		return 1
+	}
+	slog.SetDefault(slog.New(redact.NewHandler(slog.Default().Handler(), cfg.Secrets(), cfg.LogAddresses)))
+
+	submitted := testMessage(cfg, *to)
+	var relayed []byte
+	var dialogue bytes.Buffer
+	send := func(c *config.Config, env *relay.Envelope) error {
+		relayed = env.Message
+		fmt.Fprintf(&dialogue, "upstream %s:%d (%s)\n", c.DestHost, c.DestPort, c.DestTransport)
+		return relay.Trace(c, env, &dialogue)
+	}
+	if cfg.SinkMode {
+		sink, err := relay.NewSink(cfg)
+		if err != nil {
+			fmt.Fprintf(out, "FAIL  startup: %v\n", err)
+			return 1
+		}
+		send = func(c *config.Config, env *relay.Envelope) error {
+			relayed = env.Message
+			fmt.Fprintln(&dialogue, "sink mode: not relayed")
+			return sink.Send(c, env)
+		}
+	}
+	send = relay.NewRedirect(cfg).Wrap(send)
+	backend, err := proxy.NewBackend(cfg, send)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  startup: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "== submitted message\n%s\n", headerBlock(submitted))
+	err = submit(backend, cfg, []string{*to}, submitted)
+	if relayed != nil {
+		fmt.Fprintf(out, "== header changes\n%s\n", headerDiff(submitted, relayed))
+		fmt.Fprintf(out, "== upstream dialogue\n%s\n", dialogue.String())
+	}
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "ok    delivered to %s\n", *to)
+	return 0
+}
+
+// testMessage returns the canned message, carrying a few of the header
+// fields the sanitizer strips so the diff shows it at work.
+func testMessage(cfg *config.Config, to string) []byte {
+	hostname, _ := os.Hostname()
+	return []byte("Received: from " + hostname + " by " + cfg.ServerDomain + "; " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"From: " + cfg.DestFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: smtp-proxy test message\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <test-send." + relay.NewID() + "@" + hostname + ">\r\n" +
+		"X-Mailer: smtp-proxy test-send\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"This message was sent by smtp-proxy test-send to check the relay end to end.\r\n")
+}
+
+// submit runs message through a proxy session the way a client would.
+func submit(backend *proxy.Backend, cfg *config.Config, recipients []string, message []byte) error {
+	session, err := backend.NewSession(nil)
+	if err != nil {
+		return err
+	}
+	defer session.Logout()
+
+	auth, err := session.(smtp.AuthSession).Auth("PLAIN")
+	if err != nil {
+		return err
+	}
+	if _, _, err := auth.Next([]byte("\x00" + cfg.ProxyUsername + "\x00" + cfg.ProxyPassword)); err != nil {
+		return fmt.Errorf("proxy auth: %w", err)
+	}
+	if err := session.Mail(cfg.DestFrom, &smtp.MailOptions{}); err != nil {
+		return fmt.Errorf("MAIL FROM: %w", err)
+	}
+	for _, to := range recipients {
+		if err := session.Rcpt(to, &smtp.RcptOptions{}); err != nil {
+			return fmt.Errorf("RCPT TO: %w", err)
+		}
+	}
+	// The proxy accepts with a 250 reply naming the queue ID
+	var reply *smtp.SMTPError
+	if err := session.Data(bytes.NewReader(message)); err != nil && !(errors.As(err, &reply) && reply.Code == 250) {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	return nil
+}
+
+// headerBlock returns the header section of message.
+func headerBlock(message []byte) string {
+	end := bytes.Index(message, []byte("\r\n\r\n"))
+	if end < 0 {
+		return string(message)
+	}
+	return string(message[:end])
+}
+
+// headerDiff lists the header fields removed from before ("-") and added
+// in after ("+"), unfolded, in message order.
+func headerDiff(before, after []byte) string {
+	fields := func(message []byte) []string {
+		msg, err := mail.ReadMessage(bytes.NewReader(message))
+		if err != nil {
+			return nil
+		}
+		var list []string
+		for _, line := range strings.Split(headerBlock(message), "\r\n") {
+			if line == "" || line[0] == ' ' || line[0] == '\t' {
+				continue
+			}
+			name, _, _ := strings.Cut(line, ":")
+			values := msg.Header[textproto.CanonicalMIMEHeaderKey(name)]
+			if len(values) == 0 {
+				continue
+			}
+			list = append(list, name+": "+values[0])
+			msg.Header[textproto.CanonicalMIMEHeaderKey(name)] = values[1:]
+		}
+		return list
+	}
+	old, changed := fields(before), fields(after)
+	count := func(list []string) map[string]int {
+		m := make(map[string]int)
+		for _, f := range list {
+			m[f]++
+		}
+		return m
+	}
+	inOld, inNew := count(old), count(changed)
+
+	var diff []string
+	for _, f := range old {
+		if inNew[f] > 0 {
+			inNew[f]--
+			continue
+		}
+		diff = append(diff, "- "+f)
+	}
+	for _, f := range changed {
+		if inOld[f] > 0 {
+			inOld[f]--
+			continue
+		}
+		diff = append(diff, "+ "+f)
+	}
+	if len(diff) == 0 {
+		return "(none)"
+	}
+	return strings.Join(diff, "\n")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestRunTestSend_Flags(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-to", ""},
+		{"-unknown"},
+	} {
+		var out bytes.Buffer
+		if code := runTestSend(args, &out); code != 2 {
+			t.Errorf("%v: expected exit code 2, got %d\n%s", args, code, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	runTestSend(nil, &out)
+	if !strings.Contains(out.String(), "test-send: -to is required") {
+		t.Errorf("expected the missing -to explained, got %q", out.String())
+	}
+}
+
+func TestRunTestSend(t *testing.T) {
+	fake, addr := startFakeSMTP(t, "upstream@example.com", "upstreampass")
+	setTestEnv(t, addr)
+
+	var out bytes.Buffer
+	if code := runTestSend([]string{"-to", "ops@example.com"}, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d\n%s", code, out.String())
+	}
+	report := out.String()
+	for _, want := range []string{
+		"== submitted message\n",
+		"== header changes\n",
+		"- X-Mailer: smtp-proxy test-send\n",
+		"== upstream dialogue\n",
+		"ok    delivered to ops@example.com\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected %q in the report\n%s", want, report)
+		}
+	}
+
+	received := fake.received()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 message at the upstream, got %d", len(received))
+	}
+	sent := received[0]
+	if len(sent.to) != 1 || sent.to[0] != "ops@example.com" {
+		t.Errorf("expected the message sent to ops@example.com, got %v", sent.to)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(sent.data))
+	if err != nil {
+		t.Fatalf("unparsable message: %v", err)
+	}
+	if got := msg.Header.Get("Subject"); got != "smtp-proxy test message" {
+		t.Errorf("unexpected Subject %q", got)
+	}
+	if got := msg.Header.Get("To"); got != "ops@example.com" {
+		t.Errorf("unexpected To %q", got)
+	}
+	if got := msg.Header.Get("From"); got != "upstream@example.com" {
+		t.Errorf("unexpected From %q", got)
+	}
+	for _, name := range []string{"X-Mailer", "Received"} {
+		if msg.Header.Get(name) != "" {
+			t.Errorf("expected %s stripped, got %q", name, msg.Header.Get(name))
+		}
+	}
+	if id := msg.Header.Get("Message-ID"); id == "" || strings.HasPrefix(id, "<test-send.") {
+		t.Errorf("expected a new Message-ID, got %q", id)
+	}
+}
+
+func TestRunTestSend_UpstreamRefuses(t *testing.T) {
+	fake, addr := startFakeSMTP(t, "upstream@example.com", "other-pass")
+	setTestEnv(t, addr)
+
+	var out bytes.Buffer
+	if code := runTestSend([]string{"-to", "ops@example.com"}, &out); code != 1 {
+		t.Fatalf("expected exit code 1, got %d\n%s", code, out.String())
+	}
+	if report := out.String(); !strings.Contains(report, "FAIL  ") || strings.Contains(report, "ok    delivered") {
+		t.Errorf("expected the failure reported\n%s", report)
+	}
+	if n := len(fake.received()); n != 0 {
+		t.Errorf("expected nothing delivered, got %d messages", n)
+	}
+}
+
+func TestHeaderDiff(t *testing.T) {
+	before := []byte("From: a@example.com\r\nX-Mailer: test\r\nSubject: Hi\r\n there\r\n\r\nbody")
+	after := []byte("From: a@example.com\r\nSubject: Hi there\r\nMessage-ID: <1@proxy>\r\n\r\nbody")
+	want := "- X-Mailer: test\n+ Message-ID: <1@proxy>"
+	if got := headerDiff(before, after); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := headerDiff(before, before); got != "(none)" {
+		t.Errorf("expected no changes, got %q", got)
+	}
+}